@@ -0,0 +1,401 @@
+// Package client is a Go client for mini-ceph. It calculates the placement group of every object itself and sends
+// all requests directly to the responsible node.
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/go-resty/resty/v2"
+	"github.com/rstdm/mini-ceph/internal/api/object/distribution"
+	"net/http"
+	neturl "net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ReadPolicy determines which node of a placement group serves reads. All policies except ReadFromPrimary require
+// that the cluster has been started with --readBalancing.
+type ReadPolicy string
+
+const (
+	ReadFromPrimary     ReadPolicy = "primary"
+	ReadFromNearest     ReadPolicy = "nearest"     // the node with the lowest observed latency
+	ReadFromLeastLoaded ReadPolicy = "leastLoaded" // the node with the fewest running requests of this client
+)
+
+// objectNameHeader contains the percent-encoded name of the object.
+const objectNameHeader = "X-Object-Name"
+
+// objectExpiresHeader contains the time at which the object expires.
+const objectExpiresHeader = "X-Object-Expires"
+
+// objectMD5Header contains the md5 digest of the content of unencrypted objects.
+const objectMD5Header = "X-Object-MD5"
+
+// overwriteParam allows a write to replace an existing object.
+const overwriteParam = "overwrite"
+
+// latencyWeight is the weight of a new measurement in the moving average of the latency of a node.
+const latencyWeight = 0.2
+
+var (
+	ErrObjectDoesNotExist = errors.New("the object does not exist")
+	ErrObjectDoesExist    = errors.New("the object already exists")
+	// ErrObjectIsBusy is returned if an object can't be overwritten because it is currently modified. The request can
+	// be retried.
+	ErrObjectIsBusy = errors.New("the object is currently modified")
+)
+
+// StatusError is returned if a node answers with a status code that has no dedicated error, e.g. 403 Forbidden if the
+// user isn't allowed to access the object.
+type StatusError struct {
+	Method     string
+	URL        string
+	StatusCode int
+	Message    string // the body of the response
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("%v %v yielded unexpected http status code %v: %v", e.Method, e.URL, e.StatusCode, e.Message)
+}
+
+// ObjectInfo describes a stored object.
+type ObjectInfo struct {
+	Name         string
+	Size         int64
+	LastModified time.Time
+	Checksum     string // hex encoded sha256 digest of the content (an HMAC in encrypted pools); empty if the cluster doesn't know it
+	MD5          string // hex encoded md5 digest of the content; empty in encrypted pools and for older objects
+}
+
+type Config struct {
+	// Nodes contains the URL of every node, including the scheme. It must be equal to the --nodes argument of the
+	// cluster.
+	Nodes []string
+	// PlacementGroups must be equal to the --placementGroups argument of the cluster.
+	PlacementGroups [][]int
+	BearerToken     string
+	ReadPolicy      ReadPolicy
+	// TLSConfig is used for https connections to the nodes, e.g. to trust the CA of the cluster. The default
+	// configuration is used if it is nil.
+	TLSConfig *tls.Config
+}
+
+type node struct {
+	url      string
+	inFlight atomic.Int64
+
+	mu      sync.Mutex
+	latency time.Duration // moving average; 0 if no request has been sent to the node yet
+}
+
+type Client struct {
+	placementGroups [][]int
+	readPolicy      ReadPolicy
+	nodes           []*node
+	http            *resty.Client
+}
+
+func New(config Config) (*Client, error) {
+	if len(config.Nodes) == 0 || len(config.PlacementGroups) == 0 {
+		return nil, errors.New("nodes and placement groups must not be empty")
+	}
+	for pgIdx, pg := range config.PlacementGroups {
+		for _, nodeID := range pg {
+			if nodeID < 0 || nodeID >= len(config.Nodes) {
+				return nil, fmt.Errorf("placement group %v contains unknown node %v", pgIdx, nodeID)
+			}
+		}
+	}
+
+	switch config.ReadPolicy {
+	case "":
+		config.ReadPolicy = ReadFromPrimary
+	case ReadFromPrimary, ReadFromNearest, ReadFromLeastLoaded:
+	default:
+		return nil, fmt.Errorf("unknown read policy %v", config.ReadPolicy)
+	}
+
+	httpClient := resty.New()
+	if config.BearerToken != "" {
+		httpClient.SetAuthToken(config.BearerToken)
+	}
+	if config.TLSConfig != nil {
+		httpClient.SetTLSClientConfig(config.TLSConfig)
+	}
+
+	var nodes []*node
+	for _, nodeURL := range config.Nodes {
+		nodes = append(nodes, &node{url: strings.TrimSuffix(nodeURL, "/")})
+	}
+
+	client := &Client{
+		placementGroups: config.PlacementGroups,
+		readPolicy:      config.ReadPolicy,
+		nodes:           nodes,
+		http:            httpClient,
+	}
+	return client, nil
+}
+
+// ObjectHash calculates the hash that is used to address the object with the given name.
+func ObjectHash(name string) string {
+	digest := sha256.Sum256([]byte(name))
+	return hex.EncodeToString(digest[:])
+}
+
+func (c *Client) Put(ctx context.Context, name string, content []byte) error {
+	return c.PutWithExpiry(ctx, name, content, time.Time{})
+}
+
+// PutWithExpiry creates an object that expires at the given time. Expired objects read as deleted and are deleted by
+// the cluster. The object doesn't expire if the time is zero.
+func (c *Client) PutWithExpiry(ctx context.Context, name string, content []byte, expires time.Time) error {
+	return c.put(ctx, name, content, expires, false)
+}
+
+// Overwrite creates the object or replaces it in a single operation if it exists; readers see either the previous or
+// the new content. The user needs the capability to delete the existing object. It returns ErrObjectIsBusy if the
+// object is currently modified by another request.
+func (c *Client) Overwrite(ctx context.Context, name string, content []byte) error {
+	return c.put(ctx, name, content, time.Time{}, true)
+}
+
+func (c *Client) put(ctx context.Context, name string, content []byte, expires time.Time, overwrite bool) error {
+	objectHash := ObjectHash(name)
+	primary, err := c.primaryOf(objectHash)
+	if err != nil {
+		return err
+	}
+
+	response, err := c.send(ctx, primary, func(request *resty.Request, url string) (*resty.Response, error) {
+		if !expires.IsZero() {
+			request.SetHeader(objectExpiresHeader, expires.Format(time.RFC3339))
+		}
+		if overwrite {
+			request.SetQueryParam(overwriteParam, "true")
+		}
+		return request.SetFileReader("file", "file", bytes.NewReader(content)).Put(url)
+	}, name)
+	if err != nil {
+		return err
+	}
+
+	switch response.StatusCode() {
+	case http.StatusOK:
+		return nil
+	case http.StatusConflict:
+		return conflictError(overwrite)
+	default:
+		return unexpectedResponse(response)
+	}
+}
+
+// conflictError returns the error of a 409 Conflict response to a write. Overwriting writes only conflict with
+// concurrent modifications.
+func conflictError(overwrite bool) error {
+	if overwrite {
+		return ErrObjectIsBusy
+	}
+	return ErrObjectDoesExist
+}
+
+func (c *Client) Get(ctx context.Context, name string) ([]byte, error) {
+	response, err := c.read(ctx, name, func(request *resty.Request, url string) (*resty.Response, error) {
+		return request.Get(url)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	switch response.StatusCode() {
+	case http.StatusOK:
+		return response.Body(), nil
+	case http.StatusNotFound:
+		return nil, ErrObjectDoesNotExist
+	default:
+		return nil, unexpectedResponse(response)
+	}
+}
+
+// GetRange reads length bytes of the object, starting at offset. The range is shortened if it exceeds the end of the
+// object. The length must be positive.
+func (c *Client) GetRange(ctx context.Context, name string, offset int64, length int64) ([]byte, error) {
+	if offset < 0 || length <= 0 {
+		return nil, errors.New("the offset must not be negative and the length must be positive")
+	}
+
+	response, err := c.read(ctx, name, func(request *resty.Request, url string) (*resty.Response, error) {
+		return request.SetHeader("Range", fmt.Sprintf("bytes=%v-%v", offset, offset+length-1)).Get(url)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	switch response.StatusCode() {
+	case http.StatusPartialContent:
+		return response.Body(), nil
+	case http.StatusRequestedRangeNotSatisfiable:
+		return []byte{}, nil // the offset is beyond the end of the object
+	case http.StatusNotFound:
+		return nil, ErrObjectDoesNotExist
+	default:
+		return nil, unexpectedResponse(response)
+	}
+}
+
+// Stat returns the size, the modification time and the checksum of the object without reading its content.
+func (c *Client) Stat(ctx context.Context, name string) (ObjectInfo, error) {
+	response, err := c.read(ctx, name, func(request *resty.Request, url string) (*resty.Response, error) {
+		return request.Head(url)
+	})
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+
+	switch response.StatusCode() {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return ObjectInfo{}, ErrObjectDoesNotExist
+	default:
+		return ObjectInfo{}, unexpectedResponse(response)
+	}
+
+	size, err := strconv.ParseInt(response.Header().Get("Content-Length"), 10, 64)
+	if err != nil {
+		return ObjectInfo{}, fmt.Errorf("parse Content-Length of %v: %w", name, err)
+	}
+	lastModified, _ := http.ParseTime(response.Header().Get("Last-Modified")) // zero if the node didn't send it
+	info := ObjectInfo{
+		Name:         name,
+		Size:         size,
+		LastModified: lastModified,
+		Checksum:     strings.Trim(response.Header().Get("ETag"), `"`),
+		MD5:          response.Header().Get(objectMD5Header),
+	}
+	return info, nil
+}
+
+func (c *Client) Delete(ctx context.Context, name string) error {
+	objectHash := ObjectHash(name)
+	primary, err := c.primaryOf(objectHash)
+	if err != nil {
+		return err
+	}
+
+	response, err := c.send(ctx, primary, func(request *resty.Request, url string) (*resty.Response, error) {
+		return request.Delete(url)
+	}, name)
+	if err != nil {
+		return err
+	}
+
+	switch response.StatusCode() {
+	case http.StatusOK:
+		return nil
+	case http.StatusNotFound:
+		return ErrObjectDoesNotExist
+	default:
+		return unexpectedResponse(response)
+	}
+}
+
+// read sends the read request of the object to the node that is chosen by the read policy. The request is repeated on
+// the primary if the chosen secondary can't serve it.
+func (c *Client) read(ctx context.Context, name string, perform func(request *resty.Request, url string) (*resty.Response, error)) (*resty.Response, error) {
+	objectHash := ObjectHash(name)
+	primary, err := c.primaryOf(objectHash)
+	if err != nil {
+		return nil, err
+	}
+
+	target := c.chooseReadNode(objectHash, primary)
+	response, err := c.send(ctx, target, perform, name)
+	if target != primary && (err != nil || response.StatusCode() == http.StatusMisdirectedRequest) {
+		// the secondary doesn't hold a read lease or is unreachable
+		response, err = c.send(ctx, primary, perform, name)
+	}
+	return response, err
+}
+
+func (c *Client) primaryOf(objectHash string) (*node, error) {
+	pg, err := distribution.PlacementGroupOf(objectHash, len(c.placementGroups))
+	if err != nil {
+		return nil, fmt.Errorf("calculate placement group: %w", err)
+	}
+
+	return c.nodes[c.placementGroups[pg][0]], nil
+}
+
+func (c *Client) chooseReadNode(objectHash string, primary *node) *node {
+	if c.readPolicy == ReadFromPrimary {
+		return primary
+	}
+
+	pg, _ := distribution.PlacementGroupOf(objectHash, len(c.placementGroups)) // primaryOf validated the hash
+	chosen := primary
+	for _, nodeID := range c.placementGroups[pg] {
+		candidate := c.nodes[nodeID]
+		if c.readPolicy == ReadFromNearest && candidate.getLatency() < chosen.getLatency() {
+			chosen = candidate
+		}
+		if c.readPolicy == ReadFromLeastLoaded && candidate.inFlight.Load() < chosen.inFlight.Load() {
+			chosen = candidate
+		}
+	}
+
+	return chosen
+}
+
+// send sends the request of the object to the node. The name is sent as well; the cluster needs it if the grants of
+// the user are scoped by name prefixes.
+func (c *Client) send(ctx context.Context, target *node, perform func(request *resty.Request, url string) (*resty.Response, error), name string) (*resty.Response, error) {
+	url := target.url + "/object/" + ObjectHash(name)
+
+	target.inFlight.Add(1)
+	defer target.inFlight.Add(-1)
+
+	start := time.Now()
+	request := c.http.R().SetContext(ctx).SetHeader(objectNameHeader, neturl.PathEscape(name))
+	response, err := perform(request, url)
+	if err != nil {
+		return nil, fmt.Errorf("send request to %v: %w", url, err)
+	}
+	target.recordLatency(time.Since(start))
+
+	return response, nil
+}
+
+func (n *node) getLatency() time.Duration {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.latency
+}
+
+func (n *node) recordLatency(latency time.Duration) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.latency == 0 {
+		n.latency = latency
+		return
+	}
+	n.latency = time.Duration(latencyWeight*float64(latency) + (1-latencyWeight)*float64(n.latency))
+}
+
+func unexpectedResponse(response *resty.Response) error {
+	return &StatusError{
+		Method:     response.Request.Method,
+		URL:        response.Request.URL,
+		StatusCode: response.StatusCode(),
+		Message:    strings.TrimSpace(response.String()),
+	}
+}
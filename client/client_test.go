@@ -0,0 +1,193 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestNewValidatesConfig(t *testing.T) {
+	configs := map[string]Config{
+		"no nodes":            {PlacementGroups: [][]int{{0}}},
+		"no placement groups": {Nodes: []string{"http://a"}},
+		"unknown node":        {Nodes: []string{"http://a"}, PlacementGroups: [][]int{{0, 1}}},
+		"unknown read policy": {Nodes: []string{"http://a"}, PlacementGroups: [][]int{{0}}, ReadPolicy: "random"},
+	}
+	for name, config := range configs {
+		if _, err := New(config); err == nil {
+			t.Errorf("%v: New() succeeded", name)
+		}
+	}
+}
+
+// recordingNode answers every request with the configured status code and records the last request.
+type recordingNode struct {
+	status   int
+	header   http.Header // sent with every response
+	body     string
+	requests int
+	last     *http.Request
+}
+
+func (n *recordingNode) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	n.requests++
+	n.last = r
+	for key, values := range n.header {
+		w.Header()[key] = values
+	}
+	w.WriteHeader(n.status)
+	_, _ = w.Write([]byte(n.body))
+}
+
+// newTestClient creates a client of a cluster with a single placement group whose primary is the first node.
+func newTestClient(t *testing.T, readPolicy ReadPolicy, nodes ...*recordingNode) *Client {
+	var urls []string
+	var pg []int
+	for i, node := range nodes {
+		server := httptest.NewServer(node)
+		t.Cleanup(server.Close)
+		urls = append(urls, server.URL)
+		pg = append(pg, i)
+	}
+
+	client, err := New(Config{Nodes: urls, PlacementGroups: [][]int{pg}, ReadPolicy: readPolicy})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+func TestStatusCodesAreMapped(t *testing.T) {
+	ctx := context.Background()
+	node := &recordingNode{}
+	client := newTestClient(t, ReadFromPrimary, node)
+
+	node.status = http.StatusConflict
+	if err := client.Put(ctx, "a", []byte("content")); !errors.Is(err, ErrObjectDoesExist) {
+		t.Errorf("Put() = %v", err)
+	}
+	if err := client.Overwrite(ctx, "a", []byte("content")); !errors.Is(err, ErrObjectIsBusy) {
+		t.Errorf("Overwrite() = %v", err)
+	}
+	node.status = http.StatusNotFound
+	if _, err := client.Get(ctx, "a"); !errors.Is(err, ErrObjectDoesNotExist) {
+		t.Errorf("Get() = %v", err)
+	}
+	if err := client.Delete(ctx, "a"); !errors.Is(err, ErrObjectDoesNotExist) {
+		t.Errorf("Delete() = %v", err)
+	}
+
+	node.status, node.body = http.StatusForbidden, "not allowed\n"
+	_, err := client.Get(ctx, "a")
+	var statusErr *StatusError
+	if !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusForbidden || statusErr.Message != "not allowed" {
+		t.Errorf("Get() = %v", err)
+	}
+}
+
+func TestRequestsAddressTheObject(t *testing.T) {
+	ctx := context.Background()
+	node := &recordingNode{status: http.StatusOK}
+	client := newTestClient(t, ReadFromPrimary, node)
+
+	expires := time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC)
+	if err := client.PutWithExpiry(ctx, "dir/a b", []byte("content"), expires); err != nil {
+		t.Fatal(err)
+	}
+	if node.last.URL.Path != "/object/"+ObjectHash("dir/a b") {
+		t.Errorf("unexpected path %v", node.last.URL.Path)
+	}
+	if name := node.last.Header.Get(objectNameHeader); name != "dir%2Fa%20b" {
+		t.Errorf("unexpected name header %q", name)
+	}
+	if header := node.last.Header.Get(objectExpiresHeader); header != "2030-01-02T03:04:05Z" {
+		t.Errorf("unexpected expires header %q", header)
+	}
+	if node.last.URL.Query().Has(overwriteParam) {
+		t.Errorf("Put() overwrites the object")
+	}
+	if err := client.Overwrite(ctx, "a", []byte("content")); err != nil {
+		t.Fatal(err)
+	}
+	if node.last.URL.Query().Get(overwriteParam) != "true" {
+		t.Errorf("Overwrite() doesn't overwrite the object: %v", node.last.URL)
+	}
+
+	node.status = http.StatusPartialContent
+	if _, err := client.GetRange(ctx, "a", 10, 5); err != nil {
+		t.Fatal(err)
+	}
+	if header := node.last.Header.Get("Range"); header != "bytes=10-14" {
+		t.Errorf("unexpected range header %q", header)
+	}
+	node.status = http.StatusRequestedRangeNotSatisfiable
+	if read, err := client.GetRange(ctx, "a", 10, 5); err != nil || len(read) != 0 {
+		t.Errorf("GetRange() beyond the end = %q, %v", read, err)
+	}
+	if _, err := client.GetRange(ctx, "a", 0, 0); err == nil {
+		t.Error("GetRange() with an empty range succeeded")
+	}
+}
+
+func TestStat(t *testing.T) {
+	node := &recordingNode{status: http.StatusOK, header: http.Header{
+		"Content-Length": {"7"},
+		"Last-Modified":  {"Wed, 02 Jan 2030 03:04:05 GMT"},
+		"Etag":           {`"abc"`},
+	}}
+	client := newTestClient(t, ReadFromPrimary, node)
+
+	info, err := client.Stat(context.Background(), "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lastModified := time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC)
+	if info.Name != "a" || info.Size != 7 || !info.LastModified.Equal(lastModified) || info.Checksum != "abc" {
+		t.Errorf("Stat() = %+v", info)
+	}
+	if node.last.Method != http.MethodHead {
+		t.Errorf("Stat() sent %v", node.last.Method)
+	}
+}
+
+func TestReadsFailOverToThePrimary(t *testing.T) {
+	primary := &recordingNode{status: http.StatusOK, body: "content"}
+	secondary := &recordingNode{status: http.StatusMisdirectedRequest} // the secondary doesn't hold a read lease
+	client := newTestClient(t, ReadFromLeastLoaded, primary, secondary)
+
+	// the primary wins a draw; a request that is in flight makes the secondary the least loaded node
+	client.nodes[0].inFlight.Add(1)
+	read, err := client.Get(context.Background(), "a")
+	if err != nil || string(read) != "content" {
+		t.Errorf("Get() = %q, %v", read, err)
+	}
+	if secondary.requests != 1 || primary.requests != 1 {
+		t.Errorf("%v requests to the secondary and %v to the primary", secondary.requests, primary.requests)
+	}
+
+	// writes are always sent to the primary
+	if err := client.Put(context.Background(), "a", []byte("content")); err != nil {
+		t.Fatal(err)
+	}
+	if secondary.requests != 1 {
+		t.Error("a write has been sent to the secondary")
+	}
+}
+
+func TestNearestNodeServesReads(t *testing.T) {
+	primary := &recordingNode{status: http.StatusOK}
+	secondary := &recordingNode{status: http.StatusOK}
+	client := newTestClient(t, ReadFromNearest, primary, secondary)
+
+	client.nodes[0].recordLatency(time.Second)
+	client.nodes[1].recordLatency(time.Millisecond)
+	if _, err := client.Get(context.Background(), "a"); err != nil {
+		t.Fatal(err)
+	}
+	if secondary.requests != 1 || primary.requests != 0 {
+		t.Errorf("%v requests to the secondary and %v to the primary", secondary.requests, primary.requests)
+	}
+}
@@ -0,0 +1,82 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// MaxListLimit is the maximum number of objects that a single List call returns.
+const MaxListLimit = 1000
+
+type listing struct {
+	Objects     []ObjectInfo
+	IsTruncated bool
+}
+
+// List returns up to limit objects whose name starts with prefix and is greater than startAfter, sorted by name.
+// truncated is true if more objects match; the next page starts after the name of the last returned object. Only
+// objects that have been created with a name are listed, and only the objects that the user is allowed to read.
+//
+// Every node lists the objects of its primary placement groups, so all nodes are asked. The listing fails if a node
+// can't be reached.
+func (c *Client) List(ctx context.Context, prefix string, startAfter string, limit int) (objects []ObjectInfo, truncated bool, err error) {
+	if limit <= 0 || limit > MaxListLimit {
+		return nil, false, fmt.Errorf("the limit must be between 1 and %v", MaxListLimit)
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	var errs []error
+	for _, target := range c.nodes {
+		wg.Add(1)
+		go func(target *node) {
+			defer wg.Done()
+			nodeListing, err := c.listNode(ctx, target, prefix, startAfter, limit)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				errs = append(errs, err)
+				return
+			}
+			// the objects that a node hasn't returned are sorted after its last object, so there are more objects
+			truncated = truncated || nodeListing.IsTruncated
+			objects = append(objects, nodeListing.Objects...)
+		}(target)
+	}
+	wg.Wait()
+	if len(errs) > 0 {
+		return nil, false, errs[0]
+	}
+
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Name < objects[j].Name })
+	if len(objects) > limit {
+		objects = objects[:limit]
+		truncated = true
+	}
+	return objects, truncated, nil
+}
+
+func (c *Client) listNode(ctx context.Context, target *node, prefix string, startAfter string, limit int) (listing, error) {
+	url := target.url + "/objects"
+
+	var result listing
+	response, err := c.http.R().SetContext(ctx).
+		SetQueryParam("prefix", prefix).
+		SetQueryParam("startAfter", startAfter).
+		SetQueryParam("limit", strconv.Itoa(limit)).
+		SetResult(&result).
+		Get(url)
+	if err != nil {
+		return listing{}, fmt.Errorf("send request to %v: %w", url, err)
+	}
+	if response.StatusCode() != http.StatusOK {
+		return listing{}, unexpectedResponse(response)
+	}
+
+	return result, nil
+}
@@ -0,0 +1,323 @@
+package client
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+const (
+	// DefaultStripeSize is the size of the stripe objects if no size has been configured. It must not exceed the
+	// --maxObjectSizeBytes of the cluster.
+	DefaultStripeSize = 4 << 20
+	// DefaultStripeParallelism is the number of stripes that are transferred concurrently if no parallelism has been
+	// configured.
+	DefaultStripeParallelism = 8
+	// DefaultMaxStripedObjectSize is the maximum size of a striped object if no maximum has been configured.
+	DefaultMaxStripedObjectSize = 4 << 30
+
+	// maxStripeSize bounds the stripe size of the configuration and of the manifests that are read. Every stripe is
+	// held in memory.
+	maxStripeSize   = 1 << 30
+	manifestVersion = 1
+)
+
+var ErrInvalidManifest = errors.New("the object isn't the manifest of a striped object")
+
+type StriperConfig struct {
+	// StripeSize is the size of every stripe object except the last one. Objects that are written later keep the
+	// stripe size of their manifest.
+	StripeSize int64
+	// Parallelism is the maximum number of concurrent requests of a single operation.
+	Parallelism int
+	// MaxObjectSize is the maximum size of the objects that are written and of the manifests that are read. Objects
+	// are read into memory, so a manifest must not make the client allocate arbitrary amounts of memory.
+	MaxObjectSize int64
+}
+
+// Manifest describes the layout of a striped object. It is stored as content of the object with the logical name.
+// The stripes are named <name>.<WriteID>.<index as 16 hex digits>; every write uses a new random WriteID, so the
+// stripes of concurrent or failed writes of the same name never collide.
+type Manifest struct {
+	Version    int
+	Size       int64
+	StripeSize int64
+	WriteID    string
+	Checksums  []string // hex encoded sha256 digest of every stripe
+}
+
+// StripeCount returns the number of stripe objects.
+func (m Manifest) StripeCount() int {
+	return len(m.Checksums)
+}
+
+// stripeName returns the name of the stripe object with the index.
+func (m Manifest) stripeName(name string, index int) string {
+	return fmt.Sprintf("%v.%v.%016x", name, m.WriteID, index)
+}
+
+// Striper splits large logical objects into stripe objects of a fixed size, similar to libradosstriper. The hashes
+// of the stripes are spread across all placement groups, so a large object doesn't burden a single primary. The
+// stripes are transferred in parallel through the object API. A manifest with the logical name records the layout;
+// it is written after all stripes, so the object appears atomically and only one of several concurrent writers of the
+// same name succeeds.
+type Striper struct {
+	client        *Client
+	stripeSize    int64
+	parallelism   int
+	maxObjectSize int64
+}
+
+func NewStriper(client *Client, config StriperConfig) (*Striper, error) {
+	if config.StripeSize < 0 || config.Parallelism < 0 || config.MaxObjectSize < 0 {
+		return nil, errors.New("the stripe size, the parallelism and the maximum object size must not be negative")
+	}
+	if config.StripeSize > maxStripeSize {
+		return nil, fmt.Errorf("the stripe size must not exceed %v bytes", maxStripeSize)
+	}
+	if config.StripeSize == 0 {
+		config.StripeSize = DefaultStripeSize
+	}
+	if config.Parallelism == 0 {
+		config.Parallelism = DefaultStripeParallelism
+	}
+	if config.MaxObjectSize == 0 {
+		config.MaxObjectSize = DefaultMaxStripedObjectSize
+	}
+
+	striper := &Striper{
+		client:        client,
+		stripeSize:    config.StripeSize,
+		parallelism:   config.Parallelism,
+		maxObjectSize: config.MaxObjectSize,
+	}
+	return striper, nil
+}
+
+// Put writes the content as striped object. It returns ErrObjectDoesExist if an object with the name exists. The
+// stripes are deleted if the object can't be written.
+func (s *Striper) Put(ctx context.Context, name string, content []byte) error {
+	if int64(len(content)) > s.maxObjectSize {
+		return fmt.Errorf("the object has %v bytes, at most %v bytes are allowed", len(content), s.maxObjectSize)
+	}
+	if _, err := s.client.Get(ctx, name); err == nil {
+		return ErrObjectDoesExist
+	} else if !errors.Is(err, ErrObjectDoesNotExist) {
+		return fmt.Errorf("check whether the object exists: %w", err)
+	}
+
+	writeID, err := newWriteID()
+	if err != nil {
+		return err
+	}
+	manifest := Manifest{Version: manifestVersion, Size: int64(len(content)), StripeSize: s.stripeSize, WriteID: writeID}
+	for offset := int64(0); offset < manifest.Size || offset == 0; offset += s.stripeSize {
+		digest := sha256.Sum256(content[offset:min(offset+s.stripeSize, manifest.Size)])
+		manifest.Checksums = append(manifest.Checksums, hex.EncodeToString(digest[:]))
+	}
+
+	err = s.forEachStripe(ctx, manifest, 0, manifest.StripeCount(), func(ctx context.Context, index int) error {
+		offset := int64(index) * s.stripeSize
+		return s.client.Put(ctx, manifest.stripeName(name, index), content[offset:min(offset+s.stripeSize, manifest.Size)])
+	})
+	if err == nil {
+		err = s.putManifest(ctx, name, manifest)
+	}
+	if err != nil {
+		// the stripes of this write aren't referenced by any manifest
+		_ = s.deleteStripes(context.Background(), name, manifest)
+		return err
+	}
+
+	return nil
+}
+
+func (s *Striper) putManifest(ctx context.Context, name string, manifest Manifest) error {
+	encodedManifest, err := json.Marshal(manifest)
+	if err != nil {
+		return fmt.Errorf("json encode manifest: %w", err)
+	}
+	if err := s.client.Put(ctx, name, encodedManifest); err != nil {
+		return fmt.Errorf("put manifest: %w", err)
+	}
+	return nil
+}
+
+// Stat returns the manifest of the striped object. Manifests whose size or stripe size exceed the limits of the
+// striper are invalid.
+func (s *Striper) Stat(ctx context.Context, name string) (Manifest, error) {
+	encodedManifest, err := s.client.Get(ctx, name)
+	if err != nil {
+		return Manifest{}, err
+	}
+
+	var manifest Manifest
+	if err := json.Unmarshal(encodedManifest, &manifest); err != nil || manifest.Version != manifestVersion ||
+		manifest.StripeSize <= 0 || manifest.StripeSize > maxStripeSize || manifest.Size < 0 ||
+		manifest.Size > s.maxObjectSize {
+		return Manifest{}, ErrInvalidManifest
+	}
+	// an empty object consists of a single empty stripe
+	if expected := max((manifest.Size+manifest.StripeSize-1)/manifest.StripeSize, 1); int64(manifest.StripeCount()) != expected {
+		return Manifest{}, ErrInvalidManifest
+	}
+	return manifest, nil
+}
+
+// Get reads the complete striped object.
+func (s *Striper) Get(ctx context.Context, name string) ([]byte, error) {
+	manifest, err := s.Stat(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	return s.read(ctx, name, manifest, 0, manifest.Size)
+}
+
+// GetRange reads length bytes of the striped object, starting at offset. Only the stripes that contain the range are
+// read. The range is shortened if it exceeds the end of the object.
+func (s *Striper) GetRange(ctx context.Context, name string, offset int64, length int64) ([]byte, error) {
+	if offset < 0 || length < 0 {
+		return nil, errors.New("the offset and the length must not be negative")
+	}
+	manifest, err := s.Stat(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if offset > manifest.Size {
+		offset = manifest.Size
+	}
+	// offset+length may overflow
+	if length > manifest.Size-offset {
+		length = manifest.Size - offset
+	}
+	return s.read(ctx, name, manifest, offset, offset+length)
+}
+
+// read returns the bytes from start to end. Every stripe is compared with its checksum.
+func (s *Striper) read(ctx context.Context, name string, manifest Manifest, start int64, end int64) ([]byte, error) {
+	content := make([]byte, end-start)
+	if start == end {
+		return content, nil
+	}
+
+	first := int(start / manifest.StripeSize)
+	last := int((end - 1) / manifest.StripeSize)
+	err := s.forEachStripe(ctx, manifest, first, last+1, func(ctx context.Context, index int) error {
+		stripe, err := s.client.Get(ctx, manifest.stripeName(name, index))
+		if errors.Is(err, ErrObjectDoesNotExist) {
+			return fmt.Errorf("stripe %v is missing: %w", index, err)
+		}
+		if err != nil {
+			return err
+		}
+		digest := sha256.Sum256(stripe)
+		if hex.EncodeToString(digest[:]) != manifest.Checksums[index] {
+			return fmt.Errorf("stripe %v doesn't match the checksum of the manifest", index)
+		}
+
+		stripeStart := int64(index) * manifest.StripeSize
+		from := max(start, stripeStart)
+		to := min(end, stripeStart+int64(len(stripe)))
+		copy(content[from-start:to-start], stripe[from-stripeStart:to-stripeStart])
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return content, nil
+}
+
+// Delete deletes the manifest and then the stripes. The object doesn't exist anymore once the manifest has been
+// deleted; stripes that can't be deleted are returned as error, but they are no longer referenced.
+func (s *Striper) Delete(ctx context.Context, name string) error {
+	manifest, err := s.Stat(ctx, name)
+	if err != nil {
+		return err
+	}
+	if err := s.client.Delete(ctx, name); err != nil {
+		return fmt.Errorf("delete manifest: %w", err)
+	}
+
+	return s.deleteStripes(ctx, name, manifest)
+}
+
+func (s *Striper) deleteStripes(ctx context.Context, name string, manifest Manifest) error {
+	return s.forEachStripe(ctx, manifest, 0, manifest.StripeCount(), func(ctx context.Context, index int) error {
+		err := s.client.Delete(ctx, manifest.stripeName(name, index))
+		if errors.Is(err, ErrObjectDoesNotExist) {
+			return nil // the stripe hasn't been written
+		}
+		return err
+	})
+}
+
+// forEachStripe calls operation for the stripes from first to end (exclusive) with at most parallelism concurrent
+// calls. The remaining operations are canceled after the first error, which is returned.
+func (s *Striper) forEachStripe(ctx context.Context, manifest Manifest, first int, end int, operation func(ctx context.Context, index int) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	var once sync.Once
+	var firstErr error
+	indices := make(chan int)
+
+	for worker := 0; worker < s.parallelism && worker < end-first; worker++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for index := range indices {
+				if err := operation(ctx, index); err != nil {
+					once.Do(func() {
+						firstErr = fmt.Errorf("stripe %v of write %v: %w", index, manifest.WriteID, err)
+						cancel()
+					})
+				}
+			}
+		}()
+	}
+
+send:
+	for index := first; index < end; index++ {
+		select {
+		case indices <- index:
+		case <-ctx.Done():
+			break send
+		}
+	}
+	close(indices)
+	wg.Wait()
+
+	if firstErr == nil && ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return firstErr
+}
+
+func newWriteID() (string, error) {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return "", fmt.Errorf("read random bytes: %w", err)
+	}
+	return hex.EncodeToString(id), nil
+}
+
+func min(a int64, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func max(a int64, b int64) int64 {
+	if a > b {
+		return a
+	}
+	return b
+}
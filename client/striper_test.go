@@ -0,0 +1,138 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeNode stores objects in memory like a single node cluster.
+type fakeNode struct {
+	mu      sync.Mutex
+	objects map[string][]byte // hash -> content
+}
+
+func (n *fakeNode) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	objectHash := strings.TrimPrefix(r.URL.Path, "/object/")
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	content, exists := n.objects[objectHash]
+
+	switch r.Method {
+	case http.MethodPut:
+		if exists {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		formFile, _, err := r.FormFile("file")
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		n.objects[objectHash], _ = io.ReadAll(formFile)
+	case http.MethodGet:
+		if !exists {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_, _ = w.Write(content)
+	case http.MethodDelete:
+		if !exists {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		delete(n.objects, objectHash)
+	}
+}
+
+func TestStriper(t *testing.T) {
+	node := &fakeNode{objects: map[string][]byte{}}
+	server := httptest.NewServer(node)
+	defer server.Close()
+
+	client, err := New(Config{Nodes: []string{server.URL}, PlacementGroups: [][]int{{0}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	striper, err := NewStriper(client, StriperConfig{StripeSize: 10, Parallelism: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	content := []byte("0123456789abcdefghijklmnopqrstuvwxyz")
+	if err := striper.Put(ctx, "logical", content); err != nil {
+		t.Fatal(err)
+	}
+	if len(node.objects) != 5 {
+		t.Errorf("expected a manifest and 4 stripes, got %v objects", len(node.objects))
+	}
+	if err := striper.Put(ctx, "logical", content); !errors.Is(err, ErrObjectDoesExist) {
+		t.Errorf("the object has been written twice: %v", err)
+	}
+
+	if read, err := striper.Get(ctx, "logical"); err != nil || !bytes.Equal(read, content) {
+		t.Errorf("Get() = %q, %v", read, err)
+	}
+	if read, err := striper.GetRange(ctx, "logical", 8, 15); err != nil || string(read) != "89abcdefghijklm" {
+		t.Errorf("GetRange() = %q, %v", read, err)
+	}
+	if read, err := striper.GetRange(ctx, "logical", 30, 100); err != nil || string(read) != "uvwxyz" {
+		t.Errorf("GetRange() beyond the end = %q, %v", read, err)
+	}
+	if read, err := striper.GetRange(ctx, "logical", 30, math.MaxInt64); err != nil || string(read) != "uvwxyz" {
+		t.Errorf("GetRange() with the maximum length = %q, %v", read, err)
+	}
+	if read, err := striper.GetRange(ctx, "logical", math.MaxInt64, 1); err != nil || len(read) != 0 {
+		t.Errorf("GetRange() at the maximum offset = %q, %v", read, err)
+	}
+
+	manifest, err := striper.Stat(ctx, "logical")
+	if err != nil || manifest.Size != int64(len(content)) || manifest.StripeCount() != 4 {
+		t.Fatalf("Stat() = %+v, %v", manifest, err)
+	}
+	node.objects[ObjectHash(manifest.stripeName("logical", 1))][0] = 'X'
+	if _, err := striper.Get(ctx, "logical"); err == nil {
+		t.Error("a modified stripe hasn't been detected")
+	}
+
+	if err := striper.Delete(ctx, "logical"); err != nil {
+		t.Fatal(err)
+	}
+	if len(node.objects) != 0 {
+		t.Errorf("%v objects remain after the deletion", len(node.objects))
+	}
+
+	if err := client.Put(ctx, "plain", []byte("not a manifest")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := striper.Get(ctx, "plain"); !errors.Is(err, ErrInvalidManifest) {
+		t.Errorf("an object without manifest has been read: %v", err)
+	}
+
+	// the manifests are consistent but exceed the limits of the striper
+	checksums := func(count int) string {
+		return strings.TrimSuffix(strings.Repeat(`"`+strings.Repeat("0", 64)+`",`, count), ",")
+	}
+	for _, manifest := range []string{
+		`{"Version": 1, "Size": 8589934592, "StripeSize": 1073741824, "Checksums": [` + checksums(8) + `]}`,
+		`{"Version": 1, "Size": 1, "StripeSize": 1099511627776, "Checksums": [` + checksums(1) + `]}`,
+	} {
+		if err := client.Put(ctx, "huge", []byte(manifest)); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := striper.Get(ctx, "huge"); !errors.Is(err, ErrInvalidManifest) {
+			t.Errorf("the manifest %v has been accepted: %v", manifest, err)
+		}
+		if err := client.Delete(ctx, "huge"); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,178 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/go-resty/resty/v2"
+	"net/http"
+	neturl "net/url"
+	"strconv"
+	"time"
+)
+
+var (
+	ErrUploadDoesNotExist = errors.New("the upload does not exist")
+	ErrInvalidPart        = errors.New("the selected parts are invalid")
+)
+
+// Part is a part of a multipart upload. The object is assembled from the parts in ascending order of their numbers.
+type Part struct {
+	Number   int
+	Size     int64
+	Checksum string // hex encoded sha256 digest of the content of the part
+}
+
+type initiatedUpload struct {
+	UploadID string
+}
+
+type uploadParts struct {
+	UploadID  string
+	Initiated time.Time
+	Parts     []Part
+}
+
+type completion struct {
+	Parts []Part
+}
+
+// InitiateUpload starts a multipart upload of the object and returns the id of the upload. The object is created when
+// the upload is completed. It returns ErrObjectDoesExist if the object exists.
+func (c *Client) InitiateUpload(ctx context.Context, name string) (string, error) {
+	return c.initiateUpload(ctx, name, false)
+}
+
+// InitiateOverwrite starts a multipart upload that overwrites the object. The existing object is kept until the upload
+// is completed; the completion replaces it in a single operation. The user needs the capability to delete the
+// existing object.
+func (c *Client) InitiateOverwrite(ctx context.Context, name string) (string, error) {
+	return c.initiateUpload(ctx, name, true)
+}
+
+func (c *Client) initiateUpload(ctx context.Context, name string, overwrite bool) (string, error) {
+	var result initiatedUpload
+	response, err := c.sendUpload(ctx, name, func(request *resty.Request, url string) (*resty.Response, error) {
+		if overwrite {
+			request.SetQueryParam(overwriteParam, "true")
+		}
+		return request.SetResult(&result).Post(url)
+	})
+	if err != nil {
+		return "", err
+	}
+
+	switch response.StatusCode() {
+	case http.StatusOK:
+		return result.UploadID, nil
+	case http.StatusConflict:
+		return "", ErrObjectDoesExist
+	default:
+		return "", unexpectedResponse(response)
+	}
+}
+
+// UploadPart uploads a part of the object. A part that has already been uploaded is replaced. The number must be
+// between 1 and 10000, and every part must not be bigger than the --maxObjectSizeBytes of the cluster.
+func (c *Client) UploadPart(ctx context.Context, name string, uploadID string, number int, content []byte) (Part, error) {
+	var part Part
+	response, err := c.sendUpload(ctx, name, func(request *resty.Request, url string) (*resty.Response, error) {
+		url += "/" + neturl.PathEscape(uploadID) + "/" + strconv.Itoa(number)
+		return request.SetResult(&part).SetFileReader("file", "file", bytes.NewReader(content)).Put(url)
+	})
+	if err != nil {
+		return Part{}, err
+	}
+
+	switch response.StatusCode() {
+	case http.StatusOK:
+		return part, nil
+	case http.StatusNotFound:
+		return Part{}, ErrUploadDoesNotExist
+	default:
+		return Part{}, unexpectedResponse(response)
+	}
+}
+
+// ListParts returns the parts that have been uploaded, sorted by their numbers.
+func (c *Client) ListParts(ctx context.Context, name string, uploadID string) ([]Part, error) {
+	var result uploadParts
+	response, err := c.sendUpload(ctx, name, func(request *resty.Request, url string) (*resty.Response, error) {
+		return request.SetResult(&result).Get(url + "/" + neturl.PathEscape(uploadID))
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	switch response.StatusCode() {
+	case http.StatusOK:
+		return result.Parts, nil
+	case http.StatusNotFound:
+		return nil, ErrUploadDoesNotExist
+	default:
+		return nil, unexpectedResponse(response)
+	}
+}
+
+// CompleteUpload assembles the object from the parts and deletes the upload. The parts are identified by their numbers
+// and, if it isn't empty, by their checksums; all uploaded parts are used if parts is empty. It returns ErrInvalidPart
+// if a part hasn't been uploaded, if a checksum doesn't match or if the numbers aren't ascending. ErrObjectDoesExist
+// is returned if the object has been created in the meantime or, for overwriting uploads, if the object is currently
+// modified; the completion can be retried in that case.
+func (c *Client) CompleteUpload(ctx context.Context, name string, uploadID string, parts []Part) error {
+	response, err := c.sendUpload(ctx, name, func(request *resty.Request, url string) (*resty.Response, error) {
+		if len(parts) > 0 {
+			request.SetBody(completion{Parts: parts})
+		}
+		return request.Post(url + "/" + neturl.PathEscape(uploadID))
+	})
+	if err != nil {
+		return err
+	}
+
+	switch response.StatusCode() {
+	case http.StatusOK:
+		return nil
+	case http.StatusBadRequest:
+		return fmt.Errorf("%w: %v", ErrInvalidPart, response.String())
+	case http.StatusNotFound:
+		return ErrUploadDoesNotExist
+	case http.StatusConflict:
+		return ErrObjectDoesExist
+	default:
+		return unexpectedResponse(response)
+	}
+}
+
+// AbortUpload deletes the upload and all of its parts.
+func (c *Client) AbortUpload(ctx context.Context, name string, uploadID string) error {
+	response, err := c.sendUpload(ctx, name, func(request *resty.Request, url string) (*resty.Response, error) {
+		return request.Delete(url + "/" + neturl.PathEscape(uploadID))
+	})
+	if err != nil {
+		return err
+	}
+
+	switch response.StatusCode() {
+	case http.StatusOK:
+		return nil
+	case http.StatusNotFound:
+		return ErrUploadDoesNotExist
+	default:
+		return unexpectedResponse(response)
+	}
+}
+
+// sendUpload sends the request of a multipart upload to the primary of the object. Uploads are always handled by the
+// primary. The url passed to perform is the upload collection of the object.
+func (c *Client) sendUpload(ctx context.Context, name string, perform func(request *resty.Request, url string) (*resty.Response, error)) (*resty.Response, error) {
+	primary, err := c.primaryOf(ObjectHash(name))
+	if err != nil {
+		return nil, err
+	}
+
+	return c.send(ctx, primary, func(request *resty.Request, url string) (*resty.Response, error) {
+		return perform(request, url+"/uploads")
+	}, name)
+}
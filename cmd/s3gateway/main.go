@@ -0,0 +1,38 @@
+// Command s3gateway serves a subset of the S3 REST API in front of a mini-ceph cluster.
+package main
+
+import (
+	"fmt"
+	"github.com/rstdm/mini-ceph/internal/logger"
+	"github.com/rstdm/mini-ceph/internal/s3gateway"
+	"github.com/rstdm/mini-ceph/internal/server"
+	"os"
+)
+
+func main() {
+	config, err := s3gateway.Parse()
+	if err != nil {
+		fmt.Printf("Failed to parse configuration: %v\n", err)
+		fmt.Println("Exiting.")
+		os.Exit(1)
+	}
+
+	log, loggerCleanup, err := logger.New(config.UseProductionLogger)
+	if err != nil {
+		fmt.Printf("Failed to initialize logger: %v\n", err)
+		fmt.Println("Exiting.")
+		os.Exit(1)
+	}
+	defer loggerCleanup()
+
+	// the secrets are stored in the credentials file and aren't part of the configuration
+	log.Infow("Logging gateway configuration", "flagValues", config)
+
+	serv, err := server.NewGateway(config, log)
+	if err != nil {
+		log.Fatalw("Failed to start gateway", "err", err, "port", config.Port)
+		return
+	}
+
+	serv.Launch()
+}
@@ -1,40 +1,108 @@
 package api
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"github.com/gin-gonic/gin"
+	"github.com/rstdm/mini-ceph/internal/api/auth"
 	"github.com/rstdm/mini-ceph/internal/api/middleware"
 	"github.com/rstdm/mini-ceph/internal/api/object"
 	"github.com/rstdm/mini-ceph/internal/api/object/distribution"
 	"github.com/rstdm/mini-ceph/internal/configuration"
+	"github.com/rstdm/mini-ceph/internal/metrics"
 	"go.uber.org/zap"
+	"net/http"
+	"time"
 )
 
 const objectRoute = "object/:" + middleware.ObjectParam
+const listRoute = "objects"
+const uploadRoute = objectRoute + "/uploads"
+const uploadIDRoute = ":" + middleware.UploadParam
+const uploadPartRoute = uploadIDRoute + "/:" + partNumberParam
+const presignRoute = "presign/:" + middleware.ObjectParam
 const clusterRoute = "internal/:" + middleware.ObjectParam
+const placementGroupParam = "placementGroup"
+const clusterPlacementGroupRoute = "internal/pg/:" + placementGroupParam
+const clusterCapacityRoute = "internal/capacity"
+const clusterUsageRoute = "internal/usage"
+const adminRoute = "admin"
+
+// usersReloadInterval is the interval in which the users file is checked for modifications.
+const usersReloadInterval = 10 * time.Second
+
+// bearerTokenUser is the name of the user of the userBearerToken in the audit log.
+const bearerTokenUser = "userBearerToken"
 
 type API struct {
 	objectHandler       *object.Handler
 	distributionHandler *distribution.Handler
 	maxObjectSizeBytes  int64
-	userBearerToken     string
+	readBalancing       bool
+	clusterMTLS         bool
+	users               *auth.Users     // nil if authentication is disabled
+	urlSigner           *auth.URLSigner // nil if presigned URLs are disabled
+	nodeSchemes         map[string]string
+	pools               map[string]configuration.Pool
+	dataFolder          string
+	startedAt           time.Time
 	clusterBearerToken  string
 	sugar               *zap.SugaredLogger
 }
 
-func NewAPI(config configuration.Configuration, sugar *zap.SugaredLogger) (*API, error) {
+// NewAPI creates the API. The TLS configuration is used for the connections to the other nodes; it may be nil. The
+// metrics of the object handler are added to the registry.
+func NewAPI(config configuration.Configuration, clusterTLSConfig *tls.Config, registry *metrics.Registry, sugar *zap.SugaredLogger) (*API, error) {
 	distributionHandler := distribution.NewHandler(config.NodeID, config.NodeHosts, config.PlacementGroups)
-	objectHandler, err := object.NewHandler(config.ObjectFolder, config.ClusterBearerToken, distributionHandler, sugar)
+	objectHandler, err := object.NewHandler(config, distributionHandler, clusterTLSConfig, registry, sugar)
 	if err != nil {
 		err = fmt.Errorf("create object handler: %w", err)
 		return nil, err
 	}
 
+	var users *auth.Users
+	if config.UserBearerToken != "" || config.UsersFile != "" {
+		var static []auth.User
+		if config.UserBearerToken != "" {
+			static = append(static, auth.User{
+				Name:    bearerTokenUser,
+				KeyHash: auth.HashKey(config.UserBearerToken),
+				Grants:  []auth.Grant{auth.FullAccess()},
+			})
+		}
+		if users, err = auth.NewUsers(config.UsersFile, static, sugar); err != nil {
+			err = fmt.Errorf("load users: %w", err)
+			return nil, err
+		}
+		users.Watch(usersReloadInterval)
+	}
+
+	var urlSigner *auth.URLSigner
+	if config.URLSigningKey != "" {
+		if urlSigner, err = auth.NewURLSigner(config.URLSigningKey); err != nil {
+			err = fmt.Errorf("create URL signer: %w", err)
+			return nil, err
+		}
+	}
+	nodeSchemes := map[string]string{}
+	for nodeID, host := range config.NodeHosts {
+		nodeSchemes[host] = config.NodeSchemes[nodeID]
+	}
+
 	api := &API{
 		objectHandler:       objectHandler,
 		distributionHandler: distributionHandler,
 		maxObjectSizeBytes:  config.MaxObjectSizeBytes,
-		userBearerToken:     config.UserBearerToken,
+		readBalancing:       config.ReadBalancing,
+		clusterMTLS:         config.ClusterMTLS,
+		users:               users,
+		urlSigner:           urlSigner,
+		nodeSchemes:         nodeSchemes,
+		pools:               config.Pools,
+		dataFolder:          config.DataFolder,
+		startedAt:           time.Now(),
 		clusterBearerToken:  config.ClusterBearerToken,
 		sugar:               sugar,
 	}
@@ -44,37 +112,151 @@ func NewAPI(config configuration.Configuration, sugar *zap.SugaredLogger) (*API,
 
 func (a *API) RegisterHandler(engine *gin.Engine) {
 	a.registerObjectRoutes(engine)
+	a.registerUploadRoutes(engine)
+	a.registerPresignRoutes(engine)
 	a.registerClusterRoutes(engine)
+	a.registerAdminRoutes(engine)
+	a.registerHealthRoutes(engine)
 }
 
 func (a *API) registerObjectRoutes(engine *gin.Engine) {
-	var middlewares []gin.HandlerFunc
-	if a.userBearerToken != "" {
-		middlewares = append(middlewares, middleware.BearerAuthentication(a.userBearerToken))
+	middlewares := []gin.HandlerFunc{middleware.AuditLog(a.sugar)}
+	if a.urlSigner != nil {
+		middlewares = append(middlewares, middleware.PresignedURLAuthentication(a.urlSigner, a.users))
+	}
+	if a.users != nil {
+		middlewares = append(middlewares, middleware.UserAuthentication(a.users))
 	} else {
-		a.sugar.Warn("No userBearerToken has been specified. All user level API endpoints are exposed without authentication.")
+		a.sugar.Warn("Neither a userBearerToken nor a usersFile has been specified. All user level API endpoints are exposed without authentication.")
+	}
+	var readLeases middleware.ReadLeaseHolder
+	if a.readBalancing {
+		readLeases = a.objectHandler
 	}
-	middlewares = append(middlewares, middleware.ObjectMiddleware, middleware.DistributionMiddleware(false, a.distributionHandler))
+	// the pool is looked up after the distribution middleware; only the nodes that store the object know it
+	middlewares = append(middlewares, middleware.ObjectMiddleware, middleware.DistributionMiddleware(false, a.distributionHandler, readLeases),
+		middleware.ObjectAuthorization(a.objectHandler))
 
 	objectGroup := engine.Group(objectRoute, middlewares...)
 
 	objectGroup.PUT("", a.putObject)
 	objectGroup.GET("", a.getObject)
+	objectGroup.HEAD("", a.getObject)
 	objectGroup.DELETE("", a.deleteObject)
+
+	// the listing isn't bound to an object; the objects are filtered by the grants of the user
+	listMiddlewares := []gin.HandlerFunc{middleware.AuditLog(a.sugar)}
+	if a.users != nil {
+		listMiddlewares = append(listMiddlewares, middleware.UserAuthentication(a.users))
+	}
+	engine.GET(listRoute, append(listMiddlewares, a.listObjects)...)
+}
+
+// registerUploadRoutes registers the routes of multipart uploads. Uploads are always handled by the primary; presigned
+// URLs don't apply to them.
+func (a *API) registerUploadRoutes(engine *gin.Engine) {
+	middlewares := []gin.HandlerFunc{middleware.AuditLog(a.sugar)}
+	if a.users != nil {
+		middlewares = append(middlewares, middleware.UserAuthentication(a.users))
+	}
+	middlewares = append(middlewares, middleware.ObjectMiddleware, middleware.DistributionMiddleware(false, a.distributionHandler, nil),
+		middleware.UploadAuthorization(a.objectHandler, a.objectHandler))
+
+	uploadGroup := engine.Group(uploadRoute, middlewares...)
+
+	uploadGroup.POST("", a.initiateUpload)
+	uploadGroup.GET(uploadIDRoute, a.getUploadParts)
+	uploadGroup.PUT(uploadPartRoute, a.putUploadPart)
+	uploadGroup.POST(uploadIDRoute, a.completeUpload)
+	uploadGroup.DELETE(uploadIDRoute, a.abortUpload)
+}
+
+func (a *API) registerPresignRoutes(engine *gin.Engine) {
+	if a.urlSigner == nil {
+		return
+	}
+
+	middlewares := []gin.HandlerFunc{middleware.AuditLog(a.sugar)}
+	if a.users != nil {
+		middlewares = append(middlewares, middleware.UserAuthentication(a.users))
+	}
+	middlewares = append(middlewares, middleware.ObjectMiddleware)
+
+	// every node signs URLs; the URL points to the primary of the object
+	engine.POST(presignRoute, append(middlewares, a.presignObject)...)
 }
 
 func (a *API) registerClusterRoutes(engine *gin.Engine) {
 	var middlewares []gin.HandlerFunc
+	if a.clusterMTLS {
+		middlewares = append(middlewares, middleware.ClientCertificateAuthentication())
+	}
 	if a.clusterBearerToken != "" {
 		middlewares = append(middlewares, middleware.BearerAuthentication(a.clusterBearerToken))
 	} else {
 		a.sugar.Warn("No clusterBearerToken has been specified. All user level API endpoints are exposed without authentication.")
 	}
-	middlewares = append(middlewares, middleware.ObjectMiddleware, middleware.DistributionMiddleware(true, a.distributionHandler))
+	middlewares = append(middlewares, middleware.ObjectMiddleware, middleware.DistributionMiddleware(true, a.distributionHandler, nil))
 
 	clusterGroup := engine.Group(clusterRoute, middlewares...)
 
 	clusterGroup.PUT("", a.putObject)
 	clusterGroup.GET("", a.getObject)
 	clusterGroup.DELETE("", a.deleteObject)
+	clusterGroup.GET("inventory", a.getObjectInventory)
+	clusterGroup.POST("corruption", a.reportCorruption)
+	clusterGroup.PUT("uploads/"+uploadPartRoute, a.putUploadPart)
+	clusterGroup.GET("uploads/"+uploadPartRoute, a.getUploadPart)
+	clusterGroup.DELETE("uploads/"+uploadIDRoute, a.abortUpload)
+
+	var pgMiddlewares []gin.HandlerFunc
+	if a.clusterMTLS {
+		pgMiddlewares = append(pgMiddlewares, middleware.ClientCertificateAuthentication())
+	}
+	if a.clusterBearerToken != "" {
+		pgMiddlewares = append(pgMiddlewares, middleware.BearerAuthentication(a.clusterBearerToken))
+	}
+	pgGroup := engine.Group(clusterPlacementGroupRoute, pgMiddlewares...)
+
+	pgGroup.GET("inventory", a.getInventory)
+	pgGroup.POST("lease", a.grantReadLease)
+
+	// the primaries fetch the disk space of their peers to reject writes early if a peer is full
+	engine.GET(clusterCapacityRoute, append(pgMiddlewares, a.getDiskSpace)...)
+	// every node reports the usage of its primary placement groups; the sum is the usage of the cluster
+	engine.GET(clusterUsageRoute, append(pgMiddlewares, a.getUsage)...)
+}
+
+func (a *API) registerAdminRoutes(engine *gin.Engine) {
+	middlewares := []gin.HandlerFunc{middleware.AuditLog(a.sugar)}
+	if a.users != nil {
+		middlewares = append(middlewares, middleware.UserAuthentication(a.users), middleware.Authorization(auth.CapabilityAdmin))
+	} else {
+		a.sugar.Warn("Neither a userBearerToken nor a usersFile has been specified. The admin endpoints (scrub, repair, " +
+			"missing, usage, rewrap) are exposed without authentication.")
+	}
+
+	adminGroup := engine.Group(adminRoute, middlewares...)
+
+	adminGroup.GET("scrub", a.getScrubReports)
+	adminGroup.POST("scrub/:"+placementGroupParam, a.scrubPlacementGroup)
+	adminGroup.POST("repair/:"+middleware.ObjectParam, middleware.ObjectMiddleware, a.repairObject)
+	adminGroup.GET("missing", a.getMissingEntries)
+	adminGroup.GET("usage", a.getClusterUsage)
+	adminGroup.POST("rewrap", a.rewrapKeys)
+}
+
+// abortOnContextError completes the request if the operation has been canceled by the client or if it has timed out.
+func abortOnContextError(c *gin.Context, err error) bool {
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		c.String(http.StatusGatewayTimeout, "The operation timed out.")
+		return true
+	case errors.Is(err, context.Canceled):
+		// the client has gone away; nobody reads the response
+		_ = c.AbortWithError(http.StatusServiceUnavailable, err)
+		return true
+	default:
+		return false
+	}
 }
@@ -0,0 +1,124 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// query parameters of presigned URLs
+const (
+	expiresParam          = "expires"
+	userParam             = "user"
+	nameParam             = "name"
+	poolParam             = "pool"
+	minContentLengthParam = "minContentLength"
+	maxContentLengthParam = "maxContentLength"
+	SignatureParam        = "signature"
+)
+
+var ErrInvalidSignature = errors.New("the signature of the URL is invalid")
+var ErrURLExpired = errors.New("the URL has expired")
+
+// PresignedRequest is a request that can be sent without bearer token. The request is performed on behalf of the user
+// that has requested the URL; the grants of the user are checked when the URL is used.
+type PresignedRequest struct {
+	Method     string
+	ObjectHash string
+	Expires    time.Time
+	User       string // empty if authentication is disabled
+	Name       string // optional name of the object; grants that are scoped by prefixes require it
+	Pool       string // optional pool of PUT requests
+
+	// MinContentLength and MaxContentLength limit the size of the request body of PUT requests. The limits don't
+	// apply if they are 0.
+	MinContentLength int64
+	MaxContentLength int64
+}
+
+// URLSigner signs and verifies presigned URLs with HMAC-SHA256. All nodes of the cluster must use the same key, so a
+// URL can be used with every node.
+type URLSigner struct {
+	key []byte
+}
+
+func NewURLSigner(key string) (*URLSigner, error) {
+	if len(key) < 16 {
+		return nil, errors.New("the URL signing key must have at least 16 characters")
+	}
+	return &URLSigner{key: []byte(key)}, nil
+}
+
+// Query returns the query parameters of the signed URL, including the signature.
+func (s *URLSigner) Query(request PresignedRequest) url.Values {
+	query := url.Values{}
+	query.Set(expiresParam, strconv.FormatInt(request.Expires.Unix(), 10))
+	setIfNotEmpty(query, userParam, request.User)
+	setIfNotEmpty(query, nameParam, request.Name)
+	setIfNotEmpty(query, poolParam, request.Pool)
+	if request.MinContentLength > 0 {
+		query.Set(minContentLengthParam, strconv.FormatInt(request.MinContentLength, 10))
+	}
+	if request.MaxContentLength > 0 {
+		query.Set(maxContentLengthParam, strconv.FormatInt(request.MaxContentLength, 10))
+	}
+	query.Set(SignatureParam, s.sign(request.Method, request.ObjectHash, query))
+
+	return query
+}
+
+func setIfNotEmpty(query url.Values, key string, value string) {
+	if value != "" {
+		query.Set(key, value)
+	}
+}
+
+// sign calculates the signature of all parameters, so none of them can be modified or removed.
+func (s *URLSigner) sign(method string, objectHash string, query url.Values) string {
+	fields := []string{method, strings.ToLower(objectHash)}
+	for _, param := range []string{expiresParam, userParam, nameParam, poolParam, minContentLengthParam, maxContentLengthParam} {
+		fields = append(fields, query.Get(param))
+	}
+
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write([]byte(strings.Join(fields, "\n")))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Verify checks the signature and the expiry of a presigned URL and returns the signed request.
+func (s *URLSigner) Verify(method string, objectHash string, query url.Values, now time.Time) (PresignedRequest, error) {
+	if !hmac.Equal([]byte(query.Get(SignatureParam)), []byte(s.sign(method, objectHash, query))) {
+		return PresignedRequest{}, ErrInvalidSignature
+	}
+
+	request := PresignedRequest{
+		Method:     method,
+		ObjectHash: objectHash,
+		User:       query.Get(userParam),
+		Name:       query.Get(nameParam),
+		Pool:       query.Get(poolParam),
+	}
+	var expires int64
+	var err error
+	for param, value := range map[string]*int64{expiresParam: &expires, minContentLengthParam: &request.MinContentLength,
+		maxContentLengthParam: &request.MaxContentLength} {
+		if rawValue := query.Get(param); rawValue != "" {
+			if *value, err = strconv.ParseInt(rawValue, 10, 64); err != nil {
+				return PresignedRequest{}, fmt.Errorf("parse %v: %w", param, err)
+			}
+		}
+	}
+	request.Expires = time.Unix(expires, 0)
+
+	if !now.Before(request.Expires) {
+		return PresignedRequest{}, ErrURLExpired
+	}
+
+	return request, nil
+}
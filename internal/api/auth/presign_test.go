@@ -0,0 +1,63 @@
+package auth
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestPresignedURL(t *testing.T) {
+	signer, err := NewURLSigner("0123456789abcdef")
+	if err != nil {
+		t.Fatalf("create signer: %v", err)
+	}
+	now := time.Unix(1_700_000_000, 0)
+	objectHash := "2352da7280f1decc3acf1ba84eb945c9fc2b7b541094e1d0992dbffd1b6664cc"
+	request := PresignedRequest{
+		Method:           http.MethodPut,
+		ObjectHash:       objectHash,
+		Expires:          now.Add(time.Minute),
+		User:             "alice",
+		Pool:             "logs",
+		MaxContentLength: 1024,
+	}
+	query := signer.Query(request)
+
+	verified, err := signer.Verify(http.MethodPut, objectHash, query, now)
+	if err != nil {
+		t.Fatalf("verify: %v", err)
+	}
+	if verified != request {
+		t.Errorf("verified request = %+v, expected %+v", verified, request)
+	}
+
+	if _, err := signer.Verify(http.MethodPut, objectHash, query, now.Add(time.Minute)); !errors.Is(err, ErrURLExpired) {
+		t.Errorf("expired URL: %v", err)
+	}
+	if _, err := signer.Verify(http.MethodGet, objectHash, query, now); !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("other method: %v", err)
+	}
+	otherHash := "1cb5741a93260ddfc05451752faddedfec78575bf45af50cdccd555a82aa32dd"
+	if _, err := signer.Verify(http.MethodPut, otherHash, query, now); !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("other object: %v", err)
+	}
+
+	for param, value := range map[string]string{maxContentLengthParam: "4096", poolParam: "default", userParam: "admin", expiresParam: "1900000000"} {
+		tampered := signer.Query(request)
+		tampered.Set(param, value)
+		if _, err := signer.Verify(http.MethodPut, objectHash, tampered, now); !errors.Is(err, ErrInvalidSignature) {
+			t.Errorf("modified %v: %v", param, err)
+		}
+	}
+	removed := signer.Query(request)
+	removed.Del(maxContentLengthParam)
+	if _, err := signer.Verify(http.MethodPut, objectHash, removed, now); !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("removed limit: %v", err)
+	}
+
+	otherSigner, _ := NewURLSigner("fedcba9876543210")
+	if _, err := otherSigner.Verify(http.MethodPut, objectHash, query, now); !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("other key: %v", err)
+	}
+}
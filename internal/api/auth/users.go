@@ -0,0 +1,289 @@
+// Package auth manages the users of the object API. Every user has an API key and a list of grants; a grant allows
+// operations on the objects of some pools or on objects whose names start with a prefix.
+package auth
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/rstdm/mini-ceph/internal/configuration"
+	"go.uber.org/zap"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Capability string
+
+const (
+	CapabilityRead   Capability = "read"
+	CapabilityWrite  Capability = "write"
+	CapabilityDelete Capability = "delete"
+	CapabilityAdmin  Capability = "admin" // scrubs, repairs and the missing set; the scopes of the grant don't apply
+)
+
+// Grant allows the capabilities for all objects that match the scopes. An empty scope matches all objects.
+type Grant struct {
+	Capabilities []Capability
+	Pools        []string `json:",omitempty"`
+	Prefixes     []string `json:",omitempty"` // prefixes of the object names
+}
+
+type User struct {
+	Name    string
+	KeyHash string // hex encoded sha256 hash of the API key; the key itself isn't stored
+	Grants  []Grant
+	Quota   *configuration.Quota `json:",omitempty"` // the objects of the user aren't limited if it is nil
+}
+
+// Allows returns true if one of the grants allows the capability for the object. The pool is empty if it is unknown,
+// e.g. because the node doesn't have a copy of the object; grants that are scoped by pools never match unknown pools.
+// The name is empty if the client hasn't sent it; grants that are scoped by prefixes never match objects without a
+// name.
+func (u User) Allows(capability Capability, pool string, objectName string) bool {
+	for _, grant := range u.Grants {
+		if grant.allows(capability, pool, objectName) {
+			return true
+		}
+	}
+	return false
+}
+
+// MightAllow returns true if one of the grants allows the capability for the object in any pool. It is meant for
+// requests whose pool isn't known yet; the grants have to be checked with Allows once the pool is known.
+func (u User) MightAllow(capability Capability, objectName string) bool {
+	for _, grant := range u.Grants {
+		if grant.allowsName(capability, objectName) {
+			return true
+		}
+	}
+	return false
+}
+
+func (g Grant) allows(capability Capability, pool string, objectName string) bool {
+	if capability != CapabilityAdmin && len(g.Pools) > 0 && !containsString(g.Pools, pool) {
+		return false
+	}
+	return g.allowsName(capability, objectName)
+}
+
+// allowsName checks the capabilities and the prefixes of the grant.
+func (g Grant) allowsName(capability Capability, objectName string) bool {
+	if !containsCapability(g.Capabilities, capability) {
+		return false
+	}
+	if capability == CapabilityAdmin {
+		return true
+	}
+
+	if len(g.Prefixes) == 0 {
+		return true
+	}
+	if objectName == "" {
+		return false
+	}
+	for _, prefix := range g.Prefixes {
+		if strings.HasPrefix(objectName, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsCapability(capabilities []Capability, capability Capability) bool {
+	for _, c := range capabilities {
+		if c == capability {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// CapabilityOfMethod returns the capability that is required for an object request with the HTTP method.
+func CapabilityOfMethod(method string) Capability {
+	switch method {
+	case http.MethodPut:
+		return CapabilityWrite
+	case http.MethodDelete:
+		return CapabilityDelete
+	default:
+		return CapabilityRead
+	}
+}
+
+// FullAccess is the grant of users that may perform every operation.
+func FullAccess() Grant {
+	return Grant{Capabilities: []Capability{CapabilityRead, CapabilityWrite, CapabilityDelete, CapabilityAdmin}}
+}
+
+// HashKey returns the hash of the API key that is stored in the users file.
+func HashKey(apiKey string) string {
+	keyHash := sha256.Sum256([]byte(apiKey))
+	return hex.EncodeToString(keyHash[:])
+}
+
+// Users contains the users of the users file and the static users, e.g. the user of the userBearerToken. The file is
+// reloaded when it changes, so users can be added, modified and removed without restarting the node.
+type Users struct {
+	path   string
+	static []User
+	sugar  *zap.SugaredLogger
+
+	mu        sync.RWMutex
+	byKeyHash map[string]User
+	byName    map[string]User
+	modTime   time.Time
+}
+
+// NewUsers loads the users file. The file is optional; only the static users exist if the path is empty.
+func NewUsers(path string, static []User, sugar *zap.SugaredLogger) (*Users, error) {
+	u := &Users{
+		path:   path,
+		static: static,
+		sugar:  sugar,
+	}
+
+	var modTime time.Time
+	if path != "" {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, fmt.Errorf("stat users file: %w", err)
+		}
+		modTime = info.ModTime()
+	}
+	if err := u.load(modTime); err != nil {
+		return nil, err
+	}
+
+	return u, nil
+}
+
+func (u *Users) load(modTime time.Time) error {
+	users := append([]User{}, u.static...)
+	if u.path != "" {
+		encodedUsers, err := os.ReadFile(u.path)
+		if err != nil {
+			return fmt.Errorf("read users file: %w", err)
+		}
+		var fileUsers []User
+		if err := json.Unmarshal(encodedUsers, &fileUsers); err != nil {
+			return fmt.Errorf("decode users file %v: %w", u.path, err)
+		}
+		users = append(users, fileUsers...)
+	}
+
+	byKeyHash := map[string]User{}
+	byName := map[string]User{}
+	for _, user := range users {
+		if err := validateUser(user); err != nil {
+			return err
+		}
+		if _, ok := byName[user.Name]; ok {
+			return fmt.Errorf("user %v is specified twice", user.Name)
+		}
+		if _, ok := byKeyHash[user.KeyHash]; ok {
+			return fmt.Errorf("the API key of user %v is used by another user", user.Name)
+		}
+		byName[user.Name] = user
+		byKeyHash[user.KeyHash] = user
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.byKeyHash = byKeyHash
+	u.byName = byName
+	u.modTime = modTime
+
+	return nil
+}
+
+func validateUser(user User) error {
+	if user.Name == "" {
+		return errors.New("a user has no name")
+	}
+	if keyHash, err := hex.DecodeString(user.KeyHash); err != nil || len(keyHash) != sha256.Size {
+		return fmt.Errorf("KeyHash of user %v isn't a hex encoded sha256 hash", user.Name)
+	}
+	for _, grant := range user.Grants {
+		for _, capability := range grant.Capabilities {
+			switch capability {
+			case CapabilityRead, CapabilityWrite, CapabilityDelete, CapabilityAdmin:
+			default:
+				return fmt.Errorf("user %v has the unknown capability %q", user.Name, capability)
+			}
+		}
+	}
+	if err := user.Quota.Validate(); err != nil {
+		return fmt.Errorf("user %v: %w", user.Name, err)
+	}
+	return nil
+}
+
+// Watch starts reloading the users file whenever it has been modified. The file is checked every interval.
+func (u *Users) Watch(interval time.Duration) {
+	if u.path == "" {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			u.reloadIfModified()
+		}
+	}()
+}
+
+func (u *Users) reloadIfModified() {
+	info, err := os.Stat(u.path)
+	if err != nil {
+		u.sugar.Warnw("Failed to check the users file for modifications", "err", err)
+		return
+	}
+
+	u.mu.RLock()
+	modified := !info.ModTime().Equal(u.modTime)
+	u.mu.RUnlock()
+	if !modified {
+		return
+	}
+
+	if err := u.load(info.ModTime()); err != nil {
+		u.sugar.Warnw("Failed to reload the users file. The old users are used until the file is valid again.", "err", err)
+		return
+	}
+	u.sugar.Infow("Reloaded the users file", "path", u.path)
+}
+
+// Authenticate returns the user of the API key.
+func (u *Users) Authenticate(apiKey string) (User, bool) {
+	keyHash := HashKey(apiKey) // the lookup doesn't reveal anything about the keys because only hashes are compared
+
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	user, ok := u.byKeyHash[keyHash]
+	return user, ok
+}
+
+// Lookup returns the user with the name, e.g. the user that has requested a presigned URL. Presigned URLs become
+// invalid if the user is removed.
+func (u *Users) Lookup(name string) (User, bool) {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	user, ok := u.byName[name]
+	return user, ok
+}
@@ -0,0 +1,115 @@
+package auth
+
+import (
+	"encoding/json"
+	"go.uber.org/zap"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestAllows(t *testing.T) {
+	user := User{Name: "alice", Grants: []Grant{
+		{Capabilities: []Capability{CapabilityRead}},
+		{Capabilities: []Capability{CapabilityWrite, CapabilityDelete}, Pools: []string{"logs"}, Prefixes: []string{"alice/"}},
+	}}
+
+	tests := []struct {
+		capability Capability
+		pool       string
+		name       string
+		allowed    bool
+	}{
+		{CapabilityRead, "default", "", true},
+		{CapabilityWrite, "logs", "alice/a", true},
+		{CapabilityDelete, "logs", "alice/a", true},
+		{CapabilityWrite, "default", "alice/a", false}, // wrong pool
+		{CapabilityWrite, "logs", "bob/a", false},      // wrong prefix
+		{CapabilityWrite, "logs", "", false},           // the prefix can't be checked without name
+		{CapabilityDelete, "", "alice/a", false},       // the pool is unknown, e.g. because the local copy is missing
+		{CapabilityRead, "", "", true},                 // the grant isn't scoped by pools
+		{CapabilityAdmin, "", "", false},
+	}
+	for _, test := range tests {
+		if allowed := user.Allows(test.capability, test.pool, test.name); allowed != test.allowed {
+			t.Errorf("Allows(%v, %q, %q) = %v", test.capability, test.pool, test.name, allowed)
+		}
+	}
+
+	// the pool of existing objects isn't known when URLs are presigned
+	if !user.MightAllow(CapabilityDelete, "alice/a") || user.MightAllow(CapabilityDelete, "bob/a") {
+		t.Errorf("MightAllow ignores the prefixes")
+	}
+
+	admin := User{Name: "admin", Grants: []Grant{{Capabilities: []Capability{CapabilityAdmin}, Pools: []string{"logs"}}}}
+	if !admin.Allows(CapabilityAdmin, "", "") || admin.Allows(CapabilityRead, "logs", "") {
+		t.Errorf("admin grants are wrong")
+	}
+}
+
+func writeUsers(t *testing.T, path string, users []User, modTime time.Time) {
+	t.Helper()
+
+	encodedUsers, err := json.Marshal(users)
+	if err != nil {
+		t.Fatalf("encode users: %v", err)
+	}
+	if err := os.WriteFile(path, encodedUsers, 0600); err != nil {
+		t.Fatalf("write users: %v", err)
+	}
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatalf("set modification time: %v", err)
+	}
+}
+
+func TestUsersReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.json")
+	modTime := time.Now()
+	readOnly := []Grant{{Capabilities: []Capability{CapabilityRead}}}
+	writeUsers(t, path, []User{{Name: "alice", KeyHash: HashKey("alice-key"), Grants: readOnly}}, modTime)
+
+	static := []User{{Name: "token", KeyHash: HashKey("token"), Grants: []Grant{FullAccess()}}}
+	users, err := NewUsers(path, static, zap.NewNop().Sugar())
+	if err != nil {
+		t.Fatalf("load users: %v", err)
+	}
+
+	if user, ok := users.Authenticate("alice-key"); !ok || user.Name != "alice" {
+		t.Errorf("alice hasn't been authenticated: %v", ok)
+	}
+	if user, ok := users.Authenticate("token"); !ok || !user.Allows(CapabilityAdmin, "", "") {
+		t.Errorf("static user hasn't been authenticated: %v", ok)
+	}
+	if _, ok := users.Authenticate("unknown"); ok {
+		t.Errorf("unknown key has been authenticated")
+	}
+
+	// the key of alice is rotated and bob is added
+	modTime = modTime.Add(time.Second)
+	writeUsers(t, path, []User{
+		{Name: "alice", KeyHash: HashKey("new-alice-key"), Grants: readOnly},
+		{Name: "bob", KeyHash: HashKey("bob-key"), Grants: readOnly},
+	}, modTime)
+	users.reloadIfModified()
+	if _, ok := users.Authenticate("alice-key"); ok {
+		t.Errorf("the old key of alice is still valid")
+	}
+	if _, ok := users.Authenticate("bob-key"); !ok {
+		t.Errorf("bob hasn't been authenticated")
+	}
+
+	// invalid files are ignored; the old users are kept
+	modTime = modTime.Add(time.Second)
+	writeUsers(t, path, []User{{Name: "mallory", KeyHash: "not a hash"}}, modTime)
+	users.reloadIfModified()
+	if _, ok := users.Authenticate("bob-key"); !ok {
+		t.Errorf("the users of the last valid file have been dropped")
+	}
+
+	// a user of the file must not shadow a static user
+	writeUsers(t, path, []User{{Name: "token", KeyHash: HashKey("other")}}, modTime)
+	if _, err := NewUsers(path, static, zap.NewNop().Sugar()); err == nil {
+		t.Errorf("duplicate user has been accepted")
+	}
+}
@@ -0,0 +1,251 @@
+package api
+
+import (
+	"context"
+	"github.com/gin-gonic/gin"
+	"github.com/rstdm/mini-ceph/client"
+	"github.com/rstdm/mini-ceph/internal/api/object/file"
+	"github.com/rstdm/mini-ceph/internal/configuration"
+	"github.com/rstdm/mini-ceph/internal/metrics"
+	"go.uber.org/zap"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testNode is a node of a cluster that runs in the test process.
+type testNode struct {
+	config configuration.Configuration
+	server *httptest.Server
+	down   atomic.Bool // the node answers every request with 503 Service Unavailable while it is down
+
+	mu     sync.Mutex
+	api    *API
+	engine *gin.Engine
+}
+
+// newTestCluster starts a cluster of three nodes that form a single placement group. The first node is the primary;
+// every node stores a copy of the objects of the default pool, two copies are the write quorum. The configuration of
+// every node can be adjusted before the nodes are started.
+func newTestCluster(t *testing.T, configure func(config *configuration.Configuration)) []*testNode {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+
+	nodes := make([]*testNode, 3)
+	var hosts []string
+	for i := range nodes {
+		node := &testNode{}
+		node.server = httptest.NewUnstartedServer(http.HandlerFunc(node.serveHTTP))
+		nodes[i] = node
+		hosts = append(hosts, node.server.Listener.Addr().String())
+	}
+
+	for i, node := range nodes {
+		dataFolder := t.TempDir()
+		node.config = configuration.Configuration{
+			MaxObjectSizeBytes: 1 << 20,
+			OperationTimeout:   10 * time.Second,
+			ReadLeaseDuration:  time.Minute,
+			NearfullRatio:      1,
+			FullRatio:          1,
+			Pools:              map[string]configuration.Pool{configuration.DefaultPool: {Size: 3, MinSize: 2}},
+			DataFolder:         dataFolder,
+			ObjectFolder:       filepath.Join(dataFolder, "data"),
+			StorageBackend:     file.BackendFile,
+			NodeID:             i,
+			NodeHosts:          hosts,
+			NodeSchemes:        []string{"http", "http", "http"},
+			PlacementGroups:    [][]int{{0, 1, 2}},
+		}
+		if configure != nil {
+			configure(&node.config)
+		}
+		node.restart(t)
+		node.server.Start()
+		t.Cleanup(node.server.Close)
+	}
+
+	return nodes
+}
+
+func (n *testNode) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	if n.down.Load() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	n.mu.Lock()
+	engine := n.engine
+	n.mu.Unlock()
+
+	engine.ServeHTTP(w, r)
+}
+
+// restart replaces the API of the node by a new one that reads the state of the node from the data folder.
+func (n *testNode) restart(t *testing.T) {
+	t.Helper()
+
+	a, err := NewAPI(n.config, nil, metrics.NewRegistry(), zap.NewNop().Sugar())
+	if err != nil {
+		t.Fatalf("create API of node %v: %v", n.config.NodeID, err)
+	}
+
+	engine := gin.New()
+	a.RegisterHandler(engine)
+
+	n.mu.Lock()
+	n.api, n.engine = a, engine
+	n.mu.Unlock()
+}
+
+func (n *testNode) currentAPI() *API {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.api
+}
+
+// newTestClient creates a client of the cluster.
+func newTestClient(t *testing.T, nodes []*testNode, readPolicy client.ReadPolicy) *client.Client {
+	t.Helper()
+
+	var urls []string
+	for _, node := range nodes {
+		urls = append(urls, node.server.URL)
+	}
+	c, err := client.New(client.Config{Nodes: urls, PlacementGroups: nodes[0].config.PlacementGroups, ReadPolicy: readPolicy})
+	if err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+	return c
+}
+
+// corrupt modifies the stored content of the copy of the object on the node.
+func (n *testNode) corrupt(t *testing.T, objectHash string) {
+	t.Helper()
+
+	path := filepath.Join(n.config.ObjectFolder, objectHash)
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read copy: %v", err)
+	}
+	content[0] ^= 0xff
+
+	// the file mode marks the copy as persisted
+	if err := os.Chmod(path, 0600); err != nil {
+		t.Fatalf("make copy writable: %v", err)
+	}
+	if err := os.WriteFile(path, content, 0600); err != nil {
+		t.Fatalf("write corrupted copy: %v", err)
+	}
+	if err := os.Chmod(path, 0400); err != nil {
+		t.Fatalf("mark copy as persisted: %v", err)
+	}
+}
+
+// remove deletes the copy of the object from the node without telling the other nodes.
+func (n *testNode) remove(t *testing.T, objectHash string) {
+	t.Helper()
+
+	for _, path := range []string{filepath.Join(n.config.ObjectFolder, objectHash), filepath.Join(n.config.ObjectFolder, "meta", objectHash)} {
+		if err := os.Remove(path); err != nil {
+			t.Fatalf("remove copy: %v", err)
+		}
+	}
+}
+
+// computedChecksum returns the checksum of the content that the node stores; it is empty if the node doesn't store the
+// object.
+func (n *testNode) computedChecksum(t *testing.T, objectHash string) string {
+	t.Helper()
+
+	entry, err := n.currentAPI().objectHandler.ObjectInventory(objectHash)
+	if err != nil {
+		return ""
+	}
+	return entry.ComputedChecksum
+}
+
+func TestRepair(t *testing.T) {
+	tests := []struct {
+		name      string
+		damage    func(t *testing.T, nodes []*testNode, objectHash string)
+		wantError bool
+	}{
+		{
+			name:   "corrupted primary",
+			damage: func(t *testing.T, nodes []*testNode, objectHash string) { nodes[0].corrupt(t, objectHash) },
+		},
+		{
+			name:   "corrupted secondary",
+			damage: func(t *testing.T, nodes []*testNode, objectHash string) { nodes[1].corrupt(t, objectHash) },
+		},
+		{
+			name:   "missing copy",
+			damage: func(t *testing.T, nodes []*testNode, objectHash string) { nodes[2].remove(t, objectHash) },
+		},
+		{
+			name: "no intact copy",
+			damage: func(t *testing.T, nodes []*testNode, objectHash string) {
+				for _, node := range nodes {
+					node.corrupt(t, objectHash)
+				}
+			},
+			wantError: true,
+		},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			nodes := newTestCluster(t, nil)
+			c := newTestClient(t, nodes, client.ReadFromPrimary)
+			if err := c.Put(context.Background(), "object", []byte("content")); err != nil {
+				t.Fatalf("put object: %v", err)
+			}
+			objectHash := client.ObjectHash("object")
+			checksum := file.Checksum([]byte("content"))
+
+			test.damage(t, nodes, objectHash)
+
+			result, err := nodes[0].currentAPI().objectHandler.Repair(context.Background(), objectHash)
+			if test.wantError {
+				if err == nil {
+					t.Errorf("Repair() = %+v, want an error", result)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Repair() failed: %v", err)
+			}
+			if !result.ShouldExist || result.Checksum != checksum || len(result.Actions) != 1 {
+				t.Errorf("Repair() = %+v", result)
+			}
+			for i, node := range nodes {
+				if got := node.computedChecksum(t, objectHash); got != checksum {
+					t.Errorf("checksum of the copy on node %v = %q after the repair", i, got)
+				}
+			}
+			if result, err := nodes[0].currentAPI().objectHandler.Repair(context.Background(), objectHash); err != nil || len(result.Actions) != 0 {
+				t.Errorf("second Repair() = %+v, %v; the copies are already consistent", result, err)
+			}
+		})
+	}
+}
+
+// waitFor polls the condition until it is true.
+func waitFor(t *testing.T, condition func() bool, description string) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting until %v", description)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -12,11 +12,22 @@ import (
 func (a *API) deleteObject(c *gin.Context) {
 	objectHash := middleware.GetObjectHash(c)
 
-	err := a.objectHandler.Delete(objectHash)
+	err := a.objectHandler.Delete(c.Request.Context(), objectHash)
 	if err != nil && errors.Is(err, object.ErrObjectDoesNotExist) {
 		c.String(http.StatusNotFound, "the requested object does not exists")
 		return
 	}
+	if err != nil && errors.Is(err, object.ErrObjectIsRepaired) {
+		c.String(http.StatusServiceUnavailable, "the requested object is currently repaired. Try again later.")
+		return
+	}
+	if err != nil && errors.Is(err, object.ErrObjectIsReplaced) {
+		c.String(http.StatusServiceUnavailable, "the requested object is currently replaced. Try again later.")
+		return
+	}
+	if err != nil && abortOnContextError(c, err) {
+		return
+	}
 	if err != nil {
 		err = fmt.Errorf("delete object: %w", err)
 		_ = c.AbortWithError(http.StatusInternalServerError, err)
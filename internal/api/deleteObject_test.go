@@ -0,0 +1,90 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"github.com/rstdm/mini-ceph/client"
+	"github.com/rstdm/mini-ceph/internal/configuration"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDeletedObjectsStayDeletedAfterRestart(t *testing.T) {
+	tests := []struct {
+		name   string
+		delete func(t *testing.T, nodes []*testNode, c *client.Client, objectHash string)
+	}{
+		{
+			name: "deletion",
+			delete: func(t *testing.T, nodes []*testNode, c *client.Client, objectHash string) {
+				if err := c.Delete(context.Background(), "object"); err != nil {
+					t.Fatalf("delete object: %v", err)
+				}
+			},
+		},
+		{
+			name: "replica is unreachable during the deletion",
+			delete: func(t *testing.T, nodes []*testNode, c *client.Client, objectHash string) {
+				nodes[2].down.Store(true)
+				if err := c.Delete(context.Background(), "object"); err != nil {
+					t.Fatalf("delete object: %v", err)
+				}
+			},
+		},
+		{
+			// the primary stops after the tombstone has been written but before any copy has been deleted
+			name: "pending deletion",
+			delete: func(t *testing.T, nodes []*testNode, c *client.Client, objectHash string) {
+				tombstoneFolder := filepath.Join(nodes[0].config.ObjectFolder, "tombstones")
+				if err := os.MkdirAll(tombstoneFolder, 0700); err != nil {
+					t.Fatalf("create tombstone folder: %v", err)
+				}
+				if err := os.WriteFile(filepath.Join(tombstoneFolder, objectHash), nil, 0600); err != nil {
+					t.Fatalf("write tombstone: %v", err)
+				}
+			},
+		},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			nodes := newTestCluster(t, func(config *configuration.Configuration) {
+				config.RecoveryInterval = 20 * time.Millisecond
+			})
+			c := newTestClient(t, nodes, client.ReadFromPrimary)
+			if err := c.Put(context.Background(), "object", []byte("content")); err != nil {
+				t.Fatalf("put object: %v", err)
+			}
+			objectHash := client.ObjectHash("object")
+
+			test.delete(t, nodes, c, objectHash)
+			for _, node := range nodes {
+				node.restart(t)
+				node.down.Store(false)
+			}
+
+			if _, err := c.Get(context.Background(), "object"); !errors.Is(err, client.ErrObjectDoesNotExist) {
+				t.Errorf("Get() after restart returned %v, want ErrObjectDoesNotExist", err)
+			}
+
+			// the recovery deletes the remaining copies; the tombstone is removed once no copy is left
+			tombstonePath := filepath.Join(nodes[0].config.ObjectFolder, "tombstones", objectHash)
+			waitFor(t, func() bool {
+				for _, node := range nodes {
+					if node.computedChecksum(t, objectHash) != "" {
+						return false
+					}
+				}
+				_, err := os.Stat(tombstonePath)
+				return errors.Is(err, os.ErrNotExist)
+			}, "every copy and the tombstone have been deleted")
+
+			if _, err := c.Get(context.Background(), "object"); !errors.Is(err, client.ErrObjectDoesNotExist) {
+				t.Errorf("Get() after the recovery returned %v, want ErrObjectDoesNotExist", err)
+			}
+		})
+	}
+}
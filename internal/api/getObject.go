@@ -1,18 +1,32 @@
 package api
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/gin-gonic/gin"
 	"github.com/rstdm/mini-ceph/internal/api/middleware"
 	"github.com/rstdm/mini-ceph/internal/api/object"
+	"github.com/rstdm/mini-ceph/internal/api/object/file"
+	"github.com/rstdm/mini-ceph/internal/api/object/replication"
+	"io"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 )
 
+// objectMD5Header contains the hex encoded md5 digest of the clear-text content of unencrypted objects.
+const objectMD5Header = "X-Object-MD5"
+
 func (a *API) getObject(c *gin.Context) {
 	objectHash := middleware.GetObjectHash(c)
+	// other nodes skip the verification if they need the raw content, e.g. to repair the object. HEAD requests don't
+	// transfer any content; reading the whole object to verify it would be wasted.
+	verifyChecksum := (!middleware.IsClusterEndpoint(c) || c.Query("verifyChecksum") != "false") &&
+		c.Request.Method != http.MethodHead
 
-	err := a.objectHandler.Read(objectHash, a.transferObjectCallback(c))
+	err := a.objectHandler.Read(c.Request.Context(), objectHash, verifyChecksum, a.transferObjectCallback(c))
 	if err == nil {
 		// we don't have to do anything; the callback already completed the request
 		return
@@ -25,13 +39,124 @@ func (a *API) getObject(c *gin.Context) {
 		return
 	}
 
+	if errors.Is(err, object.ErrReplicaIsCorrupted) {
+		// the client repeats the request on the primary, which serves an intact copy
+		c.String(http.StatusMisdirectedRequest, "The copy of the requested object on this node is corrupted. "+
+			"This request should be directed to the primary of the placement group.")
+		return
+	}
+
+	if errors.Is(err, object.ErrObjectIsCorrupted) {
+		// the object is lost; retrying the request won't help
+		_ = c.Error(fmt.Errorf("transfer object: %w", err))
+		c.String(http.StatusInternalServerError, "All copies of the requested object are corrupted.")
+		return
+	}
+
+	if abortOnContextError(c, err) {
+		return
+	}
+
 	// it's an unexpected error
 	err = fmt.Errorf("transfer object: %w", err)
 	_ = c.AbortWithError(http.StatusInternalServerError, err)
 }
 
-func (a *API) transferObjectCallback(c *gin.Context) func(objectPath string) {
-	return func(objectPath string) {
-		c.File(objectPath) // This function also sets the response status to 200 OK
+func (a *API) transferObjectCallback(c *gin.Context) object.TransferObjectFunc {
+	return func(content io.ReadSeeker, modTime time.Time, metadata file.Metadata) {
+		reader, isObjectReader := content.(*file.ObjectReader)
+
+		// Expired objects read as deleted until the primary deletes them. The other nodes still receive them, so the
+		// replicas aren't repaired in the meantime.
+		if !middleware.IsClusterEndpoint(c) && metadata.Expired(time.Now()) {
+			c.String(http.StatusNotFound, "The requested object does not exist")
+			return
+		}
+
+		if middleware.IsClusterEndpoint(c) {
+			// other nodes need the metadata to restore the object, e.g. while it is repaired
+			encodedMetadata, err := json.Marshal(metadata)
+			if err == nil {
+				c.Header(replication.MetadataHeader, string(encodedMetadata))
+			}
+
+			// other nodes receive the stored content; encrypted objects are never sent in clear-text
+			if isObjectReader {
+				storedContent, err := reader.Stored()
+				if err != nil {
+					_ = c.AbortWithError(http.StatusInternalServerError, fmt.Errorf("get stored content: %w", err))
+					return
+				}
+				http.ServeContent(c.Writer, c.Request, "", modTime, storedContent)
+				return
+			}
+		}
+
+		// the digest refers to the clear-text content, even if the compressed content is sent
+		if metadata.MD5 != "" {
+			c.Header(objectMD5Header, metadata.MD5)
+		}
+
+		if isObjectReader && httpContentCodings[reader.Encoding()] {
+			c.Header("Vary", "Accept-Encoding")
+
+			// clients that understand the compression receive the compressed content; ranges refer to the compressed
+			// content
+			if acceptsEncoding(c.GetHeader("Accept-Encoding"), reader.Encoding()) {
+				sniffed := make([]byte, 512)
+				n, _ := io.ReadFull(content, sniffed)
+
+				compressedContent, err := reader.Encoded()
+				if err != nil {
+					_ = c.AbortWithError(http.StatusInternalServerError, fmt.Errorf("get compressed content: %w", err))
+					return
+				}
+
+				c.Header("Content-Type", http.DetectContentType(sniffed[:n]))
+				c.Header("Content-Encoding", reader.Encoding())
+				http.ServeContent(c.Writer, c.Request, "", modTime, compressedContent)
+				return
+			}
+		}
+
+		// the checksum identifies the clear-text content; the compressed content above is a different representation
+		if metadata.Checksum != "" {
+			c.Header("ETag", `"`+metadata.Checksum+`"`)
+		}
+
+		// This function also sets the response status to 200 OK and supports range requests
+		http.ServeContent(c.Writer, c.Request, "", modTime, content)
 	}
 }
+
+// httpContentCodings contains the compression algorithms that are registered HTTP content codings. Objects that are
+// compressed differently (e.g. snappy) are always decompressed before they are sent.
+var httpContentCodings = map[string]bool{
+	file.CompressionGzip: true,
+	file.CompressionZstd: true,
+}
+
+// acceptsEncoding returns true if the Accept-Encoding header allows the content coding. Codings with a quality of 0
+// are refused explicitly.
+func acceptsEncoding(acceptEncoding string, encoding string) bool {
+	for _, entry := range strings.Split(acceptEncoding, ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(entry), ";")
+		if !strings.EqualFold(strings.TrimSpace(coding), encoding) {
+			continue
+		}
+
+		for _, param := range strings.Split(params, ";") {
+			name, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+			if !strings.EqualFold(strings.TrimSpace(name), "q") {
+				continue
+			}
+			quality, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+			if err != nil || quality <= 0 {
+				return false
+			}
+		}
+		return true
+	}
+
+	return false
+}
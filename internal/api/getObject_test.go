@@ -0,0 +1,194 @@
+package api
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/rstdm/mini-ceph/client"
+	"github.com/rstdm/mini-ceph/internal/api/object/file"
+	"github.com/rstdm/mini-ceph/internal/configuration"
+	"go.uber.org/zap"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testObjectHash = "2352da7280f1decc3acf1ba84eb945c9fc2b7b541094e1d0992dbffd1b6664cc"
+
+func TestAcceptsEncoding(t *testing.T) {
+	tests := []struct {
+		acceptEncoding string
+		want           bool
+	}{
+		{"", false},
+		{"gzip", true},
+		{"br, GZIP", true},
+		{"gzip;q=0.5", true},
+		{"gzip; q=1", true},
+		{"gzip;q=0", false},
+		{"gzip;q=0.0000", false},
+		{"gzip; q=0.000, zstd", false},
+		{"gzip;q=invalid", false},
+		{"deflate;q=0.9", false},
+	}
+
+	for _, test := range tests {
+		if got := acceptsEncoding(test.acceptEncoding, file.CompressionGzip); got != test.want {
+			t.Errorf("acceptsEncoding(%q, gzip) = %v, want %v", test.acceptEncoding, got, test.want)
+		}
+	}
+}
+
+// serveObject persists the object in a pool with the given compression and serves it to a client that accepts the
+// encoding.
+func serveObject(t *testing.T, compression string, content string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	handler, err := file.NewHandler(file.BackendMemory, t.TempDir(), map[string]string{"logs": compression}, nil, zap.NewNop().Sugar())
+	if err != nil {
+		t.Fatalf("create file handler: %v", err)
+	}
+	storedContent, metadata, err := handler.EncodeObject([]byte(content), file.Metadata{Pool: "logs"})
+	if err != nil {
+		t.Fatalf("encode object: %v", err)
+	}
+	if err := handler.PersistObject(context.Background(), testObjectHash, storedContent, metadata); err != nil {
+		t.Fatalf("persist object: %v", err)
+	}
+
+	reader, err := handler.OpenObject(testObjectHash)
+	if err != nil {
+		t.Fatalf("open object: %v", err)
+	}
+	defer func() { _ = reader.Close() }()
+
+	recorder := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(recorder)
+	c.Request = httptest.NewRequest(http.MethodGet, "/object/"+testObjectHash, nil)
+	c.Request.Header.Set("Accept-Encoding", compression)
+	(&API{}).transferObjectCallback(c)(reader, time.Now(), metadata)
+
+	return recorder
+}
+
+func TestCompressedContentIsPassedThrough(t *testing.T) {
+	content := strings.Repeat("<p>compressible</p>\n", 1000)
+
+	recorder := serveObject(t, file.CompressionGzip, content)
+	if recorder.Code != http.StatusOK || recorder.Header().Get("Content-Encoding") != file.CompressionGzip {
+		t.Fatalf("response = %v with Content-Encoding %q, want the gzip content", recorder.Code, recorder.Header().Get("Content-Encoding"))
+	}
+	if recorder.Body.Len() >= len(content) {
+		t.Errorf("passed through content has %v bytes, but the object only %v", recorder.Body.Len(), len(content))
+	}
+	if contentType := recorder.Header().Get("Content-Type"); !strings.HasPrefix(contentType, "text/html") {
+		t.Errorf("Content-Type = %q, want the type of the clear-text content", contentType)
+	}
+
+	decompressor, err := gzip.NewReader(bytes.NewReader(recorder.Body.Bytes()))
+	if err != nil {
+		t.Fatalf("create gzip reader: %v", err)
+	}
+	if decompressed, err := io.ReadAll(decompressor); err != nil || string(decompressed) != content {
+		t.Errorf("passed through content doesn't match: %v", err)
+	}
+}
+
+func TestSnappyIsNeverAdvertised(t *testing.T) {
+	content := strings.Repeat("compressible ", 1000)
+
+	recorder := serveObject(t, file.CompressionSnappy, content)
+	if encoding := recorder.Header().Get("Content-Encoding"); encoding != "" {
+		t.Errorf("Content-Encoding = %q; snappy isn't an HTTP content coding", encoding)
+	}
+	if recorder.Body.String() != content {
+		t.Errorf("content hasn't been decompressed")
+	}
+}
+
+func TestExpiredObjectsAreNotFoundBeforeTheyAreReaped(t *testing.T) {
+	tests := []struct {
+		expires int64
+		want    int
+	}{
+		{0, http.StatusOK},
+		{time.Now().Add(time.Hour).Unix(), http.StatusOK},
+		{time.Now().Unix(), http.StatusNotFound},
+	}
+
+	for _, test := range tests {
+		recorder := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(recorder)
+		c.Request = httptest.NewRequest(http.MethodGet, "/object/"+testObjectHash, nil)
+		(&API{}).transferObjectCallback(c)(strings.NewReader("content"), time.Now(), file.Metadata{Expires: test.expires})
+
+		if recorder.Code != test.want {
+			t.Errorf("object that expires at %v: response = %v, want %v", test.expires, recorder.Code, test.want)
+		}
+	}
+}
+
+func TestReadsFailOverToIntactReplicas(t *testing.T) {
+	nodes := newTestCluster(t, nil)
+	c := newTestClient(t, nodes, client.ReadFromPrimary)
+	if err := c.Put(context.Background(), "object", []byte("content")); err != nil {
+		t.Fatalf("put object: %v", err)
+	}
+	objectHash := client.ObjectHash("object")
+	checksum := file.Checksum([]byte("content"))
+
+	// the primary detects the mismatch before it sends the content and serves an intact replica instead
+	nodes[0].corrupt(t, objectHash)
+	if content, err := c.Get(context.Background(), "object"); err != nil || string(content) != "content" {
+		t.Fatalf("Get() of corrupted primary copy = %q, %v", content, err)
+	}
+	waitFor(t, func() bool { return nodes[0].computedChecksum(t, objectHash) == checksum }, "the primary copy is repaired")
+
+	// the object is lost if no copy is intact
+	for _, node := range nodes {
+		node.corrupt(t, objectHash)
+	}
+	var statusErr *client.StatusError
+	if content, err := c.Get(context.Background(), "object"); !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusInternalServerError {
+		t.Errorf("Get() without intact copy = %q, %v, want 500 Internal Server Error", content, err)
+	}
+}
+
+func TestCorruptedSecondaryRedirectsToThePrimary(t *testing.T) {
+	nodes := newTestCluster(t, func(config *configuration.Configuration) { config.ReadBalancing = true })
+	c := newTestClient(t, nodes, client.ReadFromPrimary)
+	if err := c.Put(context.Background(), "object", []byte("content")); err != nil {
+		t.Fatalf("put object: %v", err)
+	}
+	objectHash := client.ObjectHash("object")
+	checksum := file.Checksum([]byte("content"))
+
+	// the secondary serves the object while it holds a read lease
+	response, err := http.Get(nodes[1].server.URL + "/object/" + objectHash)
+	if err != nil {
+		t.Fatalf("read from secondary: %v", err)
+	}
+	_ = response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		t.Fatalf("read from secondary = %v, want 200 OK", response.StatusCode)
+	}
+
+	// clients repeat requests that are answered with 421 on the primary
+	nodes[1].corrupt(t, objectHash)
+	response, err = http.Get(nodes[1].server.URL + "/object/" + objectHash)
+	if err != nil {
+		t.Fatalf("read from secondary: %v", err)
+	}
+	_ = response.Body.Close()
+	if response.StatusCode != http.StatusMisdirectedRequest {
+		t.Errorf("read of corrupted copy from secondary = %v, want 421 Misdirected Request", response.StatusCode)
+	}
+
+	// the secondary reports the corruption; the primary repairs the copy
+	waitFor(t, func() bool { return nodes[1].computedChecksum(t, objectHash) == checksum }, "the copy of the secondary is repaired")
+}
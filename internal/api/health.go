@@ -0,0 +1,126 @@
+package api
+
+import (
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/rstdm/mini-ceph/internal/api/object"
+	"github.com/rstdm/mini-ceph/internal/api/object/replication"
+	"github.com/rstdm/mini-ceph/internal/version"
+	"net/http"
+	"os"
+	"time"
+)
+
+const checkPassed = "ok"
+
+type readiness struct {
+	Ready  bool
+	Checks map[string]string // name -> "ok" or the reason of the failure
+}
+
+type nodeStatus struct {
+	NodeID                 int
+	Host                   string
+	PrimaryPlacementGroups []uint32
+	ReplicaPlacementGroups []uint32
+	Capacity               *object.Capacity `json:",omitempty"` // nil if the disk space can't be determined
+	Peers                  []object.PeerState
+	StartedAt              time.Time
+	Uptime                 string
+	Version                string
+}
+
+func (a *API) registerHealthRoutes(engine *gin.Engine) {
+	engine.GET("healthz", a.getHealth)
+	engine.GET("readyz", a.getReadiness)
+	engine.GET("status", a.getStatus)
+}
+
+// getHealth reports that the process is alive. The peers compare the hash of the pool configuration with their own.
+func (a *API) getHealth(c *gin.Context) {
+	c.Header(replication.PoolsHashHeader, a.objectHandler.PoolsHash())
+	c.String(http.StatusOK, checkPassed)
+}
+
+// getReadiness reports whether the node can serve requests. The configuration has been loaded once the API serves
+// requests. The peers check only fails if no peer is reachable, i.e. if the node is partitioned from the cluster; a
+// single failed peer would otherwise take all nodes out of service.
+func (a *API) getReadiness(c *gin.Context) {
+	result := readiness{Ready: true, Checks: map[string]string{"configuration": checkPassed}}
+	fail := func(check string, reason string) {
+		result.Ready = false
+		result.Checks[check] = reason
+	}
+
+	if err := checkWritable(a.dataFolder); err != nil {
+		fail("dataFolder", err.Error())
+	} else {
+		result.Checks["dataFolder"] = checkPassed
+	}
+
+	peers, probed := a.objectHandler.PeerStates()
+	up := 0
+	for _, peer := range peers {
+		if peer.Up {
+			up++
+		}
+	}
+	switch {
+	case !probed:
+		fail("peers", "the peers haven't been probed yet")
+	case len(peers) > 0 && up == 0:
+		fail("peers", "no peer is reachable")
+	default:
+		result.Checks["peers"] = fmt.Sprintf("%v of %v peers are reachable", up, len(peers))
+	}
+
+	status := http.StatusOK
+	if !result.Ready {
+		status = http.StatusServiceUnavailable
+	}
+	c.JSON(status, result)
+}
+
+// checkWritable creates and removes a file in the folder.
+func checkWritable(folder string) error {
+	file, err := os.CreateTemp(folder, ".readyz-*")
+	if err != nil {
+		return fmt.Errorf("create file: %w", err)
+	}
+	_ = file.Close()
+	if err := os.Remove(file.Name()); err != nil {
+		return fmt.Errorf("remove file: %w", err)
+	}
+	return nil
+}
+
+// getStatus reports the state of the node and of its peers, including the disk space of all of them.
+func (a *API) getStatus(c *gin.Context) {
+	peers, _ := a.objectHandler.PeerStates()
+	var ownCapacity *object.Capacity
+	if capacity, err := a.objectHandler.Capacity(); err == nil {
+		ownCapacity = &capacity
+	}
+
+	c.JSON(http.StatusOK, nodeStatus{
+		NodeID:                 a.distributionHandler.NodeID(),
+		Host:                   a.distributionHandler.OwnHost(),
+		PrimaryPlacementGroups: a.distributionHandler.PrimaryPlacementGroups(),
+		ReplicaPlacementGroups: a.distributionHandler.ReplicaPlacementGroups(),
+		Capacity:               ownCapacity,
+		Peers:                  peers,
+		StartedAt:              a.startedAt,
+		Uptime:                 time.Since(a.startedAt).Round(time.Second).String(),
+		Version:                version.Get(),
+	})
+}
+
+// getDiskSpace returns the disk space of the node to a primary; the primary determines the state with its ratios.
+func (a *API) getDiskSpace(c *gin.Context) {
+	space, err := a.objectHandler.DiskSpace()
+	if err != nil {
+		_ = c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	c.JSON(http.StatusOK, space)
+}
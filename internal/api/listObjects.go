@@ -0,0 +1,47 @@
+package api
+
+import (
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/rstdm/mini-ceph/internal/api/auth"
+	"github.com/rstdm/mini-ceph/internal/api/middleware"
+	"github.com/rstdm/mini-ceph/internal/api/object"
+	"net/http"
+	"strconv"
+)
+
+// maxListLimit is the maximum and the default number of objects of a listing.
+const maxListLimit = 1000
+
+type objectListing struct {
+	Objects     []object.ListedObject
+	IsTruncated bool // more objects match; the next page starts after the name of the last object
+}
+
+// listObjects lists the named objects of the placement groups of which the node is primary; a client has to merge the
+// listings of all nodes. The objects are filtered by the query parameters prefix and startAfter. Only objects that the
+// user is allowed to read are listed.
+func (a *API) listObjects(c *gin.Context) {
+	limit := maxListLimit
+	if rawLimit := c.Query("limit"); rawLimit != "" {
+		var err error
+		if limit, err = strconv.Atoi(rawLimit); err != nil || limit <= 0 || limit > maxListLimit {
+			c.String(http.StatusBadRequest, fmt.Sprintf("The limit must be an integer between 1 and %v", maxListLimit))
+			return
+		}
+	}
+
+	user, authenticated := middleware.GetUser(c)
+	readable := func(listed object.ListedObject) bool {
+		return !authenticated || user.Allows(auth.CapabilityRead, listed.Pool, listed.Name)
+	}
+
+	objects, truncated, err := a.objectHandler.ListObjects(c.Query("prefix"), c.Query("startAfter"), limit, readable)
+	if err != nil {
+		_ = c.AbortWithError(http.StatusInternalServerError, fmt.Errorf("list objects: %w", err))
+		return
+	}
+
+	listing := objectListing{Objects: objects, IsTruncated: truncated}
+	c.JSON(http.StatusOK, listing)
+}
@@ -0,0 +1,30 @@
+package middleware
+
+import (
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+// AuditLog records which user performed an operation and whether it succeeded. It must be registered before the
+// authentication; rejected requests are recorded as well.
+func AuditLog(sugar *zap.SugaredLogger) gin.HandlerFunc {
+	audit := sugar.Named("audit")
+
+	return func(c *gin.Context) {
+		c.Next()
+
+		userName := "" // authentication is disabled or the request has been rejected
+		if user, ok := GetUser(c); ok {
+			userName = user.Name
+		}
+
+		objectName := c.GetHeader(ObjectNameHeader)
+		if objectName == "" {
+			objectName = c.Query("name")
+		}
+
+		audit.Infow("Audit", "user", userName, "method", c.Request.Method, "path", c.Request.URL.Path,
+			"objectName", objectName, "pool", c.Query("pool"), "status", c.Writer.Status(),
+			"presigned", IsPresigned(c), "remoteAddress", c.ClientIP())
+	}
+}
@@ -28,3 +28,17 @@ func BearerAuthentication(bearerToken string) func(c *gin.Context) {
 		c.Next()
 	}
 }
+
+// ClientCertificateAuthentication rejects requests that haven't presented a client certificate that has been verified
+// with the CA bundle of the cluster. The listener has to request client certificates.
+func ClientCertificateAuthentication() func(c *gin.Context) {
+	return func(c *gin.Context) {
+		if c.Request.TLS == nil || len(c.Request.TLS.VerifiedChains) == 0 {
+			c.String(http.StatusUnauthorized, "This endpoint requires a client certificate of the cluster")
+			c.Abort()
+			return
+		}
+
+		c.Next()
+	}
+}
@@ -1,13 +1,23 @@
 package middleware
 
 import (
+	"context"
 	"fmt"
 	"github.com/gin-gonic/gin"
 	"github.com/rstdm/mini-ceph/internal/api/object/distribution"
 	"net/http"
 )
 
-func DistributionMiddleware(isClusterEndpoint bool, distributionHandler *distribution.Handler) gin.HandlerFunc {
+const clusterEndpointKey = "isClusterEndpoint"
+
+// ReadLeaseHolder decides weather a secondary is allowed to serve reads of a placement group.
+type ReadLeaseHolder interface {
+	HasReadLease(ctx context.Context, placementGroup uint32) bool
+}
+
+// DistributionMiddleware rejects requests that must be handled by another node. Secondaries serve GET and HEAD
+// requests of non-cluster endpoints if readLeases is not nil and they hold a read lease for the placement group.
+func DistributionMiddleware(isClusterEndpoint bool, distributionHandler *distribution.Handler, readLeases ReadLeaseHolder) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		objectHash := GetObjectHash(c)
 
@@ -19,6 +29,10 @@ func DistributionMiddleware(isClusterEndpoint bool, distributionHandler *distrib
 		}
 
 		nonPrimaryRequest := !dist.IsPrimary && !isClusterEndpoint // non-cluster endpoints must only be directed to the primary
+		if nonPrimaryRequest && dist.IsInPlacementGroup && readLeases != nil && isReadRequest(c) {
+			nonPrimaryRequest = !readLeases.HasReadLease(c.Request.Context(), dist.CorrectPlacementGroup)
+		}
+
 		if nonPrimaryRequest || !dist.IsInPlacementGroup {
 			message := fmt.Sprintf("Wrong node. This request should be directed to the primary of placement "+
 				"group %v at %v", dist.CorrectPlacementGroup, dist.PrimaryHost)
@@ -27,6 +41,17 @@ func DistributionMiddleware(isClusterEndpoint bool, distributionHandler *distrib
 			return
 		}
 
+		c.Set(clusterEndpointKey, isClusterEndpoint)
+
 		c.Next()
 	}
 }
+
+func isReadRequest(c *gin.Context) bool {
+	return c.Request.Method == http.MethodGet || c.Request.Method == http.MethodHead
+}
+
+// IsClusterEndpoint returns true if the request has been sent to an endpoint that is used by other nodes.
+func IsClusterEndpoint(c *gin.Context) bool {
+	return c.GetBool(clusterEndpointKey)
+}
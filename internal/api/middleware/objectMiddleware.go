@@ -7,6 +7,9 @@ import (
 )
 
 const ObjectParam = "objectHash"
+
+// UploadParam is the path parameter that contains the id of a multipart upload.
+const UploadParam = "uploadID"
 const objectHashKey = "objectHash"
 
 func ObjectMiddleware(c *gin.Context) {
@@ -0,0 +1,80 @@
+package middleware
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/rstdm/mini-ceph/internal/api/auth"
+	"net/http"
+	"time"
+)
+
+const presignedKey = "presigned"
+
+// PresignedURLAuthentication accepts requests with a valid presigned URL instead of a bearer token. The request is
+// performed on behalf of the user that has requested the URL; users is nil if authentication is disabled. Requests
+// without signature are passed on to the other authentication middlewares.
+func PresignedURLAuthentication(signer *auth.URLSigner, users *auth.Users) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.Query(auth.SignatureParam) == "" {
+			c.Next()
+			return
+		}
+
+		request, err := signer.Verify(c.Request.Method, c.Param(ObjectParam), c.Request.URL.Query(), time.Now())
+		if errors.Is(err, auth.ErrURLExpired) {
+			c.String(http.StatusForbidden, "The presigned URL has expired")
+			c.Abort()
+			return
+		}
+		if err != nil {
+			c.String(http.StatusForbidden, "The presigned URL is invalid. The URL must be used with the signed method.")
+			c.Abort()
+			return
+		}
+
+		if users != nil {
+			user, ok := users.Lookup(request.User)
+			if !ok {
+				c.String(http.StatusForbidden, "The user that has signed the URL doesn't exist anymore")
+				c.Abort()
+				return
+			}
+			c.Set(userKey, user)
+		}
+
+		if !checkContentLength(c, request) {
+			return
+		}
+
+		c.Set(presignedKey, true)
+
+		c.Next()
+	}
+}
+
+func checkContentLength(c *gin.Context, request auth.PresignedRequest) bool {
+	if request.MinContentLength == 0 && request.MaxContentLength == 0 {
+		return true
+	}
+
+	contentLength := c.Request.ContentLength
+	switch {
+	case contentLength < 0:
+		c.String(http.StatusLengthRequired, "The presigned URL requires header Content-Length")
+	case contentLength < request.MinContentLength:
+		c.String(http.StatusBadRequest, fmt.Sprintf("The request body must have at least %v bytes", request.MinContentLength))
+	case request.MaxContentLength > 0 && contentLength > request.MaxContentLength:
+		c.String(http.StatusRequestEntityTooLarge, fmt.Sprintf("The request body must not have more than %v bytes", request.MaxContentLength))
+	default:
+		return true // the server doesn't read more than Content-Length bytes of the body
+	}
+
+	c.Abort()
+	return false
+}
+
+// IsPresigned returns true if the request has been authenticated by a presigned URL.
+func IsPresigned(c *gin.Context) bool {
+	return c.GetBool(presignedKey)
+}
@@ -0,0 +1,216 @@
+package middleware
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/rstdm/mini-ceph/internal/api/auth"
+	"github.com/rstdm/mini-ceph/internal/configuration"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// ObjectNameHeader contains the percent-encoded name of the object. The object hash is the sha256 hash of the name, so
+// the server can verify the name; grants that are scoped by name prefixes require it. Clients that can't set headers,
+// e.g. browsers that follow a presigned URL, send the name as query parameter name instead.
+const ObjectNameHeader = "X-Object-Name"
+
+const userKey = "user"
+
+// OverwriteParam is the query parameter that allows a PUT or the initiation of a multipart upload to replace an
+// existing object.
+const OverwriteParam = "overwrite"
+
+// PoolResolver returns the pool of an object. The pool is empty if the node doesn't have a copy of the object.
+type PoolResolver interface {
+	PoolOf(objectHash string) (pool string, err error)
+}
+
+// UserAuthentication identifies the user by the API key that has been sent as bearer token. It rejects unknown keys.
+// Requests whose user has already been identified, e.g. by a presigned URL, are passed on.
+func UserAuthentication(users *auth.Users) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if _, ok := GetUser(c); ok || IsPresigned(c) {
+			c.Next()
+			return
+		}
+
+		providedAuthorization := c.Request.Header.Get("Authorization")
+		providedBearer := strings.TrimPrefix(providedAuthorization, "Bearer ")
+
+		if providedAuthorization == providedBearer {
+			c.String(http.StatusUnauthorized, "Authorization header was empty or didn't contain a bearer token")
+			c.Abort()
+			return
+		}
+		user, ok := users.Authenticate(providedBearer)
+		if !ok {
+			c.String(http.StatusUnauthorized, "The provided bearer token is invalid")
+			c.Abort()
+			return
+		}
+
+		c.Set(userKey, user)
+
+		c.Next()
+	}
+}
+
+// GetUser returns the user that has sent the request. ok is false if the request hasn't been authenticated.
+func GetUser(c *gin.Context) (user auth.User, ok bool) {
+	value, exists := c.Get(userKey)
+	if !exists {
+		return auth.User{}, false
+	}
+	return value.(auth.User), true
+}
+
+// GetObjectName returns the name of the object from header ObjectNameHeader or from query parameter name. The name is
+// empty if the client hasn't sent it. The request is aborted if the name doesn't match the object hash.
+func GetObjectName(c *gin.Context) (objectName string, ok bool) {
+	objectName, err := url.PathUnescape(c.GetHeader(ObjectNameHeader))
+	if err != nil {
+		c.String(http.StatusBadRequest, "Header "+ObjectNameHeader+" isn't percent-encoded")
+		c.Abort()
+		return "", false
+	}
+	if objectName == "" {
+		objectName = c.Query("name")
+	}
+	if objectName == "" {
+		return "", true
+	}
+
+	nameHash := sha256.Sum256([]byte(objectName))
+	if hex.EncodeToString(nameHash[:]) != strings.ToLower(GetObjectHash(c)) {
+		c.String(http.StatusBadRequest, "The object hash isn't the sha256 hash of the object name")
+		c.Abort()
+		return "", false
+	}
+
+	return objectName, true
+}
+
+// UploadPoolResolver returns the pool of a multipart upload. The pool is empty if the upload doesn't exist.
+type UploadPoolResolver interface {
+	UploadPool(objectHash string, uploadID string) (pool string, err error)
+}
+
+// ObjectAuthorization rejects object requests if the user doesn't have the capability of the method for the object.
+// PUT requests are checked against the requested pool, the other requests against the pool of the existing object.
+// Overwriting PUT requests also require the capability to delete the existing object. Requests without authenticated
+// user are allowed; authentication is disabled in that case.
+func ObjectAuthorization(pools PoolResolver) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var pool string
+		if c.Request.Method == http.MethodPut {
+			pool = c.DefaultQuery("pool", configuration.DefaultPool)
+			if IsOverwrite(c) && !allowObject(c, auth.CapabilityDelete, "", replacedPool(pool, pools.PoolOf)) {
+				return
+			}
+		}
+
+		authorizeObject(c, auth.CapabilityOfMethod(c.Request.Method), pool, pools.PoolOf)
+	}
+}
+
+// UploadAuthorization rejects requests of multipart uploads if the user isn't allowed to write the object. The
+// initiation of an upload is checked against the requested pool, the other requests against the pool of the upload.
+// The initiation of an overwriting upload also requires the capability to delete the existing object. Requests
+// without authenticated user are allowed; authentication is disabled in that case.
+func UploadAuthorization(uploads UploadPoolResolver, pools PoolResolver) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		uploadID := c.Param(UploadParam)
+
+		var pool string
+		if uploadID == "" {
+			pool = c.DefaultQuery("pool", configuration.DefaultPool)
+			if IsOverwrite(c) && !allowObject(c, auth.CapabilityDelete, "", replacedPool(pool, pools.PoolOf)) {
+				return
+			}
+		}
+		lookupPool := func(objectHash string) (string, error) { return uploads.UploadPool(objectHash, uploadID) }
+
+		authorizeObject(c, auth.CapabilityWrite, pool, lookupPool)
+	}
+}
+
+// IsOverwrite returns true if the request may replace an existing object.
+func IsOverwrite(c *gin.Context) bool {
+	return c.Query(OverwriteParam) == "true"
+}
+
+// replacedPool returns a lookup of the pool of the object that is replaced. If the node doesn't have a copy, the
+// object is checked against the requested pool.
+func replacedPool(requestedPool string, lookupPool func(objectHash string) (string, error)) func(objectHash string) (string, error) {
+	return func(objectHash string) (string, error) {
+		pool, err := lookupPool(objectHash)
+		if err == nil && pool == "" {
+			pool = requestedPool
+		}
+		return pool, err
+	}
+}
+
+// authorizeObject passes the request on if the user has the capability for the object in the pool. If the pool is
+// empty, it is looked up with lookupPool.
+func authorizeObject(c *gin.Context, capability auth.Capability, pool string, lookupPool func(objectHash string) (string, error)) {
+	if allowObject(c, capability, pool, lookupPool) {
+		c.Next()
+	}
+}
+
+// allowObject returns true if the user has the capability for the object in the pool. Otherwise, the request is
+// aborted.
+func allowObject(c *gin.Context, capability auth.Capability, pool string, lookupPool func(objectHash string) (string, error)) bool {
+	user, ok := GetUser(c)
+	if !ok {
+		return true
+	}
+
+	objectHash := GetObjectHash(c)
+	objectName, ok := GetObjectName(c)
+	if !ok {
+		return false
+	}
+
+	if pool == "" {
+		// The pool is empty if the node doesn't have a copy, although the request might still reach the replicas (e.g. a
+		// read of a missing copy or a deletion). Grants that are scoped by pools deny such requests.
+		var err error
+		if pool, err = lookupPool(objectHash); err != nil {
+			err = fmt.Errorf("get pool of object: %w", err)
+			_ = c.AbortWithError(http.StatusInternalServerError, err)
+			return false
+		}
+	}
+
+	if !user.Allows(capability, pool, objectName) {
+		message := fmt.Sprintf("User %v isn't allowed to %v this object", user.Name, capability)
+		if objectName == "" {
+			message += ". Grants that are scoped by name prefixes require header " + ObjectNameHeader
+		}
+		c.String(http.StatusForbidden, message)
+		c.Abort()
+		return false
+	}
+
+	return true
+}
+
+// Authorization rejects requests if the user doesn't have the capability. Requests without authenticated user are
+// allowed; authentication is disabled in that case.
+func Authorization(capability auth.Capability) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user, ok := GetUser(c)
+		if ok && !user.Allows(capability, "", "") {
+			c.String(http.StatusForbidden, fmt.Sprintf("User %v doesn't have the capability %v", user.Name, capability))
+			c.Abort()
+			return
+		}
+
+		c.Next()
+	}
+}
@@ -0,0 +1,300 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/rstdm/mini-ceph/internal/api/middleware"
+	"github.com/rstdm/mini-ceph/internal/api/object"
+	"github.com/rstdm/mini-ceph/internal/api/object/file"
+	"github.com/rstdm/mini-ceph/internal/api/object/replication"
+	"github.com/rstdm/mini-ceph/internal/api/object/upload"
+	"github.com/rstdm/mini-ceph/internal/configuration"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"time"
+)
+
+const partNumberParam = "partNumber"
+
+type initiatedUpload struct {
+	UploadID string
+}
+
+type uploadParts struct {
+	UploadID  string
+	Initiated time.Time
+	Parts     []upload.Part
+}
+
+// completion selects the parts of the object; all uploaded parts are used if it is empty.
+type completion struct {
+	Parts []upload.Part
+}
+
+// initiateUpload starts a multipart upload. The pool, the owner, the name and the expiry of the object are determined
+// like for a PUT of the object. If the query parameter overwrite is true, the completion replaces an existing object.
+func (a *API) initiateUpload(c *gin.Context) {
+	objectHash := middleware.GetObjectHash(c)
+	if !a.checkCapacity(c, objectHash) {
+		return
+	}
+
+	overwrite := middleware.IsOverwrite(c)
+	metadata := file.Metadata{Pool: c.DefaultQuery("pool", configuration.DefaultPool)}
+	var ownerQuota *configuration.Quota
+	var err error
+	metadata.Owner, ownerQuota = ownerOf(c)
+	if overwrite {
+		err = a.objectHandler.CheckReplaceQuota(objectHash, metadata.Owner, ownerQuota, metadata.Pool, 0)
+	} else {
+		err = a.objectHandler.CheckQuota(metadata.Owner, ownerQuota, metadata.Pool, 0)
+	}
+	if !respondQuotaError(c, err) {
+		return
+	}
+	expires, ok := parseExpiresHeader(c)
+	if !ok {
+		return
+	}
+	metadata.Expires = expires
+	if metadata.Name, ok = middleware.GetObjectName(c); !ok {
+		return
+	}
+
+	multipartUpload, err := a.objectHandler.InitiateUpload(objectHash, metadata, overwrite)
+	if err != nil {
+		respondUploadError(c, err, "initiate upload")
+		return
+	}
+
+	c.JSON(http.StatusOK, initiatedUpload{UploadID: multipartUpload.ID})
+}
+
+// putUploadPart persists a part of a multipart upload. The primary encodes and replicates the part; the replicas
+// store the part that they have received from the primary.
+func (a *API) putUploadPart(c *gin.Context) {
+	objectHash := middleware.GetObjectHash(c)
+	uploadID := c.Param(middleware.UploadParam)
+	number, err := upload.ParsePartNumber(c.Param(partNumberParam))
+	if err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+	if !a.checkCapacity(c, objectHash) {
+		return
+	}
+
+	formFile, err := c.FormFile("file")
+	if err != nil {
+		c.String(http.StatusBadRequest, "Missing form-file 'file'")
+		return
+	}
+	if formFile.Size > a.maxObjectSizeBytes && !middleware.IsClusterEndpoint(c) {
+		message := fmt.Sprintf("The part size is bigger than the configured threshold of %v bytes.", a.maxObjectSizeBytes)
+		c.String(http.StatusRequestEntityTooLarge, message)
+		return
+	}
+	content, err := readFormFile(formFile)
+	if err != nil {
+		_ = c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	if middleware.IsClusterEndpoint(c) {
+		a.storeReplicatedPart(c, objectHash, uploadID, number, content)
+		return
+	}
+
+	pool, err := a.objectHandler.UploadPool(objectHash, uploadID)
+	if err != nil {
+		respondUploadError(c, err, "get pool of upload")
+		return
+	}
+	ownerName, ownerQuota := ownerOf(c)
+	if err := a.objectHandler.CheckQuota(ownerName, ownerQuota, pool, formFile.Size); err != nil {
+		c.String(http.StatusForbidden, err.Error())
+		return
+	}
+
+	part, err := a.objectHandler.UploadPart(c.Request.Context(), objectHash, uploadID, number, content)
+	if err != nil {
+		respondUploadError(c, err, "upload part")
+		return
+	}
+
+	c.JSON(http.StatusOK, part)
+}
+
+// storeReplicatedPart persists a part that has been sent by the primary with its metadata and its upload.
+func (a *API) storeReplicatedPart(c *gin.Context, objectHash string, uploadID string, number int, storedContent []byte) {
+	var metadata file.Metadata
+	if err := json.Unmarshal([]byte(c.GetHeader(replication.MetadataHeader)), &metadata); err != nil {
+		c.String(http.StatusBadRequest, "Invalid header "+replication.MetadataHeader)
+		return
+	}
+	var multipartUpload upload.Upload
+	if err := json.Unmarshal([]byte(c.GetHeader(replication.UploadHeader)), &multipartUpload); err != nil {
+		c.String(http.StatusBadRequest, "Invalid header "+replication.UploadHeader)
+		return
+	}
+	multipartUpload.ObjectHash = objectHash
+	multipartUpload.ID = uploadID
+
+	if err := a.objectHandler.StorePart(multipartUpload, number, storedContent, metadata); err != nil {
+		respondUploadError(c, err, "store part")
+		return
+	}
+
+	c.String(http.StatusOK, "part persisted")
+}
+
+// getUploadPart sends the stored content of a part to the primary. The metadata is sent in a header.
+func (a *API) getUploadPart(c *gin.Context) {
+	number, err := upload.ParsePartNumber(c.Param(partNumberParam))
+	if err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	storedContent, metadata, err := a.objectHandler.ReadStoredPart(middleware.GetObjectHash(c),
+		c.Param(middleware.UploadParam), number)
+	if err != nil {
+		respondUploadError(c, err, "read part")
+		return
+	}
+	encodedMetadata, err := json.Marshal(metadata)
+	if err != nil {
+		_ = c.AbortWithError(http.StatusInternalServerError, fmt.Errorf("json encode metadata: %w", err))
+		return
+	}
+
+	c.Header(replication.MetadataHeader, string(encodedMetadata))
+	c.Data(http.StatusOK, "application/octet-stream", storedContent)
+}
+
+// getUploadParts lists the parts that have been uploaded.
+func (a *API) getUploadParts(c *gin.Context) {
+	multipartUpload, parts, err := a.objectHandler.UploadParts(middleware.GetObjectHash(c), c.Param(middleware.UploadParam))
+	if err != nil {
+		respondUploadError(c, err, "list parts")
+		return
+	}
+	if parts == nil {
+		parts = []upload.Part{}
+	}
+
+	c.JSON(http.StatusOK, uploadParts{UploadID: multipartUpload.ID, Initiated: multipartUpload.Initiated, Parts: parts})
+}
+
+// completeUpload assembles the object from the parts. The quota is checked with the size of the assembled object; the
+// object that is replaced by an overwriting upload is subtracted.
+func (a *API) completeUpload(c *gin.Context) {
+	objectHash := middleware.GetObjectHash(c)
+	uploadID := c.Param(middleware.UploadParam)
+
+	var selection completion
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&selection); err != nil {
+			c.String(http.StatusBadRequest, fmt.Sprintf("Invalid list of parts: %v", err))
+			return
+		}
+	}
+
+	multipartUpload, uploadedParts, err := a.objectHandler.UploadParts(objectHash, uploadID)
+	if err != nil {
+		respondUploadError(c, err, "list parts")
+		return
+	}
+	parts, size, err := a.objectHandler.SelectParts(uploadedParts, selection.Parts)
+	if err != nil {
+		respondUploadError(c, err, "select parts")
+		return
+	}
+	if !a.checkCapacity(c, objectHash) {
+		return
+	}
+	ownerName, ownerQuota := ownerOf(c)
+	if multipartUpload.Overwrite {
+		err = a.objectHandler.CheckReplaceQuota(objectHash, ownerName, ownerQuota, multipartUpload.Metadata.Pool, size)
+	} else {
+		err = a.objectHandler.CheckQuota(ownerName, ownerQuota, multipartUpload.Metadata.Pool, size)
+	}
+	if !respondQuotaError(c, err) {
+		return
+	}
+
+	if err := a.objectHandler.CompleteUpload(c.Request.Context(), objectHash, uploadID, parts); err != nil {
+		respondUploadError(c, err, "complete upload")
+		return
+	}
+
+	c.String(http.StatusOK, "object persisted")
+}
+
+// abortUpload deletes the upload and its parts. The primary deletes the copies of the replicas as well.
+func (a *API) abortUpload(c *gin.Context) {
+	objectHash := middleware.GetObjectHash(c)
+	uploadID := c.Param(middleware.UploadParam)
+
+	var err error
+	if middleware.IsClusterEndpoint(c) {
+		err = a.objectHandler.DeleteStoredUpload(objectHash, uploadID)
+	} else {
+		err = a.objectHandler.AbortUpload(c.Request.Context(), objectHash, uploadID)
+	}
+	if err != nil {
+		respondUploadError(c, err, "abort upload")
+		return
+	}
+
+	c.String(http.StatusOK, "upload aborted")
+}
+
+// respondUploadError completes a request of a multipart upload that has failed.
+func respondUploadError(c *gin.Context, err error, operation string) {
+	if abortOnContextError(c, err) {
+		return
+	}
+
+	switch {
+	case errors.Is(err, upload.ErrUploadDoesNotExist):
+		c.String(http.StatusNotFound, "The requested upload does not exist.")
+	case errors.Is(err, upload.ErrPartDoesNotExist):
+		c.String(http.StatusNotFound, "The requested part does not exist.")
+	case errors.Is(err, object.ErrInvalidPart):
+		c.String(http.StatusBadRequest, err.Error())
+	case errors.Is(err, object.ErrObjectTooLarge):
+		c.String(http.StatusRequestEntityTooLarge, err.Error())
+	case errors.Is(err, object.ErrObjectDoesExist):
+		c.String(http.StatusConflict, "The requested object already exists.")
+	case errors.Is(err, object.ErrObjectIsBusy):
+		c.String(http.StatusConflict, "The requested object is currently modified. Try again later.")
+	case errors.Is(err, object.ErrUnknownPool):
+		c.String(http.StatusBadRequest, "The requested pool does not exist.")
+	case errors.Is(err, object.ErrWriteQuorumNotReached):
+		c.String(http.StatusServiceUnavailable, "Too few replicas are available to persist the part. Try again later.")
+	case errors.Is(err, object.ErrObjectIsRepaired):
+		c.String(http.StatusServiceUnavailable, "The requested object is currently repaired. Try again later.")
+	default:
+		err = fmt.Errorf("%v: %w", operation, err)
+		_ = c.AbortWithError(http.StatusInternalServerError, err)
+	}
+}
+
+// readFormFile reads the complete content of an uploaded file into memory.
+func readFormFile(formFile *multipart.FileHeader) ([]byte, error) {
+	content, err := formFile.Open()
+	if err != nil {
+		return nil, fmt.Errorf("open form file: %w", err)
+	}
+	defer func() { _ = content.Close() }()
+
+	data, err := io.ReadAll(content)
+	if err != nil {
+		return nil, fmt.Errorf("read form file: %w", err)
+	}
+	return data, nil
+}
@@ -0,0 +1,114 @@
+package object
+
+import (
+	"errors"
+	"fmt"
+	"github.com/rstdm/mini-ceph/internal/api/object/file"
+)
+
+// CapacityState classifies the disk space of a node according to the nearfull and full ratios.
+type CapacityState string
+
+const (
+	CapacityOK       CapacityState = "ok"
+	CapacityNearfull CapacityState = "nearfull"
+	CapacityFull     CapacityState = "full"
+)
+
+var ErrStorageFull = errors.New("a node of the placement group is full")
+
+// Capacity is the disk space of a node. The state is determined with the ratios of the current node, so all nodes
+// are judged by the same thresholds.
+type Capacity struct {
+	file.DiskSpace
+	UsedRatio float64
+	State     CapacityState
+}
+
+func (f *Handler) capacityOf(space file.DiskSpace) Capacity {
+	capacity := Capacity{DiskSpace: space, UsedRatio: space.UsedRatio(), State: CapacityOK}
+	switch {
+	case capacity.UsedRatio >= f.fullRatio:
+		capacity.State = CapacityFull
+	case capacity.UsedRatio >= f.nearfullRatio:
+		capacity.State = CapacityNearfull
+	}
+	return capacity
+}
+
+// DiskSpace returns the disk space of the data folder of the current node.
+func (f *Handler) DiskSpace() (file.DiskSpace, error) {
+	return f.fileHandler.DiskSpace()
+}
+
+// Capacity returns the capacity of the current node.
+func (f *Handler) Capacity() (Capacity, error) {
+	space, err := f.fileHandler.DiskSpace()
+	if err != nil {
+		return Capacity{}, err
+	}
+	return f.capacityOf(space), nil
+}
+
+// CheckCapacity returns ErrStorageFull if the object can't be written because the current node is full. The primary
+// also checks the other nodes of the placement group with the result of the last probe; nodes whose capacity is
+// unknown are ignored, the write fails on them anyway if they are full. The check is done before the content of the
+// object is received, so clients don't upload objects that would be rolled back.
+func (f *Handler) CheckCapacity(object string) error {
+	capacity, err := f.Capacity()
+	if err != nil {
+		return fmt.Errorf("determine capacity: %w", err)
+	}
+	if capacity.State == CapacityFull {
+		return fmt.Errorf("%w: %v uses %.1f%% of its disk space", ErrStorageFull, f.distributionHandler.OwnHost(),
+			100*capacity.UsedRatio)
+	}
+
+	dist, err := f.distributionHandler.GetDistribution(object)
+	if err != nil {
+		return fmt.Errorf("calculate distribution: %w", err)
+	}
+	if !dist.IsPrimary {
+		return nil
+	}
+
+	peers, _ := f.PeerStates()
+	for _, host := range dist.SlaveHosts {
+		for _, peer := range peers {
+			if peer.Host == host && peer.Capacity != nil && peer.Capacity.State == CapacityFull {
+				return fmt.Errorf("%w: %v uses %.1f%% of its disk space", ErrStorageFull, host,
+					100*peer.Capacity.UsedRatio)
+			}
+		}
+	}
+
+	return nil
+}
+
+// logCapacityChange logs if the state of the current node's capacity has changed since the last call.
+func (f *Handler) logCapacityChange() {
+	capacity, err := f.Capacity()
+	if errors.Is(err, file.ErrDiskSpaceUnsupported) {
+		return
+	}
+	if err != nil {
+		f.sugar.Warnw("Failed to determine the capacity of the node", "err", err)
+		return
+	}
+
+	previous := f.peers.setOwnCapacityState(capacity.State)
+	if capacity.State == previous {
+		return
+	}
+	switch capacity.State {
+	case CapacityFull:
+		f.sugar.Errorw("The node is full. Writes to its placement groups are rejected.",
+			"usedRatio", capacity.UsedRatio, "availableBytes", capacity.AvailableBytes)
+	case CapacityNearfull:
+		f.sugar.Warnw("The node is nearfull.", "usedRatio", capacity.UsedRatio, "availableBytes", capacity.AvailableBytes)
+	default:
+		if previous != "" {
+			f.sugar.Infow("The node has enough disk space again.", "usedRatio", capacity.UsedRatio)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package object
+
+import (
+	"errors"
+	"github.com/rstdm/mini-ceph/internal/api/object/distribution"
+	"github.com/rstdm/mini-ceph/internal/api/object/file"
+	"go.uber.org/zap"
+	"testing"
+)
+
+func TestCapacityState(t *testing.T) {
+	handler := &Handler{nearfullRatio: 0.85, fullRatio: 0.95}
+
+	for _, test := range []struct {
+		available uint64
+		want      CapacityState
+	}{
+		{available: 100, want: CapacityOK},
+		{available: 16, want: CapacityOK},
+		{available: 15, want: CapacityNearfull},
+		{available: 6, want: CapacityNearfull},
+		{available: 5, want: CapacityFull},
+		{available: 0, want: CapacityFull},
+	} {
+		capacity := handler.capacityOf(file.DiskSpace{TotalBytes: 100, AvailableBytes: test.available})
+		if capacity.State != test.want {
+			t.Errorf("%v of 100 bytes available: state = %v, want %v", test.available, capacity.State, test.want)
+		}
+	}
+}
+
+func TestCheckCapacity(t *testing.T) {
+	fileHandler, err := file.NewHandler(file.BackendMemory, t.TempDir(), nil, nil, zap.NewNop().Sugar())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fileHandler.DiskSpace(); errors.Is(err, file.ErrDiskSpaceUnsupported) {
+		t.Skip(err)
+	}
+
+	hosts := []string{"n0", "n1"}
+	distributionHandler := distribution.NewHandler(0, hosts, [][]int{{0, 1}, {1, 0}})
+	handler := &Handler{
+		fileHandler:         fileHandler,
+		distributionHandler: distributionHandler,
+		nearfullRatio:       1,
+		fullRatio:           1, // the disk of the test is never completely full
+	}
+
+	primaryObject, replicaObject := objectsOfBothRoles(t, distributionHandler)
+
+	if err := handler.CheckCapacity(primaryObject); err != nil {
+		t.Errorf("no node is full: %v", err)
+	}
+
+	handler.peers.update([]PeerState{{Host: "n1", Up: true, Capacity: &Capacity{State: CapacityFull}}})
+	if err := handler.CheckCapacity(primaryObject); !errors.Is(err, ErrStorageFull) {
+		t.Errorf("the primary accepts writes although the replica is full: %v", err)
+	}
+	// the replica doesn't check the primary
+	if err := handler.CheckCapacity(replicaObject); err != nil {
+		t.Errorf("the replica checks the capacity of the primary: %v", err)
+	}
+
+	handler.fullRatio = 0 // the current node is full
+	if err := handler.CheckCapacity(replicaObject); !errors.Is(err, ErrStorageFull) {
+		t.Errorf("the node accepts writes although it is full: %v", err)
+	}
+}
@@ -21,15 +21,23 @@ func NewHandler(nodeID int, nodeHosts []string, placementGroups [][]int) *Handle
 	return handler
 }
 
-func (h *Handler) GetDistribution(objectHash string) (Distribution, error) {
+// PlacementGroupOf calculates the placement group in which the object is stored.
+func PlacementGroupOf(objectHash string, numPlacementGroups int) (uint32, error) {
 	binaryHash, err := hash.GetBinaryHash(objectHash)
 	if err != nil {
 		err = fmt.Errorf("get binary hash from object hash: %w", err)
-		return Distribution{}, err
+		return 0, err
 	}
 
 	lastFourBytes := binaryHash[len(binaryHash)-4:]
-	pgIdx := binary.BigEndian.Uint32(lastFourBytes) % uint32(len(h.placementGroups))
+	return binary.BigEndian.Uint32(lastFourBytes) % uint32(numPlacementGroups), nil
+}
+
+func (h *Handler) GetDistribution(objectHash string) (Distribution, error) {
+	pgIdx, err := PlacementGroupOf(objectHash, len(h.placementGroups))
+	if err != nil {
+		return Distribution{}, err
+	}
 	pg := h.placementGroups[pgIdx]
 
 	isPrimary := pg[0] == h.nodeID
@@ -65,3 +73,91 @@ func (h *Handler) GetDistribution(objectHash string) (Distribution, error) {
 	}
 	return distribution, nil
 }
+
+// PrimaryPlacementGroups returns all placement groups for which the current node is the primary.
+func (h *Handler) PrimaryPlacementGroups() []uint32 {
+	var pgs []uint32
+	for pgIdx, pg := range h.placementGroups {
+		if pg[0] == h.nodeID {
+			pgs = append(pgs, uint32(pgIdx))
+		}
+	}
+
+	return pgs
+}
+
+// ReplicaPlacementGroups returns all placement groups in which the current node stores replicas, i.e. in which it isn't
+// the primary.
+func (h *Handler) ReplicaPlacementGroups() []uint32 {
+	var pgs []uint32
+	for pgIdx, pg := range h.placementGroups {
+		for _, nodeID := range pg[1:] {
+			if nodeID == h.nodeID {
+				pgs = append(pgs, uint32(pgIdx))
+				break
+			}
+		}
+	}
+
+	return pgs
+}
+
+// PeerHosts returns the hosts of all other nodes that share a placement group with the current node, ordered by their
+// node ID.
+func (h *Handler) PeerHosts() []string {
+	isPeer := make([]bool, len(h.nodeHosts))
+	for _, pg := range h.placementGroups {
+		isMember := false
+		for _, nodeID := range pg {
+			isMember = isMember || nodeID == h.nodeID
+		}
+		if !isMember {
+			continue
+		}
+		for _, nodeID := range pg {
+			isPeer[nodeID] = nodeID != h.nodeID
+		}
+	}
+
+	var peerHosts []string
+	for nodeID, host := range h.nodeHosts {
+		if isPeer[nodeID] {
+			peerHosts = append(peerHosts, host)
+		}
+	}
+
+	return peerHosts
+}
+
+// SlaveHosts returns the hosts of all nodes of the placement group except the primary.
+func (h *Handler) SlaveHosts(placementGroup uint32) []string {
+	var slaveHosts []string
+	for _, slaveHostID := range h.placementGroups[placementGroup][1:] {
+		slaveHosts = append(slaveHosts, h.nodeHosts[slaveHostID])
+	}
+
+	return slaveHosts
+}
+
+// PrimaryHost returns the host of the primary of the placement group.
+func (h *Handler) PrimaryHost(placementGroup uint32) string {
+	return h.nodeHosts[h.placementGroups[placementGroup][0]]
+}
+
+func (h *Handler) NodeID() int {
+	return h.nodeID
+}
+
+// Hosts returns the hosts of all nodes of the cluster, ordered by their node ID.
+func (h *Handler) Hosts() []string {
+	return append([]string{}, h.nodeHosts...)
+}
+
+// OwnHost returns the host of the current node.
+func (h *Handler) OwnHost() string {
+	return h.nodeHosts[h.nodeID]
+}
+
+func (h *Handler) NumPlacementGroups() int {
+	return len(h.placementGroups)
+}
@@ -0,0 +1,28 @@
+package distribution
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPlacementGroupsOfNode(t *testing.T) {
+	hosts := []string{"n0", "n1", "n2", "n3"}
+	placementGroups := [][]int{{0, 1}, {1, 2}, {2, 0}, {3, 2}}
+
+	handler := NewHandler(0, hosts, placementGroups)
+	if pgs := handler.PrimaryPlacementGroups(); !reflect.DeepEqual(pgs, []uint32{0}) {
+		t.Errorf("primary placement groups = %v", pgs)
+	}
+	if pgs := handler.ReplicaPlacementGroups(); !reflect.DeepEqual(pgs, []uint32{2}) {
+		t.Errorf("replica placement groups = %v", pgs)
+	}
+	// node 3 doesn't share a placement group with node 0
+	if peers := handler.PeerHosts(); !reflect.DeepEqual(peers, []string{"n1", "n2"}) {
+		t.Errorf("peers = %v", peers)
+	}
+
+	handler = NewHandler(2, hosts, placementGroups)
+	if peers := handler.PeerHosts(); !reflect.DeepEqual(peers, []string{"n0", "n1", "n3"}) {
+		t.Errorf("peers of node 2 = %v", peers)
+	}
+}
@@ -0,0 +1,171 @@
+package file
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+	"io"
+	"sync"
+)
+
+// Compression algorithms that can be configured per pool. gzip and zstd are HTTP content codings as well; snappy
+// isn't registered as one.
+const (
+	CompressionGzip   = "gzip"
+	CompressionZstd   = "zstd"
+	CompressionSnappy = "snappy"
+)
+
+// zstdEncoder is shared by all objects; it is safe for concurrent use of EncodeAll.
+var (
+	zstdEncoderOnce sync.Once
+	zstdEncoder     *zstd.Encoder
+	zstdEncoderErr  error
+)
+
+// getZstdEncoder creates the encoder when the first object of a zstd pool is stored.
+func getZstdEncoder() (*zstd.Encoder, error) {
+	zstdEncoderOnce.Do(func() {
+		zstdEncoder, zstdEncoderErr = zstd.NewWriter(nil)
+	})
+	return zstdEncoder, zstdEncoderErr
+}
+
+func validateCompression(algorithm string) error {
+	switch algorithm {
+	case "", CompressionGzip, CompressionZstd, CompressionSnappy:
+		return nil
+	default:
+		return fmt.Errorf("unknown compression algorithm %q", algorithm)
+	}
+}
+
+func compress(algorithm string, content []byte) ([]byte, error) {
+	switch algorithm {
+	case CompressionZstd:
+		encoder, err := getZstdEncoder()
+		if err != nil {
+			return nil, fmt.Errorf("create zstd encoder: %w", err)
+		}
+		return encoder.EncodeAll(content, nil), nil
+
+	case CompressionGzip, CompressionSnappy:
+		var buf bytes.Buffer
+		var writer io.WriteCloser = gzip.NewWriter(&buf)
+		if algorithm == CompressionSnappy {
+			writer = snappy.NewBufferedWriter(&buf)
+		}
+		if _, err := writer.Write(content); err != nil {
+			return nil, err
+		}
+		if err := writer.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+
+	default:
+		return nil, fmt.Errorf("unknown compression algorithm %q", algorithm)
+	}
+}
+
+func newDecompressor(algorithm string, reader io.Reader) (io.ReadCloser, error) {
+	switch algorithm {
+	case CompressionZstd:
+		decoder, err := zstd.NewReader(reader, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		return decoder.IOReadCloser(), nil
+	case CompressionGzip:
+		return gzip.NewReader(reader)
+	case CompressionSnappy:
+		return io.NopCloser(snappy.NewReader(reader)), nil
+	default:
+		return nil, fmt.Errorf("unknown compression algorithm %q", algorithm)
+	}
+}
+
+// decompressingReader decompresses the stored content on the fly. The decompression is only restarted if the reader
+// seeks backwards; seeking forward skips the decompressed bytes.
+type decompressingReader struct {
+	compressed   io.ReadSeeker
+	algorithm    string
+	size         int64 // size of the decompressed content
+	decompressor io.ReadCloser
+	position     int64 // position of the decompressor in the decompressed content
+	offset       int64 // position that has been requested by Seek
+}
+
+func newDecompressingReader(compressed io.ReadSeeker, algorithm string, size int64) *decompressingReader {
+	return &decompressingReader{compressed: compressed, algorithm: algorithm, size: size}
+}
+
+func (r *decompressingReader) Read(p []byte) (int, error) {
+	if r.offset >= r.size {
+		return 0, io.EOF
+	}
+
+	if r.decompressor == nil || r.offset < r.position {
+		if err := r.restart(); err != nil {
+			return 0, fmt.Errorf("restart decompression: %w", err)
+		}
+	}
+	if r.offset > r.position {
+		skipped, err := io.CopyN(io.Discard, r.decompressor, r.offset-r.position)
+		r.position += skipped
+		if err != nil {
+			return 0, fmt.Errorf("skip to offset %v: %w", r.offset, err)
+		}
+	}
+
+	n, err := r.decompressor.Read(p)
+	r.position += int64(n)
+	r.offset = r.position
+	return n, err
+}
+
+func (r *decompressingReader) restart() error {
+	if r.decompressor != nil {
+		_ = r.decompressor.Close()
+		r.decompressor = nil
+	}
+	if _, err := r.compressed.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	decompressor, err := newDecompressor(r.algorithm, r.compressed)
+	if err != nil {
+		return err
+	}
+	r.decompressor = decompressor
+	r.position = 0
+
+	return nil
+}
+
+func (r *decompressingReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += r.size
+	}
+	if offset < 0 {
+		return 0, errors.New("seek to negative position")
+	}
+
+	r.offset = offset
+	return offset, nil
+}
+
+// Close stops the decompression. The compressed content isn't closed.
+func (r *decompressingReader) Close() error {
+	if r.decompressor != nil {
+		_ = r.decompressor.Close()
+		r.decompressor = nil
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+package file
+
+import (
+	"context"
+	"go.uber.org/zap"
+	"io"
+	"strings"
+	"testing"
+)
+
+// persistObject encodes and persists the object like the primary of the object.
+func persistObject(t *testing.T, handler *Handler, objectHash string, content string, metadata Metadata) {
+	t.Helper()
+
+	storedContent, metadata, err := handler.EncodeObject([]byte(content), metadata)
+	if err != nil {
+		t.Fatalf("encode object: %v", err)
+	}
+	if err := handler.PersistObject(context.Background(), objectHash, storedContent, metadata); err != nil {
+		t.Fatalf("persist object: %v", err)
+	}
+}
+
+func TestCompression(t *testing.T) {
+	compressible := strings.Repeat(`{"level":"info","msg":"request served"}`+"\n", 1000)
+
+	for _, algorithm := range []string{CompressionGzip, CompressionZstd, CompressionSnappy} {
+		algorithm := algorithm
+		t.Run(algorithm, func(t *testing.T) {
+			handler, err := NewHandler(BackendMemory, t.TempDir(), map[string]string{"logs": algorithm}, nil, zap.NewNop().Sugar())
+			if err != nil {
+				t.Fatalf("create handler: %v", err)
+			}
+
+			persistObject(t, handler, testHashA, compressible, Metadata{Pool: "logs"})
+
+			stored, err := handler.store.Stat(testHashA)
+			if err != nil {
+				t.Fatalf("stat stored object: %v", err)
+			}
+			if stored.Metadata.Compression != algorithm || stored.Size >= int64(len(compressible)) {
+				t.Errorf("stored object isn't compressed: %+v", stored)
+			}
+			info, err := handler.StatObject(testHashA)
+			if err != nil || info.Size != int64(len(compressible)) || info.Metadata.Checksum != Checksum([]byte(compressible)) ||
+				info.Metadata.MD5 != md5Of([]byte(compressible)) {
+				t.Errorf("StatObject = %+v, %v", info, err)
+			}
+
+			reader, err := handler.OpenObject(testHashA)
+			if err != nil {
+				t.Fatalf("open object: %v", err)
+			}
+			defer func() { _ = reader.Close() }()
+
+			// ranges are served by seeking; seeking backwards restarts the decompression
+			for _, offset := range []int64{1000, 40, 20000} {
+				if _, err := reader.Seek(offset, io.SeekStart); err != nil {
+					t.Fatalf("seek to %v: %v", offset, err)
+				}
+				part := make([]byte, 100)
+				if _, err := io.ReadFull(reader, part); err != nil || string(part) != compressible[offset:offset+100] {
+					t.Errorf("read at offset %v = %q, %v", offset, part, err)
+				}
+			}
+			if size, err := reader.Seek(0, io.SeekEnd); err != nil || size != int64(len(compressible)) {
+				t.Errorf("seek to end = %v, %v", size, err)
+			}
+			if _, err := reader.Seek(0, io.SeekStart); err != nil {
+				t.Fatalf("seek to start: %v", err)
+			}
+			if content, err := io.ReadAll(reader); err != nil || string(content) != compressible {
+				t.Errorf("content doesn't match: %v", err)
+			}
+
+			if reader.Encoding() != algorithm {
+				t.Fatalf("Encoding = %q", reader.Encoding())
+			}
+			storedReader, err := reader.Encoded()
+			if err != nil {
+				t.Fatalf("get stored content: %v", err)
+			}
+			decompressor, err := newDecompressor(algorithm, storedReader)
+			if err != nil {
+				t.Fatalf("create decompressor: %v", err)
+			}
+			if content, err := io.ReadAll(decompressor); err != nil || string(content) != compressible {
+				t.Errorf("stored content can't be decompressed: %v", err)
+			}
+		})
+	}
+}
+
+func TestCompressionIsSkippedIfItDoesNotShrink(t *testing.T) {
+	handler, err := NewHandler(BackendMemory, t.TempDir(), map[string]string{"logs": CompressionZstd}, nil, zap.NewNop().Sugar())
+	if err != nil {
+		t.Fatalf("create handler: %v", err)
+	}
+
+	persistObject(t, handler, testHashA, "x", Metadata{Pool: "logs"})
+
+	reader, err := handler.OpenObject(testHashA)
+	if err != nil {
+		t.Fatalf("open object: %v", err)
+	}
+	defer func() { _ = reader.Close() }()
+
+	if reader.Encoding() != "" {
+		t.Errorf("object has been compressed although the compression doesn't shrink it")
+	}
+}
@@ -0,0 +1,32 @@
+package file
+
+import (
+	"errors"
+	"fmt"
+)
+
+var ErrDiskSpaceUnsupported = errors.New("the disk space can't be determined on this platform")
+
+// DiskSpace describes the file system that contains the object folder.
+type DiskSpace struct {
+	TotalBytes     uint64
+	AvailableBytes uint64 // bytes that can be used by the node, i.e. without the blocks that are reserved for root
+}
+
+// UsedRatio returns the share of the file system that can't be used by the node anymore.
+func (d DiskSpace) UsedRatio() float64 {
+	if d.TotalBytes == 0 {
+		return 0
+	}
+	return 1 - float64(d.AvailableBytes)/float64(d.TotalBytes)
+}
+
+// DiskSpace returns the size and the free space of the file system that contains the object folder. The memory backend
+// doesn't store the objects in the object folder; its disk space doesn't change when objects are created.
+func (h *Handler) DiskSpace() (DiskSpace, error) {
+	space, err := statDiskSpace(h.objectFolder)
+	if err != nil {
+		return DiskSpace{}, fmt.Errorf("determine disk space of %v: %w", h.objectFolder, err)
+	}
+	return space, nil
+}
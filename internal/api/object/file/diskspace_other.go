@@ -0,0 +1,7 @@
+//go:build !linux && !darwin && !freebsd && !windows
+
+package file
+
+func statDiskSpace(string) (DiskSpace, error) {
+	return DiskSpace{}, ErrDiskSpaceUnsupported
+}
@@ -0,0 +1,19 @@
+//go:build linux || darwin || freebsd
+
+package file
+
+import "syscall"
+
+func statDiskSpace(folder string) (DiskSpace, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(folder, &stat); err != nil {
+		return DiskSpace{}, err
+	}
+
+	// the types of the fields differ between the platforms
+	blockSize := uint64(stat.Bsize)
+	return DiskSpace{
+		TotalBytes:     uint64(stat.Blocks) * blockSize,
+		AvailableBytes: uint64(stat.Bavail) * blockSize,
+	}, nil
+}
@@ -0,0 +1,26 @@
+//go:build windows
+
+package file
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+var getDiskFreeSpaceEx = syscall.NewLazyDLL("kernel32.dll").NewProc("GetDiskFreeSpaceExW")
+
+func statDiskSpace(folder string) (DiskSpace, error) {
+	path, err := syscall.UTF16PtrFromString(folder)
+	if err != nil {
+		return DiskSpace{}, err
+	}
+
+	var available, total, free uint64
+	ok, _, err := getDiskFreeSpaceEx.Call(uintptr(unsafe.Pointer(path)), uintptr(unsafe.Pointer(&available)),
+		uintptr(unsafe.Pointer(&total)), uintptr(unsafe.Pointer(&free)))
+	if ok == 0 {
+		return DiskSpace{}, err
+	}
+
+	return DiskSpace{TotalBytes: total, AvailableBytes: available}, nil
+}
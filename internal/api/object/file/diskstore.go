@@ -0,0 +1,501 @@
+package file
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/rstdm/mini-ceph/internal/api/object/hash"
+	"go.uber.org/multierr"
+	"go.uber.org/zap"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// replacementInfix separates the object hash from the unique suffix in the name of a file with the new content of an
+// object that is being replaced.
+const replacementInfix = ".replacement-"
+
+// diskStore stores every object in a file that is named after the object hash. The metadata is stored in a separate
+// file in the metadata folder.
+//
+// Replace writes the new content to a replacement file and commits it with a single rename of the metadata file,
+// whose Replacement field names the replacement file. Afterwards the replacement file is moved to the name of the
+// object hash and the field is removed again. Readers read the metadata before and after they open the content file
+// and retry if it has changed, so they never pair the metadata of one version with the content of another.
+type diskStore struct {
+	objectFolder string
+	sugar        *zap.SugaredLogger
+}
+
+func newDiskStore(objectFolder string, sugar *zap.SugaredLogger) (*diskStore, error) {
+	metadataFolder := filepath.Join(objectFolder, relativeMetadataFolder)
+	if err := os.MkdirAll(metadataFolder, 0700); err != nil {
+		err = fmt.Errorf("create [metadataFolder=%v]: %w", metadataFolder, err)
+		return nil, err
+	}
+
+	if err := finishReplacements(objectFolder, sugar); err != nil {
+		err = fmt.Errorf("finish committed replacements: %w", err)
+		return nil, err
+	}
+
+	if err := purgeObjects(objectFolder, sugar); err != nil {
+		err = fmt.Errorf("purge not persisted objects: %w", err)
+		return nil, err
+	}
+
+	if err := purgeMetadata(objectFolder, sugar); err != nil {
+		err = fmt.Errorf("purge orphaned metadata: %w", err)
+		return nil, err
+	}
+
+	store := &diskStore{
+		objectFolder: objectFolder,
+		sugar:        sugar,
+	}
+
+	return store, nil
+}
+
+func (s *diskStore) Exists(objectHash string) (exists bool, err error) {
+	objectPath, err := getObjectPath(objectHash, s.objectFolder)
+	if err != nil {
+		err = fmt.Errorf("get object path: %w", err)
+		return false, err
+	}
+
+	exists, err = fileExists(objectPath)
+	if err != nil {
+		err = fmt.Errorf("check file existence: %w", err)
+		return false, err
+	}
+
+	return exists, nil
+}
+
+func (s *diskStore) Create(ctx context.Context, objectHash string, content io.Reader, metadata Metadata) error {
+	objectPath, err := getObjectPath(objectHash, s.objectFolder)
+	if err != nil {
+		return fmt.Errorf("get object path: %w", err)
+	}
+
+	fileExists, err := fileExists(objectPath)
+	if err != nil {
+		return fmt.Errorf("check file existence: %w", err)
+	}
+	if fileExists {
+		return ErrObjectAlreadyExists
+	}
+
+	// the object doesn't exit
+
+	metadataPath, err := getMetadataPath(objectHash, s.objectFolder)
+	if err != nil {
+		return fmt.Errorf("get metadata path: %w", err)
+	}
+
+	err = createObject(objectPath, content, s.sugar)
+	if err != nil {
+		err = fmt.Errorf("create object: %w", err)
+	} else if err = ctx.Err(); err == nil {
+		if err = writeMetadata(metadataPath, diskMetadata{Metadata: metadata}); err == nil {
+			return nil
+		}
+		err = fmt.Errorf("write metadata: %w", err)
+	}
+
+	// the object couldn't be persisted in a file and the file might be in an inconsistent state. Remove the files
+	// (if they exist) to ensure a consistent state.
+	for _, path := range []string{objectPath, metadataPath} {
+		if removeErr := os.Remove(path); removeErr != nil && !errors.Is(removeErr, os.ErrNotExist) {
+			removeErr = fmt.Errorf("remove %v to ensure a consistent state: %w", path, removeErr)
+			err = multierr.Append(err, removeErr)
+		}
+	}
+
+	return err
+}
+
+func (s *diskStore) Replace(objectHash string, content io.Reader, metadata Metadata) error {
+	objectPath, err := getObjectPath(objectHash, s.objectFolder)
+	if err != nil {
+		return fmt.Errorf("get object path: %w", err)
+	}
+
+	metadataPath, err := getMetadataPath(objectHash, s.objectFolder)
+	if err != nil {
+		return fmt.Errorf("get metadata path: %w", err)
+	}
+
+	// the replacement isn't committed until the metadata file has been renamed; purgeObjects removes the replacement
+	// file if the process crashes before
+	replacement := objectHash + replacementInfix + strconv.FormatInt(time.Now().UnixNano(), 10)
+	replacementPath := filepath.Join(s.objectFolder, replacement)
+	temporaryMetadataPath := metadataPath + temporaryFileSuffix
+
+	if err := createObject(replacementPath, content, s.sugar); err != nil {
+		_ = os.Remove(replacementPath)
+		return fmt.Errorf("create replacement: %w", err)
+	}
+	if err := writeMetadata(temporaryMetadataPath, diskMetadata{Metadata: metadata, Replacement: replacement}); err != nil {
+		_ = os.Remove(replacementPath)
+		_ = os.Remove(temporaryMetadataPath)
+		return fmt.Errorf("write temporary metadata: %w", err)
+	}
+	if err := os.Rename(temporaryMetadataPath, metadataPath); err != nil {
+		_ = os.Remove(replacementPath)
+		_ = os.Remove(temporaryMetadataPath)
+		return fmt.Errorf("commit replacement: %w", err)
+	}
+
+	// the replacement has been committed; readers follow the Replacement field until it has been moved
+	if err := finishReplacement(objectPath, metadataPath, replacementPath, metadata); err != nil {
+		s.sugar.Warnw("Failed to finish committed replacement; it is finished at the next start",
+			"err", err,
+			"object", objectHash,
+		)
+	}
+
+	return nil
+}
+
+// getReplacementPath validates the name of the replacement file that is read from the metadata before it is used to
+// create a path.
+func getReplacementPath(objectHash string, replacement string, objectFolder string) (string, error) {
+	if !strings.HasPrefix(replacement, objectHash+replacementInfix) || filepath.Base(replacement) != replacement {
+		return "", fmt.Errorf("invalid replacement %v of object %v", replacement, objectHash)
+	}
+
+	return filepath.Join(objectFolder, replacement), nil
+}
+
+// finishReplacement moves the content of a committed replacement to the name of the object hash and removes the
+// Replacement field from the metadata. The replacement file doesn't exist anymore if it has already been moved.
+func finishReplacement(objectPath string, metadataPath string, replacementPath string, metadata Metadata) error {
+	if err := os.Rename(replacementPath, objectPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("move replacement: %w", err)
+	}
+
+	temporaryMetadataPath := metadataPath + temporaryFileSuffix
+	if err := writeMetadata(temporaryMetadataPath, diskMetadata{Metadata: metadata}); err != nil {
+		_ = os.Remove(temporaryMetadataPath)
+		return fmt.Errorf("write temporary metadata: %w", err)
+	}
+	if err := os.Rename(temporaryMetadataPath, metadataPath); err != nil {
+		_ = os.Remove(temporaryMetadataPath)
+		return fmt.Errorf("rename temporary metadata: %w", err)
+	}
+
+	return nil
+}
+
+func (s *diskStore) ReplaceMetadata(objectHash string, metadata Metadata) error {
+	if exists, err := s.Exists(objectHash); err != nil || !exists {
+		return fmt.Errorf("replace metadata of %v: %w", objectHash, os.ErrNotExist)
+	}
+
+	metadataPath, err := getMetadataPath(objectHash, s.objectFolder)
+	if err != nil {
+		return fmt.Errorf("get metadata path: %w", err)
+	}
+
+	// a replacement that is being finished keeps its Replacement field
+	stored, err := readMetadata(metadataPath)
+	if err != nil && !errors.Is(err, ErrNoMetadata) {
+		return fmt.Errorf("read metadata: %w", err)
+	}
+
+	temporaryMetadataPath := metadataPath + temporaryFileSuffix
+	if err := writeMetadata(temporaryMetadataPath, diskMetadata{Metadata: metadata, Replacement: stored.Replacement}); err != nil {
+		_ = os.Remove(temporaryMetadataPath)
+		return fmt.Errorf("write temporary metadata: %w", err)
+	}
+	if err := os.Rename(temporaryMetadataPath, metadataPath); err != nil {
+		_ = os.Remove(temporaryMetadataPath)
+		return fmt.Errorf("rename temporary metadata: %w", err)
+	}
+
+	return nil
+}
+
+func (s *diskStore) Open(objectHash string) (io.ReadSeekCloser, ObjectInfo, error) {
+	openedFile, info, err := s.open(objectHash)
+	if err != nil {
+		return nil, ObjectInfo{}, err
+	}
+
+	return openedFile, info, nil
+}
+
+// open opens the content file of the object together with the metadata that describes it. The metadata is read again
+// after the content file has been opened; if it has changed, the object has been replaced in between and open tries
+// again.
+func (s *diskStore) open(objectHash string) (*os.File, ObjectInfo, error) {
+	objectPath, err := getObjectPath(objectHash, s.objectFolder)
+	if err != nil {
+		return nil, ObjectInfo{}, fmt.Errorf("get object path: %w", err)
+	}
+
+	for {
+		before, err := s.readMetadata(objectHash)
+		if err != nil {
+			return nil, ObjectInfo{}, fmt.Errorf("read metadata: %w", err)
+		}
+
+		contentPath := objectPath
+		if before.Replacement != "" {
+			if contentPath, err = getReplacementPath(objectHash, before.Replacement, s.objectFolder); err != nil {
+				return nil, ObjectInfo{}, err
+			}
+		}
+		openedFile, err := os.Open(contentPath)
+		if errors.Is(err, os.ErrNotExist) && contentPath != objectPath {
+			// the replacement has been moved to the object path in the meantime
+			openedFile, err = os.Open(objectPath)
+		}
+		if err != nil {
+			return nil, ObjectInfo{}, fmt.Errorf("open %v: %w", objectHash, err)
+		}
+
+		after, err := s.readMetadata(objectHash)
+		if err != nil {
+			_ = openedFile.Close()
+			return nil, ObjectInfo{}, fmt.Errorf("read metadata: %w", err)
+		}
+		if after != before {
+			_ = openedFile.Close()
+			continue
+		}
+
+		fileInfo, err := openedFile.Stat()
+		if err != nil {
+			_ = openedFile.Close()
+			return nil, ObjectInfo{}, fmt.Errorf("stat %v: %w", objectHash, err)
+		}
+
+		info := ObjectInfo{Hash: objectHash, Size: fileInfo.Size(), ModTime: fileInfo.ModTime(), Metadata: before.Metadata}
+		return openedFile, info, nil
+	}
+}
+
+func (s *diskStore) Delete(objectHash string) error {
+	objectPath, err := getObjectPath(objectHash, s.objectFolder)
+	if err != nil {
+		return fmt.Errorf("get object path: %w", err)
+	}
+
+	err = os.Remove(objectPath)
+	if err != nil {
+		err = fmt.Errorf("remove object: %w", err)
+		return err
+	}
+
+	metadataPath, err := getMetadataPath(objectHash, s.objectFolder)
+	if err != nil {
+		return fmt.Errorf("get metadata path: %w", err)
+	}
+
+	// objects that have been created by older versions don't have any metadata
+	if err := os.Remove(metadataPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("remove metadata: %w", err)
+	}
+
+	return nil
+}
+
+func (s *diskStore) List() ([]ObjectInfo, error) {
+	dirEntries, err := os.ReadDir(s.objectFolder)
+	if err != nil {
+		return nil, fmt.Errorf("list files in object dir: %w", err)
+	}
+
+	var objects []ObjectInfo
+	for _, entry := range dirEntries {
+		if entry.IsDir() || !hash.IsObjectHash(entry.Name()) {
+			continue
+		}
+
+		info, err := entry.Info()
+		if errors.Is(err, os.ErrNotExist) {
+			continue // the object has been deleted in the meantime
+		}
+		if err != nil {
+			return nil, fmt.Errorf("read file info of object %v: %w", entry.Name(), err)
+		}
+
+		if !isMarkedAsPersisted(info) {
+			continue // the object is currently created
+		}
+
+		object, err := s.Stat(entry.Name())
+		if errors.Is(err, os.ErrNotExist) {
+			continue // the object has been deleted in the meantime
+		}
+		if err != nil {
+			return nil, fmt.Errorf("stat object %v: %w", entry.Name(), err)
+		}
+
+		objects = append(objects, object)
+	}
+
+	return objects, nil
+}
+
+func (s *diskStore) Stat(objectHash string) (ObjectInfo, error) {
+	openedFile, info, err := s.open(objectHash)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	_ = openedFile.Close()
+
+	return info, nil
+}
+
+// readMetadata returns empty metadata for objects that have been created by older versions.
+func (s *diskStore) readMetadata(objectHash string) (diskMetadata, error) {
+	metadataPath, err := getMetadataPath(objectHash, s.objectFolder)
+	if err != nil {
+		return diskMetadata{}, fmt.Errorf("get metadata path: %w", err)
+	}
+
+	metadata, err := readMetadata(metadataPath)
+	if err != nil && !errors.Is(err, ErrNoMetadata) {
+		return diskMetadata{}, err
+	}
+
+	return metadata, nil
+}
+
+// finishReplacements finishes the replacements that have been committed before the process has stopped.
+func finishReplacements(objectFolder string, sugar *zap.SugaredLogger) error {
+	metadataFolder := filepath.Join(objectFolder, relativeMetadataFolder)
+	dirEntries, err := os.ReadDir(metadataFolder)
+	if err != nil {
+		return fmt.Errorf("list files in metadata dir: %w", err)
+	}
+
+	for _, entry := range dirEntries {
+		if entry.IsDir() || !hash.IsObjectHash(entry.Name()) {
+			continue
+		}
+
+		metadataPath := filepath.Join(metadataFolder, entry.Name())
+		metadata, err := readMetadata(metadataPath)
+		if err != nil {
+			return fmt.Errorf("read metadata of object %v: %w", entry.Name(), err)
+		}
+		if metadata.Replacement == "" {
+			continue
+		}
+
+		sugar.Infow("Finishing committed replacement.",
+			"object", entry.Name(),
+			"replacement", metadata.Replacement,
+		)
+		replacementPath, err := getReplacementPath(entry.Name(), metadata.Replacement, objectFolder)
+		if err != nil {
+			return err
+		}
+		objectPath := filepath.Join(objectFolder, entry.Name())
+		if err := finishReplacement(objectPath, metadataPath, replacementPath, metadata.Metadata); err != nil {
+			return fmt.Errorf("finish replacement of object %v: %w", entry.Name(), err)
+		}
+	}
+
+	return nil
+}
+
+func purgeObjects(objectFolder string, sugar *zap.SugaredLogger) error {
+	dirEntries, err := os.ReadDir(objectFolder)
+	if err != nil {
+		return fmt.Errorf("list files in object dir: %w", err)
+	}
+
+	var merr error
+	for _, entry := range dirEntries {
+		if entry.IsDir() {
+			continue
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			err = fmt.Errorf("read file info of object %v: %w", entry.Name(), err)
+			merr = multierr.Append(merr, err)
+			continue
+		}
+
+		// committed replacements have been finished before; the remaining ones haven't been committed
+		isTemporary := strings.HasSuffix(entry.Name(), temporaryFileSuffix) ||
+			strings.Contains(entry.Name(), replacementInfix)
+		if isMarkedAsPersisted(info) && !isTemporary {
+			continue
+		}
+
+		path := filepath.Join(objectFolder, entry.Name())
+		sugar.Infow("Deleting object that is not marked as persisted.",
+			"object", entry.Name(),
+			"path", path,
+		)
+
+		if err := os.Remove(path); err != nil {
+			err = fmt.Errorf("remove %v: %w", path, err)
+			merr = multierr.Append(merr, err)
+		}
+	}
+
+	if merr != nil {
+		return fmt.Errorf("process files: %w", err)
+	}
+
+	return nil
+}
+
+// purgeMetadata removes metadata files that are not marked as persisted or whose object doesn't exist anymore.
+func purgeMetadata(objectFolder string, sugar *zap.SugaredLogger) error {
+	metadataFolder := filepath.Join(objectFolder, relativeMetadataFolder)
+	dirEntries, err := os.ReadDir(metadataFolder)
+	if err != nil {
+		return fmt.Errorf("list files in metadata dir: %w", err)
+	}
+
+	var merr error
+	for _, entry := range dirEntries {
+		if entry.IsDir() {
+			continue
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			err = fmt.Errorf("read file info of metadata %v: %w", entry.Name(), err)
+			merr = multierr.Append(merr, err)
+			continue
+		}
+
+		objectExists, err := fileExists(filepath.Join(objectFolder, entry.Name()))
+		if err != nil {
+			merr = multierr.Append(merr, err)
+			continue
+		}
+
+		if objectExists && isMarkedAsPersisted(info) {
+			continue
+		}
+
+		path := filepath.Join(metadataFolder, entry.Name())
+		sugar.Infow("Deleting orphaned metadata.",
+			"object", entry.Name(),
+			"path", path,
+		)
+
+		if err := os.Remove(path); err != nil {
+			err = fmt.Errorf("remove %v: %w", path, err)
+			merr = multierr.Append(merr, err)
+		}
+	}
+
+	return merr
+}
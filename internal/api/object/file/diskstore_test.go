@@ -0,0 +1,128 @@
+package file
+
+import (
+	"context"
+	"fmt"
+	"go.uber.org/zap"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// TestConcurrentReadsOfReplacedObject checks that readers never pair the metadata of one version with the content of
+// another while the object is replaced.
+func TestConcurrentReadsOfReplacedObject(t *testing.T) {
+	store, err := newDiskStore(t.TempDir(), zap.NewNop().Sugar())
+	if err != nil {
+		t.Fatalf("create disk store: %v", err)
+	}
+
+	version := func(i int) (string, Metadata) {
+		content := strings.Repeat(fmt.Sprint(i), i+1)
+		return content, Metadata{Checksum: Checksum([]byte(content))}
+	}
+	content, metadata := version(0)
+	if err := store.Create(context.Background(), testHashA, strings.NewReader(content), metadata); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for reader := 0; reader < 4; reader++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+
+				opened, info, err := store.Open(testHashA)
+				if err != nil {
+					t.Errorf("Open: %v", err)
+					return
+				}
+				content, err := io.ReadAll(opened)
+				_ = opened.Close()
+				if err != nil || Checksum(content) != info.Metadata.Checksum || int64(len(content)) != info.Size {
+					t.Errorf("read %q with %+v, %v", content, info, err)
+					return
+				}
+			}
+		}()
+	}
+
+	for i := 1; i < 200; i++ {
+		content, metadata := version(i % 10)
+		if err := store.Replace(testHashA, strings.NewReader(content), metadata); err != nil {
+			t.Errorf("Replace: %v", err)
+			break
+		}
+	}
+	close(done)
+	wg.Wait()
+}
+
+func TestReplacementsAreFinishedAtStart(t *testing.T) {
+	folder := t.TempDir()
+	store, err := newDiskStore(folder, zap.NewNop().Sugar())
+	if err != nil {
+		t.Fatalf("create disk store: %v", err)
+	}
+	for _, objectHash := range []string{testHashA, testHashB} {
+		if err := store.Create(context.Background(), objectHash, strings.NewReader("old"), Metadata{Pool: "old"}); err != nil {
+			t.Fatalf("Create: %v", err)
+		}
+	}
+
+	// the replacement of A has been committed, the one of B hasn't when the process stops
+	for _, objectHash := range []string{testHashA, testHashB} {
+		replacement := objectHash + replacementInfix + "1"
+		if err := createObject(filepath.Join(folder, replacement), strings.NewReader("new"), zap.NewNop().Sugar()); err != nil {
+			t.Fatalf("create replacement: %v", err)
+		}
+		if objectHash == testHashB {
+			continue
+		}
+		metadataPath, _ := getMetadataPath(objectHash, folder)
+		if err := os.Remove(metadataPath); err != nil {
+			t.Fatalf("remove metadata: %v", err)
+		}
+		if err := writeMetadata(metadataPath, diskMetadata{Metadata: Metadata{Pool: "new"}, Replacement: replacement}); err != nil {
+			t.Fatalf("commit replacement: %v", err)
+		}
+	}
+
+	// readers follow the committed replacement before it is finished
+	if info, err := store.Stat(testHashA); err != nil || info.Metadata.Pool != "new" || readObject(t, store, testHashA) != "new" {
+		t.Errorf("Stat of committed replacement = %+v, %v", info, err)
+	}
+
+	restarted, err := newDiskStore(folder, zap.NewNop().Sugar())
+	if err != nil {
+		t.Fatalf("restart disk store: %v", err)
+	}
+	for objectHash, want := range map[string]string{testHashA: "new", testHashB: "old"} {
+		info, err := restarted.Stat(objectHash)
+		if err != nil || info.Metadata.Pool != want || readObject(t, restarted, objectHash) != want {
+			t.Errorf("Stat of %v after restart = %+v, %v, want %v", objectHash, info, err, want)
+		}
+	}
+	entries, err := os.ReadDir(folder)
+	if err != nil {
+		t.Fatalf("read object folder: %v", err)
+	}
+	for _, entry := range entries {
+		if strings.Contains(entry.Name(), replacementInfix) {
+			t.Errorf("replacement %v hasn't been removed", entry.Name())
+		}
+	}
+	if metadata, err := readMetadata(filepath.Join(folder, relativeMetadataFolder, testHashA)); err != nil || metadata.Replacement != "" {
+		t.Errorf("metadata after restart = %+v, %v", metadata, err)
+	}
+}
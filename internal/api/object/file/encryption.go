@@ -0,0 +1,319 @@
+package file
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"strings"
+)
+
+const (
+	masterKeySize = 32 // AES-256
+	dataKeySize   = 32
+
+	// encryptionChunkSize is the size of the plaintext chunks that are sealed separately. Ranges are decrypted without
+	// decrypting the whole object; only the chunks that contain the range are read.
+	encryptionChunkSize = 64 * 1024
+)
+
+var (
+	ErrUnknownMasterKey   = errors.New("the master key of the object is unknown")
+	ErrContentIsCorrupted = errors.New("the encrypted content has been modified")
+)
+
+// Keyring contains the master keys that wrap the data keys of encrypted objects. Every object is encrypted with its
+// own random data key. New objects use the current master key; the other keys are kept to unwrap the data keys of
+// objects that have been written before the key has been rotated. Rotating the master key therefore doesn't require
+// rewriting any object. An old key can be retired once the data keys of all its objects have been rewrapped with the
+// current key (see Handler.RewrapObject); only the metadata of the objects is rewritten.
+type Keyring struct {
+	currentID string
+	keys      map[string]cipher.AEAD
+}
+
+// ParseKeyring parses master keys in the format "<id>:<base64 encoded 32 byte key>". The keys are separated by
+// newlines or commas; empty lines and lines starting with # are ignored. The last key is the current key.
+func ParseKeyring(rawKeys string) (*Keyring, error) {
+	keyring := &Keyring{keys: map[string]cipher.AEAD{}}
+
+	for _, line := range strings.FieldsFunc(rawKeys, func(r rune) bool { return r == '\n' || r == ',' }) {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		id, encodedKey, found := strings.Cut(line, ":")
+		id = strings.TrimSpace(id)
+		if !found || id == "" {
+			return nil, fmt.Errorf("master key %q has no id; the format is <id>:<base64 encoded key>", redactKey(line))
+		}
+		if _, ok := keyring.keys[id]; ok {
+			return nil, fmt.Errorf("master key %v is specified twice", id)
+		}
+
+		key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encodedKey))
+		if err != nil {
+			return nil, fmt.Errorf("decode master key %v: %w", id, err)
+		}
+		if len(key) != masterKeySize {
+			return nil, fmt.Errorf("master key %v has %v bytes, expected %v", id, len(key), masterKeySize)
+		}
+
+		aead, err := newAEAD(key)
+		if err != nil {
+			return nil, fmt.Errorf("create cipher of master key %v: %w", id, err)
+		}
+		keyring.keys[id] = aead
+		keyring.currentID = id
+	}
+
+	if keyring.currentID == "" {
+		return nil, errors.New("no master key has been specified")
+	}
+
+	return keyring, nil
+}
+
+func redactKey(line string) string {
+	if len(line) > 4 {
+		return line[:4] + "..."
+	}
+	return line
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func (k *Keyring) CurrentKeyID() string {
+	return k.currentID
+}
+
+// newDataKey generates a random data key for a new object. It returns the data key, the id of the current master key
+// and the data key wrapped with the master key.
+func (k *Keyring) newDataKey() (dataKey []byte, keyID string, wrappedKey string, err error) {
+	dataKey = make([]byte, dataKeySize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, "", "", fmt.Errorf("generate data key: %w", err)
+	}
+
+	keyID, wrappedKey, err = k.wrap(dataKey)
+	if err != nil {
+		return nil, "", "", err
+	}
+	return dataKey, keyID, wrappedKey, nil
+}
+
+// wrap encrypts the data key with the current master key.
+func (k *Keyring) wrap(dataKey []byte) (keyID string, wrappedKey string, err error) {
+	masterKey := k.keys[k.currentID]
+	nonce := make([]byte, masterKey.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", "", fmt.Errorf("generate nonce: %w", err)
+	}
+	// the id is authenticated; the wrapped key can't be moved to another master key
+	sealedKey := masterKey.Seal(nonce, nonce, dataKey, []byte(k.currentID))
+
+	return k.currentID, base64.StdEncoding.EncodeToString(sealedKey), nil
+}
+
+// unwrap returns the data key that has been wrapped by wrap.
+func (k *Keyring) unwrap(keyID string, wrappedKey string) ([]byte, error) {
+	masterKey, ok := k.keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("%w: %v", ErrUnknownMasterKey, keyID)
+	}
+
+	sealedKey, err := base64.StdEncoding.DecodeString(wrappedKey)
+	if err != nil {
+		return nil, fmt.Errorf("decode wrapped data key: %w", err)
+	}
+	if len(sealedKey) < masterKey.NonceSize() {
+		return nil, errors.New("wrapped data key is truncated")
+	}
+
+	nonce, sealedKey := sealedKey[:masterKey.NonceSize()], sealedKey[masterKey.NonceSize():]
+	dataKey, err := masterKey.Open(nil, nonce, sealedKey, []byte(keyID))
+	if err != nil {
+		return nil, fmt.Errorf("unwrap data key with master key %v: %w", keyID, err)
+	}
+
+	return dataKey, nil
+}
+
+// rewrap wraps the data key of an object with the current master key. The content and its checksum stay valid because
+// the data key doesn't change.
+func (k *Keyring) rewrap(keyID string, wrappedKey string) (newKeyID string, newWrappedKey string, err error) {
+	dataKey, err := k.unwrap(keyID, wrappedKey)
+	if err != nil {
+		return "", "", err
+	}
+	return k.wrap(dataKey)
+}
+
+// encryptContent seals the content chunk by chunk with the data key.
+func encryptContent(dataKey []byte, content []byte) ([]byte, error) {
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, fmt.Errorf("create cipher of data key: %w", err)
+	}
+
+	numChunks := encryptedChunks(int64(len(content)))
+	encrypted := make([]byte, 0, int64(len(content))+numChunks*int64(aead.Overhead()))
+	for chunk := int64(0); chunk < numChunks; chunk++ {
+		start := chunk * encryptionChunkSize
+		end := start + encryptionChunkSize
+		if end > int64(len(content)) {
+			end = int64(len(content))
+		}
+		encrypted = aead.Seal(encrypted, chunkNonce(chunk, aead.NonceSize()), content[start:end], chunkAD(chunk == numChunks-1))
+	}
+
+	return encrypted, nil
+}
+
+// newKeyedDigest returns the digest of Metadata.Checksum for objects that are encrypted with the data key. The digest
+// is an HMAC with a key that is derived from the data key, so the checksums of equal clear-text content differ
+// between objects and don't reveal anything about the content.
+func newKeyedDigest(dataKey []byte) hash.Hash {
+	derivation := hmac.New(sha256.New, dataKey)
+	derivation.Write([]byte("mini-ceph checksum"))
+	return hmac.New(sha256.New, derivation.Sum(nil))
+}
+
+// encryptedChunks returns the number of chunks of the content. Empty content is stored as a single empty chunk;
+// otherwise truncating the content after a chunk boundary couldn't be detected.
+func encryptedChunks(size int64) int64 {
+	if size == 0 {
+		return 1
+	}
+	return (size + encryptionChunkSize - 1) / encryptionChunkSize
+}
+
+// chunkNonce derives the nonce from the position of the chunk. The nonces are unique because every object has its own
+// data key. A chunk can't be moved to another position without failing the authentication.
+func chunkNonce(chunk int64, nonceSize int) []byte {
+	nonce := make([]byte, nonceSize)
+	binary.BigEndian.PutUint64(nonce[nonceSize-8:], uint64(chunk))
+	return nonce
+}
+
+// chunkAD marks the last chunk; removing chunks from the end of the content fails the authentication.
+func chunkAD(isLast bool) []byte {
+	if isLast {
+		return []byte{1}
+	}
+	return []byte{0}
+}
+
+// decryptingReader decrypts the stored content on the fly. Only the chunk that contains the current offset is kept in
+// memory. Modifications of the stored content are detected when the modified chunk is read.
+type decryptingReader struct {
+	stored     io.ReadSeeker
+	aead       cipher.AEAD
+	storedSize int64
+	size       int64 // size of the decrypted content
+	numChunks  int64
+	offset     int64
+	chunk      int64 // index of the decrypted chunk; -1 if no chunk has been decrypted yet
+	sealed     []byte
+	plaintext  []byte
+	err        error // returned by Read if the stored content is truncated
+}
+
+func newDecryptingReader(stored io.ReadSeeker, storedSize int64, aead cipher.AEAD) *decryptingReader {
+	sealedChunkSize := int64(encryptionChunkSize + aead.Overhead())
+	numChunks := (storedSize + sealedChunkSize - 1) / sealedChunkSize
+	if numChunks == 0 {
+		numChunks = 1
+	}
+
+	reader := &decryptingReader{
+		stored:     stored,
+		aead:       aead,
+		storedSize: storedSize,
+		size:       storedSize - numChunks*int64(aead.Overhead()),
+		numChunks:  numChunks,
+		chunk:      -1,
+		sealed:     make([]byte, sealedChunkSize),
+	}
+	if reader.size < 0 || storedSize-(numChunks-1)*sealedChunkSize < int64(aead.Overhead()) {
+		reader.size = 0
+		reader.err = fmt.Errorf("%w: %v bytes are truncated", ErrContentIsCorrupted, storedSize)
+	}
+
+	return reader
+}
+
+func (r *decryptingReader) Read(p []byte) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	if r.offset >= r.size {
+		return 0, io.EOF
+	}
+
+	chunk := r.offset / encryptionChunkSize
+	if chunk != r.chunk {
+		if err := r.decryptChunk(chunk); err != nil {
+			return 0, fmt.Errorf("decrypt chunk %v: %w", chunk, err)
+		}
+	}
+
+	n := copy(p, r.plaintext[r.offset-chunk*encryptionChunkSize:])
+	r.offset += int64(n)
+	return n, nil
+}
+
+func (r *decryptingReader) decryptChunk(chunk int64) error {
+	r.chunk = -1
+
+	start := chunk * int64(len(r.sealed))
+	end := start + int64(len(r.sealed))
+	if end > r.storedSize {
+		end = r.storedSize
+	}
+	if _, err := r.stored.Seek(start, io.SeekStart); err != nil {
+		return err
+	}
+	sealed := r.sealed[:end-start]
+	if _, err := io.ReadFull(r.stored, sealed); err != nil {
+		return err
+	}
+
+	plaintext, err := r.aead.Open(r.plaintext[:0], chunkNonce(chunk, r.aead.NonceSize()), sealed, chunkAD(chunk == r.numChunks-1))
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrContentIsCorrupted, err)
+	}
+	r.plaintext = plaintext
+	r.chunk = chunk
+
+	return nil
+}
+
+func (r *decryptingReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += r.size
+	}
+	if offset < 0 {
+		return 0, errors.New("seek to negative position")
+	}
+
+	r.offset = offset
+	return offset, nil
+}
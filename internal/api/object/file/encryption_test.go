@@ -0,0 +1,231 @@
+package file
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"go.uber.org/zap"
+	"io"
+	"math/rand"
+	"testing"
+)
+
+func testKey(id string, fill byte) string {
+	return id + ":" + base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{fill}, masterKeySize))
+}
+
+func newEncryptingHandler(t *testing.T, objectFolder string, rawKeys string) *Handler {
+	t.Helper()
+
+	keyring, err := ParseKeyring(rawKeys)
+	if err != nil {
+		t.Fatalf("parse keyring: %v", err)
+	}
+	handler, err := NewHandler(BackendFile, objectFolder, map[string]string{"logs": CompressionZstd}, keyring, zap.NewNop().Sugar())
+	if err != nil {
+		t.Fatalf("create handler: %v", err)
+	}
+	return handler
+}
+
+func TestParseKeyring(t *testing.T) {
+	keyring, err := ParseKeyring("# rotated 2022-10\n" + testKey("old", 1) + "\n\n" + testKey("new", 2) + "\n")
+	if err != nil || keyring.CurrentKeyID() != "new" || len(keyring.keys) != 2 {
+		t.Errorf("ParseKeyring = %+v, %v", keyring, err)
+	}
+	if keyring, err := ParseKeyring(testKey("a", 1) + "," + testKey("b", 2)); err != nil || keyring.CurrentKeyID() != "b" {
+		t.Errorf("comma separated keys = %+v, %v", keyring, err)
+	}
+
+	for _, rawKeys := range []string{
+		"",
+		"# only a comment",
+		base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, masterKeySize)), // no id
+		"short:" + base64.StdEncoding.EncodeToString([]byte("too short")),
+		"invalid:not base64!",
+		testKey("twice", 1) + "\n" + testKey("twice", 2),
+	} {
+		if _, err := ParseKeyring(rawKeys); err == nil {
+			t.Errorf("ParseKeyring(%q) succeeded", rawKeys)
+		}
+	}
+}
+
+func TestEncryption(t *testing.T) {
+	// the content spans several chunks; the random part doesn't compress
+	content := make([]byte, 3*encryptionChunkSize+1000)
+	rand.New(rand.NewSource(1)).Read(content[:2*encryptionChunkSize])
+
+	for name, pool := range map[string]string{"uncompressed": "default", "compressed": "logs"} {
+		pool := pool
+		t.Run(name, func(t *testing.T) {
+			handler := newEncryptingHandler(t, t.TempDir(), testKey("k1", 1))
+			persistObject(t, handler, testHashA, string(content), Metadata{Pool: pool})
+
+			stored, err := handler.store.Stat(testHashA)
+			if err != nil {
+				t.Fatalf("stat stored object: %v", err)
+			}
+			if stored.Metadata.KeyID != "k1" || stored.Metadata.WrappedKey == "" {
+				t.Errorf("stored object isn't encrypted: %+v", stored.Metadata)
+			}
+			if info, err := handler.StatObject(testHashA); err != nil || info.Size != int64(len(content)) {
+				t.Errorf("StatObject = %+v, %v", info, err)
+			}
+
+			reader, err := handler.OpenObject(testHashA)
+			if err != nil {
+				t.Fatalf("open object: %v", err)
+			}
+			defer func() { _ = reader.Close() }()
+
+			// ranges within and across chunk boundaries
+			for _, offset := range []int64{encryptionChunkSize - 50, 10, 2*encryptionChunkSize + 7, 0} {
+				if _, err := reader.Seek(offset, io.SeekStart); err != nil {
+					t.Fatalf("seek to %v: %v", offset, err)
+				}
+				part := make([]byte, 100)
+				if _, err := io.ReadFull(reader, part); err != nil || !bytes.Equal(part, content[offset:offset+100]) {
+					t.Errorf("read at offset %v doesn't match: %v", offset, err)
+				}
+			}
+			if _, err := reader.Seek(0, io.SeekStart); err != nil {
+				t.Fatalf("seek to start: %v", err)
+			}
+			if decoded, err := io.ReadAll(reader); err != nil || !bytes.Equal(decoded, content) {
+				t.Errorf("content doesn't match: %v", err)
+			}
+
+			storedReader, err := reader.Stored()
+			if err != nil {
+				t.Fatalf("get stored content: %v", err)
+			}
+			storedContent, err := io.ReadAll(storedReader)
+			if err != nil {
+				t.Fatalf("read stored content: %v", err)
+			}
+			if bytes.Contains(storedContent, content[:64]) || bytes.Contains(storedContent, content[len(content)-64:]) {
+				t.Errorf("stored content contains clear-text")
+			}
+
+			// the stored content can be decoded by another node that has the same keyring
+			other := newEncryptingHandler(t, t.TempDir(), testKey("k1", 1))
+			decodedCopy, err := other.DecodeObject(storedContent, stored.Metadata)
+			if err != nil {
+				t.Fatalf("decode copy: %v", err)
+			}
+			if checksum, err := decodedCopy.Checksum(); err != nil || checksum != stored.Metadata.Checksum {
+				t.Errorf("checksum of decoded copy = %v, %v", checksum, err)
+			}
+		})
+	}
+}
+
+func TestEncryptionDetectsTampering(t *testing.T) {
+	handler := newEncryptingHandler(t, t.TempDir(), testKey("k1", 1))
+	content := bytes.Repeat([]byte("0123456789"), encryptionChunkSize/5) // two chunks
+	storedContent, metadata, err := handler.EncodeObject(content, Metadata{})
+	if err != nil {
+		t.Fatalf("encode object: %v", err)
+	}
+
+	flipped := append([]byte{}, storedContent...)
+	flipped[10] ^= 1
+	truncated := storedContent[:encryptionChunkSize+handler.keyring.keys["k1"].Overhead()] // the last chunk is missing
+	for name, tampered := range map[string][]byte{"flipped bit": flipped, "truncated": truncated} {
+		reader, err := handler.DecodeObject(tampered, metadata)
+		if err == nil {
+			_, err = io.ReadAll(reader)
+		}
+		if err == nil {
+			t.Errorf("%v: content has been decrypted", name)
+		}
+	}
+
+	otherKey := metadata
+	if _, _, otherKey.WrappedKey, err = handler.keyring.newDataKey(); err != nil {
+		t.Fatalf("generate another data key: %v", err)
+	}
+	if reader, err := handler.DecodeObject(storedContent, otherKey); err == nil {
+		if _, err := io.ReadAll(reader); err == nil {
+			t.Errorf("content has been decrypted with another data key")
+		}
+	}
+}
+
+func TestEncryptionKeyRotation(t *testing.T) {
+	objectFolder := t.TempDir()
+	before := newEncryptingHandler(t, objectFolder, testKey("2022", 1))
+	persistObject(t, before, testHashA, "written before the rotation", Metadata{})
+
+	// the old key is kept to decrypt the existing objects; new objects use the new key
+	after := newEncryptingHandler(t, objectFolder, testKey("2022", 1)+"\n"+testKey("2023", 2))
+	persistObject(t, after, testHashB, "written after the rotation", Metadata{})
+
+	for objectHash, want := range map[string]string{testHashA: "written before the rotation", testHashB: "written after the rotation"} {
+		reader, err := after.OpenObject(objectHash)
+		if err != nil {
+			t.Fatalf("open %v: %v", objectHash, err)
+		}
+		content, err := io.ReadAll(reader)
+		_ = reader.Close()
+		if err != nil || string(content) != want {
+			t.Errorf("content of %v = %q, %v", objectHash, content, err)
+		}
+	}
+	if metadata, err := after.GetMetadata(testHashB); err != nil || metadata.KeyID != "2023" {
+		t.Errorf("metadata of new object = %+v, %v", metadata, err)
+	}
+
+	// the old key can't be dropped while objects use it
+	withoutOldKey := newEncryptingHandler(t, objectFolder, testKey("2023", 2))
+	if _, err := withoutOldKey.OpenObject(testHashA); !errors.Is(err, ErrUnknownMasterKey) {
+		t.Errorf("OpenObject without the old key returned %v, want ErrUnknownMasterKey", err)
+	}
+	storedContent, metadata, _ := before.EncodeObject([]byte("x"), Metadata{})
+	if err := withoutOldKey.ReplaceObject(testHashA, storedContent, metadata); !errors.Is(err, ErrUnknownMasterKey) {
+		t.Errorf("ReplaceObject with unknown key returned %v, want ErrUnknownMasterKey", err)
+	}
+
+	// after the data keys have been rewrapped, the old key can be dropped; the checksum doesn't change
+	oldMetadata, _ := after.GetMetadata(testHashA)
+	for objectHash, want := range map[string]bool{testHashA: true, testHashB: false} {
+		if rewrapped, err := after.RewrapObject(objectHash); err != nil || rewrapped != want {
+			t.Errorf("RewrapObject(%v) = %v, %v, want %v", objectHash, rewrapped, err, want)
+		}
+	}
+	newMetadata, err := withoutOldKey.GetMetadata(testHashA)
+	if err != nil || newMetadata.KeyID != "2023" || newMetadata.Checksum != oldMetadata.Checksum {
+		t.Errorf("metadata after rewrap = %+v, %v", newMetadata, err)
+	}
+	reader, err := withoutOldKey.OpenObject(testHashA)
+	if err != nil {
+		t.Fatalf("open rewrapped object without the old key: %v", err)
+	}
+	defer func() { _ = reader.Close() }()
+	if checksum, err := reader.Checksum(); err != nil || checksum != oldMetadata.Checksum {
+		t.Errorf("checksum of rewrapped object = %v, %v", checksum, err)
+	}
+}
+
+func TestChecksumsOfEncryptedObjectsAreKeyed(t *testing.T) {
+	handler := newEncryptingHandler(t, t.TempDir(), testKey("k1", 1))
+	content := []byte("equal content")
+
+	_, first, err := handler.EncodeObject(content, Metadata{})
+	if err != nil {
+		t.Fatalf("encode object: %v", err)
+	}
+	_, second, err := handler.EncodeObject(content, Metadata{})
+	if err != nil {
+		t.Fatalf("encode object: %v", err)
+	}
+
+	// the checksums must not reveal that the objects are equal
+	if first.Checksum == second.Checksum || first.Checksum == Checksum(content) {
+		t.Errorf("checksums of encrypted objects aren't keyed: %v, %v", first.Checksum, second.Checksum)
+	}
+	if first.MD5 != "" || second.MD5 != "" {
+		t.Errorf("md5 digests of encrypted objects are stored: %v, %v", first.MD5, second.MD5)
+	}
+}
@@ -13,12 +13,6 @@ import (
 // no access for anyone else. See https://wiki.ubuntuusers.de/chmod/ for details.
 const persistedFileMode fs.FileMode = 0400
 
-// notPersistedFileMode CAN (!) be set on a file to signal that it is not persisted. Note, however, that os.Create
-// creates files with mode 0666. Use persistedFileMode to check weather a file is persisted.
-// 0600 means read and write access for the current user and no access for anyone else. See
-// https://wiki.ubuntuusers.de/chmod/ for details.
-const notPersistedFileMode fs.FileMode = 0600
-
 func fileExists(path string) (exists bool, err error) {
 	// https://stackoverflow.com/questions/12518876/how-to-check-if-a-file-exists-in-go
 	_, err = os.Stat(path)
@@ -56,9 +50,37 @@ func isMarkedAsPersisted(fileInfo fs.FileInfo) bool {
 	return fileInfo.Mode() == persistedFileMode
 }
 
-func removePersistedFlag(objectPath string) error {
-	if err := os.Chmod(objectPath, notPersistedFileMode); err != nil {
-		return fmt.Errorf("chmod %v: %w", notPersistedFileMode, err)
+// syncFolder flushes the directory entries of the folder to disk. Files that have been created or renamed might get
+// lost after a crash otherwise.
+func syncFolder(folder string) error {
+	openedFolder, err := os.Open(folder)
+	if err != nil {
+		return fmt.Errorf("open %v: %w", folder, err)
+	}
+	defer func() { _ = openedFolder.Close() }()
+
+	if err := openedFolder.Sync(); err != nil {
+		return fmt.Errorf("sync %v: %w", folder, err)
+	}
+
+	return nil
+}
+
+func writeFileAndSync(path string, content []byte) error {
+	createdFile, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("create file: %w", err)
+	}
+	if _, err := createdFile.Write(content); err != nil {
+		_ = createdFile.Close()
+		return fmt.Errorf("write to file: %w", err)
+	}
+	if err := createdFile.Sync(); err != nil {
+		_ = createdFile.Close()
+		return fmt.Errorf("sync file: %w", err)
+	}
+	if err := createdFile.Close(); err != nil {
+		return fmt.Errorf("close file: %w", err)
 	}
 
 	return nil
@@ -1,9 +1,10 @@
 package file
 
 import (
+	"bytes"
+	"context"
 	"errors"
 	"fmt"
-	"go.uber.org/multierr"
 	"go.uber.org/zap"
 	"os"
 	"path/filepath"
@@ -14,12 +15,29 @@ var (
 	errNoObjectHash        = errors.New("provided object hash is no object hash")
 )
 
+// Handler manages the objects of the node. The objects are stored by an ObjectStore; the tombstones are always stored
+// in files in the object folder. The content of objects is encoded before it is stored: it is compressed according
+// to the pool of the object and it is encrypted if master keys have been configured. Objects are encoded once by the
+// primary; the replicas store the encoded content without decoding it. The content is only decoded when it is read.
 type Handler struct {
+	store        ObjectStore
+	compression  map[string]string // pool -> compression algorithm
+	keyring      *Keyring          // nil if the objects aren't encrypted
+	names        *nameIndex
 	objectFolder string
 	sugar        *zap.SugaredLogger
 }
 
-func NewHandler(objectFolder string, sugar *zap.SugaredLogger) (*Handler, error) {
+// NewHandler creates a handler that stores the objects with the given backend (see BackendFile, BackendSegment and
+// BackendMemory). The objects of the pools in the compression map are compressed with the given algorithm. New
+// objects are encrypted with the current key of the keyring unless the keyring is nil.
+func NewHandler(backend string, objectFolder string, compression map[string]string, keyring *Keyring, sugar *zap.SugaredLogger) (*Handler, error) {
+	for pool, algorithm := range compression {
+		if err := validateCompression(algorithm); err != nil {
+			return nil, fmt.Errorf("compression of pool %v: %w", pool, err)
+		}
+	}
+
 	absFolder, err := filepath.Abs(objectFolder)
 	if err != nil {
 		err = fmt.Errorf("convert [objectFolder=%v] to abs path: %w", objectFolder, err)
@@ -33,12 +51,28 @@ func NewHandler(objectFolder string, sugar *zap.SugaredLogger) (*Handler, error)
 		return nil, err
 	}
 
-	if err := purgeObjects(objectFolder, sugar); err != nil {
-		err = fmt.Errorf("purge not persisted objects: %w", err)
+	tombstoneFolder := filepath.Join(absFolder, relativeTombstoneFolder)
+	if err := os.MkdirAll(tombstoneFolder, 0700); err != nil {
+		err = fmt.Errorf("create [tombstoneFolder=%v]: %w", tombstoneFolder, err)
 		return nil, err
 	}
 
+	store, err := newStore(backend, absFolder, sugar)
+	if err != nil {
+		err = fmt.Errorf("create object store: %w", err)
+		return nil, err
+	}
+
+	objects, err := store.List()
+	if err != nil {
+		return nil, fmt.Errorf("list objects for the name index: %w", err)
+	}
+
 	handler := &Handler{
+		store:        store,
+		compression:  compression,
+		keyring:      keyring,
+		names:        newNameIndex(objects),
 		objectFolder: absFolder,
 		sugar:        sugar,
 	}
@@ -47,138 +81,234 @@ func NewHandler(objectFolder string, sugar *zap.SugaredLogger) (*Handler, error)
 }
 
 func (h *Handler) ObjectExists(objectHash string) (exists bool, err error) {
-	objectPath, err := getObjectPath(objectHash, h.objectFolder)
-	if err != nil {
-		err = fmt.Errorf("get object path: %w", err)
-		return false, err
+	return h.store.Exists(objectHash)
+}
+
+// PersistObject creates the object and its metadata. The content must have been encoded by EncodeObject, either by
+// this node or by the primary of the object. Nothing is persisted if the context is canceled before the object is
+// complete.
+func (h *Handler) PersistObject(ctx context.Context, objectHash string, storedContent []byte, metadata Metadata) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := h.checkDecodable(metadata); err != nil {
+		return err
 	}
 
-	exists, err = fileExists(objectPath)
-	if err != nil {
-		err = fmt.Errorf("check file existence: %w", err)
-		return false, err
+	if err := h.store.Create(ctx, objectHash, bytes.NewReader(storedContent), metadata); err != nil {
+		return err
 	}
+	h.names.put(objectHash, metadata.Name)
 
-	return exists, nil
+	return nil
 }
 
-func (h *Handler) PersistObject(objectHash string, objectContent []byte) error {
-	objectPath, err := getObjectPath(objectHash, h.objectFolder)
+// ReplaceObject atomically replaces the content of an existing object with content that has been encoded by
+// EncodeObject. Running reads that have already opened the object will still read the old content.
+func (h *Handler) ReplaceObject(objectHash string, storedContent []byte, metadata Metadata) error {
+	if err := h.checkDecodable(metadata); err != nil {
+		return err
+	}
+
+	if err := h.store.Replace(objectHash, bytes.NewReader(storedContent), metadata); err != nil {
+		return err
+	}
+	h.names.put(objectHash, metadata.Name)
+
+	return nil
+}
+
+// RewrapObject wraps the data key of an encrypted object with the current master key. Only the metadata is rewritten;
+// the content and its checksum stay the same. It returns false if the object isn't encrypted or if it already uses the
+// current master key. Once all objects have been rewrapped, the old master keys can be removed.
+func (h *Handler) RewrapObject(objectHash string) (bool, error) {
+	info, err := h.store.Stat(objectHash)
 	if err != nil {
-		return fmt.Errorf("get object path: %w", err)
+		return false, err
+	}
+	metadata := info.Metadata
+	if !h.NeedsRewrap(metadata) {
+		return false, nil
 	}
 
-	fileExists, err := fileExists(objectPath)
+	metadata.KeyID, metadata.WrappedKey, err = h.keyring.rewrap(metadata.KeyID, metadata.WrappedKey)
 	if err != nil {
-		return fmt.Errorf("check file existence: %w", err)
+		return false, fmt.Errorf("rewrap data key: %w", err)
 	}
-	if fileExists {
-		return ErrObjectAlreadyExists
+	if err := h.store.ReplaceMetadata(objectHash, metadata); err != nil {
+		return false, fmt.Errorf("replace metadata: %w", err)
 	}
 
-	// the object doesn't exit
+	return true, nil
+}
 
-	if err := createObject(objectPath, objectContent, h.sugar); err == nil {
+// NeedsRewrap returns true if the data key of the object is wrapped with an old master key.
+func (h *Handler) NeedsRewrap(metadata Metadata) bool {
+	return metadata.KeyID != "" && h.keyring != nil && metadata.KeyID != h.keyring.currentID
+}
+
+// checkDecodable makes sure that objects are only stored if this node can decrypt them.
+func (h *Handler) checkDecodable(metadata Metadata) error {
+	if metadata.KeyID == "" {
 		return nil
 	}
+	if h.keyring == nil {
+		return fmt.Errorf("%w: no master keys have been configured", ErrUnknownMasterKey)
+	}
+	if _, ok := h.keyring.keys[metadata.KeyID]; !ok {
+		return fmt.Errorf("%w: %v", ErrUnknownMasterKey, metadata.KeyID)
+	}
+	return nil
+}
 
-	// the object couldn't be created
-	err = fmt.Errorf("create object: %w", err)
-
-	// the object couldn't be persisted in a file and the file might be in an inconsistent state. Remove the file
-	// (if it exists) to ensure a consistent state.
-	if removeErr := os.Remove(objectPath); removeErr != nil && !errors.Is(removeErr, os.ErrNotExist) {
-		removeErr = fmt.Errorf("remove object file to ensure a consistent state: %w", removeErr)
-		err = multierr.Append(err, removeErr)
+// EncodeObject returns the content that is stored and completes the metadata. The content is compressed first and
+// encrypted afterwards; it is stored uncompressed if the compression doesn't shrink it.
+func (h *Handler) EncodeObject(objectContent []byte, metadata Metadata) ([]byte, Metadata, error) {
+	metadata.Checksum = Checksum(objectContent)
+	metadata.MD5 = md5Of(objectContent)
+	metadata.Size = int64(len(objectContent))
+	metadata.Compression = ""
+	metadata.KeyID = ""
+	metadata.WrappedKey = ""
+
+	storedContent := objectContent
+	if algorithm := h.compression[metadata.Pool]; algorithm != "" {
+		compressedContent, err := compress(algorithm, objectContent)
+		if err != nil {
+			return nil, Metadata{}, fmt.Errorf("compress with %v: %w", algorithm, err)
+		}
+		if len(compressedContent) < len(objectContent) {
+			storedContent = compressedContent
+			metadata.Compression = algorithm
+		}
 	}
 
-	return err
-}
+	if h.keyring == nil {
+		return storedContent, metadata, nil
+	}
 
-func (h *Handler) GetObjectPath(objectHash string) (string, error) {
-	objectPath, err := getObjectPath(objectHash, h.objectFolder)
+	dataKey, keyID, wrappedKey, err := h.keyring.newDataKey()
 	if err != nil {
-		return "", fmt.Errorf("get object path: %w", err)
+		return nil, Metadata{}, err
 	}
-
-	objectExists, err := fileExists(objectPath)
+	encryptedContent, err := encryptContent(dataKey, storedContent)
 	if err != nil {
-		return "", fmt.Errorf("file exists: %w", err)
+		return nil, Metadata{}, fmt.Errorf("encrypt: %w", err)
 	}
-
-	if objectExists {
-		return objectPath, nil
-	} else {
-		return "", nil
+	metadata.KeyID = keyID
+	metadata.WrappedKey = wrappedKey
+	metadata.MD5 = ""
+	if metadata.Checksum, err = digestOf(newKeyedDigest(dataKey), bytes.NewReader(objectContent)); err != nil {
+		return nil, Metadata{}, fmt.Errorf("compute keyed checksum: %w", err)
 	}
+
+	return encryptedContent, metadata, nil
+}
+
+// DecodeObject returns a reader of the clear-text content of an encoded object, e.g. of a copy that has been fetched
+// from another node.
+func (h *Handler) DecodeObject(storedContent []byte, metadata Metadata) (*ObjectReader, error) {
+	return h.newObjectReader(readSeekNopCloser{bytes.NewReader(storedContent)}, int64(len(storedContent)), metadata)
 }
 
 func (h *Handler) DeleteObject(objectHash string) error {
-	objectPath, err := getObjectPath(objectHash, h.objectFolder)
+	if err := h.store.Delete(objectHash); err != nil {
+		return err
+	}
+	h.names.remove(objectHash)
+
+	return nil
+}
+
+// GetMetadata returns ErrNoMetadata if the object doesn't exist or if it has been created without metadata.
+func (h *Handler) GetMetadata(objectHash string) (Metadata, error) {
+	info, err := h.store.Stat(objectHash)
+	if errors.Is(err, os.ErrNotExist) {
+		return Metadata{}, ErrNoMetadata
+	}
 	if err != nil {
-		return fmt.Errorf("get object path: %w", err)
+		return Metadata{}, err
 	}
+	if info.Metadata == (Metadata{}) {
+		return Metadata{}, ErrNoMetadata
+	}
+
+	return info.Metadata, nil
+}
 
-	err = os.Remove(objectPath)
+// StatObject returns an error that wraps os.ErrNotExist if the object doesn't exist. The size is the size of the
+// clear-text content.
+func (h *Handler) StatObject(objectHash string) (ObjectInfo, error) {
+	info, err := h.store.Stat(objectHash)
 	if err != nil {
-		err = fmt.Errorf("remove object: %w", err)
-		return err
+		return ObjectInfo{}, err
 	}
 
-	return nil
+	return info.decoded(), nil
 }
 
-func (h *Handler) RemovePersistedFlag(objectHash string) error {
-	objectPath, err := getObjectPath(objectHash, h.objectFolder)
+// OpenObject opens the object for reading. The reader returns the clear-text content. The caller is responsible for
+// closing the reader.
+func (h *Handler) OpenObject(objectHash string) (*ObjectReader, error) {
+	stored, info, err := h.store.Open(objectHash)
 	if err != nil {
-		return fmt.Errorf("get object path: %w", err)
+		return nil, err
 	}
 
-	if err := removePersistedFlag(objectPath); err != nil {
-		return fmt.Errorf("remove persisted flag: %w", err)
+	reader, err := h.newObjectReader(stored, info.Size, info.Metadata)
+	if err != nil {
+		_ = stored.Close()
+		return nil, fmt.Errorf("decode object: %w", err)
 	}
 
-	return nil
+	return reader, nil
 }
 
-func purgeObjects(objectFolder string, sugar *zap.SugaredLogger) error {
-	dirEntries, err := os.ReadDir(objectFolder)
+// ListObjects returns all persisted objects. The sizes are the sizes of the clear-text content.
+func (h *Handler) ListObjects() ([]ObjectInfo, error) {
+	objects, err := h.store.List()
 	if err != nil {
-		return fmt.Errorf("list files in object dir: %w", err)
+		return nil, err
 	}
 
-	var merr error
-	for _, entry := range dirEntries {
-		if entry.IsDir() {
-			continue
-		}
+	for i := range objects {
+		objects[i] = objects[i].decoded()
+	}
 
-		info, err := entry.Info()
+	return objects, nil
+}
+
+// ListNamedObjects returns up to limit persisted objects whose name starts with prefix and is greater than
+// startAfter, sorted by name. The names are read from an index in memory; objects without name aren't returned.
+func (h *Handler) ListNamedObjects(prefix string, startAfter string, limit int) []NamedObject {
+	return h.names.after(prefix, startAfter, limit)
+}
+
+// DiskUsage returns the number of bytes that are used by the files in the object folder, including tombstones and
+// the space of deleted objects that hasn't been reclaimed by the backend yet.
+func (h *Handler) DiskUsage() (int64, error) {
+	var usage int64
+	err := filepath.WalkDir(h.objectFolder, func(path string, entry os.DirEntry, err error) error {
 		if err != nil {
-			err = fmt.Errorf("read file info of object %v: %w", entry.Name(), err)
-			merr = multierr.Append(merr, err)
-			continue
+			if errors.Is(err, os.ErrNotExist) {
+				return nil // the file has been deleted in the meantime
+			}
+			return err
 		}
-
-		if isMarkedAsPersisted(info) {
-			continue
+		if entry.IsDir() {
+			return nil
 		}
 
-		path := filepath.Join(objectFolder, entry.Name())
-		sugar.Infow("Deleting object that is not marked as persisted.",
-			"object", entry.Name(),
-			"path", path,
-		)
-
-		if err := os.Remove(path); err != nil {
-			err = fmt.Errorf("remove %v: %w", path, err)
-			merr = multierr.Append(merr, err)
+		info, err := entry.Info()
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
 		}
-	}
-
-	if merr != nil {
-		return fmt.Errorf("process files: %w", err)
-	}
+		if err != nil {
+			return err
+		}
+		usage += info.Size()
+		return nil
+	})
 
-	return nil
+	return usage, err
 }
@@ -0,0 +1,157 @@
+package file
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+type memoryObject struct {
+	content  []byte
+	metadata Metadata
+	modTime  time.Time
+}
+
+// memoryStore keeps all objects in memory. It is meant for tests and for nodes whose data doesn't have to survive a
+// restart.
+type memoryStore struct {
+	mu      sync.RWMutex
+	objects map[string]memoryObject
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{objects: map[string]memoryObject{}}
+}
+
+func (s *memoryStore) Exists(objectHash string) (bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	_, ok := s.objects[objectHash]
+	return ok, nil
+}
+
+func (s *memoryStore) Create(ctx context.Context, objectHash string, content io.Reader, metadata Metadata) error {
+	if exists, _ := s.Exists(objectHash); exists {
+		return ErrObjectAlreadyExists
+	}
+
+	objectContent, err := io.ReadAll(content)
+	if err != nil {
+		return fmt.Errorf("read content: %w", err)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.objects[objectHash]; ok {
+		return ErrObjectAlreadyExists
+	}
+	s.objects[objectHash] = memoryObject{content: objectContent, metadata: metadata, modTime: time.Now()}
+
+	return nil
+}
+
+func (s *memoryStore) Replace(objectHash string, content io.Reader, metadata Metadata) error {
+	objectContent, err := io.ReadAll(content)
+	if err != nil {
+		return fmt.Errorf("read content: %w", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.objects[objectHash]; !ok {
+		return fmt.Errorf("replace %v: %w", objectHash, os.ErrNotExist)
+	}
+	// the old content isn't modified; readers that have opened the object keep their slice
+	s.objects[objectHash] = memoryObject{content: objectContent, metadata: metadata, modTime: time.Now()}
+
+	return nil
+}
+
+func (s *memoryStore) ReplaceMetadata(objectHash string, metadata Metadata) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	object, ok := s.objects[objectHash]
+	if !ok {
+		return fmt.Errorf("replace metadata of %v: %w", objectHash, os.ErrNotExist)
+	}
+	object.metadata = metadata
+	s.objects[objectHash] = object
+
+	return nil
+}
+
+// readSeekNopCloser adds a Close method that does nothing to a bytes.Reader.
+type readSeekNopCloser struct {
+	*bytes.Reader
+}
+
+func (readSeekNopCloser) Close() error {
+	return nil
+}
+
+func (s *memoryStore) Open(objectHash string) (io.ReadSeekCloser, ObjectInfo, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	object, ok := s.objects[objectHash]
+	if !ok {
+		return nil, ObjectInfo{}, fmt.Errorf("open %v: %w", objectHash, os.ErrNotExist)
+	}
+
+	return readSeekNopCloser{bytes.NewReader(object.content)}, object.info(objectHash), nil
+}
+
+func (s *memoryStore) Delete(objectHash string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.objects[objectHash]; !ok {
+		return fmt.Errorf("delete %v: %w", objectHash, os.ErrNotExist)
+	}
+	delete(s.objects, objectHash)
+
+	return nil
+}
+
+func (s *memoryStore) List() ([]ObjectInfo, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var objects []ObjectInfo
+	for objectHash, object := range s.objects {
+		objects = append(objects, object.info(objectHash))
+	}
+	sort.Slice(objects, func(i, j int) bool {
+		return objects[i].Hash < objects[j].Hash
+	})
+
+	return objects, nil
+}
+
+func (s *memoryStore) Stat(objectHash string) (ObjectInfo, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	object, ok := s.objects[objectHash]
+	if !ok {
+		return ObjectInfo{}, fmt.Errorf("stat %v: %w", objectHash, os.ErrNotExist)
+	}
+
+	return object.info(objectHash), nil
+}
+
+func (o memoryObject) info(objectHash string) ObjectInfo {
+	return ObjectInfo{Hash: objectHash, Size: int64(len(o.content)), ModTime: o.modTime, Metadata: o.metadata}
+}
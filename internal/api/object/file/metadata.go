@@ -0,0 +1,137 @@
+package file
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// relativeMetadataFolder is the folder (relative to the object folder) that contains one metadata file per object.
+// The metadata file has the same name as the object.
+const relativeMetadataFolder = "meta"
+
+// temporaryFileSuffix is appended to the name of files that are about to replace an existing file.
+const temporaryFileSuffix = ".tmp"
+
+var ErrNoMetadata = errors.New("object has no metadata")
+
+// Metadata is persisted next to every object when the object is created.
+type Metadata struct {
+	// Checksum is the hex encoded sha256 digest of the clear-text object content. It serves as reference when the
+	// content is verified. The checksum is always calculated by the file handler. The checksum of encrypted objects
+	// is an HMAC keyed with their data key; a plain digest would reveal which objects have equal content.
+	Checksum string `json:",omitempty"`
+	// MD5 is the hex encoded md5 digest of the clear-text content of unencrypted objects. S3 clients expect it as
+	// entity tag. Encrypted objects don't have it because it would reveal which objects have equal content.
+	MD5   string `json:",omitempty"`
+	Pool  string `json:",omitempty"`
+	Owner string `json:",omitempty"` // name of the user that has created the object; empty without authentication
+	// Name is the name of the object if the client has sent it. Only named objects are listed. The name is stored in
+	// clear-text, even if the content is encrypted.
+	Name string `json:",omitempty"`
+	// Expires is the unix time in seconds at which the object expires. Expired objects read as deleted and are deleted
+	// by the primary. The object doesn't expire if it is 0.
+	Expires int64 `json:",omitempty"`
+
+	// Compression is the algorithm that has been used to compress the stored content; the content is stored
+	// uncompressed if it is empty. Size is the size of the uncompressed content. Both are set by the file handler.
+	Compression string `json:",omitempty"`
+	Size        int64  `json:",omitempty"`
+
+	// KeyID is the id of the master key that wraps the data key of the object; the content is stored unencrypted if
+	// it is empty. WrappedKey is the base64 encoded data key, encrypted with the master key. Both are set by the file
+	// handler.
+	KeyID      string `json:",omitempty"`
+	WrappedKey string `json:",omitempty"`
+}
+
+// Expired returns true if the object has expired at the given time.
+func (m Metadata) Expired(now time.Time) bool {
+	return m.Expires != 0 && now.Unix() >= m.Expires
+}
+
+// Checksum calculates the digest that is stored in Metadata.Checksum of unencrypted objects.
+func Checksum(content []byte) string {
+	digest := sha256.Sum256(content)
+	return hex.EncodeToString(digest[:])
+}
+
+// md5Of calculates the digest that is stored in Metadata.MD5 of unencrypted objects.
+func md5Of(content []byte) string {
+	digest := md5.Sum(content)
+	return hex.EncodeToString(digest[:])
+}
+
+// digestOf returns the hex encoded digest of everything that can be read from the reader.
+func digestOf(digest hash.Hash, reader io.Reader) (string, error) {
+	if _, err := io.Copy(digest, reader); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(digest.Sum(nil)), nil
+}
+
+// diskMetadata is the content of a metadata file of the disk store. Replacement is the name of the file with the
+// content of an object whose replacement has been committed but not finished yet; the content is stored in the file
+// named after the object hash if it is empty.
+type diskMetadata struct {
+	Metadata
+	Replacement string `json:",omitempty"`
+}
+
+func getMetadataPath(objectHash string, objectFolder string) (string, error) {
+	objectPath, err := getObjectPath(objectHash, filepath.Join(objectFolder, relativeMetadataFolder))
+	if err != nil {
+		return "", err
+	}
+
+	return objectPath, nil
+}
+
+func writeMetadata(metadataPath string, metadata diskMetadata) error {
+	encodedMetadata, err := json.Marshal(metadata)
+	if err != nil {
+		return fmt.Errorf("json encode: %w", err)
+	}
+
+	createdFile, err := os.Create(metadataPath)
+	if err != nil {
+		return fmt.Errorf("create file: %w", err)
+	}
+	defer func() { _ = createdFile.Close() }()
+
+	if _, err := createdFile.Write(encodedMetadata); err != nil {
+		return fmt.Errorf("write metadata to file: %w", err)
+	}
+
+	if err := markAsPersisted(createdFile); err != nil {
+		return fmt.Errorf("mark as persisted: %w", err)
+	}
+
+	return nil
+}
+
+func readMetadata(metadataPath string) (diskMetadata, error) {
+	encodedMetadata, err := os.ReadFile(metadataPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return diskMetadata{}, ErrNoMetadata
+	}
+	if err != nil {
+		return diskMetadata{}, fmt.Errorf("read %v: %w", metadataPath, err)
+	}
+
+	var metadata diskMetadata
+	if err := json.Unmarshal(encodedMetadata, &metadata); err != nil {
+		return diskMetadata{}, fmt.Errorf("parse content of %v: %w", metadataPath, err)
+	}
+
+	return metadata, nil
+}
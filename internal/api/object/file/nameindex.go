@@ -0,0 +1,105 @@
+package file
+
+import (
+	"sort"
+	"strings"
+	"sync"
+)
+
+// NamedObject is an entry of the name index.
+type NamedObject struct {
+	Name string
+	Hash string
+}
+
+// nameIndex keeps the names of the persisted objects sorted, so that a listing doesn't have to read the metadata of
+// every object. Objects without name aren't indexed. The index only knows which objects are persisted; tombstones and
+// the expiry are checked when the objects are listed.
+type nameIndex struct {
+	mutex   sync.RWMutex
+	objects []NamedObject     // sorted by name
+	names   map[string]string // hash -> name
+}
+
+func newNameIndex(objects []ObjectInfo) *nameIndex {
+	index := &nameIndex{names: map[string]string{}}
+	for _, info := range objects {
+		if info.Metadata.Name == "" {
+			continue
+		}
+		index.names[info.Hash] = info.Metadata.Name
+		index.objects = append(index.objects, NamedObject{Name: info.Metadata.Name, Hash: info.Hash})
+	}
+	sort.Slice(index.objects, func(i, j int) bool { return index.objects[i].less(index.objects[j]) })
+
+	return index
+}
+
+func (o NamedObject) less(other NamedObject) bool {
+	if o.Name != other.Name {
+		return o.Name < other.Name
+	}
+	return o.Hash < other.Hash
+}
+
+// put indexes the object under the given name. An object that has already been indexed under another name is moved.
+func (n *nameIndex) put(objectHash string, name string) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	if oldName, ok := n.names[objectHash]; ok {
+		if oldName == name {
+			return
+		}
+		n.removeLocked(objectHash, oldName)
+	}
+	if name == "" {
+		return
+	}
+
+	entry := NamedObject{Name: name, Hash: objectHash}
+	i := sort.Search(len(n.objects), func(i int) bool { return !n.objects[i].less(entry) })
+	n.objects = append(n.objects, NamedObject{})
+	copy(n.objects[i+1:], n.objects[i:])
+	n.objects[i] = entry
+	n.names[objectHash] = name
+}
+
+func (n *nameIndex) remove(objectHash string) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	if name, ok := n.names[objectHash]; ok {
+		n.removeLocked(objectHash, name)
+	}
+}
+
+func (n *nameIndex) removeLocked(objectHash string, name string) {
+	entry := NamedObject{Name: name, Hash: objectHash}
+	i := sort.Search(len(n.objects), func(i int) bool { return !n.objects[i].less(entry) })
+	if i < len(n.objects) && n.objects[i] == entry {
+		n.objects = append(n.objects[:i], n.objects[i+1:]...)
+	}
+	delete(n.names, objectHash)
+}
+
+// after returns up to limit objects whose name starts with prefix and is greater than startAfter, sorted by name.
+func (n *nameIndex) after(prefix string, startAfter string, limit int) []NamedObject {
+	n.mutex.RLock()
+	defer n.mutex.RUnlock()
+
+	i := sort.Search(len(n.objects), func(i int) bool {
+		name := n.objects[i].Name
+		return name >= prefix && name > startAfter
+	})
+
+	objects := []NamedObject{}
+	for ; i < len(n.objects) && len(objects) < limit; i++ {
+		if !strings.HasPrefix(n.objects[i].Name, prefix) {
+			break // the names with the prefix are contiguous
+		}
+		objects = append(objects, n.objects[i])
+	}
+
+	return objects
+}
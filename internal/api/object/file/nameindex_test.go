@@ -0,0 +1,45 @@
+package file
+
+import (
+	"go.uber.org/zap"
+	"reflect"
+	"testing"
+)
+
+func TestNameIndex(t *testing.T) {
+	folder := t.TempDir()
+	handler, err := NewHandler(BackendFile, folder, nil, nil, zap.NewNop().Sugar())
+	if err != nil {
+		t.Fatalf("create handler: %v", err)
+	}
+
+	persistObject(t, handler, testHashA, "a", Metadata{Name: "photos/b"})
+	persistObject(t, handler, testHashB, "b", Metadata{Name: "photos/a"})
+	want := []NamedObject{{Name: "photos/a", Hash: testHashB}, {Name: "photos/b", Hash: testHashA}}
+	if named := handler.ListNamedObjects("photos/", "", 10); !reflect.DeepEqual(named, want) {
+		t.Errorf("ListNamedObjects() = %+v", named)
+	}
+
+	// the index is rebuilt from the persisted objects
+	restarted, err := NewHandler(BackendFile, folder, nil, nil, zap.NewNop().Sugar())
+	if err != nil {
+		t.Fatalf("create handler: %v", err)
+	}
+	if named := restarted.ListNamedObjects("photos/", "photos/a", 10); !reflect.DeepEqual(named, want[1:]) {
+		t.Errorf("ListNamedObjects() after restart = %+v", named)
+	}
+
+	content, metadata, err := handler.EncodeObject([]byte("c"), Metadata{Name: "videos/c"})
+	if err != nil {
+		t.Fatalf("encode object: %v", err)
+	}
+	if err := handler.ReplaceObject(testHashA, content, metadata); err != nil {
+		t.Fatalf("replace object: %v", err)
+	}
+	if named := handler.ListNamedObjects("", "", 1); !reflect.DeepEqual(named, want[:1]) {
+		t.Errorf("ListNamedObjects() with limit = %+v", named)
+	}
+	if named := handler.ListNamedObjects("photos/", "", 10); !reflect.DeepEqual(named, want[:1]) {
+		t.Errorf("ListNamedObjects() after replacement = %+v", named)
+	}
+}
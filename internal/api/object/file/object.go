@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"github.com/rstdm/mini-ceph/internal/api/object/hash"
 	"go.uber.org/zap"
+	"io"
 	"os"
 	"path/filepath"
 )
@@ -21,14 +22,14 @@ func getObjectPath(objectHash string, objectFolder string) (string, error) {
 	return objectPath, nil
 }
 
-func createObject(objectPath string, objectContent []byte, sugar *zap.SugaredLogger) error {
+func createObject(objectPath string, content io.Reader, sugar *zap.SugaredLogger) error {
 	createdFile, err := os.Create(objectPath)
 	if err != nil {
 		return fmt.Errorf("create file: %w", err)
 	}
 	defer CloseAndLogError(createdFile, objectPath, sugar)
 
-	if _, err := createdFile.Write(objectContent); err != nil {
+	if _, err := io.Copy(createdFile, content); err != nil {
 		return fmt.Errorf("write content to file: %w", err)
 	}
 
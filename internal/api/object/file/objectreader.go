@@ -0,0 +1,110 @@
+package file
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+)
+
+// ObjectReader reads the content of an object. The stored content is decrypted and decompressed on the fly, so Read
+// and Seek refer to the clear-text content. The encoded content is available as well: clients that understand the
+// compression receive the compressed content and the other nodes of the cluster receive the content exactly as it is
+// stored.
+type ObjectReader struct {
+	stored       io.ReadSeekCloser
+	metadata     Metadata
+	compressed   io.ReadSeeker        // the decrypted content; it is still compressed
+	decoded      io.ReadSeeker        // the clear-text content
+	decompressor *decompressingReader // nil if the content isn't compressed
+	dataKey      []byte               // nil if the content isn't encrypted
+}
+
+func (h *Handler) newObjectReader(stored io.ReadSeekCloser, storedSize int64, metadata Metadata) (*ObjectReader, error) {
+	reader := &ObjectReader{stored: stored, metadata: metadata, compressed: stored}
+
+	if metadata.KeyID != "" {
+		if h.keyring == nil {
+			return nil, fmt.Errorf("%w: no master keys have been configured", ErrUnknownMasterKey)
+		}
+		dataKey, err := h.keyring.unwrap(metadata.KeyID, metadata.WrappedKey)
+		if err != nil {
+			return nil, err
+		}
+		aead, err := newAEAD(dataKey)
+		if err != nil {
+			return nil, fmt.Errorf("create cipher of data key: %w", err)
+		}
+		reader.compressed = newDecryptingReader(stored, storedSize, aead)
+		reader.dataKey = dataKey
+	}
+
+	reader.decoded = reader.compressed
+	if metadata.Compression != "" {
+		reader.decompressor = newDecompressingReader(reader.compressed, metadata.Compression, metadata.Size)
+		reader.decoded = reader.decompressor
+	}
+
+	return reader, nil
+}
+
+func (r *ObjectReader) Read(p []byte) (int, error) {
+	return r.decoded.Read(p)
+}
+
+func (r *ObjectReader) Seek(offset int64, whence int) (int64, error) {
+	return r.decoded.Seek(offset, whence)
+}
+
+// Checksum reads the remaining clear-text content and returns its checksum in the format of Metadata.Checksum.
+func (r *ObjectReader) Checksum() (string, error) {
+	return r.ChecksumOf(r)
+}
+
+// ChecksumOf returns the checksum of the clear-text content that is read from content, e.g. from a throttled wrapper
+// of the reader. The checksum of encrypted objects is keyed with their data key.
+func (r *ObjectReader) ChecksumOf(content io.Reader) (string, error) {
+	digest := sha256.New()
+	if r.dataKey != nil {
+		digest = newKeyedDigest(r.dataKey)
+	}
+	return digestOf(digest, content)
+}
+
+func (r *ObjectReader) Close() error {
+	if r.decompressor != nil {
+		_ = r.decompressor.Close()
+	}
+	return r.stored.Close()
+}
+
+// Encoding returns the compression algorithm of the content; it is empty if the content isn't compressed.
+func (r *ObjectReader) Encoding() string {
+	return r.metadata.Compression
+}
+
+// Encoded returns a reader of the decrypted but still compressed content. The clear-text content must not be read
+// afterwards.
+func (r *ObjectReader) Encoded() (io.ReadSeeker, error) {
+	if r.decompressor != nil {
+		_ = r.decompressor.Close()
+	}
+	if _, err := r.compressed.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	return r.compressed, nil
+}
+
+// Stored returns a reader of the content exactly as it is stored, i.e. compressed and encrypted. The other nodes
+// store this content together with the metadata without decoding it. The clear-text content must not be read
+// afterwards.
+func (r *ObjectReader) Stored() (io.ReadSeeker, error) {
+	if r.decompressor != nil {
+		_ = r.decompressor.Close()
+	}
+	if _, err := r.stored.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	return r.stored, nil
+}
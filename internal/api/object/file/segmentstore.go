@@ -0,0 +1,825 @@
+package file
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/rstdm/mini-ceph/internal/api/object/hash"
+	"go.uber.org/zap"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// relativeSegmentFolder is the folder (relative to the object folder) that contains the segments and the index
+	// of the segment store.
+	relativeSegmentFolder = "segments"
+	segmentFileSuffix     = ".seg"
+	segmentIndexFileName  = "index.json"
+
+	defaultSegmentSize         int64 = 64 << 20
+	segmentMaintenanceInterval       = time.Minute
+
+	// segments whose live records take up less than this fraction of the segment are compacted
+	compactionThreshold = 0.5
+
+	recordMagic      uint32 = 0x4d435352 // "MCSR"
+	recordHeaderSize        = 4 + 1 + 32 + 8 + 4 + 8
+	recordCRCSize           = 4
+	maxMetadataSize         = 1 << 20
+
+	recordPut    byte = 1
+	recordDelete byte = 2
+)
+
+var (
+	crcTable           = crc32.MakeTable(crc32.Castagnoli)
+	errCorruptedRecord = errors.New("corrupted record")
+)
+
+// recordLocation describes where the latest record of an object is stored.
+type recordLocation struct {
+	Segment       uint32
+	Offset        int64 // start of the record
+	Size          int64 // size of the whole record
+	ContentOffset int64
+	ContentLength int64
+	ModTime       time.Time
+	Metadata      Metadata
+}
+
+// segmentIndex is the on-disk snapshot of the index. All records before Offset in Segment (and all records of older
+// segments) are reflected by Objects; the remaining records are replayed on startup.
+type segmentIndex struct {
+	Segment uint32
+	Offset  int64
+	Objects map[string]recordLocation
+}
+
+type segmentInfo struct {
+	size      int64
+	liveBytes int64 // bytes of records that are referenced by the index
+}
+
+// segmentStore appends objects to large segment files instead of creating one file per object. Every record is
+// protected by a CRC; deletions append a delete record. Records that have been replaced or deleted are reclaimed by
+// compacting segments whose records are mostly dead. The index is kept in memory, persisted periodically and brought
+// up to date by replaying the newer records on startup. Torn records at the end of the last segment (e.g. after a
+// crash) are truncated.
+//
+// Record layout (little endian): magic uint32 | kind byte | object hash [32]byte | modTime int64 (unix nanoseconds) |
+// metadata length uint32 | content length uint64 | metadata (json) | content | CRC-32C of everything before.
+type segmentStore struct {
+	folder      string
+	segmentSize int64
+	sugar       *zap.SugaredLogger
+
+	mu         sync.RWMutex
+	index      map[string]recordLocation
+	segments   map[uint32]*segmentInfo
+	active     *os.File
+	activeID   uint32
+	activeSize int64
+	dirty      bool // the index has changed since the last snapshot
+
+	compactionMu sync.Mutex // serializes compactions
+
+	stop        chan struct{} // closed by Close to stop the maintenance
+	maintenance sync.WaitGroup
+	closeOnce   sync.Once
+}
+
+// newSegmentStore opens the store in the given folder. A maintenance interval of 0 disables background compaction
+// and index snapshots.
+func newSegmentStore(objectFolder string, segmentSize int64, maintenanceInterval time.Duration, sugar *zap.SugaredLogger) (*segmentStore, error) {
+	folder := filepath.Join(objectFolder, relativeSegmentFolder)
+	if err := os.MkdirAll(folder, 0700); err != nil {
+		return nil, fmt.Errorf("create [segmentFolder=%v]: %w", folder, err)
+	}
+
+	s := &segmentStore{
+		folder:      folder,
+		segmentSize: segmentSize,
+		sugar:       sugar,
+		index:       map[string]recordLocation{},
+		segments:    map[uint32]*segmentInfo{},
+		stop:        make(chan struct{}),
+	}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+
+	if maintenanceInterval > 0 {
+		s.maintenance.Add(1)
+		go s.maintain(maintenanceInterval)
+	}
+
+	return s, nil
+}
+
+func (s *segmentStore) segmentPath(id uint32) string {
+	return filepath.Join(s.folder, fmt.Sprintf("%08d%v", id, segmentFileSuffix))
+}
+
+// load restores the index from the snapshot and the segments and opens the active segment.
+func (s *segmentStore) load() error {
+	dirEntries, err := os.ReadDir(s.folder)
+	if err != nil {
+		return fmt.Errorf("list files in segment dir: %w", err)
+	}
+
+	var ids []uint32
+	for _, entry := range dirEntries {
+		rawID := strings.TrimSuffix(entry.Name(), segmentFileSuffix)
+		id, err := strconv.ParseUint(rawID, 10, 32)
+		if entry.IsDir() || rawID == entry.Name() || err != nil {
+			continue
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return fmt.Errorf("read file info of segment %v: %w", entry.Name(), err)
+		}
+		ids = append(ids, uint32(id))
+		s.segments[uint32(id)] = &segmentInfo{size: info.Size()}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	snapshot, err := s.readIndex()
+	if err != nil {
+		return fmt.Errorf("read index: %w", err)
+	}
+	for objectHash, location := range snapshot.Objects {
+		if _, ok := s.segments[location.Segment]; !ok {
+			s.sugar.Errorw("Index references a missing segment; the object is lost",
+				"object", objectHash, "segment", location.Segment)
+			continue
+		}
+		s.setLocation(objectHash, location)
+	}
+
+	for i, id := range ids {
+		if id < snapshot.Segment {
+			continue
+		}
+		offset := int64(0)
+		if id == snapshot.Segment {
+			offset = snapshot.Offset
+		}
+		if err := s.replay(id, offset, i == len(ids)-1); err != nil {
+			return fmt.Errorf("replay segment %v: %w", id, err)
+		}
+	}
+
+	if len(ids) == 0 {
+		return s.openSegment(1)
+	}
+	lastID := ids[len(ids)-1]
+	if s.segments[lastID].size >= s.segmentSize {
+		return s.openSegment(lastID + 1)
+	}
+	return s.openSegment(lastID)
+}
+
+func (s *segmentStore) readIndex() (segmentIndex, error) {
+	indexPath := filepath.Join(s.folder, segmentIndexFileName)
+	encodedIndex, err := os.ReadFile(indexPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return segmentIndex{}, nil // all segments are replayed
+	}
+	if err != nil {
+		return segmentIndex{}, fmt.Errorf("read %v: %w", indexPath, err)
+	}
+
+	var index segmentIndex
+	if err := json.Unmarshal(encodedIndex, &index); err != nil {
+		return segmentIndex{}, fmt.Errorf("parse content of %v: %w", indexPath, err)
+	}
+
+	return index, nil
+}
+
+// replay applies all records of the segment that start at or after the offset to the index.
+func (s *segmentStore) replay(id uint32, offset int64, isLastSegment bool) error {
+	segmentPath := s.segmentPath(id)
+	segmentFile, err := os.OpenFile(segmentPath, os.O_RDWR, 0)
+	if err != nil {
+		return fmt.Errorf("open %v: %w", segmentPath, err)
+	}
+	defer CloseAndLogError(segmentFile, segmentPath, s.sugar)
+
+	if _, err := segmentFile.Seek(offset, io.SeekStart); err != nil {
+		return fmt.Errorf("seek to offset %v: %w", offset, err)
+	}
+
+	reader := bufio.NewReader(segmentFile)
+	position := offset
+	for {
+		r, _, err := readRecord(reader, s.segments[id].size-position)
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil && isLastSegment {
+			// the node crashed while the record was written; the write hasn't been acknowledged
+			s.sugar.Warnw("Truncating incomplete record at the end of the segment",
+				"err", err, "segment", segmentPath, "offset", position)
+			if err := segmentFile.Truncate(position); err != nil {
+				return fmt.Errorf("truncate %v: %w", segmentPath, err)
+			}
+			s.segments[id].size = position
+			return nil
+		}
+		if err != nil {
+			// the following records can't be located anymore. Skipping them would serve outdated versions and
+			// resurrect deleted objects, so the segment has to be inspected before the store is used.
+			return fmt.Errorf("read record of sealed segment %v at offset %v: %w", segmentPath, position, err)
+		}
+
+		s.apply(r, id, position)
+		position += r.size
+	}
+}
+
+// record is a decoded record without its content.
+type record struct {
+	kind          byte
+	objectHash    string
+	modTime       time.Time
+	metadata      Metadata
+	contentOffset int64 // relative to the start of the record
+	contentLength int64
+	size          int64
+}
+
+// apply requires that the mutex has already been locked.
+func (s *segmentStore) apply(r record, segment uint32, offset int64) {
+	switch r.kind {
+	case recordPut:
+		s.setLocation(r.objectHash, recordLocation{
+			Segment:       segment,
+			Offset:        offset,
+			Size:          r.size,
+			ContentOffset: offset + r.contentOffset,
+			ContentLength: r.contentLength,
+			ModTime:       r.modTime,
+			Metadata:      r.metadata,
+		})
+	case recordDelete:
+		s.removeLocation(r.objectHash)
+	}
+}
+
+// setLocation requires that the mutex has already been locked.
+func (s *segmentStore) setLocation(objectHash string, location recordLocation) {
+	s.removeLocation(objectHash)
+	s.index[objectHash] = location
+	s.segments[location.Segment].liveBytes += location.Size
+	s.dirty = true
+}
+
+// removeLocation requires that the mutex has already been locked.
+func (s *segmentStore) removeLocation(objectHash string) {
+	if old, ok := s.index[objectHash]; ok {
+		s.segments[old.Segment].liveBytes -= old.Size
+		delete(s.index, objectHash)
+		s.dirty = true
+	}
+}
+
+// openSegment makes the segment the target of all appends. It requires that the mutex has already been locked (or
+// that the store isn't used concurrently yet).
+func (s *segmentStore) openSegment(id uint32) error {
+	segmentPath := s.segmentPath(id)
+	segmentFile, err := os.OpenFile(segmentPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("open %v: %w", segmentPath, err)
+	}
+	info, err := segmentFile.Stat()
+	if err != nil {
+		_ = segmentFile.Close()
+		return fmt.Errorf("stat %v: %w", segmentPath, err)
+	}
+	if err := syncFolder(s.folder); err != nil {
+		_ = segmentFile.Close()
+		return fmt.Errorf("sync segment folder: %w", err)
+	}
+
+	if s.active != nil {
+		CloseAndLogError(s.active, s.segmentPath(s.activeID), s.sugar)
+	}
+	if _, ok := s.segments[id]; !ok {
+		s.segments[id] = &segmentInfo{}
+	}
+	s.active = segmentFile
+	s.activeID = id
+	s.activeSize = info.Size()
+	s.segments[id].size = info.Size()
+
+	return nil
+}
+
+// append durably writes the record to the active segment and returns its location. It requires that the mutex has
+// already been locked.
+func (s *segmentStore) append(kind byte, objectHash string, modTime time.Time, metadata Metadata, content []byte) (recordLocation, error) {
+	encodedRecord, r, err := encodeRecord(kind, objectHash, modTime, metadata, content)
+	if err != nil {
+		return recordLocation{}, fmt.Errorf("encode record: %w", err)
+	}
+
+	if s.activeSize > 0 && s.activeSize+r.size > s.segmentSize {
+		if err := s.active.Sync(); err != nil {
+			return recordLocation{}, fmt.Errorf("sync full segment: %w", err)
+		}
+		if err := s.openSegment(s.activeID + 1); err != nil {
+			return recordLocation{}, fmt.Errorf("open next segment: %w", err)
+		}
+	}
+
+	if _, err := s.active.Write(encodedRecord); err != nil {
+		// a partial record would hide all following records from the replay
+		if truncateErr := s.active.Truncate(s.activeSize); truncateErr != nil {
+			s.sugar.Errorw("Failed to remove partial record", "err", truncateErr, "segment", s.activeID)
+		}
+		return recordLocation{}, fmt.Errorf("write record: %w", err)
+	}
+	if err := s.active.Sync(); err != nil {
+		return recordLocation{}, fmt.Errorf("sync segment: %w", err)
+	}
+
+	location := recordLocation{
+		Segment:       s.activeID,
+		Offset:        s.activeSize,
+		Size:          r.size,
+		ContentOffset: s.activeSize + r.contentOffset,
+		ContentLength: r.contentLength,
+		ModTime:       modTime,
+		Metadata:      metadata,
+	}
+	s.activeSize += r.size
+	s.segments[s.activeID].size = s.activeSize
+
+	return location, nil
+}
+
+func encodeRecord(kind byte, objectHash string, modTime time.Time, metadata Metadata, content []byte) ([]byte, record, error) {
+	binaryHash, err := hash.GetBinaryHash(objectHash)
+	if err != nil {
+		return nil, record{}, errNoObjectHash
+	}
+
+	var encodedMetadata []byte
+	if kind == recordPut {
+		if encodedMetadata, err = json.Marshal(metadata); err != nil {
+			return nil, record{}, fmt.Errorf("json encode metadata: %w", err)
+		}
+	}
+
+	size := recordHeaderSize + len(encodedMetadata) + len(content) + recordCRCSize
+	buf := make([]byte, recordHeaderSize, size)
+	binary.LittleEndian.PutUint32(buf[0:4], recordMagic)
+	buf[4] = kind
+	copy(buf[5:37], binaryHash)
+	binary.LittleEndian.PutUint64(buf[37:45], uint64(modTime.UnixNano()))
+	binary.LittleEndian.PutUint32(buf[45:49], uint32(len(encodedMetadata)))
+	binary.LittleEndian.PutUint64(buf[49:57], uint64(len(content)))
+	buf = append(buf, encodedMetadata...)
+	buf = append(buf, content...)
+	buf = binary.LittleEndian.AppendUint32(buf, crc32.Checksum(buf, crcTable))
+
+	r := record{
+		kind:          kind,
+		objectHash:    objectHash,
+		modTime:       modTime,
+		metadata:      metadata,
+		contentOffset: int64(recordHeaderSize + len(encodedMetadata)),
+		contentLength: int64(len(content)),
+		size:          int64(size),
+	}
+
+	return buf, r, nil
+}
+
+// readRecord returns io.EOF if the reader is at the end of the segment and io.ErrUnexpectedEOF if the record is
+// incomplete. A record that claims to be larger than the remaining bytes of the segment is treated as corrupted.
+func readRecord(reader io.Reader, remaining int64) (record, []byte, error) {
+	header := make([]byte, recordHeaderSize)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return record{}, nil, err
+	}
+
+	if binary.LittleEndian.Uint32(header[0:4]) != recordMagic {
+		return record{}, nil, fmt.Errorf("%w: invalid magic number", errCorruptedRecord)
+	}
+	metadataLength := int64(binary.LittleEndian.Uint32(header[45:49]))
+	contentLength := int64(binary.LittleEndian.Uint64(header[49:57]))
+	bodyLength := remaining - recordHeaderSize - recordCRCSize
+	if metadataLength > maxMetadataSize || contentLength < 0 || metadataLength+contentLength > bodyLength {
+		return record{}, nil, fmt.Errorf("%w: invalid length", errCorruptedRecord)
+	}
+
+	body := make([]byte, metadataLength+contentLength+recordCRCSize)
+	if _, err := io.ReadFull(reader, body); err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return record{}, nil, err
+	}
+
+	crc := crc32.Update(crc32.Checksum(header, crcTable), crcTable, body[:len(body)-recordCRCSize])
+	if crc != binary.LittleEndian.Uint32(body[len(body)-recordCRCSize:]) {
+		return record{}, nil, fmt.Errorf("%w: checksum mismatch", errCorruptedRecord)
+	}
+
+	r := record{
+		kind:          header[4],
+		objectHash:    hex.EncodeToString(header[5:37]),
+		modTime:       time.Unix(0, int64(binary.LittleEndian.Uint64(header[37:45]))),
+		contentOffset: recordHeaderSize + metadataLength,
+		contentLength: contentLength,
+		size:          int64(recordHeaderSize + len(body)),
+	}
+	if metadataLength > 0 {
+		if err := json.Unmarshal(body[:metadataLength], &r.metadata); err != nil {
+			return record{}, nil, fmt.Errorf("%w: parse metadata: %v", errCorruptedRecord, err)
+		}
+	}
+
+	return r, body[metadataLength : metadataLength+contentLength], nil
+}
+
+func (s *segmentStore) Exists(objectHash string) (bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	_, ok := s.index[objectHash]
+	return ok, nil
+}
+
+func (s *segmentStore) Create(ctx context.Context, objectHash string, content io.Reader, metadata Metadata) error {
+	if exists, _ := s.Exists(objectHash); exists {
+		return ErrObjectAlreadyExists
+	}
+
+	// the length of the content is part of the record header
+	objectContent, err := io.ReadAll(content)
+	if err != nil {
+		return fmt.Errorf("read content: %w", err)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.index[objectHash]; ok {
+		return ErrObjectAlreadyExists
+	}
+
+	location, err := s.append(recordPut, objectHash, time.Now(), metadata, objectContent)
+	if err != nil {
+		return fmt.Errorf("append record: %w", err)
+	}
+	s.setLocation(objectHash, location)
+
+	return nil
+}
+
+func (s *segmentStore) Replace(objectHash string, content io.Reader, metadata Metadata) error {
+	objectContent, err := io.ReadAll(content)
+	if err != nil {
+		return fmt.Errorf("read content: %w", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.index[objectHash]; !ok {
+		return fmt.Errorf("replace %v: %w", objectHash, os.ErrNotExist)
+	}
+
+	// the old record stays in its segment until the segment is compacted; readers that have opened it keep reading it
+	location, err := s.append(recordPut, objectHash, time.Now(), metadata, objectContent)
+	if err != nil {
+		return fmt.Errorf("append record: %w", err)
+	}
+	s.setLocation(objectHash, location)
+
+	return nil
+}
+
+// ReplaceMetadata appends a copy of the record with the new metadata; the metadata is part of the record.
+func (s *segmentStore) ReplaceMetadata(objectHash string, metadata Metadata) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	location, ok := s.index[objectHash]
+	if !ok {
+		return fmt.Errorf("replace metadata of %v: %w", objectHash, os.ErrNotExist)
+	}
+
+	segmentPath := s.segmentPath(location.Segment)
+	segmentFile, err := os.Open(segmentPath)
+	if err != nil {
+		return fmt.Errorf("open %v: %w", segmentPath, err)
+	}
+	defer CloseAndLogError(segmentFile, segmentPath, s.sugar)
+
+	content := make([]byte, location.ContentLength)
+	if _, err := segmentFile.ReadAt(content, location.ContentOffset); err != nil {
+		return fmt.Errorf("read content of %v: %w", objectHash, err)
+	}
+
+	newLocation, err := s.append(recordPut, objectHash, location.ModTime, metadata, content)
+	if err != nil {
+		return fmt.Errorf("append record: %w", err)
+	}
+	s.setLocation(objectHash, newLocation)
+
+	return nil
+}
+
+// segmentReader reads the content of a single record.
+type segmentReader struct {
+	*io.SectionReader
+	segmentFile *os.File
+}
+
+func (r segmentReader) Close() error {
+	return r.segmentFile.Close()
+}
+
+func (s *segmentStore) Open(objectHash string) (io.ReadSeekCloser, ObjectInfo, error) {
+	// the lock prevents the compaction from removing the segment before it is opened; afterwards the file stays
+	// readable until it is closed
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	location, ok := s.index[objectHash]
+	if !ok {
+		return nil, ObjectInfo{}, fmt.Errorf("open %v: %w", objectHash, os.ErrNotExist)
+	}
+
+	segmentPath := s.segmentPath(location.Segment)
+	segmentFile, err := os.Open(segmentPath)
+	if err != nil {
+		return nil, ObjectInfo{}, fmt.Errorf("open %v: %w", segmentPath, err)
+	}
+
+	return segmentReader{
+		SectionReader: io.NewSectionReader(segmentFile, location.ContentOffset, location.ContentLength),
+		segmentFile:   segmentFile,
+	}, location.info(objectHash), nil
+}
+
+func (s *segmentStore) Delete(objectHash string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.index[objectHash]; !ok {
+		return fmt.Errorf("delete %v: %w", objectHash, os.ErrNotExist)
+	}
+
+	if _, err := s.append(recordDelete, objectHash, time.Now(), Metadata{}, nil); err != nil {
+		return fmt.Errorf("append delete record: %w", err)
+	}
+	s.removeLocation(objectHash)
+
+	return nil
+}
+
+func (s *segmentStore) List() ([]ObjectInfo, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var objects []ObjectInfo
+	for objectHash, location := range s.index {
+		objects = append(objects, location.info(objectHash))
+	}
+	sort.Slice(objects, func(i, j int) bool {
+		return objects[i].Hash < objects[j].Hash
+	})
+
+	return objects, nil
+}
+
+func (s *segmentStore) Stat(objectHash string) (ObjectInfo, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	location, ok := s.index[objectHash]
+	if !ok {
+		return ObjectInfo{}, fmt.Errorf("stat %v: %w", objectHash, os.ErrNotExist)
+	}
+
+	return location.info(objectHash), nil
+}
+
+func (l recordLocation) info(objectHash string) ObjectInfo {
+	return ObjectInfo{Hash: objectHash, Size: l.ContentLength, ModTime: l.ModTime, Metadata: l.Metadata}
+}
+
+// maintain compacts the segments and persists the index periodically.
+func (s *segmentStore) maintain(interval time.Duration) {
+	defer s.maintenance.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+		}
+
+		if err := s.compact(); err != nil {
+			s.sugar.Errorw("Failed to compact segments", "err", err)
+		}
+
+		s.mu.RLock()
+		dirty := s.dirty
+		s.mu.RUnlock()
+		if dirty {
+			if err := s.writeIndex(); err != nil {
+				s.sugar.Errorw("Failed to persist segment index", "err", err)
+			}
+		}
+	}
+}
+
+// Close stops the background maintenance and closes the active segment. The store must not be used afterwards.
+func (s *segmentStore) Close() error {
+	var err error
+	s.closeOnce.Do(func() {
+		close(s.stop)
+		s.maintenance.Wait()
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if closeErr := s.active.Close(); closeErr != nil {
+			err = fmt.Errorf("close active segment: %w", closeErr)
+		}
+	})
+	return err
+}
+
+// compact rewrites the live records of all sealed segments that consist mostly of dead records and removes the
+// segments afterwards.
+func (s *segmentStore) compact() error {
+	s.compactionMu.Lock()
+	defer s.compactionMu.Unlock()
+
+	s.mu.RLock()
+	var candidates []uint32
+	for id, info := range s.segments {
+		if id != s.activeID && float64(info.liveBytes) < float64(info.size)*compactionThreshold {
+			candidates = append(candidates, id)
+		}
+	}
+	s.mu.RUnlock()
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i] < candidates[j] })
+
+	for _, id := range candidates {
+		if err := s.compactSegment(id); err != nil {
+			return fmt.Errorf("compact segment %v: %w", id, err)
+		}
+	}
+
+	return nil
+}
+
+func (s *segmentStore) compactSegment(id uint32) error {
+	segmentPath := s.segmentPath(id)
+	segmentFile, err := os.Open(segmentPath)
+	if err != nil {
+		return fmt.Errorf("open %v: %w", segmentPath, err)
+	}
+	defer CloseAndLogError(segmentFile, segmentPath, s.sugar)
+
+	info, err := segmentFile.Stat()
+	if err != nil {
+		return fmt.Errorf("stat %v: %w", segmentPath, err)
+	}
+
+	// sealed segments are never modified, so they can be read without holding the mutex
+	reader := bufio.NewReader(segmentFile)
+	numMoved := 0
+	for position := int64(0); ; {
+		r, content, err := readRecord(reader, info.Size()-position)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			// the segment is kept; the records after the corruption can't be located anymore
+			return fmt.Errorf("read record at offset %v: %w", position, err)
+		}
+
+		moved, err := s.moveRecord(r, content, id, position)
+		if err != nil {
+			return fmt.Errorf("move record at offset %v: %w", position, err)
+		}
+		if moved {
+			numMoved++
+		}
+		position += r.size
+	}
+
+	// the index must not reference the segment anymore when it is removed
+	if err := s.writeIndex(); err != nil {
+		return fmt.Errorf("persist index: %w", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := os.Remove(segmentPath); err != nil {
+		return fmt.Errorf("remove %v: %w", segmentPath, err)
+	}
+	delete(s.segments, id)
+
+	s.sugar.Infow("Compacted segment", "segment", segmentPath, "movedRecords", numMoved)
+	return nil
+}
+
+// moveRecord appends the record to the active segment if it is still needed.
+func (s *segmentStore) moveRecord(r record, content []byte, segment uint32, offset int64) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	location, isLive := s.index[r.objectHash]
+	switch {
+	case r.kind == recordPut && isLive && location.Segment == segment && location.Offset == offset:
+		newLocation, err := s.append(recordPut, r.objectHash, r.modTime, r.metadata, content)
+		if err != nil {
+			return false, err
+		}
+		s.setLocation(r.objectHash, newLocation)
+		return true, nil
+
+	case r.kind == recordDelete && !isLive && s.hasOlderSegment(segment):
+		// an older segment might still contain a put record of the object that must not be resurrected by a replay
+		if _, err := s.append(recordDelete, r.objectHash, r.modTime, Metadata{}, nil); err != nil {
+			return false, err
+		}
+		return true, nil
+
+	default:
+		return false, nil // the record is dead
+	}
+}
+
+// hasOlderSegment requires that the mutex has already been locked.
+func (s *segmentStore) hasOlderSegment(segment uint32) bool {
+	for id := range s.segments {
+		if id < segment {
+			return true
+		}
+	}
+	return false
+}
+
+// writeIndex atomically replaces the snapshot of the index.
+func (s *segmentStore) writeIndex() error {
+	s.mu.Lock()
+	encodedIndex, err := json.Marshal(segmentIndex{Segment: s.activeID, Offset: s.activeSize, Objects: s.index})
+	s.dirty = false
+	s.mu.Unlock()
+
+	if err == nil {
+		err = s.replaceIndexFile(encodedIndex)
+	}
+	if err != nil {
+		s.mu.Lock()
+		s.dirty = true // the next maintenance retries
+		s.mu.Unlock()
+	}
+
+	return err
+}
+
+func (s *segmentStore) replaceIndexFile(encodedIndex []byte) error {
+	indexPath := filepath.Join(s.folder, segmentIndexFileName)
+	temporaryPath := indexPath + temporaryFileSuffix
+	if err := writeFileAndSync(temporaryPath, encodedIndex); err != nil {
+		return fmt.Errorf("write %v: %w", temporaryPath, err)
+	}
+	if err := os.Rename(temporaryPath, indexPath); err != nil {
+		return fmt.Errorf("rename %v: %w", temporaryPath, err)
+	}
+	if err := syncFolder(s.folder); err != nil {
+		return fmt.Errorf("sync segment folder: %w", err)
+	}
+
+	return nil
+}
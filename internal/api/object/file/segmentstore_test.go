@@ -0,0 +1,201 @@
+package file
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"go.uber.org/zap"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func openSegmentStore(t *testing.T, folder string, segmentSize int64) *segmentStore {
+	t.Helper()
+
+	store, err := newSegmentStore(folder, segmentSize, 0, zap.NewNop().Sugar())
+	if err != nil {
+		t.Fatalf("open segment store: %v", err)
+	}
+	t.Cleanup(func() { _ = store.Close() })
+	return store
+}
+
+func testHash(i int) string {
+	return fmt.Sprintf("%064x", i)
+}
+
+// expectObjects checks that the store contains exactly the given objects.
+func expectObjects(t *testing.T, store *segmentStore, objects map[string]string) {
+	t.Helper()
+
+	listed, err := store.List()
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	if len(listed) != len(objects) {
+		t.Errorf("store contains %v objects, want %v", len(listed), len(objects))
+	}
+	for objectHash, content := range objects {
+		if got := readObject(t, store, objectHash); got != content {
+			t.Errorf("content of %v = %q, want %q", objectHash, got, content)
+		}
+	}
+}
+
+func TestSegmentStoreRecovery(t *testing.T) {
+	folder := t.TempDir()
+	store := openSegmentStore(t, folder, defaultSegmentSize)
+	ctx := context.Background()
+
+	objects := map[string]string{}
+	for i := 0; i < 10; i++ {
+		objects[testHash(i)] = fmt.Sprintf("object %v", i)
+		if err := store.Create(ctx, testHash(i), strings.NewReader(objects[testHash(i)]), Metadata{}); err != nil {
+			t.Fatalf("Create: %v", err)
+		}
+	}
+	if err := store.writeIndex(); err != nil {
+		t.Fatalf("writeIndex: %v", err)
+	}
+
+	// these records are newer than the snapshot of the index and have to be replayed
+	for i := 0; i < 3; i++ {
+		if err := store.Delete(testHash(i)); err != nil {
+			t.Fatalf("Delete: %v", err)
+		}
+		delete(objects, testHash(i))
+	}
+	objects[testHash(3)] = "replaced"
+	if err := store.Replace(testHash(3), strings.NewReader("replaced"), Metadata{}); err != nil {
+		t.Fatalf("Replace: %v", err)
+	}
+
+	// simulate a crash while a record is written
+	segmentFile, err := os.OpenFile(store.segmentPath(store.activeID), os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatalf("open segment: %v", err)
+	}
+	if _, err := segmentFile.Write([]byte("torn record")); err != nil {
+		t.Fatalf("write torn record: %v", err)
+	}
+	_ = segmentFile.Close()
+
+	reopened := openSegmentStore(t, folder, defaultSegmentSize)
+	expectObjects(t, reopened, objects)
+
+	// the torn record has been truncated; new records must be found by the next replay
+	objects[testHash(20)] = "after crash"
+	if err := reopened.Create(ctx, testHash(20), strings.NewReader("after crash"), Metadata{}); err != nil {
+		t.Fatalf("Create after recovery: %v", err)
+	}
+	expectObjects(t, openSegmentStore(t, folder, defaultSegmentSize), objects)
+
+	// without a snapshot all segments are replayed
+	if err := os.Remove(filepath.Join(folder, relativeSegmentFolder, segmentIndexFileName)); err != nil {
+		t.Fatalf("remove index: %v", err)
+	}
+	expectObjects(t, openSegmentStore(t, folder, defaultSegmentSize), objects)
+}
+
+func TestSegmentStoreCompaction(t *testing.T) {
+	folder := t.TempDir()
+	store := openSegmentStore(t, folder, 1024) // small segments to get many sealed segments
+	ctx := context.Background()
+
+	objects := map[string]string{}
+	for i := 0; i < 100; i++ {
+		content := strings.Repeat(fmt.Sprint(i%10), 100)
+		if err := store.Create(ctx, testHash(i), strings.NewReader(content), Metadata{}); err != nil {
+			t.Fatalf("Create: %v", err)
+		}
+		if i%4 == 0 {
+			objects[testHash(i)] = content
+		} else if err := store.Delete(testHash(i)); err != nil {
+			t.Fatalf("Delete: %v", err)
+		}
+	}
+
+	// a reader that has opened an object before the compaction keeps reading the old segment
+	reader, _, err := store.Open(testHash(0))
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer func() { _ = reader.Close() }()
+
+	numSegmentsBefore := len(store.segments)
+	if err := store.compact(); err != nil {
+		t.Fatalf("compact: %v", err)
+	}
+	if len(store.segments) >= numSegmentsBefore {
+		t.Errorf("compaction didn't remove segments: %v before, %v after", numSegmentsBefore, len(store.segments))
+	}
+	for id, info := range store.segments {
+		if id != store.activeID && info.liveBytes == 0 {
+			t.Errorf("segment %v without live records hasn't been removed", id)
+		}
+	}
+
+	buf := make([]byte, 100)
+	if n, err := reader.Read(buf); err != nil || n != 100 {
+		t.Errorf("read of opened object after compaction = %v, %v", n, err)
+	}
+
+	expectObjects(t, store, objects)
+	expectObjects(t, openSegmentStore(t, folder, 1024), objects)
+
+	// the deleted objects must not be resurrected by a replay of all segments
+	if err := os.Remove(filepath.Join(folder, relativeSegmentFolder, segmentIndexFileName)); err != nil {
+		t.Fatalf("remove index: %v", err)
+	}
+	expectObjects(t, openSegmentStore(t, folder, 1024), objects)
+}
+
+func TestSegmentStoreRejectsCorruptedSealedSegments(t *testing.T) {
+	folder := t.TempDir()
+	store := openSegmentStore(t, folder, 1024)
+	ctx := context.Background()
+
+	for i := 0; i < 20; i++ {
+		content := strings.Repeat(fmt.Sprint(i%10), 100)
+		if err := store.Create(ctx, testHash(i), strings.NewReader(content), Metadata{}); err != nil {
+			t.Fatalf("Create: %v", err)
+		}
+	}
+	if err := store.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	// the records after the corruption (e.g. deletions) can't be found; the store must not silently ignore them
+	segmentPath := store.segmentPath(1)
+	content, err := os.ReadFile(segmentPath)
+	if err != nil {
+		t.Fatalf("read segment: %v", err)
+	}
+	content[recordHeaderSize] ^= 0xff
+	if err := os.WriteFile(segmentPath, content, 0600); err != nil {
+		t.Fatalf("write segment: %v", err)
+	}
+
+	_, err = newSegmentStore(folder, 1024, 0, zap.NewNop().Sugar())
+	if !errors.Is(err, errCorruptedRecord) {
+		t.Errorf("open store with corrupted sealed segment: err = %v, want %v", err, errCorruptedRecord)
+	}
+}
+
+func TestReadRecordRejectsLengthsBeyondTheSegment(t *testing.T) {
+	encodedRecord, _, err := encodeRecord(recordPut, testHash(1), time.Now(), Metadata{}, []byte("content"))
+	if err != nil {
+		t.Fatalf("encodeRecord: %v", err)
+	}
+	binary.LittleEndian.PutUint64(encodedRecord[49:57], 1<<40)
+
+	_, _, err = readRecord(bytes.NewReader(encodedRecord), int64(len(encodedRecord)))
+	if !errors.Is(err, errCorruptedRecord) {
+		t.Errorf("readRecord with oversized content length: err = %v, want %v", err, errCorruptedRecord)
+	}
+}
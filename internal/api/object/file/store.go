@@ -0,0 +1,76 @@
+package file
+
+import (
+	"context"
+	"fmt"
+	"go.uber.org/zap"
+	"io"
+	"time"
+)
+
+// Names of the storage backends that can be selected by configuration.
+const (
+	BackendFile    = "file"    // one file per object
+	BackendSegment = "segment" // objects are appended to large segment files
+	BackendMemory  = "memory"  // objects are kept in memory and are lost when the process exits
+)
+
+// ObjectStore persists the content and the metadata of objects. Implementations must be safe for concurrent use, but
+// they don't have to provide mutual exclusion between operations on the same object; this is ensured by the object
+// handler. Operations on objects that don't exist return an error that wraps os.ErrNotExist.
+type ObjectStore interface {
+	Exists(objectHash string) (bool, error)
+
+	// Create stores a new object. It returns ErrObjectAlreadyExists if the object exists. Nothing is stored if the
+	// content can't be read completely or if the context is canceled before the object is complete.
+	Create(ctx context.Context, objectHash string, content io.Reader, metadata Metadata) error
+
+	// Replace atomically replaces the content and the metadata of an existing object. Readers that have opened the
+	// object before keep reading the old content.
+	Replace(objectHash string, content io.Reader, metadata Metadata) error
+
+	// ReplaceMetadata atomically replaces the metadata of an existing object. The content and the modification time
+	// don't change.
+	ReplaceMetadata(objectHash string, metadata Metadata) error
+
+	// Open returns a reader for the content of the object and the info that describes this content, even if the
+	// object is replaced concurrently. Ranges are read by seeking the reader. The caller is responsible for closing the
+	// reader.
+	Open(objectHash string) (io.ReadSeekCloser, ObjectInfo, error)
+
+	Delete(objectHash string) error
+
+	// List returns all objects that have been created completely.
+	List() ([]ObjectInfo, error)
+
+	Stat(objectHash string) (ObjectInfo, error)
+}
+
+// ObjectInfo describes a persisted object.
+type ObjectInfo struct {
+	Hash     string
+	Size     int64
+	ModTime  time.Time
+	Metadata Metadata
+}
+
+func newStore(backend string, objectFolder string, sugar *zap.SugaredLogger) (ObjectStore, error) {
+	switch backend {
+	case BackendFile:
+		return newDiskStore(objectFolder, sugar)
+	case BackendSegment:
+		return newSegmentStore(objectFolder, defaultSegmentSize, segmentMaintenanceInterval, sugar)
+	case BackendMemory:
+		return newMemoryStore(), nil
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q", backend)
+	}
+}
+
+// decoded replaces the size of the stored content with the size of the clear-text content.
+func (i ObjectInfo) decoded() ObjectInfo {
+	if i.Metadata.Compression != "" || i.Metadata.KeyID != "" {
+		i.Size = i.Metadata.Size
+	}
+	return i
+}
@@ -0,0 +1,169 @@
+package file
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"go.uber.org/zap"
+	"io"
+	"os"
+	"strings"
+	"testing"
+)
+
+const (
+	testHashA = "2352da7280f1decc3acf1ba84eb945c9fc2b7b541094e1d0992dbffd1b6664cc"
+	testHashB = "9250b9912ee91d6b46e23299459ecd6eb8154451d62558a3a0a708a77926ad04"
+)
+
+// storeFactories creates an empty store of every backend.
+var storeFactories = map[string]func(t *testing.T) ObjectStore{
+	BackendFile: func(t *testing.T) ObjectStore {
+		store, err := newDiskStore(t.TempDir(), zap.NewNop().Sugar())
+		if err != nil {
+			t.Fatalf("create disk store: %v", err)
+		}
+		return store
+	},
+	BackendSegment: func(t *testing.T) ObjectStore {
+		store, err := newSegmentStore(t.TempDir(), defaultSegmentSize, 0, zap.NewNop().Sugar())
+		if err != nil {
+			t.Fatalf("create segment store: %v", err)
+		}
+		t.Cleanup(func() { _ = store.Close() })
+		return store
+	},
+	BackendMemory: func(t *testing.T) ObjectStore {
+		return newMemoryStore()
+	},
+}
+
+func readObject(t *testing.T, store ObjectStore, objectHash string) string {
+	t.Helper()
+
+	reader, _, err := store.Open(objectHash)
+	if err != nil {
+		t.Fatalf("open %v: %v", objectHash, err)
+	}
+	defer func() { _ = reader.Close() }()
+
+	content, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("read %v: %v", objectHash, err)
+	}
+	return string(content)
+}
+
+// TestObjectStore checks the behaviour that the object handler expects from every backend.
+func TestObjectStore(t *testing.T) {
+	for backend, newStore := range storeFactories {
+		newStore := newStore
+		t.Run(backend, func(t *testing.T) {
+			store := newStore(t)
+			ctx := context.Background()
+			metadata := Metadata{Checksum: Checksum([]byte("hello world")), Pool: "logs"}
+
+			if exists, err := store.Exists(testHashA); err != nil || exists {
+				t.Fatalf("Exists of missing object = %v, %v", exists, err)
+			}
+			for name, err := range map[string]error{
+				"Open":            func() error { _, _, err := store.Open(testHashA); return err }(),
+				"ReplaceMetadata": store.ReplaceMetadata(testHashA, metadata),
+				"Stat":            func() error { _, err := store.Stat(testHashA); return err }(),
+				"Delete":          store.Delete(testHashA),
+			} {
+				if !errors.Is(err, os.ErrNotExist) {
+					t.Errorf("%v of missing object returned %v, want os.ErrNotExist", name, err)
+				}
+			}
+
+			if err := store.Create(ctx, testHashA, strings.NewReader("hello world"), metadata); err != nil {
+				t.Fatalf("Create: %v", err)
+			}
+			if err := store.Create(ctx, testHashA, strings.NewReader("other"), metadata); !errors.Is(err, ErrObjectAlreadyExists) {
+				t.Errorf("second Create returned %v, want ErrObjectAlreadyExists", err)
+			}
+			if got := readObject(t, store, testHashA); got != "hello world" {
+				t.Errorf("content = %q", got)
+			}
+
+			info, err := store.Stat(testHashA)
+			if err != nil {
+				t.Fatalf("Stat: %v", err)
+			}
+			if info.Hash != testHashA || info.Size != 11 || info.Metadata != metadata || info.ModTime.IsZero() {
+				t.Errorf("Stat = %+v", info)
+			}
+
+			// ranges are read by seeking
+			reader, opened, err := store.Open(testHashA)
+			if err != nil {
+				t.Fatalf("Open: %v", err)
+			}
+			if opened != info {
+				t.Errorf("info of opened object = %+v, want %+v", opened, info)
+			}
+			if _, err := reader.Seek(6, io.SeekStart); err != nil {
+				t.Fatalf("Seek: %v", err)
+			}
+			part := make([]byte, 3)
+			if _, err := io.ReadFull(reader, part); err != nil || string(part) != "wor" {
+				t.Errorf("range read = %q, %v", part, err)
+			}
+
+			// readers that have opened the object keep the old content
+			if err := store.Replace(testHashA, strings.NewReader("replaced"), Metadata{Pool: "logs"}); err != nil {
+				t.Fatalf("Replace: %v", err)
+			}
+			if rest, err := io.ReadAll(reader); err != nil || string(rest) != "ld" {
+				t.Errorf("read after Replace = %q, %v", rest, err)
+			}
+			_ = reader.Close()
+			if got := readObject(t, store, testHashA); got != "replaced" {
+				t.Errorf("content after Replace = %q", got)
+			}
+
+			// only the metadata changes; the content and the modification time are kept
+			before, err := store.Stat(testHashA)
+			if err != nil {
+				t.Fatalf("Stat: %v", err)
+			}
+			if err := store.ReplaceMetadata(testHashA, Metadata{Pool: "photos"}); err != nil {
+				t.Fatalf("ReplaceMetadata: %v", err)
+			}
+			if after, err := store.Stat(testHashA); err != nil || after.Metadata.Pool != "photos" || !after.ModTime.Equal(before.ModTime) {
+				t.Errorf("Stat after ReplaceMetadata = %+v, %v", after, err)
+			}
+			if got := readObject(t, store, testHashA); got != "replaced" {
+				t.Errorf("content after ReplaceMetadata = %q", got)
+			}
+			if err := store.ReplaceMetadata(testHashB, Metadata{}); !errors.Is(err, os.ErrNotExist) {
+				t.Errorf("ReplaceMetadata of missing object returned %v, want os.ErrNotExist", err)
+			}
+
+			canceledCtx, cancel := context.WithCancel(ctx)
+			cancel()
+			if err := store.Create(canceledCtx, testHashB, bytes.NewReader([]byte("x")), Metadata{}); err == nil {
+				t.Errorf("Create with canceled context succeeded")
+			}
+			if exists, _ := store.Exists(testHashB); exists {
+				t.Errorf("canceled Create left the object behind")
+			}
+
+			objects, err := store.List()
+			if err != nil {
+				t.Fatalf("List: %v", err)
+			}
+			if len(objects) != 1 || objects[0].Hash != testHashA || objects[0].Size != 8 {
+				t.Errorf("List = %+v", objects)
+			}
+
+			if err := store.Delete(testHashA); err != nil {
+				t.Fatalf("Delete: %v", err)
+			}
+			if exists, err := store.Exists(testHashA); err != nil || exists {
+				t.Errorf("Exists after Delete = %v, %v", exists, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,78 @@
+package file
+
+import (
+	"errors"
+	"fmt"
+	"github.com/rstdm/mini-ceph/internal/api/object/hash"
+	"os"
+	"path/filepath"
+)
+
+// relativeTombstoneFolder is the folder (relative to the object folder) that contains one empty file for every
+// deletion that has been confirmed but not yet completed on all nodes.
+const relativeTombstoneFolder = "tombstones"
+
+func (h *Handler) getTombstonePath(objectHash string) (string, error) {
+	return getObjectPath(objectHash, filepath.Join(h.objectFolder, relativeTombstoneFolder))
+}
+
+// WriteTombstone durably records that the object has been deleted. The function only returns after the tombstone has
+// been flushed to disk.
+func (h *Handler) WriteTombstone(objectHash string) error {
+	tombstonePath, err := h.getTombstonePath(objectHash)
+	if err != nil {
+		return fmt.Errorf("get tombstone path: %w", err)
+	}
+
+	if err := writeFileAndSync(tombstonePath, nil); err != nil {
+		return fmt.Errorf("write %v: %w", tombstonePath, err)
+	}
+
+	// the directory entry has to be flushed as well; otherwise the file might be lost after a crash
+	if err := syncFolder(filepath.Dir(tombstonePath)); err != nil {
+		return fmt.Errorf("sync tombstone folder: %w", err)
+	}
+
+	return nil
+}
+
+func (h *Handler) HasTombstone(objectHash string) (bool, error) {
+	tombstonePath, err := h.getTombstonePath(objectHash)
+	if err != nil {
+		return false, fmt.Errorf("get tombstone path: %w", err)
+	}
+
+	return fileExists(tombstonePath)
+}
+
+// RemoveTombstone succeeds if the object has no tombstone.
+func (h *Handler) RemoveTombstone(objectHash string) error {
+	tombstonePath, err := h.getTombstonePath(objectHash)
+	if err != nil {
+		return fmt.Errorf("get tombstone path: %w", err)
+	}
+
+	if err := os.Remove(tombstonePath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("remove %v: %w", tombstonePath, err)
+	}
+
+	return nil
+}
+
+// ListTombstones returns the hashes of all objects that have a tombstone.
+func (h *Handler) ListTombstones() ([]string, error) {
+	tombstoneFolder := filepath.Join(h.objectFolder, relativeTombstoneFolder)
+	dirEntries, err := os.ReadDir(tombstoneFolder)
+	if err != nil {
+		return nil, fmt.Errorf("list files in tombstone dir: %w", err)
+	}
+
+	var objectHashes []string
+	for _, entry := range dirEntries {
+		if !entry.IsDir() && hash.IsObjectHash(entry.Name()) {
+			objectHashes = append(objectHashes, entry.Name())
+		}
+	}
+
+	return objectHashes, nil
+}
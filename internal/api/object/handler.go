@@ -1,13 +1,23 @@
 package object
 
 import (
+	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"github.com/rstdm/mini-ceph/internal/api/object/distribution"
 	"github.com/rstdm/mini-ceph/internal/api/object/file"
+	"github.com/rstdm/mini-ceph/internal/api/object/replication"
+	"github.com/rstdm/mini-ceph/internal/api/object/upload"
+	"github.com/rstdm/mini-ceph/internal/configuration"
+	"github.com/rstdm/mini-ceph/internal/metrics"
+	"github.com/rstdm/mini-ceph/internal/tracing"
 	"go.uber.org/zap"
-	"mime/multipart"
+	"hash/fnv"
+	"os"
+	"path/filepath"
 	"sync"
+	"time"
 )
 
 type fsOperationResult string
@@ -16,14 +26,37 @@ const (
 	fsOperationAllowed fsOperationResult = "allowed"
 	fsOperationDenied  fsOperationResult = "denied"
 	fsOperationError   fsOperationResult = "error"
+	// fsOperationCanceled is returned if the context has been canceled before the lookup finished
+	fsOperationCanceled fsOperationResult = "canceled"
 )
 
 var (
 	ErrLookupError        = errors.New("error during object lookup")
 	ErrObjectDoesNotExist = errors.New("the object does not exist")
 	ErrObjectDoesExist    = errors.New("the object already exists")
+	ErrObjectIsRepaired   = errors.New("the object is currently repaired")
+	ErrObjectIsReplaced   = errors.New("the object is currently replaced")
+	ErrObjectIsCorrupted  = errors.New("all copies of the object are corrupted")
+	// ErrReplicaIsCorrupted is returned by a secondary whose copy is corrupted. The primary serves the object from an
+	// intact copy and repairs the copy of the secondary.
+	ErrReplicaIsCorrupted = errors.New("the copy of the secondary is corrupted")
+
+	ErrUnknownPool           = errors.New("the pool does not exist")
+	ErrWriteQuorumNotReached = errors.New("not enough copies of the object could be persisted")
 )
 
+// relativeMissingSetPath is the path of the persisted missing set relative to the data folder.
+const relativeMissingSetPath = "missing.json"
+
+// relativeUploadFolder is the folder (relative to the data folder) that contains the incomplete multipart uploads.
+const relativeUploadFolder = "uploads"
+
+// numLockShards is the number of independently locked segments of the lock table.
+const numLockShards = 64
+
+// repairQueueSize is the number of objects that can wait for a repair that has been requested by the read path.
+const repairQueueSize = 128
+
 type MutexEntry struct {
 	wantRead                 []chan fsOperationResult
 	read                     int
@@ -34,125 +67,286 @@ type MutexEntry struct {
 	scheduledDelayedDeletion bool
 
 	runningFSCheck bool
+	repair         bool // reads are allowed during a repair, but the object must not be created or deleted
+	replace        bool // reads are allowed during a replacement; running reads keep reading the previous version
 }
 
-type Handler struct {
+// lockShard guards the state of all objects whose hash is mapped to the shard. Operations on objects of different
+// shards don't contend for the same mutex.
+type lockShard struct {
 	mu        sync.Mutex
 	mutexDict map[string]MutexEntry
+}
 
-	operationHandler *operationHandler
-	fileHandler      *file.Handler
-	sugar            *zap.SugaredLogger
+// objectOperations performs the operations whose mutual exclusion is ensured by the Handler. Tests replace it to
+// control the interleaving of concurrent operations.
+type objectOperations interface {
+	objectExists(objectHash string) (bool, error)
+	transferObject(ctx context.Context, objectHash string, verifyChecksum bool, transferObjectFunc TransferObjectFunc) error
+	persistObject(ctx context.Context, objectHash string, openContent OpenContentFunc, metadata file.Metadata) error
+	replaceObject(ctx context.Context, objectHash string, openContent OpenContentFunc, metadata file.Metadata) error
+	deleteObject(ctx context.Context, objectHash string, deleteReplicas bool) error
+	deleteReplicas(ctx context.Context, objectHash string) error
+	writeTombstone(objectHash string) error
+	removeTombstone(objectHash string) error
+	withTimeout(ctx context.Context) (context.Context, context.CancelFunc)
 }
 
-func NewHandler(objectFolder string, clusterBearerToken string, distributionHandler *distribution.Handler, sugar *zap.SugaredLogger) (*Handler, error) {
-	fileHandler, err := file.NewHandler(objectFolder, sugar)
+type Handler struct {
+	shards        [numLockShards]lockShard
+	operations    objectOperations
+	readBalancing bool
+	nearfullRatio float64
+	fullRatio     float64
+	maxUploadSize int64 // maximum size of an object that is assembled from the parts of a multipart upload
+	poolsHash     string
+
+	operationHandler    *operationHandler
+	fileHandler         *file.Handler
+	distributionHandler *distribution.Handler
+	scrubber            *scrubber
+	leases              *leaseTable
+	missing             *missingSet
+	repairQueue         chan string
+	storageStats        storageStats
+	peers               peerMonitor
+	usage               usageTracker
+	uploads             *upload.Store
+	sugar               *zap.SugaredLogger
+}
+
+// NewHandler creates the object handler. The TLS configuration is used for the connections to the other nodes; it
+// may be nil. The metrics of the handler are added to the registry.
+func NewHandler(config configuration.Configuration, distributionHandler *distribution.Handler, clusterTLSConfig *tls.Config, registry *metrics.Registry, sugar *zap.SugaredLogger) (*Handler, error) {
+	compression := map[string]string{}
+	for name, pool := range config.Pools {
+		compression[name] = pool.Compression
+	}
+	var keyring *file.Keyring
+	if config.MasterKeys != "" {
+		var err error
+		if keyring, err = file.ParseKeyring(config.MasterKeys); err != nil {
+			err = fmt.Errorf("parse master keys: %w", err)
+			return nil, err
+		}
+		sugar.Infow("Objects are encrypted at rest", "currentKeyID", keyring.CurrentKeyID())
+	}
+	fileHandler, err := file.NewHandler(config.StorageBackend, config.ObjectFolder, compression, keyring, sugar)
 	if err != nil {
 		err = fmt.Errorf("create file handler: %w", err)
 		return nil, err
 	}
 
-	operationHandler, err := newOperationHandler(clusterBearerToken, fileHandler, distributionHandler, sugar)
+	leases := newLeaseTable(config.ReadLeaseDuration)
+	schemes := map[string]string{}
+	for nodeID, host := range config.NodeHosts {
+		schemes[host] = config.NodeSchemes[nodeID]
+	}
+	replicationHandler := replication.NewHandler(config.ClusterBearerToken, schemes, clusterTLSConfig, registry, sugar)
+
+	operationHandler, err := newOperationHandler(replicationHandler, fileHandler, distributionHandler,
+		config.Pools, config.OperationTimeout, config.ReadBalancing, leases, sugar)
 	if err != nil {
 		err = fmt.Errorf("create newOperationHandler: %w", err)
 		return nil, err
 	}
 
+	missingSetPath := filepath.Join(config.DataFolder, relativeMissingSetPath)
+	missing, err := loadMissingSet(missingSetPath)
+	if err != nil {
+		err = fmt.Errorf("load missing set: %w", err)
+		return nil, err
+	}
+
+	uploads, err := upload.NewStore(filepath.Join(config.DataFolder, relativeUploadFolder))
+	if err != nil {
+		err = fmt.Errorf("create upload store: %w", err)
+		return nil, err
+	}
+
 	handler := &Handler{
-		mutexDict:        map[string]MutexEntry{},
-		operationHandler: operationHandler,
-		fileHandler:      fileHandler,
-		sugar:            sugar,
+		operations:          operationHandler,
+		readBalancing:       config.ReadBalancing,
+		nearfullRatio:       config.NearfullRatio,
+		fullRatio:           config.FullRatio,
+		maxUploadSize:       config.MaxMultipartObjectSizeBytes,
+		poolsHash:           configuration.PoolsHash(config.Pools),
+		operationHandler:    operationHandler,
+		fileHandler:         fileHandler,
+		distributionHandler: distributionHandler,
+		leases:              leases,
+		missing:             missing,
+		repairQueue:         make(chan string, repairQueueSize),
+		usage:               usageTracker{scanned: replication.NewUsageReport(), remote: map[string]remoteUsage{}},
+		uploads:             uploads,
+		sugar:               sugar,
+	}
+	for i := range handler.shards {
+		handler.shards[i].mutexDict = map[string]MutexEntry{}
+	}
+	operationHandler.requestRepair = handler.RequestRepair
+	operationHandler.recordMissing = handler.recordMissing
+	operationHandler.recordUsage = handler.recordUsage
+	if err := handler.finishPendingDeletions(); err != nil {
+		err = fmt.Errorf("finish pending deletions: %w", err)
+		return nil, err
+	}
+	if err := handler.scanUsage(); err != nil {
+		err = fmt.Errorf("determine usage: %w", err)
+		return nil, err
+	}
+	go handler.processRepairQueue()
+	go handler.monitorPeers()
+	go handler.syncUsage()
+	if config.RecoveryInterval > 0 {
+		go handler.recover(config.RecoveryInterval)
+	}
+	if config.ReapInterval > 0 {
+		go handler.reapExpiredObjects(config.ReapInterval)
 	}
+	if config.MultipartUploadTimeout > 0 {
+		go handler.collectStaleUploads(config.MultipartUploadTimeout)
+	}
+	handler.scrubber = newScrubber(handler, config.ScrubInterval, config.DeepScrubInterval, config.AutoRepair, config.ScrubBytesPerSecond)
+	handler.scrubber.start()
+	handler.registerMetrics(registry)
+
 	return handler, nil
 }
 
-func (f *Handler) Read(object string, transferObjectFunc func(objectPath string)) error {
-	f.mu.Lock()
-	entry := f.getEntry(object)
+// PoolOf returns the pool of the object or an empty string if the object doesn't exist. Objects that have been created
+// without pool belong to the default pool.
+func (f *Handler) PoolOf(object string) (string, error) {
+	info, err := f.fileHandler.StatObject(object)
+	if errors.Is(err, os.ErrNotExist) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return poolOf(info.Metadata), nil
+}
+
+// Read sends the object to the client. If verifyChecksum is true the content is compared with the checksum that has
+// been persisted when the object was created.
+func (f *Handler) Read(ctx context.Context, object string, verifyChecksum bool, transferObjectFunc TransferObjectFunc) error {
+	ctx, cancel := f.operations.withTimeout(ctx)
+	defer cancel()
+
+	shard := f.shardOf(object)
+	shard.mu.Lock()
+	entry := shard.getEntry(object)
 
 	if fileIsModified(entry) || entry.wantDelete != nil {
-		f.mu.Unlock()
+		shard.mu.Unlock()
 		return ErrObjectDoesNotExist
 	}
 
 	canReadImmediately := fileExistsWithoutLookup(entry)
 	if canReadImmediately {
 		entry.read += 1
-		f.setEntry(object, entry)
-		f.mu.Unlock()
+		shard.setEntry(object, entry)
+		shard.mu.Unlock()
 	} else {
 		setChannelFunc := func(entry *MutexEntry, c chan fsOperationResult) {
 			entry.wantRead = append(entry.wantRead, c)
 		}
-		lookupResult := f.performFSLookup(object, entry, setChannelFunc) // this function unlocks the mutex
+		rollback := func() { f.finishRead(object) }
+		lookupResult := f.performFSLookup(ctx, object, entry, setChannelFunc, rollback) // this function unlocks the mutex
 		switch lookupResult {
 		case fsOperationError:
 			return ErrLookupError
 		case fsOperationDenied:
 			return ErrObjectDoesNotExist
+		case fsOperationCanceled:
+			return ctx.Err()
 		}
 	}
 
 	// this performs the actual read; the error is returned at the end of the function
-	readError := f.operationHandler.transferObject(object, transferObjectFunc)
+	readError := f.operations.transferObject(ctx, object, verifyChecksum, transferObjectFunc)
 
-	f.mu.Lock()
-	entry = f.getEntry(object)
+	f.finishRead(object)
+
+	if readError != nil {
+		readError = fmt.Errorf("transferObject: %w", readError)
+		return readError
+	}
+
+	return nil
+}
+
+// finishRead releases the read lock and performs the scheduled deletion after the last read.
+func (f *Handler) finishRead(object string) {
+	shard := f.shardOf(object)
+	shard.mu.Lock()
+	entry := shard.getEntry(object)
 	entry.read -= 1
-	f.setEntry(object, entry)
-	f.mu.Unlock()
+	shard.setEntry(object, entry)
+	shard.mu.Unlock()
 
 	if entry.read == 0 && entry.scheduledDelayedDeletion {
-		if err := f.operationHandler.deleteObject(object); err != nil {
-			f.sugar.Errorw("Failed to delete object after the last read operation ended",
+		// The deletion has already been confirmed to the client; it mustn't be aborted with the read operation.
+		ctx, cancel := f.operations.withTimeout(context.Background())
+		defer cancel()
+
+		// with read balancing the replicas have already been deleted when the deletion has been scheduled
+		deleteReplicas := !f.readBalancing
+		if err := f.operations.deleteObject(ctx, object, deleteReplicas); err != nil {
+			f.sugar.Errorw("Failed to delete object after the last read operation ended. The deletion will be "+
+				"finished after the next restart.",
 				"err", err,
 				"object", object)
+		} else {
+			f.finishDeletion(object)
 		}
 
-		f.mu.Lock()
-		entry = f.getEntry(object)
+		shard.mu.Lock()
+		entry = shard.getEntry(object)
 		entry.scheduledDelayedDeletion = false
-		f.setEntry(object, entry)
-		f.mu.Unlock()
+		shard.setEntry(object, entry)
+		shard.mu.Unlock()
 	}
+}
 
-	if readError != nil {
-		readError = fmt.Errorf("transferObject: %w", readError)
-		return readError
-	}
+// Write persists the object. The primary replicates the object according to the pool that is specified in the
+// metadata.
+func (f *Handler) Write(ctx context.Context, object string, openContent OpenContentFunc, metadata file.Metadata) error {
+	ctx, cancel := f.operations.withTimeout(ctx)
+	defer cancel()
 
-	return nil
-}
+	shard := f.shardOf(object)
+	shard.mu.Lock()
+	entry := shard.getEntry(object)
 
-func (f *Handler) Write(object string, formFile *multipart.FileHeader) error {
-	f.mu.Lock()
-	entry := f.getEntry(object)
+	if entry.repair {
+		shard.mu.Unlock()
+		return ErrObjectIsRepaired
+	}
 
-	if fileIsModified(entry) || entry.wantWrite != nil || fileExistsWithoutLookup(entry) {
-		f.mu.Unlock()
+	if fileIsModified(entry) || entry.wantWrite != nil || entry.replace || fileExistsWithoutLookup(entry) {
+		shard.mu.Unlock()
 		return ErrObjectDoesExist // objects are immutable, if fileIsModified is true the object is either currently created or it is currently deleted
 	}
 
 	setChannelFunc := func(entry *MutexEntry, c chan fsOperationResult) {
 		entry.wantWrite = c
 	}
-	lookupResult := f.performFSLookup(object, entry, setChannelFunc) // this function unlocks the mutex
+	release := func() { f.updateEntry(object, func(entry *MutexEntry) { entry.write = false }) }
+	lookupResult := f.performFSLookup(ctx, object, entry, setChannelFunc, release) // this function unlocks the mutex
 	switch lookupResult {
 	case fsOperationError:
 		return ErrLookupError
 	case fsOperationDenied:
 		return ErrObjectDoesExist
+	case fsOperationCanceled:
+		return ctx.Err()
 	}
 
 	// this function saves the object to disk; the error is returned at the end of this function
-	persistError := f.operationHandler.persistObject(object, formFile)
+	persistError := f.operations.persistObject(ctx, object, openContent, metadata)
 
-	f.mu.Lock()
-	entry = f.getEntry(object)
-	entry.write = false
-	f.setEntry(object, entry)
-	f.mu.Unlock()
+	release()
 
 	if persistError != nil {
 		persistError = fmt.Errorf("persistObject: %w", persistError)
@@ -162,59 +356,195 @@ func (f *Handler) Write(object string, formFile *multipart.FileHeader) error {
 	return nil
 }
 
-func (f *Handler) Delete(object string) error {
-	f.mu.Lock()
-	entry := f.getEntry(object)
+// Replace persists the object and replaces the previous version if the object already exists. The primary replaces
+// the replicas as well. Reads that have already started keep reading the previous version. ErrObjectIsBusy is
+// returned if the object is currently created, deleted, replaced or repaired.
+func (f *Handler) Replace(ctx context.Context, object string, openContent OpenContentFunc, metadata file.Metadata) error {
+	return f.replace(ctx, object, openContent, metadata, false)
+}
+
+// ReplaceExpired replaces the object like Replace, but only if the stored version has expired. Expired objects read as
+// deleted until the primary deletes them, so they must not prevent a new object with the same hash. It returns
+// ErrObjectDoesExist if the stored version hasn't expired.
+func (f *Handler) ReplaceExpired(ctx context.Context, object string, openContent OpenContentFunc, metadata file.Metadata) error {
+	return f.replace(ctx, object, openContent, metadata, true)
+}
+
+func (f *Handler) replace(ctx context.Context, object string, openContent OpenContentFunc, metadata file.Metadata, onlyExpired bool) error {
+	ctx, cancel := f.operations.withTimeout(ctx)
+	defer cancel()
+
+	shard := f.shardOf(object)
+	shard.mu.Lock()
+	entry := shard.getEntry(object)
+	if fileIsBusy(entry) {
+		shard.mu.Unlock()
+		return ErrObjectIsBusy
+	}
+	entry.replace = true
+	shard.setEntry(object, entry)
+	shard.mu.Unlock()
+
+	// this function replaces the object on disk; the error is returned at the end of this function. The expiry is
+	// checked while the object can't be modified by anyone else.
+	var replaceError error
+	if onlyExpired && !f.hasExpired(object) {
+		replaceError = ErrObjectDoesExist
+	} else {
+		replaceError = f.operations.replaceObject(ctx, object, openContent, metadata)
+	}
+
+	f.updateEntry(object, func(entry *MutexEntry) { entry.replace = false })
+
+	if replaceError != nil {
+		replaceError = fmt.Errorf("replaceObject: %w", replaceError)
+		return replaceError
+	}
+
+	return nil
+}
+
+// hasExpired returns true if the local copy of the object has expired or if it doesn't exist anymore.
+func (f *Handler) hasExpired(object string) bool {
+	info, err := f.fileHandler.StatObject(object)
+	if errors.Is(err, os.ErrNotExist) {
+		return true
+	}
+	return err == nil && info.Metadata.Expired(time.Now())
+}
+
+func (f *Handler) Delete(ctx context.Context, object string) error {
+	ctx, cancel := f.operations.withTimeout(ctx)
+	defer cancel()
+
+	shard := f.shardOf(object)
+	shard.mu.Lock()
+	entry := shard.getEntry(object)
+
+	if entry.repair {
+		shard.mu.Unlock()
+		return ErrObjectIsRepaired
+	}
+	if entry.replace {
+		shard.mu.Unlock()
+		return ErrObjectIsReplaced
+	}
 
 	if fileIsModified(entry) || entry.wantDelete != nil || entry.scheduledDelayedDeletion {
-		f.mu.Unlock()
+		shard.mu.Unlock()
 		return ErrObjectDoesNotExist // objects are immutable; the object is either created, deleted, or is scheduled for deletion
 	}
 
+	release := func() { f.updateEntry(object, func(entry *MutexEntry) { entry.delete = false }) }
 	canDeleteImmediately := entry.read > 0 && !entry.runningFSCheck
 	if canDeleteImmediately {
 		entry.delete = true
+		shard.setEntry(object, entry)
+		shard.mu.Unlock()
 	} else {
 		setChannelFunc := func(entry *MutexEntry, c chan fsOperationResult) {
 			entry.wantDelete = c
 		}
-		lookupResult := f.performFSLookup(object, entry, setChannelFunc) // this function unlocks the mutex
+		lookupResult := f.performFSLookup(ctx, object, entry, setChannelFunc, release) // this function unlocks the mutex
 		switch lookupResult {
 		case fsOperationError:
 			return ErrLookupError
 		case fsOperationDenied:
 			return ErrObjectDoesNotExist
+		case fsOperationCanceled:
+			return ctx.Err()
 		}
+	}
 
-		f.mu.Lock() // the call to f.performFSLookup unlocked the mutex
-		entry = f.getEntry(object)
+	// the deletion can't be aborted once the tombstone has been written
+	if err := ctx.Err(); err != nil {
+		release()
+		return err
 	}
 
+	// The deletion is recorded before it is confirmed. The client is informed before the object is actually deleted
+	// if the object is currently read; the deletion must not get lost if the node restarts in the meantime.
+	if err := f.operations.writeTombstone(object); err != nil {
+		release()
+		return fmt.Errorf("write tombstone: %w", err)
+	}
+
+	shard.mu.Lock()
+	entry = shard.getEntry(object)
+
 	if entry.read > 0 {
 		entry.delete = false
 		entry.scheduledDelayedDeletion = true
-		f.setEntry(object, entry)
-		f.mu.Unlock()
+		shard.setEntry(object, entry)
+		shard.mu.Unlock()
+
+		if f.readBalancing {
+			// secondaries serve reads as well; they mustn't return the object after the deletion has been confirmed
+			if err := f.operations.deleteReplicas(ctx, object); err != nil {
+				return fmt.Errorf("deleteReplicas: %w", err)
+			}
+		}
 		return nil
 	}
 
-	f.setEntry(object, entry)
-	f.mu.Unlock()
+	shard.setEntry(object, entry)
+	shard.mu.Unlock()
 
 	// this function performs the actual deletion; the error is returned at the end of this function
-	deleteError := f.operationHandler.deleteObject(object)
+	deleteError := f.operations.deleteObject(ctx, object, true)
 
-	f.mu.Lock()
-	entry = f.getEntry(object)
-	entry.delete = false
-	f.setEntry(object, entry)
-	f.mu.Unlock()
+	release()
 
 	if deleteError != nil {
 		deleteError = fmt.Errorf("deleteObject: %w", deleteError)
 		return deleteError
 	}
 
+	f.finishDeletion(object)
+	return nil
+}
+
+// finishDeletion removes the tombstone of a deleted object. The tombstone is kept until all replicas have deleted
+// the object as well; otherwise a repair could restore the object from the remaining replicas.
+func (f *Handler) finishDeletion(object string) {
+	if f.missing.containsObject(object) {
+		return // Repair removes the tombstone
+	}
+
+	if err := f.operations.removeTombstone(object); err != nil {
+		f.sugar.Errorw("Failed to remove tombstone", "err", err, "object", object)
+	}
+}
+
+// finishPendingDeletions deletes all objects that have a tombstone. It is called before the first request is served.
+// The primary deletes the replicas as part of the recovery of degraded replicas; the function doesn't wait for other
+// nodes.
+func (f *Handler) finishPendingDeletions() error {
+	objects, err := f.fileHandler.ListTombstones()
+	if err != nil {
+		return fmt.Errorf("list tombstones: %w", err)
+	}
+
+	for _, object := range objects {
+		f.sugar.Infow("Finishing pending deletion", "object", object)
+
+		if err := f.fileHandler.DeleteObject(object); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("delete %v: %w", object, err)
+		}
+
+		dist, err := f.distributionHandler.GetDistribution(object)
+		if err != nil {
+			return fmt.Errorf("calculate distribution of %v: %w", object, err)
+		}
+		if dist.IsPrimary {
+			for _, host := range dist.SlaveHosts {
+				f.recordMissing(MissingEntry{dist.CorrectPlacementGroup, host, object})
+			}
+		}
+
+		f.finishDeletion(object)
+	}
+
 	return nil
 }
 
@@ -222,46 +552,69 @@ func fileIsModified(entry MutexEntry) bool {
 	return entry.write || entry.delete || entry.scheduledDelayedDeletion
 }
 
+// fileIsBusy returns true if the object can't be modified exclusively, i.e. if it is created, deleted, looked up,
+// replaced or repaired. Reads don't prevent exclusive modifications.
+func fileIsBusy(entry MutexEntry) bool {
+	return fileIsModified(entry) || entry.wantWrite != nil || entry.wantDelete != nil || entry.runningFSCheck ||
+		entry.repair || entry.replace
+}
+
 func fileExistsWithoutLookup(entry MutexEntry) bool {
 	return entry.read > 0 && entry.wantDelete == nil && !entry.scheduledDelayedDeletion
 }
 
-// performFSLookup requires that the mutex has already been locked. At the end of the function the mutex will be unlocked.
-func (f *Handler) performFSLookup(object string, entry MutexEntry, setChannelFunc func(entry *MutexEntry, c chan fsOperationResult)) fsOperationResult {
-	var c chan fsOperationResult
+// performFSLookup requires that the mutex of the object's shard has already been locked. At the end of the function the
+// mutex will be unlocked. If the context is canceled before the lookup has finished, fsOperationCanceled is returned
+// and rollback is called as soon as the lookup allows the operation; rollback must undo the state change of the
+// allowed operation.
+func (f *Handler) performFSLookup(ctx context.Context, object string, entry MutexEntry, setChannelFunc func(entry *MutexEntry, c chan fsOperationResult), rollback func()) fsOperationResult {
+	shard := f.shardOf(object)
+	_, span := tracing.Start(ctx, "object.lock_wait", "object", object)
+	defer span.End()
 
-	if entry.runningFSCheck {
-		c = make(chan fsOperationResult)
-		setChannelFunc(&entry, c)
+	// checkFS sends to this channel while it holds the mutex. The channel is buffered because the receiver might have
+	// given up waiting; otherwise it would create a deadlock.
+	c := make(chan fsOperationResult, 1)
+	setChannelFunc(&entry, c)
 
-		f.setEntry(object, entry)
-		f.mu.Unlock()
+	if entry.runningFSCheck {
+		shard.setEntry(object, entry)
+		shard.mu.Unlock()
 	} else {
-		c = make(chan fsOperationResult, 1) // checkFS will send to this channel; if the channel wasn't buffered it would create a deadlock
-		setChannelFunc(&entry, c)
-
 		entry.runningFSCheck = true
-		f.setEntry(object, entry)
-		f.mu.Unlock()
+		shard.setEntry(object, entry)
+		shard.mu.Unlock()
 
 		f.checkFS(object)
 	}
 
-	operationResult := <-c
-	return operationResult
+	select {
+	case operationResult := <-c:
+		span.SetAttribute("result", string(operationResult))
+		return operationResult
+	case <-ctx.Done():
+		go func() {
+			if <-c == fsOperationAllowed {
+				rollback()
+			}
+		}()
+		span.SetAttribute("result", string(fsOperationCanceled))
+		return fsOperationCanceled
+	}
 }
 
 func (f *Handler) checkFS(object string) {
-	objectExists, err := f.fileHandler.ObjectExists(object)
+	objectExists, err := f.operations.objectExists(object)
 	if err != nil {
 		f.sugar.Errorw("Could not check weather the object exists",
 			"err", err,
 			"object", object)
 	}
 
-	f.mu.Lock()
-	defer f.mu.Unlock()
-	entry := f.getEntry(object)
+	shard := f.shardOf(object)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	entry := shard.getEntry(object)
 	entry.runningFSCheck = false
 
 	if len(entry.wantRead) > 0 {
@@ -310,11 +663,29 @@ func (f *Handler) checkFS(object string) {
 	}
 	entry.wantDelete = nil
 
-	f.mutexDict[object] = entry
+	shard.setEntry(object, entry)
+}
+
+// updateEntry locks the shard of the object and applies the update to the entry of the object.
+func (f *Handler) updateEntry(object string, update func(entry *MutexEntry)) {
+	shard := f.shardOf(object)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	entry := shard.getEntry(object)
+	update(&entry)
+	shard.setEntry(object, entry)
+}
+
+// shardOf returns the shard of the lock table that is responsible for the object.
+func (f *Handler) shardOf(object string) *lockShard {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(object))
+	return &f.shards[h.Sum32()%numLockShards]
 }
 
-func (f *Handler) getEntry(object string) MutexEntry {
-	entry, ok := f.mutexDict[object]
+func (s *lockShard) getEntry(object string) MutexEntry {
+	entry, ok := s.mutexDict[object]
 	if ok {
 		return entry
 	}
@@ -322,7 +693,7 @@ func (f *Handler) getEntry(object string) MutexEntry {
 	return MutexEntry{}
 }
 
-func (f *Handler) setEntry(object string, entry MutexEntry) {
+func (s *lockShard) setEntry(object string, entry MutexEntry) {
 	isEmpty := len(entry.wantRead) == 0 &&
 		entry.read == 0 &&
 		entry.wantWrite == nil &&
@@ -330,11 +701,13 @@ func (f *Handler) setEntry(object string, entry MutexEntry) {
 		entry.wantDelete == nil &&
 		!entry.delete &&
 		!entry.scheduledDelayedDeletion &&
-		!entry.runningFSCheck
+		!entry.runningFSCheck &&
+		!entry.repair &&
+		!entry.replace
 
 	if isEmpty { // unfortunately the test entry == MutexEntry{} is not allowed
-		delete(f.mutexDict, object)
+		delete(s.mutexDict, object)
 	} else {
-		f.mutexDict[object] = entry
+		s.mutexDict[object] = entry
 	}
 }
@@ -0,0 +1,732 @@
+package object
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/rstdm/mini-ceph/internal/api/object/distribution"
+	"github.com/rstdm/mini-ceph/internal/api/object/file"
+	"go.uber.org/zap"
+	"io"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// The tests in this file drive the lock state machine of the Handler with a fake backend. Every backend call parks
+// until the scheduler of the test releases it. A run of a scenario repeatedly waits until every operation is either
+// finished, parked in the backend or waiting for the result of a parked lookup, and then releases exactly one parked
+// call (or starts one operation). This serializes the execution, so a run is fully determined by the sequence of
+// choices. The choices are explored exhaustively by a depth first search.
+
+const testObject = "2352da7280f1decc3acf1ba84eb945c9fc2b7b541094e1d0992dbffd1b6664cc"
+
+type opKind string
+
+const (
+	opRead    opKind = "R"
+	opWrite   opKind = "W"
+	opDelete  opKind = "D"
+	opReplace opKind = "P"
+)
+
+type workerKey struct{}
+
+// workerOf returns the ID of the operation that performs a backend call, or -1 if the call isn't bound to an
+// operation (e.g. the deletion after the last read).
+func workerOf(ctx context.Context) int {
+	if worker, ok := ctx.Value(workerKey{}).(int); ok {
+		return worker
+	}
+	return -1
+}
+
+// scheduler parks backend calls until the test releases them.
+type scheduler struct {
+	mu     sync.Mutex
+	parked map[string]chan struct{}
+}
+
+func newScheduler() *scheduler {
+	return &scheduler{parked: map[string]chan struct{}{}}
+}
+
+func (s *scheduler) park(call string, worker int) {
+	if s == nil {
+		return
+	}
+
+	release := make(chan struct{})
+	s.mu.Lock()
+	s.parked[call+"/"+strconv.Itoa(worker)] = release
+	s.mu.Unlock()
+	<-release
+}
+
+// parkedCalls returns the parked calls in a deterministic order.
+func (s *scheduler) parkedCalls() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var calls []string
+	for call := range s.parked {
+		calls = append(calls, call)
+	}
+	sort.Strings(calls)
+	return calls
+}
+
+func (s *scheduler) release(call string) {
+	s.mu.Lock()
+	release := s.parked[call]
+	delete(s.parked, call)
+	s.mu.Unlock()
+	close(release)
+}
+
+// fakeOperations stores objects in memory and reports every violation of the mutual exclusion.
+type fakeOperations struct {
+	scheduler *scheduler // nil if calls shouldn't block
+
+	mu            sync.Mutex
+	exists        map[string]bool
+	activeReads   map[string]int
+	activeWrites  map[string]int
+	activeDeletes map[string]int
+	activeReplace map[string]int
+	violations    []string
+}
+
+func newFakeOperations(scheduler *scheduler) *fakeOperations {
+	return &fakeOperations{
+		scheduler:     scheduler,
+		exists:        map[string]bool{},
+		activeReads:   map[string]int{},
+		activeWrites:  map[string]int{},
+		activeDeletes: map[string]int{},
+		activeReplace: map[string]int{},
+	}
+}
+
+func (o *fakeOperations) violation(format string, args ...any) {
+	o.violations = append(o.violations, fmt.Sprintf(format, args...))
+}
+
+func (o *fakeOperations) objectExists(objectHash string) (bool, error) {
+	o.scheduler.park("objectExists", -1)
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.exists[objectHash], nil
+}
+
+func (o *fakeOperations) transferObject(ctx context.Context, objectHash string, _ bool, _ TransferObjectFunc) error {
+	o.mu.Lock()
+	if !o.exists[objectHash] {
+		o.violation("read of object that doesn't exist")
+	}
+	if o.activeWrites[objectHash] > 0 || o.activeDeletes[objectHash] > 0 {
+		o.violation("read while the object is created or deleted")
+	}
+	o.activeReads[objectHash]++
+	o.mu.Unlock()
+
+	o.scheduler.park("transferObject", workerOf(ctx))
+
+	o.mu.Lock()
+	o.activeReads[objectHash]--
+	o.mu.Unlock()
+	return nil
+}
+
+func (o *fakeOperations) persistObject(ctx context.Context, objectHash string, _ OpenContentFunc, _ file.Metadata) error {
+	o.mu.Lock()
+	if o.exists[objectHash] {
+		o.violation("create of object that already exists")
+	}
+	if o.activeReads[objectHash] > 0 || o.activeWrites[objectHash] > 0 || o.activeDeletes[objectHash] > 0 ||
+		o.activeReplace[objectHash] > 0 {
+		o.violation("create while the object is read, created, deleted or replaced")
+	}
+	o.activeWrites[objectHash]++
+	o.mu.Unlock()
+
+	o.scheduler.park("persistObject", workerOf(ctx))
+
+	o.mu.Lock()
+	o.activeWrites[objectHash]--
+	o.exists[objectHash] = true
+	o.mu.Unlock()
+	return nil
+}
+
+func (o *fakeOperations) deleteObject(ctx context.Context, objectHash string, _ bool) error {
+	o.mu.Lock()
+	if !o.exists[objectHash] {
+		o.violation("delete of object that doesn't exist")
+	}
+	if o.activeReads[objectHash] > 0 {
+		o.violation("delete while the object is read")
+	}
+	if o.activeWrites[objectHash] > 0 || o.activeDeletes[objectHash] > 0 || o.activeReplace[objectHash] > 0 {
+		o.violation("delete while the object is created, deleted or replaced")
+	}
+	o.activeDeletes[objectHash]++
+	o.mu.Unlock()
+
+	o.scheduler.park("deleteObject", workerOf(ctx))
+
+	o.mu.Lock()
+	o.activeDeletes[objectHash]--
+	o.exists[objectHash] = false
+	o.mu.Unlock()
+	return nil
+}
+
+// replaceObject may run concurrently with reads; they keep reading the previous version.
+func (o *fakeOperations) replaceObject(ctx context.Context, objectHash string, _ OpenContentFunc, _ file.Metadata) error {
+	o.mu.Lock()
+	if o.activeWrites[objectHash] > 0 || o.activeDeletes[objectHash] > 0 || o.activeReplace[objectHash] > 0 {
+		o.violation("replace while the object is created, deleted or replaced")
+	}
+	o.activeReplace[objectHash]++
+	o.mu.Unlock()
+
+	o.scheduler.park("replaceObject", workerOf(ctx))
+
+	o.mu.Lock()
+	o.activeReplace[objectHash]--
+	o.exists[objectHash] = true
+	o.mu.Unlock()
+	return nil
+}
+
+func (o *fakeOperations) deleteReplicas(ctx context.Context, _ string) error {
+	o.scheduler.park("deleteReplicas", workerOf(ctx))
+	return nil
+}
+
+func (o *fakeOperations) writeTombstone(string) error {
+	return nil
+}
+
+func (o *fakeOperations) removeTombstone(string) error {
+	return nil
+}
+
+func (o *fakeOperations) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithCancel(ctx)
+}
+
+func newTestHandler(t testing.TB, operations objectOperations, readBalancing bool) *Handler {
+	missing, err := loadMissingSet(filepath.Join(t.TempDir(), relativeMissingSetPath))
+	if err != nil {
+		t.Fatalf("load missing set: %v", err)
+	}
+
+	handler := &Handler{
+		operations:    operations,
+		readBalancing: readBalancing,
+		missing:       missing,
+		sugar:         zap.NewNop().Sugar(),
+	}
+	for i := range handler.shards {
+		handler.shards[i].mutexDict = map[string]MutexEntry{}
+	}
+
+	return handler
+}
+
+// scenario is a set of concurrent operations on a single object.
+type scenario struct {
+	ops           []opKind
+	initiallyHeld bool // the object exists before the first operation starts
+	readBalancing bool
+}
+
+func (s scenario) String() string {
+	var ops []string
+	for _, op := range s.ops {
+		ops = append(ops, string(op))
+	}
+	return fmt.Sprintf("ops=%v exists=%v readBalancing=%v", strings.Join(ops, ""), s.initiallyHeld, s.readBalancing)
+}
+
+// opResult records when an operation started and returned. The sequence numbers are steps of the scheduler.
+type opResult struct {
+	kind     opKind
+	err      error
+	started  int
+	returned int
+}
+
+type runResult struct {
+	choices    []int
+	branching  []int
+	trace      []string
+	results    []opResult
+	violations []string
+}
+
+// run executes the scenario once. The first choices are taken from prefix; all following choices are 0.
+func (s scenario) run(t *testing.T, prefix []int) runResult {
+	sched := newScheduler()
+	operations := newFakeOperations(sched)
+	operations.exists[testObject] = s.initiallyHeld
+	handler := newTestHandler(t, operations, s.readBalancing)
+
+	var result runResult
+	result.results = make([]opResult, len(s.ops))
+
+	var step atomic.Int64
+	var numReturned atomic.Int64
+	var wg sync.WaitGroup
+	started := make([]bool, len(s.ops))
+
+	start := func(worker int) {
+		started[worker] = true
+		result.results[worker] = opResult{kind: s.ops[worker], started: int(step.Load())}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			ctx := context.WithValue(context.Background(), workerKey{}, worker)
+			var err error
+			switch s.ops[worker] {
+			case opRead:
+				err = handler.Read(ctx, testObject, true, func(_ io.ReadSeeker, _ time.Time, _ file.Metadata) {})
+			case opWrite:
+				err = handler.Write(ctx, testObject, nil, file.Metadata{})
+			case opDelete:
+				err = handler.Delete(ctx, testObject)
+			case opReplace:
+				err = handler.Replace(ctx, testObject, nil, file.Metadata{})
+			}
+
+			result.results[worker].err = err
+			result.results[worker].returned = int(step.Load())
+			numReturned.Add(1)
+		}()
+	}
+
+	numStarted := func() int {
+		n := 0
+		for _, isStarted := range started {
+			if isStarted {
+				n++
+			}
+		}
+		return n
+	}
+
+	for {
+		parked, ok := waitUntilQuiescent(handler, sched, numStarted, &numReturned)
+		if !ok {
+			result.violations = append(result.violations, "operations didn't settle; trace: "+strings.Join(result.trace, " "))
+			break
+		}
+
+		// The choices are the parked calls and the operations that haven't been started yet. Operations of the same
+		// kind are interchangeable, so only the first operation of every kind that hasn't been started is a choice.
+		choices := parked
+		canStart := map[opKind]bool{}
+		for worker, isStarted := range started {
+			if !isStarted && !canStart[s.ops[worker]] {
+				canStart[s.ops[worker]] = true
+				choices = append(choices, "start/"+strconv.Itoa(worker))
+			}
+		}
+		if len(choices) == 0 {
+			if int(numReturned.Load()) != len(s.ops) {
+				result.violations = append(result.violations, "deadlock; trace: "+strings.Join(result.trace, " "))
+			}
+			break
+		}
+
+		choice := 0
+		if len(result.choices) < len(prefix) {
+			choice = prefix[len(result.choices)]
+		}
+		result.choices = append(result.choices, choice)
+		result.branching = append(result.branching, len(choices))
+		result.trace = append(result.trace, choices[choice])
+		step.Add(1)
+
+		if strings.HasPrefix(choices[choice], "start/") {
+			worker, _ := strconv.Atoi(strings.TrimPrefix(choices[choice], "start/"))
+			start(worker)
+		} else {
+			sched.release(choices[choice])
+		}
+	}
+
+	if len(result.violations) == 0 {
+		wg.Wait()
+	}
+
+	operations.mu.Lock()
+	result.violations = append(result.violations, operations.violations...)
+	exists := operations.exists[testObject]
+	operations.mu.Unlock()
+
+	if len(result.violations) == 0 {
+		result.violations = append(result.violations, s.checkResults(handler, result.results, exists)...)
+	}
+
+	return result
+}
+
+// waitUntilQuiescent waits until every started operation is finished, parked in the backend or waiting for the
+// result of a parked lookup. It returns the parked calls.
+func waitUntilQuiescent(handler *Handler, sched *scheduler, numStarted func() int, numReturned *atomic.Int64) ([]string, bool) {
+	isQuiescent := func() bool {
+		parked := len(sched.parkedCalls())
+
+		shard := handler.shardOf(testObject)
+		shard.mu.Lock()
+		entry := shard.getEntry(testObject)
+		shard.mu.Unlock()
+
+		waiting := len(entry.wantRead)
+		if entry.wantWrite != nil {
+			waiting++
+		}
+		if entry.wantDelete != nil {
+			waiting++
+		}
+		if entry.runningFSCheck {
+			waiting-- // the operation that performs the lookup registered itself as well; it is parked or about to park
+		}
+
+		return int(numReturned.Load())+parked+waiting == numStarted()
+	}
+
+	// Every transition that leaves the quiescent state is performed by a goroutine that isn't counted (it isn't
+	// parked, waiting or finished). The counters can therefore only underestimate the progress and a single check
+	// suffices.
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if isQuiescent() {
+			return sched.parkedCalls(), true
+		}
+		runtime.Gosched()
+	}
+
+	return nil, false
+}
+
+// checkResults checks the invariants that can only be verified after all operations have returned.
+func (s scenario) checkResults(handler *Handler, results []opResult, exists bool) []string {
+	var violations []string
+
+	// the lock table must not leak any state
+	for i := range handler.shards {
+		if len(handler.shards[i].mutexDict) != 0 {
+			violations = append(violations, fmt.Sprintf("lock table isn't empty: %+v", handler.shards[i].mutexDict))
+		}
+	}
+
+	// Writes only succeed if the object doesn't exist and deletions only succeed if it exists. Every deletion must
+	// have been performed once the last read finished.
+	expected := s.initiallyHeld
+	numWrites, numDeletes, numReplaces := 0, 0, 0
+	for _, result := range results {
+		if result.err != nil {
+			continue
+		}
+		switch result.kind {
+		case opWrite:
+			numWrites++
+		case opDelete:
+			numDeletes++
+		case opReplace:
+			numReplaces++
+		}
+	}
+	count := numWrites - numDeletes
+	if s.initiallyHeld {
+		count++
+	}
+	// a replacement creates the object if it doesn't exist; the final state depends on the order of the operations
+	if numReplaces > 0 {
+		expected = exists
+	} else if count != 0 && count != 1 {
+		violations = append(violations, fmt.Sprintf("%v successful writes and %v successful deletes", numWrites, numDeletes))
+	} else {
+		expected = count == 1
+	}
+	if exists != expected {
+		violations = append(violations, fmt.Sprintf("object exists=%v, expected %v", exists, expected))
+	}
+
+	// A read that starts after a confirmed deletion must fail unless the object has been created again. A write that
+	// overlaps with the deletion may take effect after the deletion.
+	for _, read := range results {
+		if read.kind != opRead || read.err != nil {
+			continue
+		}
+		for _, deletion := range results {
+			if deletion.kind != opDelete || deletion.err != nil || deletion.returned >= read.started {
+				continue
+			}
+
+			recreated := false
+			for _, write := range results {
+				recreated = recreated || ((write.kind == opWrite || write.kind == opReplace) && write.err == nil &&
+					write.returned >= deletion.started && write.started <= read.returned)
+			}
+			if !recreated {
+				violations = append(violations, "read succeeded after the deletion had been confirmed")
+			}
+		}
+	}
+
+	// failed operations must report the documented errors
+	for _, result := range results {
+		switch {
+		case result.err == nil:
+		case result.kind == opRead && errors.Is(result.err, ErrObjectDoesNotExist):
+		case result.kind == opWrite && errors.Is(result.err, ErrObjectDoesExist):
+		case result.kind == opDelete && errors.Is(result.err, ErrObjectDoesNotExist):
+		case result.kind == opDelete && errors.Is(result.err, ErrObjectIsReplaced):
+		case result.kind == opReplace && errors.Is(result.err, ErrObjectIsBusy):
+		default:
+			violations = append(violations, fmt.Sprintf("%v failed with unexpected error %v", result.kind, result.err))
+		}
+	}
+
+	return violations
+}
+
+// explore runs the scenario with every possible sequence of choices and returns the number of runs.
+func (s scenario) explore(t *testing.T) int {
+	var prefix []int
+	for runs := 1; ; runs++ {
+		result := s.run(t, prefix)
+		if len(result.violations) > 0 {
+			t.Fatalf("%v: trace %v: %v", s, strings.Join(result.trace, " "), result.violations)
+		}
+
+		// backtrack to the last choice that has an unexplored alternative
+		i := len(result.choices) - 1
+		for i >= 0 && result.choices[i]+1 >= result.branching[i] {
+			i--
+		}
+		if i < 0 {
+			return runs
+		}
+		prefix = append(result.choices[:i:i], result.choices[i]+1)
+	}
+}
+
+// scenarios returns all multisets of the given size of read, write, delete and replace operations.
+func scenarios(size int) [][]opKind {
+	kinds := []opKind{opRead, opWrite, opDelete, opReplace}
+
+	var result [][]opKind
+	var build func(ops []opKind, minKind int)
+	build = func(ops []opKind, minKind int) {
+		if len(ops) == size {
+			result = append(result, append([]opKind(nil), ops...))
+			return
+		}
+		for k := minKind; k < len(kinds); k++ {
+			build(append(ops, kinds[k]), k)
+		}
+	}
+	build(nil, 0)
+
+	return result
+}
+
+func TestInterleavings(t *testing.T) {
+	sizes := []int{1, 2, 3}
+	if !testing.Short() {
+		sizes = append(sizes, 4)
+	}
+
+	for _, size := range sizes {
+		for _, ops := range scenarios(size) {
+			for _, initiallyHeld := range []bool{false, true} {
+				for _, readBalancing := range []bool{false, true} {
+					s := scenario{ops: ops, initiallyHeld: initiallyHeld, readBalancing: readBalancing}
+					t.Run(s.String(), func(t *testing.T) {
+						t.Parallel()
+						runs := s.explore(t)
+						t.Logf("explored %v interleavings", runs)
+					})
+				}
+			}
+		}
+	}
+}
+
+// TestCanceledLookupIsRolledBack cancels a read that waits for the lookup of another read. The lookup allows both
+// reads; the canceled read must release its read lock again.
+func TestCanceledLookupIsRolledBack(t *testing.T) {
+	sched := newScheduler()
+	operations := newFakeOperations(sched)
+	operations.exists[testObject] = true
+	handler := newTestHandler(t, operations, false)
+	noop := func(_ io.ReadSeeker, _ time.Time, _ file.Metadata) {}
+
+	firstRead := make(chan error)
+	go func() {
+		firstRead <- handler.Read(context.Background(), testObject, true, noop)
+	}()
+	waitForParkedCall(t, sched, "objectExists/-1")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	secondRead := make(chan error)
+	go func() {
+		secondRead <- handler.Read(ctx, testObject, true, noop)
+	}()
+	waitForEntry(t, handler, func(entry MutexEntry) bool { return len(entry.wantRead) == 2 })
+
+	cancel()
+	if err := <-secondRead; !errors.Is(err, context.Canceled) {
+		t.Fatalf("canceled read returned %v", err)
+	}
+
+	sched.release("objectExists/-1")
+	waitForParkedCall(t, sched, "transferObject/-1")
+	sched.release("transferObject/-1")
+	if err := <-firstRead; err != nil {
+		t.Fatalf("read returned %v", err)
+	}
+
+	waitForEntry(t, handler, func(entry MutexEntry) bool { return entry.read == 0 && !entry.runningFSCheck })
+
+	// the object can be deleted immediately; nothing holds the read lock anymore
+	deleted := make(chan error)
+	go func() {
+		deleted <- handler.Delete(context.Background(), testObject)
+	}()
+	waitForParkedCall(t, sched, "objectExists/-1")
+	sched.release("objectExists/-1")
+	waitForParkedCall(t, sched, "deleteObject/-1")
+	sched.release("deleteObject/-1")
+	if err := <-deleted; err != nil {
+		t.Fatalf("delete returned %v", err)
+	}
+
+	if len(operations.violations) > 0 {
+		t.Fatal(operations.violations)
+	}
+}
+
+func waitForParkedCall(t *testing.T, sched *scheduler, call string) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		for _, parked := range sched.parkedCalls() {
+			if parked == call {
+				return
+			}
+		}
+		time.Sleep(100 * time.Microsecond)
+	}
+	t.Fatalf("%v hasn't been called", call)
+}
+
+func waitForEntry(t *testing.T, handler *Handler, condition func(entry MutexEntry) bool) {
+	t.Helper()
+
+	shard := handler.shardOf(testObject)
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		shard.mu.Lock()
+		entry := shard.getEntry(testObject)
+		shard.mu.Unlock()
+		if condition(entry) {
+			return
+		}
+		time.Sleep(100 * time.Microsecond)
+	}
+	t.Fatal("the state of the object didn't change as expected")
+}
+
+// objectsOfBothRoles returns an object of a placement group of which the node is primary and an object of a placement
+// group of which it is a replica.
+func objectsOfBothRoles(t *testing.T, distributionHandler *distribution.Handler) (primaryObject string, replicaObject string) {
+	t.Helper()
+
+	for i := 0; primaryObject == "" || replicaObject == ""; i++ {
+		hash := sha256.Sum256([]byte(strconv.Itoa(i)))
+		object := hex.EncodeToString(hash[:])
+		dist, err := distributionHandler.GetDistribution(object)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if dist.IsPrimary {
+			primaryObject = object
+		} else {
+			replicaObject = object
+		}
+	}
+	return primaryObject, replicaObject
+}
+
+// BenchmarkLockTable measures the throughput of the bookkeeping that every read performs in the lock table. Run it
+// with -cpu 1,2,4,8: with objects spread over all shards the throughput grows with the number of cores, with all
+// objects in one shard it doesn't.
+func BenchmarkLockTable(b *testing.B) {
+	const numObjects = 4096
+
+	spread := make([]string, numObjects)
+	for i := range spread {
+		spread[i] = fmt.Sprintf("%064x", i)
+	}
+
+	var handler Handler
+	sameShard := make([]string, 0, numObjects)
+	for i := 0; len(sameShard) < numObjects; i++ {
+		object := fmt.Sprintf("%064x", i)
+		if handler.shardOf(object) == &handler.shards[0] {
+			sameShard = append(sameShard, object)
+		}
+	}
+
+	b.Run("spread", func(b *testing.B) { benchmarkLockTable(b, spread) })
+	b.Run("oneShard", func(b *testing.B) { benchmarkLockTable(b, sameShard) })
+}
+
+func benchmarkLockTable(b *testing.B, objects []string) {
+	handler := &Handler{}
+	for i := range handler.shards {
+		handler.shards[i].mutexDict = map[string]MutexEntry{}
+	}
+
+	var nextGoroutine atomic.Int64
+	b.RunParallel(func(pb *testing.PB) {
+		i := int(nextGoroutine.Add(1)) * 7919
+		for pb.Next() {
+			i++
+			object := objects[i%len(objects)]
+			shard := handler.shardOf(object)
+
+			// start and finish a read like Read does
+			shard.mu.Lock()
+			entry := shard.getEntry(object)
+			entry.read += 1
+			shard.setEntry(object, entry)
+			shard.mu.Unlock()
+
+			shard.mu.Lock()
+			entry = shard.getEntry(object)
+			entry.read -= 1
+			shard.setEntry(object, entry)
+			shard.mu.Unlock()
+		}
+	})
+}
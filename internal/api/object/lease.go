@@ -0,0 +1,196 @@
+package object
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+var ErrReplicaNotClean = errors.New("the replica isn't in sync with the primary")
+
+// leaseSafetyMargin compensates for clock drift and network latency. Secondaries consider their leases as expired
+// before the primary does.
+const leaseSafetyMargin = 500 * time.Millisecond
+
+type leaseKey struct {
+	placementGroup uint32
+	host           string
+}
+
+// leaseTable keeps track of the read leases that the current node has granted (as primary) and that it holds (as
+// secondary). A secondary only serves reads while it holds a lease. The primary doesn't acknowledge a deletion before
+// all secondaries either deleted their copy or their lease has expired.
+type leaseTable struct {
+	duration time.Duration
+
+	mu      sync.Mutex
+	granted map[leaseKey]time.Time // expiry of every lease granted by the primary
+	unclean map[leaseKey]bool      // replicas that missed a deletion don't get a lease until they are repaired
+	held    map[uint32]time.Time   // expiry of every lease held by the secondary
+
+	// only one lease per placement group is requested at a time; the buffered channel of size one is the lock
+	acquiring map[uint32]chan struct{}
+}
+
+func newLeaseTable(duration time.Duration) *leaseTable {
+	return &leaseTable{
+		duration:  duration,
+		granted:   map[leaseKey]time.Time{},
+		unclean:   map[leaseKey]bool{},
+		held:      map[uint32]time.Time{},
+		acquiring: map[uint32]chan struct{}{},
+	}
+}
+
+// GrantReadLease is called by a secondary of a placement group for which the current node is the primary.
+func (f *Handler) GrantReadLease(placementGroup uint32, host string) (time.Duration, error) {
+	if !f.isPrimaryOf(placementGroup) {
+		return 0, ErrNotPrimary
+	}
+
+	isSecondary := false
+	for _, slaveHost := range f.distributionHandler.SlaveHosts(placementGroup) {
+		isSecondary = isSecondary || slaveHost == host
+	}
+	if !isSecondary {
+		return 0, fmt.Errorf("%v is no secondary of placement group %v", host, placementGroup)
+	}
+
+	if !f.isCleanReplica(placementGroup, host) {
+		return 0, ErrReplicaNotClean
+	}
+
+	l := f.leases
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	key := leaseKey{placementGroup, host}
+	if l.unclean[key] {
+		return 0, ErrReplicaNotClean
+	}
+	l.granted[key] = time.Now().Add(l.duration)
+
+	return l.duration, nil
+}
+
+// HasReadLease returns true if the current node is allowed to serve reads of the placement group as secondary. A new
+// lease is requested from the primary if necessary. Requests that wait for the lease request of another request give
+// up when their context is done.
+func (f *Handler) HasReadLease(ctx context.Context, placementGroup uint32) bool {
+	l := f.leases
+	if l.holds(placementGroup) {
+		return true
+	}
+
+	if !l.lockAcquiring(ctx, placementGroup) {
+		return false
+	}
+	defer l.unlockAcquiring(placementGroup)
+	if l.holds(placementGroup) { // another request acquired the lease in the meantime
+		return true
+	}
+
+	// a lease that is granted after its duration has already expired is useless
+	ctx, cancel := context.WithTimeout(ctx, l.duration)
+	defer cancel()
+
+	requestedAt := time.Now()
+	lease, granted, err := f.operationHandler.replicationHandler.RequestReadLease(ctx, placementGroup,
+		f.distributionHandler.OwnHost(), f.distributionHandler.PrimaryHost(placementGroup))
+	if err != nil {
+		f.sugar.Warnw("Failed to request read lease", "err", err, "placementGroup", placementGroup)
+		return false
+	}
+	if !granted {
+		return false
+	}
+
+	l.mu.Lock()
+	// the lease starts when the request has been sent; the primary started it later
+	l.held[placementGroup] = requestedAt.Add(lease.Duration - leaseSafetyMargin)
+	l.mu.Unlock()
+
+	return true
+}
+
+// lockAcquiring locks the lease requests of the placement group. It returns false if the context is done before the
+// lock has been acquired.
+func (l *leaseTable) lockAcquiring(ctx context.Context, placementGroup uint32) bool {
+	l.mu.Lock()
+	lock, ok := l.acquiring[placementGroup]
+	if !ok {
+		lock = make(chan struct{}, 1)
+		l.acquiring[placementGroup] = lock
+	}
+	l.mu.Unlock()
+
+	select {
+	case lock <- struct{}{}:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (l *leaseTable) unlockAcquiring(placementGroup uint32) {
+	l.mu.Lock()
+	lock := l.acquiring[placementGroup]
+	l.mu.Unlock()
+
+	<-lock
+}
+
+func (l *leaseTable) holds(placementGroup uint32) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return time.Now().Before(l.held[placementGroup])
+}
+
+// revoke prevents that the replica gets new leases and waits until the existing lease has expired. It is called if
+// the replica couldn't be informed about a deletion.
+func (l *leaseTable) revoke(placementGroup uint32, host string) {
+	l.mu.Lock()
+	key := leaseKey{placementGroup, host}
+	l.unclean[key] = true
+	expiry := l.granted[key]
+	l.mu.Unlock()
+
+	time.Sleep(time.Until(expiry))
+}
+
+// markClean allows the replica to get leases again. It is called once the replica has been repaired, either by the
+// recovery of the missing set or by a scrub.
+func (l *leaseTable) markClean(placementGroup uint32, host string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	delete(l.unclean, leaseKey{placementGroup, host})
+}
+
+// isCleanReplica returns false if the last scrub of the placement group detected inconsistencies on the replica that
+// haven't been repaired or if the replica missed a write or a deletion.
+func (f *Handler) isCleanReplica(placementGroup uint32, host string) bool {
+	if !f.missing.isEmpty(placementGroup, host) {
+		return false
+	}
+
+	report, ok := f.scrubber.getReport(placementGroup)
+	if !ok {
+		return true
+	}
+
+	repaired := map[string]bool{}
+	for _, repair := range report.Repairs {
+		repaired[repair.ObjectHash] = true
+	}
+	for _, inconsistency := range report.Inconsistencies {
+		if inconsistency.Host == host && !repaired[inconsistency.ObjectHash] {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,115 @@
+package object
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/rstdm/mini-ceph/internal/api/object/distribution"
+	"github.com/rstdm/mini-ceph/internal/api/object/file"
+	"github.com/rstdm/mini-ceph/internal/api/object/replication"
+	"github.com/rstdm/mini-ceph/internal/configuration"
+	"github.com/rstdm/mini-ceph/internal/metrics"
+	"go.uber.org/zap"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newSecondaryHandler creates the handler of a node that is the secondary of two placement groups. The primary of
+// both placement groups is the given server.
+func newSecondaryHandler(t *testing.T, primary *httptest.Server, leaseDuration time.Duration) *Handler {
+	dataFolder := t.TempDir()
+	config := configuration.Configuration{
+		Pools:             map[string]configuration.Pool{configuration.DefaultPool: {Size: 2, MinSize: 1}},
+		DataFolder:        dataFolder,
+		ObjectFolder:      filepath.Join(dataFolder, "data"),
+		StorageBackend:    file.BackendFile,
+		NodeHosts:         []string{"localhost:0", strings.TrimPrefix(primary.URL, "http://")},
+		NodeSchemes:       []string{"http", "http"},
+		PlacementGroups:   [][]int{{1, 0}, {1, 0}},
+		ReadBalancing:     true,
+		ReadLeaseDuration: leaseDuration,
+	}
+	distributionHandler := distribution.NewHandler(0, config.NodeHosts, config.PlacementGroups)
+	handler, err := NewHandler(config, distributionHandler, nil, metrics.NewRegistry(), zap.NewNop().Sugar())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return handler
+}
+
+func TestLeaseRequestsArePerPlacementGroup(t *testing.T) {
+	release := make(chan struct{})
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasSuffix(r.URL.Path, "/lease") {
+			return // health checks and the other background requests of the secondary
+		}
+		if strings.Contains(r.URL.Path, "/pg/0/") {
+			select {
+			case <-release:
+			case <-r.Context().Done():
+				return
+			}
+		}
+		_ = json.NewEncoder(w).Encode(replication.ReadLease{Duration: time.Minute})
+	}))
+	defer primary.Close()
+	defer close(release)
+	handler := newSecondaryHandler(t, primary, time.Minute)
+
+	blocked := make(chan bool)
+	go func() { blocked <- handler.HasReadLease(context.Background(), 0) }()
+	waitForLeaseRequest(t, handler, 0)
+
+	// the lease of another placement group doesn't wait for the blocked request
+	if !handler.HasReadLease(context.Background(), 1) {
+		t.Error("HasReadLease(1) = false")
+	}
+
+	// waiting requests give up when their context is done
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if handler.HasReadLease(ctx, 0) {
+		t.Error("HasReadLease(0) of a waiting request = true")
+	}
+
+	release <- struct{}{}
+	if !<-blocked {
+		t.Error("HasReadLease(0) = false after the primary answered")
+	}
+}
+
+func TestLeaseRequestIsBoundedByTheLeaseDuration(t *testing.T) {
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/lease") {
+			<-r.Context().Done() // the primary never answers
+		}
+	}))
+	defer primary.Close()
+	handler := newSecondaryHandler(t, primary, 100*time.Millisecond)
+
+	start := time.Now()
+	if handler.HasReadLease(context.Background(), 0) {
+		t.Error("HasReadLease() = true")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("HasReadLease() returned after %v", elapsed)
+	}
+}
+
+// waitForLeaseRequest waits until a request holds the lock of the lease requests of the placement group.
+func waitForLeaseRequest(t *testing.T, handler *Handler, placementGroup uint32) {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		handler.leases.mu.Lock()
+		lock := handler.leases.acquiring[placementGroup]
+		handler.leases.mu.Unlock()
+		if lock != nil && len(lock) == 1 {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatal("the lease hasn't been requested")
+}
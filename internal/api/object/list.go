@@ -0,0 +1,93 @@
+package object
+
+import (
+	"errors"
+	"fmt"
+	"github.com/rstdm/mini-ceph/internal/api/object/file"
+	"os"
+	"time"
+)
+
+// ListedObject is an entry of the object listing.
+type ListedObject struct {
+	Name         string
+	Pool         string
+	Size         int64 // size of the clear-text content
+	LastModified time.Time
+	Checksum     string // hex encoded sha256 digest of the clear-text content; empty for objects of older versions
+	MD5          string `json:",omitempty"` // hex encoded md5 digest of the clear-text content of unencrypted objects
+}
+
+// listBatchSize is the number of names that are read from the name index at once.
+const listBatchSize = 1000
+
+// ListObjects returns up to limit named objects of the placement groups of which the current node is primary, sorted
+// by name. Every node lists only its primary placement groups, so the objects of the cluster are the union of the
+// listings of all nodes. Only objects whose name starts with prefix and is greater than startAfter and for which
+// include returns true are returned. Deleted and expired objects aren't listed, neither are objects that have been
+// created without name. The second return value is true if more objects match. The names are read from the sorted
+// name index, so only the metadata of the listed objects and of the skipped ones is read.
+func (f *Handler) ListObjects(prefix string, startAfter string, limit int, include func(ListedObject) bool) ([]ListedObject, bool, error) {
+	listed := []ListedObject{}
+	now := time.Now()
+	for {
+		batch := f.fileHandler.ListNamedObjects(prefix, startAfter, listBatchSize)
+		for _, named := range batch {
+			object, ok, err := f.listedObject(named, now)
+			if err != nil {
+				return nil, false, err
+			}
+			if !ok || !include(object) {
+				continue
+			}
+			if len(listed) == limit {
+				return listed, true, nil
+			}
+			listed = append(listed, object)
+		}
+		if len(batch) < listBatchSize {
+			return listed, false, nil
+		}
+		startAfter = batch[len(batch)-1].Name
+	}
+}
+
+// listedObject returns false if the object mustn't be listed by this node.
+func (f *Handler) listedObject(named file.NamedObject, now time.Time) (ListedObject, bool, error) {
+	dist, err := f.distributionHandler.GetDistribution(named.Hash)
+	if err != nil {
+		return ListedObject{}, false, fmt.Errorf("calculate distribution of %v: %w", named.Hash, err)
+	}
+	if !dist.IsPrimary {
+		return ListedObject{}, false, nil // the primary lists the object
+	}
+
+	deleted, err := f.fileHandler.HasTombstone(named.Hash)
+	if err != nil {
+		return ListedObject{}, false, fmt.Errorf("check tombstone of %v: %w", named.Hash, err)
+	}
+	if deleted {
+		return ListedObject{}, false, nil
+	}
+
+	info, err := f.fileHandler.StatObject(named.Hash)
+	if errors.Is(err, os.ErrNotExist) {
+		return ListedObject{}, false, nil // deleted in the meantime
+	}
+	if err != nil {
+		return ListedObject{}, false, fmt.Errorf("stat %v: %w", named.Hash, err)
+	}
+	if info.Metadata.Expired(now) || info.Metadata.Name != named.Name {
+		return ListedObject{}, false, nil
+	}
+
+	object := ListedObject{
+		Name:         info.Metadata.Name,
+		Pool:         poolOf(info.Metadata),
+		Size:         info.Size,
+		LastModified: info.ModTime,
+		Checksum:     info.Metadata.Checksum,
+		MD5:          info.Metadata.MD5,
+	}
+	return object, true, nil
+}
@@ -0,0 +1,66 @@
+package object
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/rstdm/mini-ceph/internal/api/object/file"
+	"testing"
+	"time"
+)
+
+func TestListObjects(t *testing.T) {
+	handler := newSingleNodeHandler(t)
+
+	objects := map[string]file.Metadata{
+		"photos/b":   {},
+		"photos/a":   {Pool: "images"},
+		"photos/old": {Expires: time.Now().Add(-time.Minute).Unix()},
+		"videos/a":   {},
+		"":           {}, // objects without name aren't listed
+	}
+	for name, metadata := range objects {
+		metadata.Name = name
+		digest := sha256.Sum256([]byte(name))
+		content, metadata, err := handler.fileHandler.EncodeObject([]byte(name), metadata)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := handler.fileHandler.PersistObject(context.Background(), hex.EncodeToString(digest[:]), content, metadata); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	all := func(ListedObject) bool { return true }
+	listed, truncated, err := handler.ListObjects("photos/", "", 10, all)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(listed) != 2 || listed[0].Name != "photos/a" || listed[1].Name != "photos/b" || truncated {
+		t.Fatalf("ListObjects() = %+v, %v", listed, truncated)
+	}
+	if listed[0].Pool != "images" || listed[1].Pool != "default" || listed[0].Size != 8 ||
+		listed[0].Checksum != file.Checksum([]byte("photos/a")) {
+		t.Errorf("unexpected entry %+v", listed[0])
+	}
+
+	if listed, _, err := handler.ListObjects("", "photos/a", 10, all); err != nil || len(listed) != 2 || listed[0].Name != "photos/b" {
+		t.Errorf("ListObjects() after photos/a = %+v, %v", listed, err)
+	}
+
+	// objects that aren't included don't count towards the limit
+	notImages := func(object ListedObject) bool { return object.Pool != "images" }
+	listed, truncated, err = handler.ListObjects("", "", 1, notImages)
+	if err != nil || len(listed) != 1 || listed[0].Name != "photos/b" || !truncated {
+		t.Errorf("ListObjects() with limit = %+v, %v, %v", listed, truncated, err)
+	}
+
+	// the name index follows deletions
+	digest := sha256.Sum256([]byte("photos/b"))
+	if err := handler.fileHandler.DeleteObject(hex.EncodeToString(digest[:])); err != nil {
+		t.Fatal(err)
+	}
+	if listed, _, err := handler.ListObjects("photos/", "", 10, all); err != nil || len(listed) != 1 || listed[0].Name != "photos/a" {
+		t.Errorf("ListObjects() after deletion = %+v, %v", listed, err)
+	}
+}
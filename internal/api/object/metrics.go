@@ -0,0 +1,98 @@
+package object
+
+import (
+	"github.com/rstdm/mini-ceph/internal/metrics"
+	"sync"
+	"time"
+)
+
+// storageStatsInterval is the minimum interval between two calculations of the disk usage and the object count.
+// Both require listing all objects, which is too expensive for every scrape.
+const storageStatsInterval = 30 * time.Second
+
+// lockTableStats summarizes the lock table.
+type lockTableStats struct {
+	entries                 int // entries of mutexDict
+	readsInProgress         int
+	delayedDeletionsPending int
+	fsLookupsInFlight       int
+}
+
+func (f *Handler) lockTableStats() lockTableStats {
+	var stats lockTableStats
+	for i := range f.shards {
+		shard := &f.shards[i]
+		shard.mu.Lock()
+		stats.entries += len(shard.mutexDict)
+		for _, entry := range shard.mutexDict {
+			stats.readsInProgress += entry.read
+			if entry.scheduledDelayedDeletion {
+				stats.delayedDeletionsPending++
+			}
+			if entry.runningFSCheck {
+				stats.fsLookupsInFlight++
+			}
+		}
+		shard.mu.Unlock()
+	}
+	return stats
+}
+
+// storageStats caches the disk usage and the object count.
+type storageStats struct {
+	mu         sync.Mutex
+	calculated time.Time
+	objects    int
+	diskUsage  int64
+}
+
+func (f *Handler) getStorageStats() (objects int, diskUsage int64) {
+	stats := &f.storageStats
+	stats.mu.Lock()
+	defer stats.mu.Unlock()
+
+	if time.Since(stats.calculated) < storageStatsInterval {
+		return stats.objects, stats.diskUsage
+	}
+
+	listedObjects, err := f.fileHandler.ListObjects()
+	if err != nil {
+		f.sugar.Warnw("Failed to count the objects for the metrics", "err", err)
+	} else {
+		stats.objects = len(listedObjects)
+	}
+	if diskUsage, err := f.fileHandler.DiskUsage(); err != nil {
+		f.sugar.Warnw("Failed to calculate the disk usage for the metrics", "err", err)
+	} else {
+		stats.diskUsage = diskUsage
+	}
+	stats.calculated = time.Now()
+
+	return stats.objects, stats.diskUsage
+}
+
+// registerMetrics registers the gauges of the lock table and of the stored objects. The lock table is summarized once
+// whenever the metrics are collected; all of its gauges report the same snapshot.
+func (f *Handler) registerMetrics(registry *metrics.Registry) {
+	registry.NewGaugeCollector(func() []metrics.Gauge {
+		stats := f.lockTableStats()
+		return []metrics.Gauge{
+			{Name: "miniceph_lock_table_entries", Help: "Number of objects in the lock table (mutexDict).", Value: float64(stats.entries)},
+			{Name: "miniceph_reads_in_progress", Help: "Number of object reads that are currently in progress.", Value: float64(stats.readsInProgress)},
+			{Name: "miniceph_delayed_deletions_pending", Help: "Number of deletions that wait for running reads.", Value: float64(stats.delayedDeletionsPending)},
+			{Name: "miniceph_fs_lookups_in_flight", Help: "Number of file system lookups that are currently running.", Value: float64(stats.fsLookupsInFlight)},
+		}
+	})
+	registry.NewGaugeFunc("miniceph_objects", "Number of objects that are stored on this node.", func() float64 {
+		objects, _ := f.getStorageStats()
+		return float64(objects)
+	})
+	registry.NewGaugeFunc("miniceph_disk_usage_bytes", "Number of bytes that are used by the object folder.", func() float64 {
+		_, diskUsage := f.getStorageStats()
+		return float64(diskUsage)
+	})
+	registry.NewGaugeFunc("miniceph_disk_used_ratio", "Share of the disk space of the data folder that is used.", func() float64 {
+		capacity, _ := f.Capacity()
+		return capacity.UsedRatio
+	})
+}
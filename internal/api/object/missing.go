@@ -0,0 +1,342 @@
+package object
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MissingEntry describes a replica that lacks an object or that still stores an object which has been deleted.
+type MissingEntry struct {
+	PlacementGroup uint32
+	Host           string
+	ObjectHash     string
+}
+
+// missingSet records the replicas that are degraded because they were unreachable during a write or a deletion. The
+// primary repairs the objects as soon as the replicas are reachable again. The set is persisted so that the repairs
+// survive restarts: every change is appended to a journal, which is merged into the snapshot once it has grown to
+// maxJournalSize changes.
+type missingSet struct {
+	path string // the snapshot; the journal is stored next to it
+
+	mu          sync.Mutex
+	entries     map[uint32]map[string]map[string]bool // placement group -> host -> object hashes
+	journal     *os.File                              // nil until the first change is appended
+	journalSize int                                   // number of changes in the journal
+}
+
+// missingChange is a line of the journal of the missing set.
+type missingChange struct {
+	MissingEntry
+	Removed bool `json:",omitempty"`
+}
+
+// maxJournalSize is the number of changes after which the journal is merged into the snapshot.
+const maxJournalSize = 1000
+
+// journalSuffix is appended to the path of the snapshot to get the path of the journal.
+const journalSuffix = ".journal"
+
+func loadMissingSet(path string) (*missingSet, error) {
+	m := &missingSet{
+		path:    path,
+		entries: map[uint32]map[string]map[string]bool{},
+	}
+
+	encodedEntries, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("read %v: %w", path, err)
+	}
+	if err == nil {
+		var entries []MissingEntry
+		if err := json.Unmarshal(encodedEntries, &entries); err != nil {
+			return nil, fmt.Errorf("parse content of %v: %w", path, err)
+		}
+		for _, entry := range entries {
+			m.addWithoutPersisting(entry)
+		}
+	}
+
+	replayed, err := m.replayJournal()
+	if err != nil {
+		return nil, err
+	}
+
+	// the replayed changes are merged into the snapshot; this also drops a line that has been truncated by a crash
+	if replayed {
+		if err := m.compact(); err != nil {
+			return nil, err
+		}
+	}
+
+	return m, nil
+}
+
+// replayJournal applies the changes of the journal. Replaying changes that are already part of the snapshot doesn't
+// change the set because every change sets the state of its entry. The last line is incomplete if the node crashed
+// while the line was appended; it is ignored. replayed is false if the journal is empty.
+func (m *missingSet) replayJournal() (replayed bool, err error) {
+	journal, err := os.ReadFile(m.path + journalSuffix)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("read journal: %w", err)
+	}
+	if len(journal) == 0 {
+		return false, nil
+	}
+
+	lines := bytes.Split(journal, []byte("\n"))
+	for i, line := range lines {
+		if len(line) == 0 {
+			continue
+		}
+		var change missingChange
+		if err := json.Unmarshal(line, &change); err != nil {
+			if i == len(lines)-1 {
+				break // incomplete last line
+			}
+			return false, fmt.Errorf("parse line %v of the journal: %w", i+1, err)
+		}
+		if change.Removed {
+			m.removeWithoutPersisting(change.MissingEntry)
+		} else {
+			m.addWithoutPersisting(change.MissingEntry)
+		}
+	}
+
+	return true, nil
+}
+
+// add records the entry. The change is synced to disk before add returns; a replica that lacks an object must not be
+// forgotten.
+func (m *missingSet) add(entry MissingEntry) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.entries[entry.PlacementGroup][entry.Host][entry.ObjectHash] {
+		return nil
+	}
+	m.addWithoutPersisting(entry)
+	return m.appendChange(missingChange{MissingEntry: entry}, true)
+}
+
+func (m *missingSet) addWithoutPersisting(entry MissingEntry) {
+	hosts, ok := m.entries[entry.PlacementGroup]
+	if !ok {
+		hosts = map[string]map[string]bool{}
+		m.entries[entry.PlacementGroup] = hosts
+	}
+
+	objects, ok := hosts[entry.Host]
+	if !ok {
+		objects = map[string]bool{}
+		hosts[entry.Host] = objects
+	}
+
+	objects[entry.ObjectHash] = true
+}
+
+// remove deletes the entry. The change isn't synced; if it gets lost the object is repaired once more.
+func (m *missingSet) remove(entry MissingEntry) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !m.entries[entry.PlacementGroup][entry.Host][entry.ObjectHash] {
+		return nil
+	}
+	m.removeWithoutPersisting(entry)
+	return m.appendChange(missingChange{MissingEntry: entry, Removed: true}, false)
+}
+
+func (m *missingSet) removeWithoutPersisting(entry MissingEntry) {
+	objects := m.entries[entry.PlacementGroup][entry.Host]
+	delete(objects, entry.ObjectHash)
+	if len(objects) == 0 {
+		delete(m.entries[entry.PlacementGroup], entry.Host)
+	}
+	if len(m.entries[entry.PlacementGroup]) == 0 {
+		delete(m.entries, entry.PlacementGroup)
+	}
+}
+
+func (m *missingSet) isEmpty(placementGroup uint32, host string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return len(m.entries[placementGroup][host]) == 0
+}
+
+// containsObject returns true if any replica lacks the object or still stores it.
+func (m *missingSet) containsObject(objectHash string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, hosts := range m.entries {
+		for _, objects := range hosts {
+			if objects[objectHash] {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func (m *missingSet) list() []MissingEntry {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.listWithoutLocking()
+}
+
+func (m *missingSet) listWithoutLocking() []MissingEntry {
+	entries := []MissingEntry{}
+	for placementGroup, hosts := range m.entries {
+		for host, objects := range hosts {
+			for objectHash := range objects {
+				entries = append(entries, MissingEntry{placementGroup, host, objectHash})
+			}
+		}
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		a, b := entries[i], entries[j]
+		if a.PlacementGroup != b.PlacementGroup {
+			return a.PlacementGroup < b.PlacementGroup
+		}
+		if a.Host != b.Host {
+			return a.Host < b.Host
+		}
+		return a.ObjectHash < b.ObjectHash
+	})
+
+	return entries
+}
+
+// appendChange appends the change to the journal and merges the journal into the snapshot if it has grown too large.
+// It requires that the mutex has already been locked.
+func (m *missingSet) appendChange(change missingChange, durable bool) error {
+	line, err := json.Marshal(change)
+	if err != nil {
+		return fmt.Errorf("json encode: %w", err)
+	}
+	if m.journal == nil {
+		if m.journal, err = os.OpenFile(m.path+journalSuffix, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600); err != nil {
+			return fmt.Errorf("open journal: %w", err)
+		}
+	}
+	if _, err := m.journal.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("append to journal: %w", err)
+	}
+	if durable {
+		if err := m.journal.Sync(); err != nil {
+			return fmt.Errorf("sync journal: %w", err)
+		}
+	}
+
+	m.journalSize++
+	if m.journalSize < maxJournalSize {
+		return nil
+	}
+	return m.compact()
+}
+
+// compact writes the snapshot and truncates the journal. It requires that the mutex has already been locked.
+func (m *missingSet) compact() error {
+	encodedEntries, err := json.Marshal(m.listWithoutLocking())
+	if err != nil {
+		return fmt.Errorf("json encode: %w", err)
+	}
+
+	// the snapshot is replaced atomically; a crash must not leave a truncated file behind
+	temporaryPath := m.path + ".tmp"
+	if err := writeFileSynced(temporaryPath, encodedEntries); err != nil {
+		return fmt.Errorf("write to file %v: %w", temporaryPath, err)
+	}
+	if err := os.Rename(temporaryPath, m.path); err != nil {
+		return fmt.Errorf("rename %v: %w", temporaryPath, err)
+	}
+
+	// the journal is replayed on top of the new snapshot if the node crashes before it has been truncated
+	if err := os.Truncate(m.path+journalSuffix, 0); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("truncate journal: %w", err)
+	}
+	m.journalSize = 0
+
+	return nil
+}
+
+// writeFileSynced writes the file and syncs it to disk.
+func writeFileSynced(path string, content []byte) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(content); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// recordMissing adds the entry to the missing set. The replica won't get read leases until the object is repaired.
+func (f *Handler) recordMissing(entry MissingEntry) {
+	f.sugar.Warnw("Replica is degraded", "placementGroup", entry.PlacementGroup, "host", entry.Host,
+		"object", entry.ObjectHash)
+
+	if err := f.missing.add(entry); err != nil {
+		f.sugar.Errorw("Failed to persist missing set", "err", err)
+	}
+}
+
+// MissingEntries returns all replicas that are currently degraded.
+func (f *Handler) MissingEntries() []MissingEntry {
+	return f.missing.list()
+}
+
+// recover repairs the degraded replicas periodically.
+func (f *Handler) recover(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+
+		repaired := map[string]RepairResult{}
+		for _, entry := range f.missing.list() {
+			result, ok := repaired[entry.ObjectHash]
+			if !ok {
+				var err error
+				result, err = f.Repair(context.Background(), entry.ObjectHash)
+				if err != nil {
+					if !errors.Is(err, ErrObjectIsBusy) {
+						f.sugar.Warnw("Failed to recover degraded object", "err", err, "object", entry.ObjectHash)
+					}
+					continue
+				}
+				repaired[entry.ObjectHash] = result
+			}
+
+			if result.isUnreachable(entry.Host) {
+				continue
+			}
+			if err := f.missing.remove(entry); err != nil {
+				f.sugar.Errorw("Failed to persist missing set", "err", err)
+			}
+			if f.missing.isEmpty(entry.PlacementGroup, entry.Host) {
+				// the replica has caught up with all writes and deletions it missed
+				f.leases.markClean(entry.PlacementGroup, entry.Host)
+			}
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package object
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestMissingSetSurvivesRestarts(t *testing.T) {
+	path := filepath.Join(t.TempDir(), relativeMissingSetPath)
+	m, err := loadMissingSet(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a := MissingEntry{0, "a:5000", "01"}
+	b := MissingEntry{1, "b:5000", "02"}
+	for _, entry := range []MissingEntry{a, b, a} {
+		if err := m.add(entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := m.remove(a); err != nil {
+		t.Fatal(err)
+	}
+	if m.journalSize != 3 {
+		t.Errorf("%v changes have been journaled, expected 3", m.journalSize)
+	}
+
+	// a crash while a change is appended leaves an incomplete line behind
+	if _, err := m.journal.WriteString(`{"PlacementGroup":2,"Ho`); err != nil {
+		t.Fatal(err)
+	}
+
+	reloaded, err := loadMissingSet(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entries := reloaded.list(); !reflect.DeepEqual(entries, []MissingEntry{b}) {
+		t.Errorf("reloaded entries = %v", entries)
+	}
+	if info, err := os.Stat(path + journalSuffix); err != nil || info.Size() != 0 {
+		t.Errorf("the journal hasn't been merged into the snapshot: %v, %v", info, err)
+	}
+}
+
+func TestMissingSetCompactsTheJournal(t *testing.T) {
+	path := filepath.Join(t.TempDir(), relativeMissingSetPath)
+	m, err := loadMissingSet(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entry := MissingEntry{0, "a:5000", "01"}
+	for i := 0; i < maxJournalSize/2; i++ {
+		if err := m.add(entry); err != nil {
+			t.Fatal(err)
+		}
+		if err := m.remove(entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if m.journalSize != 0 {
+		t.Errorf("the journal contains %v changes after %v changes", m.journalSize, maxJournalSize)
+	}
+}
@@ -0,0 +1,370 @@
+package object
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/rstdm/mini-ceph/internal/api/object/file"
+	"github.com/rstdm/mini-ceph/internal/api/object/upload"
+	"io"
+	"os"
+	"time"
+)
+
+// uploadCollectionInterval is the interval in which every node deletes the multipart uploads that have been neither
+// completed nor aborted within the upload timeout.
+const uploadCollectionInterval = 10 * time.Minute
+
+var (
+	ErrInvalidPart    = errors.New("the part hasn't been uploaded or its checksum doesn't match")
+	ErrObjectTooLarge = errors.New("the object is bigger than the configured threshold")
+)
+
+// InitiateUpload starts a multipart upload of the object. The metadata is the metadata of the assembled object. If
+// overwrite is true, the completion replaces an existing object; otherwise, the upload can't be started if the object
+// exists. Only the primary stores the upload; the replicas create it with its first part.
+func (f *Handler) InitiateUpload(objectHash string, metadata file.Metadata, overwrite bool) (upload.Upload, error) {
+	if _, ok := f.operationHandler.pools[metadata.Pool]; !ok {
+		return upload.Upload{}, ErrUnknownPool
+	}
+	// the object can't be created anyway; the completion checks again while it holds the lock of the object. Expired
+	// objects are replaced by the completion.
+	if !overwrite {
+		info, err := f.fileHandler.StatObject(objectHash)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return upload.Upload{}, fmt.Errorf("check whether the object exists: %w", err)
+		}
+		if err == nil && !info.Metadata.Expired(time.Now()) {
+			return upload.Upload{}, ErrObjectDoesExist
+		}
+	}
+
+	id, err := upload.NewID()
+	if err != nil {
+		return upload.Upload{}, fmt.Errorf("create upload id: %w", err)
+	}
+	multipartUpload := upload.Upload{ID: id, ObjectHash: objectHash, Metadata: metadata, Initiated: time.Now(),
+		Overwrite: overwrite}
+	if err := f.uploads.Create(multipartUpload); err != nil {
+		return upload.Upload{}, fmt.Errorf("persist upload: %w", err)
+	}
+
+	return multipartUpload, nil
+}
+
+// UploadPart encodes the content of the part like an object of the pool of the upload and persists it on the primary
+// and on the replicas. A part with the same number is replaced, so failed parts can be uploaded again. The part is
+// accepted once MinSize copies have been persisted.
+func (f *Handler) UploadPart(ctx context.Context, objectHash string, uploadID string, number int, content []byte) (upload.Part, error) {
+	ctx, cancel := f.operationHandler.withTimeout(ctx)
+	defer cancel()
+
+	multipartUpload, err := f.uploads.Get(objectHash, uploadID)
+	if err != nil {
+		return upload.Part{}, err
+	}
+	pool := f.operationHandler.pools[multipartUpload.Metadata.Pool]
+	dist, err := f.distributionHandler.GetDistribution(objectHash)
+	if err != nil {
+		return upload.Part{}, fmt.Errorf("calculate distribution: %w", err)
+	}
+
+	storedContent, metadata, err := f.fileHandler.EncodeObject(content, file.Metadata{Pool: multipartUpload.Metadata.Pool})
+	if err != nil {
+		return upload.Part{}, fmt.Errorf("encode part: %w", err)
+	}
+	if err := f.uploads.PutPart(multipartUpload, number, storedContent, metadata); err != nil {
+		return upload.Part{}, fmt.Errorf("persist part locally: %w", err)
+	}
+
+	// copies on replicas that have failed are replaced when the part is uploaded again and deleted with the upload
+	numCopies := 1
+	var replicationErr error
+	for _, host := range f.operationHandler.replicaHosts(dist.SlaveHosts, multipartUpload.Metadata.Pool) {
+		err := f.operationHandler.replicationHandler.ReplicatePart(ctx, multipartUpload, number, storedContent, metadata, host)
+		if err != nil {
+			f.sugar.Warnw("Failed to replicate part", "err", err, "object", objectHash, "upload", uploadID,
+				"part", number, "host", host)
+			replicationErr = err
+			continue
+		}
+		numCopies++
+	}
+	if ctx.Err() != nil {
+		return upload.Part{}, fmt.Errorf("replicate part: %w", ctx.Err())
+	}
+	if numCopies < pool.MinSize {
+		return upload.Part{}, fmt.Errorf("%w: %v of %v copies of the part, replication error: %v",
+			ErrWriteQuorumNotReached, numCopies, pool.MinSize, replicationErr)
+	}
+
+	return upload.Part{Number: number, Size: metadata.Size, Checksum: metadata.Checksum}, nil
+}
+
+// UploadParts returns the upload and its parts.
+func (f *Handler) UploadParts(objectHash string, uploadID string) (upload.Upload, []upload.Part, error) {
+	multipartUpload, err := f.uploads.Get(objectHash, uploadID)
+	if err != nil {
+		return upload.Upload{}, nil, err
+	}
+	parts, err := f.uploads.Parts(objectHash, uploadID)
+	if err != nil {
+		return upload.Upload{}, nil, fmt.Errorf("list parts: %w", err)
+	}
+	return multipartUpload, parts, nil
+}
+
+// UploadPool returns the pool of the upload or an empty string if the upload doesn't exist.
+func (f *Handler) UploadPool(objectHash string, uploadID string) (string, error) {
+	multipartUpload, err := f.uploads.Get(objectHash, uploadID)
+	if errors.Is(err, upload.ErrUploadDoesNotExist) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return multipartUpload.Metadata.Pool, nil
+}
+
+// SelectParts returns the parts that make up the object. If selection is empty, all uploaded parts are used in the
+// order of their numbers. Otherwise, the numbers of the selection must be ascending and the checksums, if they are
+// set, must match the uploaded parts. The size of the assembled object is limited by maxUploadSize.
+func (f *Handler) SelectParts(parts []upload.Part, selection []upload.Part) ([]upload.Part, int64, error) {
+	if len(selection) > 0 {
+		uploaded := map[int]upload.Part{}
+		for _, part := range parts {
+			uploaded[part.Number] = part
+		}
+
+		var selected []upload.Part
+		for i, requested := range selection {
+			part, ok := uploaded[requested.Number]
+			if !ok || (requested.Checksum != "" && requested.Checksum != part.Checksum) {
+				return nil, 0, fmt.Errorf("%w: part %v", ErrInvalidPart, requested.Number)
+			}
+			if i > 0 && requested.Number <= selection[i-1].Number {
+				return nil, 0, fmt.Errorf("%w: the part numbers must be ascending", ErrInvalidPart)
+			}
+			selected = append(selected, part)
+		}
+		parts = selected
+	}
+	if len(parts) == 0 {
+		return nil, 0, fmt.Errorf("%w: the upload doesn't have any parts", ErrInvalidPart)
+	}
+
+	var size int64
+	for _, part := range parts {
+		size += part.Size
+	}
+	if size > f.maxUploadSize {
+		return nil, 0, fmt.Errorf("%w: the parts have %v bytes, at most %v bytes are allowed", ErrObjectTooLarge, size,
+			f.maxUploadSize)
+	}
+
+	return parts, size, nil
+}
+
+// CompleteUpload assembles the object from the parts that have been selected by SelectParts and writes it like an
+// object that has been uploaded in a single request. Uploads that overwrite replace an existing object under its
+// lock. Readers don't see the object before it has been persisted completely. The upload is deleted once the object
+// has been written; it is kept if the write fails, so that the completion can be retried.
+func (f *Handler) CompleteUpload(ctx context.Context, objectHash string, uploadID string, parts []upload.Part) error {
+	multipartUpload, err := f.uploads.Get(objectHash, uploadID)
+	if err != nil {
+		return err
+	}
+
+	openContent := func() (io.ReadCloser, error) {
+		return &partsReader{handler: f, ctx: ctx, objectHash: objectHash, uploadID: uploadID, parts: parts}, nil
+	}
+	if multipartUpload.Overwrite {
+		err = f.Replace(ctx, objectHash, openContent, multipartUpload.Metadata)
+	} else {
+		err = f.Write(ctx, objectHash, openContent, multipartUpload.Metadata)
+		if errors.Is(err, ErrObjectDoesExist) {
+			err = f.ReplaceExpired(ctx, objectHash, openContent, multipartUpload.Metadata)
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	// leftovers are deleted by the collection of stale uploads
+	if err := f.AbortUpload(context.Background(), objectHash, uploadID); err != nil {
+		f.sugar.Warnw("Failed to delete the parts of a completed upload", "err", err, "object", objectHash,
+			"upload", uploadID)
+	}
+	return nil
+}
+
+// partsReader reads the clear-text content of the parts one after another. A part is only decoded once the previous
+// part has been read, so at most one decoded part is held in memory besides the assembled object.
+type partsReader struct {
+	handler    *Handler
+	ctx        context.Context
+	objectHash string
+	uploadID   string
+	parts      []upload.Part
+	current    io.Reader
+}
+
+func (r *partsReader) Read(p []byte) (int, error) {
+	for {
+		if r.current == nil {
+			if len(r.parts) == 0 {
+				return 0, io.EOF
+			}
+			part := r.parts[0]
+			reader, err := r.handler.readPart(r.ctx, r.objectHash, r.uploadID, part)
+			if err != nil {
+				return 0, fmt.Errorf("read part %v: %w", part.Number, err)
+			}
+			r.current = reader
+			r.parts = r.parts[1:]
+		}
+
+		n, err := r.current.Read(p)
+		if err == io.EOF {
+			r.current = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (r *partsReader) Close() error {
+	r.current = nil
+	r.parts = nil
+	return nil
+}
+
+// readPart returns the clear-text content of the part. If the local copy is missing or doesn't match the checksum,
+// the copies of the replicas are used.
+func (f *Handler) readPart(ctx context.Context, objectHash string, uploadID string, part upload.Part) (io.Reader, error) {
+	storedContent, metadata, err := f.uploads.ReadPart(objectHash, uploadID, part.Number)
+	if err == nil {
+		if reader, err := f.decodePart(storedContent, metadata, part.Checksum); err == nil {
+			return reader, nil
+		}
+		f.sugar.Errorw("The local copy of the part is corrupted", "object", objectHash, "upload", uploadID,
+			"part", part.Number)
+	} else if !errors.Is(err, upload.ErrPartDoesNotExist) {
+		return nil, err
+	}
+
+	dist, err := f.distributionHandler.GetDistribution(objectHash)
+	if err != nil {
+		return nil, fmt.Errorf("calculate distribution: %w", err)
+	}
+	for _, host := range dist.SlaveHosts {
+		storedContent, metadata, exists, err := f.operationHandler.replicationHandler.FetchPart(ctx, objectHash,
+			uploadID, part.Number, host)
+		if err != nil {
+			f.sugar.Warnw("Failed to fetch replica of part", "err", err, "object", objectHash, "upload", uploadID,
+				"part", part.Number, "host", host)
+			continue
+		}
+		if !exists {
+			continue
+		}
+		if reader, err := f.decodePart(storedContent, metadata, part.Checksum); err == nil {
+			return reader, nil
+		}
+	}
+
+	return nil, fmt.Errorf("%w: no intact copy of part %v", ErrInvalidPart, part.Number)
+}
+
+// decodePart returns a reader of the clear-text content if it matches the checksum.
+func (f *Handler) decodePart(storedContent []byte, metadata file.Metadata, checksum string) (io.Reader, error) {
+	reader, err := f.fileHandler.DecodeObject(storedContent, metadata)
+	if err != nil {
+		return nil, fmt.Errorf("decode part: %w", err)
+	}
+	if computed, err := reader.Checksum(); err != nil || computed != checksum {
+		return nil, fmt.Errorf("%w: checksum mismatch", file.ErrContentIsCorrupted)
+	}
+	if _, err := reader.Seek(0, io.SeekStart); err != nil {
+		return nil, fmt.Errorf("seek to start of part: %w", err)
+	}
+	return reader, nil
+}
+
+// AbortUpload deletes the upload and its parts from the primary and from the replicas. Copies that can't be deleted
+// from a replica are deleted by the collection of stale uploads of the replica.
+func (f *Handler) AbortUpload(ctx context.Context, objectHash string, uploadID string) error {
+	ctx, cancel := f.operationHandler.withTimeout(ctx)
+	defer cancel()
+
+	if _, err := f.uploads.Get(objectHash, uploadID); err != nil {
+		return err
+	}
+
+	dist, err := f.distributionHandler.GetDistribution(objectHash)
+	if err != nil {
+		return fmt.Errorf("calculate distribution: %w", err)
+	}
+	for _, host := range dist.SlaveHosts {
+		if err := f.operationHandler.replicationHandler.AbortUpload(ctx, objectHash, uploadID, host); err != nil {
+			f.sugar.Warnw("Failed to delete upload from replica", "err", err, "object", objectHash,
+				"upload", uploadID, "host", host)
+		}
+	}
+
+	return f.uploads.Delete(objectHash, uploadID)
+}
+
+// StorePart persists a part that has been replicated by the primary.
+func (f *Handler) StorePart(multipartUpload upload.Upload, number int, storedContent []byte, metadata file.Metadata) error {
+	return f.uploads.PutPart(multipartUpload, number, storedContent, metadata)
+}
+
+// ReadStoredPart returns the encoded content of a part and its metadata to the primary.
+func (f *Handler) ReadStoredPart(objectHash string, uploadID string, number int) ([]byte, file.Metadata, error) {
+	return f.uploads.ReadPart(objectHash, uploadID, number)
+}
+
+// DeleteStoredUpload deletes the local copy of the upload on behalf of the primary.
+func (f *Handler) DeleteStoredUpload(objectHash string, uploadID string) error {
+	return f.uploads.Delete(objectHash, uploadID)
+}
+
+// collectStaleUploads periodically deletes the uploads that have been initiated before the timeout.
+func (f *Handler) collectStaleUploads(timeout time.Duration) {
+	for {
+		time.Sleep(uploadCollectionInterval)
+
+		if _, err := f.deleteStaleUploads(time.Now().Add(-timeout)); err != nil {
+			f.sugar.Errorw("Failed to delete stale multipart uploads", "err", err)
+		}
+	}
+}
+
+// deleteStaleUploads deletes the local copies of all uploads that have been initiated before the given time. Every
+// node deletes its own copies; the replicas know the time at which the primary has initiated the upload. It returns
+// the number of deleted uploads.
+func (f *Handler) deleteStaleUploads(before time.Time) (int, error) {
+	uploads, err := f.uploads.List()
+	if err != nil {
+		return 0, fmt.Errorf("list uploads: %w", err)
+	}
+
+	deleted := 0
+	for _, multipartUpload := range uploads {
+		if !multipartUpload.Initiated.Before(before) {
+			continue
+		}
+		if err := f.uploads.Delete(multipartUpload.ObjectHash, multipartUpload.ID); err != nil {
+			return deleted, fmt.Errorf("delete upload %v of %v: %w", multipartUpload.ID, multipartUpload.ObjectHash, err)
+		}
+		f.sugar.Infow("Deleted stale multipart upload", "object", multipartUpload.ObjectHash,
+			"upload", multipartUpload.ID, "initiated", multipartUpload.Initiated)
+		deleted++
+	}
+
+	return deleted, nil
+}
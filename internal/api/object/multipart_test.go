@@ -0,0 +1,214 @@
+package object
+
+import (
+	"context"
+	"errors"
+	"github.com/rstdm/mini-ceph/internal/api/object/distribution"
+	"github.com/rstdm/mini-ceph/internal/api/object/file"
+	"github.com/rstdm/mini-ceph/internal/api/object/upload"
+	"github.com/rstdm/mini-ceph/internal/configuration"
+	"github.com/rstdm/mini-ceph/internal/metrics"
+	"go.uber.org/zap"
+	"io"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newSingleNodeHandler(t *testing.T) *Handler {
+	dataFolder := t.TempDir()
+	config := configuration.Configuration{
+		Pools:                       map[string]configuration.Pool{configuration.DefaultPool: {Size: 1, MinSize: 1}},
+		DataFolder:                  dataFolder,
+		ObjectFolder:                filepath.Join(dataFolder, "data"),
+		StorageBackend:              file.BackendFile,
+		NodeHosts:                   []string{"localhost:0"},
+		NodeSchemes:                 []string{"http"},
+		PlacementGroups:             [][]int{{0}},
+		MaxMultipartObjectSizeBytes: 100,
+	}
+	distributionHandler := distribution.NewHandler(0, config.NodeHosts, config.PlacementGroups)
+	handler, err := NewHandler(config, distributionHandler, nil, metrics.NewRegistry(), zap.NewNop().Sugar())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return handler
+}
+
+func TestMultipartUpload(t *testing.T) {
+	handler := newSingleNodeHandler(t)
+	ctx := context.Background()
+	object := "0000000000000000000000000000000000000000000000000000000000000001"
+
+	multipartUpload, err := handler.InitiateUpload(object, file.Metadata{Pool: configuration.DefaultPool, Owner: "alice"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for number, content := range map[int]string{1: "hello ", 3: "world", 2: "wrong"} {
+		if _, err := handler.UploadPart(ctx, object, multipartUpload.ID, number, []byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// a part that is uploaded again replaces the previous content
+	second, err := handler.UploadPart(ctx, object, multipartUpload.ID, 2, []byte("multipart "))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, uploadedParts, err := handler.UploadParts(object, multipartUpload.ID)
+	if err != nil || len(uploadedParts) != 3 {
+		t.Fatalf("UploadParts() = %+v, %v", uploadedParts, err)
+	}
+	if _, _, err := handler.SelectParts(uploadedParts, []upload.Part{{Number: 2, Checksum: "stale"}}); !errors.Is(err, ErrInvalidPart) {
+		t.Errorf("a part with a stale checksum has been selected: %v", err)
+	}
+	if _, _, err := handler.SelectParts(uploadedParts, []upload.Part{{Number: 3}, {Number: 1}}); !errors.Is(err, ErrInvalidPart) {
+		t.Errorf("parts in descending order have been selected: %v", err)
+	}
+	parts, size, err := handler.SelectParts(uploadedParts, []upload.Part{{Number: 1}, second, {Number: 3}})
+	if err != nil || size != 21 {
+		t.Fatalf("SelectParts() = %v, %v", size, err)
+	}
+
+	if err := handler.CompleteUpload(ctx, object, multipartUpload.ID, parts); err != nil {
+		t.Fatal(err)
+	}
+	var content []byte
+	var metadata file.Metadata
+	err = handler.Read(ctx, object, true, func(reader io.ReadSeeker, _ time.Time, m file.Metadata) {
+		content, _ = io.ReadAll(reader)
+		metadata = m
+	})
+	if err != nil || string(content) != "hello multipart world" || metadata.Owner != "alice" {
+		t.Errorf("Read() = %q, %+v, %v", content, metadata, err)
+	}
+	if _, _, err := handler.UploadParts(object, multipartUpload.ID); !errors.Is(err, upload.ErrUploadDoesNotExist) {
+		t.Errorf("the upload hasn't been deleted after the completion: %v", err)
+	}
+	if _, err := handler.InitiateUpload(object, file.Metadata{Pool: configuration.DefaultPool}, false); !errors.Is(err, ErrObjectDoesExist) {
+		t.Errorf("an upload of an existing object has been initiated: %v", err)
+	}
+}
+
+func TestOverwritingUpload(t *testing.T) {
+	handler := newSingleNodeHandler(t)
+	ctx := context.Background()
+	object := "0000000000000000000000000000000000000000000000000000000000000003"
+
+	openContent := func() (io.ReadCloser, error) { return io.NopCloser(strings.NewReader("old")), nil }
+	if err := handler.Write(ctx, object, openContent, file.Metadata{Pool: configuration.DefaultPool}); err != nil {
+		t.Fatal(err)
+	}
+	read := func() string {
+		var content []byte
+		err := handler.Read(ctx, object, true, func(reader io.ReadSeeker, _ time.Time, _ file.Metadata) {
+			content, _ = io.ReadAll(reader)
+		})
+		if err != nil {
+			t.Fatalf("read object: %v", err)
+		}
+		return string(content)
+	}
+
+	// the existing object is kept until the upload is completed
+	aborted, err := handler.InitiateUpload(object, file.Metadata{Pool: configuration.DefaultPool}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := handler.UploadPart(ctx, object, aborted.ID, 1, []byte("aborted")); err != nil {
+		t.Fatal(err)
+	}
+	if err := handler.AbortUpload(ctx, object, aborted.ID); err != nil {
+		t.Fatal(err)
+	}
+	if content := read(); content != "old" {
+		t.Errorf("the object is %q after the upload has been aborted", content)
+	}
+
+	completed, err := handler.InitiateUpload(object, file.Metadata{Pool: configuration.DefaultPool}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	part, err := handler.UploadPart(ctx, object, completed.ID, 1, []byte("new"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := handler.CompleteUpload(ctx, object, completed.ID, []upload.Part{part}); err != nil {
+		t.Fatal(err)
+	}
+	if content := read(); content != "new" {
+		t.Errorf("the object is %q after the upload has been completed", content)
+	}
+}
+
+func TestDeleteStaleUploads(t *testing.T) {
+	handler := newSingleNodeHandler(t)
+	object := "0000000000000000000000000000000000000000000000000000000000000002"
+
+	stale, err := handler.InitiateUpload(object, file.Metadata{Pool: configuration.DefaultPool}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := handler.UploadPart(context.Background(), object, stale.ID, 1, []byte("content")); err != nil {
+		t.Fatal(err)
+	}
+	cutoff := time.Now()
+	recent, err := handler.InitiateUpload(object, file.Metadata{Pool: configuration.DefaultPool}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deleted, err := handler.deleteStaleUploads(cutoff)
+	if err != nil || deleted != 1 {
+		t.Fatalf("deleteStaleUploads deleted %v uploads: %v", deleted, err)
+	}
+	if _, _, err := handler.UploadParts(object, stale.ID); !errors.Is(err, upload.ErrUploadDoesNotExist) {
+		t.Errorf("the stale upload hasn't been deleted: %v", err)
+	}
+	if _, _, err := handler.UploadParts(object, recent.ID); err != nil {
+		t.Errorf("the recent upload has been deleted: %v", err)
+	}
+}
+
+func TestSelectParts(t *testing.T) {
+	handler := newSingleNodeHandler(t)
+	parts := []upload.Part{{Number: 1, Size: 10, Checksum: "a"}, {Number: 2, Size: 20, Checksum: "b"},
+		{Number: 5, Size: 30, Checksum: "c"}}
+
+	tests := []struct {
+		name      string
+		parts     []upload.Part
+		selection []upload.Part
+		want      []int
+		wantSize  int64
+		wantErr   error
+	}{
+		{"all parts", parts, nil, []int{1, 2, 5}, 60, nil},
+		{"selection", parts, []upload.Part{{Number: 1, Checksum: "a"}, {Number: 5}}, []int{1, 5}, 40, nil},
+		{"no parts", nil, nil, nil, 0, ErrInvalidPart},
+		{"unknown part", parts, []upload.Part{{Number: 3}}, nil, 0, ErrInvalidPart},
+		{"checksum mismatch", parts, []upload.Part{{Number: 2, Checksum: "a"}}, nil, 0, ErrInvalidPart},
+		{"descending numbers", parts, []upload.Part{{Number: 2}, {Number: 1}}, nil, 0, ErrInvalidPart},
+		{"too large", append(parts, upload.Part{Number: 6, Size: 41}), nil, nil, 0, ErrObjectTooLarge},
+	}
+
+	for _, test := range tests {
+		selected, size, err := handler.SelectParts(test.parts, test.selection)
+		if test.wantErr != nil {
+			if !errors.Is(err, test.wantErr) {
+				t.Errorf("%v: error = %v, want %v", test.name, err, test.wantErr)
+			}
+			continue
+		}
+		var numbers []int
+		for _, part := range selected {
+			numbers = append(numbers, part.Number)
+		}
+		if err != nil || !reflect.DeepEqual(numbers, test.want) || size != test.wantSize {
+			t.Errorf("%v: selected parts %v with %v bytes, %v, want parts %v with %v bytes", test.name, numbers, size,
+				err, test.want, test.wantSize)
+		}
+	}
+}
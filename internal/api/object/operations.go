@@ -1,51 +1,81 @@
 package object
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"github.com/rstdm/mini-ceph/internal/api/object/distribution"
 	"github.com/rstdm/mini-ceph/internal/api/object/file"
 	"github.com/rstdm/mini-ceph/internal/api/object/replication"
+	"github.com/rstdm/mini-ceph/internal/configuration"
+	"github.com/rstdm/mini-ceph/internal/tracing"
 	"go.uber.org/multierr"
 	"go.uber.org/zap"
 	"io"
-	"mime/multipart"
+	"os"
+	"time"
 )
 
 type operationHandler struct {
 	distributionHandler *distribution.Handler
 	replicationHandler  *replication.Handler
 	fileHandler         *file.Handler
+	requestRepair       func(objectHash string)
+	recordMissing       func(entry MissingEntry)
+	recordUsage         func(objectHash string, metadata file.Metadata, objects int64)
+	pools               map[string]configuration.Pool
+	operationTimeout    time.Duration
+	readBalancing       bool
+	leases              *leaseTable
 	sugar               *zap.SugaredLogger
 }
 
-func newOperationHandler(clusterBearerToken string, fileHandler *file.Handler, distributionHandler *distribution.Handler, sugar *zap.SugaredLogger) (*operationHandler, error) {
-	replicationHandler := replication.NewHandler(clusterBearerToken, sugar)
-
+func newOperationHandler(replicationHandler *replication.Handler, fileHandler *file.Handler, distributionHandler *distribution.Handler, pools map[string]configuration.Pool, operationTimeout time.Duration, readBalancing bool, leases *leaseTable, sugar *zap.SugaredLogger) (*operationHandler, error) {
 	operationHandler := &operationHandler{
 		distributionHandler: distributionHandler,
 		replicationHandler:  replicationHandler,
 		fileHandler:         fileHandler,
+		pools:               pools,
+		operationTimeout:    operationTimeout,
+		readBalancing:       readBalancing,
+		leases:              leases,
 		sugar:               sugar,
 	}
 
 	return operationHandler, nil
 }
 
-func (h *operationHandler) deleteObject(objectHash string) error {
+func (h *operationHandler) objectExists(objectHash string) (bool, error) {
+	return h.fileHandler.ObjectExists(objectHash)
+}
 
-	dist, err := h.distributionHandler.GetDistribution(objectHash)
-	if err != nil {
-		err = fmt.Errorf("calculate distribution: %w", err)
+// writeTombstone marks the object as deleted. The deletion is subtracted from the usage of the owner and the pool.
+func (h *operationHandler) writeTombstone(objectHash string) error {
+	metadata, err := h.fileHandler.GetMetadata(objectHash)
+	if err != nil && !errors.Is(err, file.ErrNoMetadata) {
+		return fmt.Errorf("read metadata: %w", err)
+	}
+
+	if err := h.fileHandler.WriteTombstone(objectHash); err != nil {
 		return err
 	}
+	h.recordUsage(objectHash, metadata, -1)
+	return nil
+}
 
-	if dist.IsPrimary {
-		if err := h.replicationHandler.Delete(objectHash, dist.SlaveHosts); err != nil {
-			h.sugar.Errorw("Failed to delete replicated copies of object", "err", err, "objectHash", objectHash)
+func (h *operationHandler) removeTombstone(objectHash string) error {
+	return h.fileHandler.RemoveTombstone(objectHash)
+}
+
+// deleteObject deletes the local copy. The primary also deletes all replicas if deleteReplicas is true.
+func (h *operationHandler) deleteObject(ctx context.Context, objectHash string, deleteReplicas bool) error {
+	if deleteReplicas {
+		if err := h.deleteReplicas(ctx, objectHash); err != nil {
+			return err
 		}
 	}
 
-	err = h.fileHandler.DeleteObject(objectHash)
+	err := h.fileHandler.DeleteObject(objectHash)
 	if err != nil {
 		err = fmt.Errorf("delete local replica: %w", err)
 		return err
@@ -54,35 +84,147 @@ func (h *operationHandler) deleteObject(objectHash string) error {
 	return nil
 }
 
-func (h *operationHandler) transferObject(objectHash string, transferObjectFunc func(objectPath string)) error {
-
-	objectPath, err := h.fileHandler.GetObjectPath(objectHash)
+// deleteReplicas deletes the replicas if the current node is the primary. If read balancing is enabled, the function
+// only returns after no replica serves the object anymore.
+func (h *operationHandler) deleteReplicas(ctx context.Context, objectHash string) error {
+	dist, err := h.distributionHandler.GetDistribution(objectHash)
 	if err != nil {
-		return fmt.Errorf("get object path: %w", err)
+		err = fmt.Errorf("calculate distribution: %w", err)
+		return err
+	}
+	if !dist.IsPrimary {
+		return nil
+	}
+
+	for _, host := range dist.SlaveHosts {
+		if err := h.replicationHandler.DeleteFromHost(ctx, objectHash, host); err != nil {
+			h.sugar.Errorw("Failed to delete replicated copy of object", "err", err, "objectHash", objectHash, "host", host)
+			h.recordMissing(MissingEntry{dist.CorrectPlacementGroup, host, objectHash})
+
+			if h.readBalancing {
+				// the replica could still serve the object
+				h.leases.revoke(dist.CorrectPlacementGroup, host)
+			}
+		}
 	}
 
+	return nil
+}
+
+// TransferObjectFunc sends the content of an object to the client.
+type TransferObjectFunc func(content io.ReadSeeker, modTime time.Time, metadata file.Metadata)
+
+// OpenContentFunc opens the content of an object that is written. It is only called once the write is allowed.
+type OpenContentFunc func() (io.ReadCloser, error)
+
+func (h *operationHandler) transferObject(ctx context.Context, objectHash string, verifyChecksum bool, transferObjectFunc TransferObjectFunc) (err error) {
+	_, span := tracing.Start(ctx, "file.read", "object", objectHash)
+	defer func() {
+		span.SetError(err)
+		span.End()
+	}()
+
+	openedFile, err := h.fileHandler.OpenObject(objectHash)
 	// we have to check again. Maybe the object was deleted after the last check and before the call to
 	// operationStateHandler.StartReading
-	if objectPath == "" {
+	if errors.Is(err, os.ErrNotExist) {
 		return ErrObjectDoesNotExist
 	}
+	if err != nil {
+		return fmt.Errorf("open object: %w", err)
+	}
+	defer file.CloseAndLogError(openedFile, objectHash, h.sugar)
+
+	info, err := h.fileHandler.StatObject(objectHash)
+	if err != nil {
+		return fmt.Errorf("stat object: %w", err)
+	}
+	metadata := info.Metadata
 
-	transferObjectFunc(objectPath)
+	// The checksum is verified before the first byte is sent to the client. Otherwise the client would receive
+	// corrupted data before the corruption is detected. Objects that have been created by older versions don't have
+	// a checksum and can't be verified.
+	if !verifyChecksum || metadata.Checksum == "" {
+		transferObjectFunc(openedFile, info.ModTime, metadata)
+		return nil
+	}
 
-	return nil
+	// modified encrypted content can't be decrypted; it is treated like a checksum mismatch
+	checksum, err := openedFile.Checksum()
+	if err != nil && !errors.Is(err, file.ErrContentIsCorrupted) {
+		return fmt.Errorf("compute checksum: %w", err)
+	}
+	if err == nil && checksum == metadata.Checksum {
+		if _, err := openedFile.Seek(0, io.SeekStart); err != nil {
+			return fmt.Errorf("seek to start of object: %w", err)
+		}
+		transferObjectFunc(openedFile, info.ModTime, metadata)
+		return nil
+	}
+
+	h.sugar.Errorw("The local copy of the object is corrupted",
+		"object", objectHash,
+		"expectedChecksum", metadata.Checksum,
+		"computedChecksum", checksum,
+		"err", err,
+	)
+	h.requestRepair(objectHash)
+
+	return h.transferReplica(ctx, objectHash, metadata, transferObjectFunc)
+}
+
+// transferReplica sends the first intact replica to the client. Only the primary fails over to the replicas; a
+// secondary returns ErrReplicaIsCorrupted, and the repair that has been requested reports the corruption to the
+// primary.
+func (h *operationHandler) transferReplica(ctx context.Context, objectHash string, metadata file.Metadata, transferObjectFunc TransferObjectFunc) error {
+	dist, err := h.distributionHandler.GetDistribution(objectHash)
+	if err != nil {
+		return fmt.Errorf("calculate distribution: %w", err)
+	}
+	if !dist.IsPrimary {
+		return ErrReplicaIsCorrupted
+	}
+
+	for _, host := range dist.SlaveHosts {
+		storedContent, replicaMetadata, exists, err := h.replicationHandler.Fetch(ctx, objectHash, true, host)
+		if err != nil {
+			h.sugar.Warnw("Failed to fetch replica of corrupted object", "err", err, "object", objectHash, "host", host)
+			continue
+		}
+		if !exists {
+			continue
+		}
+
+		reader, err := h.fileHandler.DecodeObject(storedContent, replicaMetadata)
+		if err != nil {
+			h.sugar.Warnw("Failed to decode replica of corrupted object", "err", err, "object", objectHash, "host", host)
+			continue
+		}
+		if checksum, err := reader.Checksum(); err != nil || checksum != metadata.Checksum {
+			continue
+		}
+		if _, err := reader.Seek(0, io.SeekStart); err != nil {
+			return fmt.Errorf("seek to start of replica: %w", err)
+		}
+
+		transferObjectFunc(reader, time.Now(), replicaMetadata)
+		return nil
+	}
+
+	return ErrObjectIsCorrupted
 }
 
-func (h *operationHandler) persistObject(objectHash string, formFile *multipart.FileHeader) error {
+func (h *operationHandler) persistObject(ctx context.Context, objectHash string, openContent OpenContentFunc, metadata file.Metadata) error {
 
-	openedFile, err := formFile.Open()
+	content, err := openContent()
 	if err != nil {
-		return fmt.Errorf("open form file: %w", err)
+		return fmt.Errorf("open content: %w", err)
 	}
-	defer file.CloseAndLogError(openedFile, "formFile", h.sugar)
+	defer file.CloseAndLogError(content, "content", h.sugar)
 
-	objectContent, err := io.ReadAll(openedFile)
+	objectContent, err := io.ReadAll(content)
 	if err != nil {
-		return fmt.Errorf("read formFile into memory: %w", err)
+		return fmt.Errorf("read content into memory: %w", err)
 	}
 
 	dist, err := h.distributionHandler.GetDistribution(objectHash)
@@ -91,22 +233,204 @@ func (h *operationHandler) persistObject(objectHash string, formFile *multipart.
 		return err
 	}
 
+	var replicaHosts []string
+	var failedHosts []string
 	if dist.IsPrimary {
-		if err := h.replicationHandler.Replicate(objectHash, objectContent, dist.SlaveHosts); err != nil {
-			// we don't have to delete the objects because Replicate() deletes all already created objects if it
-			// encounters an error.
-			return fmt.Errorf("replicate object to slaves: %w", err)
+		pool, ok := h.pools[metadata.Pool]
+		if !ok {
+			return ErrUnknownPool
+		}
+
+		// the object is encoded once; the replicas store the encoded (i.e. compressed and encrypted) content
+		objectContent, metadata, err = h.fileHandler.EncodeObject(objectContent, metadata)
+		if err != nil {
+			return fmt.Errorf("encode object: %w", err)
+		}
+
+		replicaHosts = h.replicaHosts(dist.SlaveHosts, metadata.Pool)
+		var replicationErr error
+		failedHosts, replicationErr = h.replicationHandler.Replicate(ctx, objectHash, objectContent, metadata, replicaHosts)
+
+		numCopies := 1 + len(replicaHosts) - len(failedHosts) // the local copy is persisted below
+		if numCopies < pool.MinSize || ctx.Err() != nil {
+			merr := fmt.Errorf("%w: %v of %v copies, replication error: %v", ErrWriteQuorumNotReached, numCopies,
+				pool.MinSize, replicationErr)
+			if ctx.Err() != nil {
+				merr = fmt.Errorf("replicate object: %w", ctx.Err())
+			}
+			h.sugar.Errorw("Failed to replicate object. Deleting created replicas from all hosts.",
+				"err", merr,
+				"objectHash", objectHash,
+			)
+			if err := h.rollbackReplicas(dist.CorrectPlacementGroup, objectHash, replicaHosts); err != nil {
+				err = fmt.Errorf("delete replicas after failed replication attempt: %w", err)
+				merr = multierr.Append(merr, err)
+			}
+			return merr
 		}
 	}
 
-	if err := h.fileHandler.PersistObject(objectHash, objectContent); err != nil {
+	if err := h.persistLocally(ctx, objectHash, objectContent, metadata); err != nil {
 		merr := fmt.Errorf("persist object locally: %w", err)
-		if err = h.replicationHandler.Delete(objectHash, dist.SlaveHosts); err != nil {
+		if err = h.rollbackReplicas(dist.CorrectPlacementGroup, objectHash, replicaHosts); err != nil {
 			err = fmt.Errorf("delete replicated object because object could not be persisted locally: %w", err)
 			merr = multierr.Append(merr, err)
 		}
 		return merr
 	}
 
+	// the object might have been deleted before; the old replicas are replaced by the repair of the missing copies
+	if err := h.fileHandler.RemoveTombstone(objectHash); err != nil {
+		return fmt.Errorf("remove tombstone of deleted object: %w", err)
+	}
+
+	h.recordUsage(objectHash, metadata, 1)
+
+	// the write quorum has been reached; the missing copies are created as soon as the hosts are reachable again
+	for _, failedHost := range failedHosts {
+		h.recordMissing(MissingEntry{dist.CorrectPlacementGroup, failedHost, objectHash})
+		if h.readBalancing {
+			// the replica would answer reads of the object with 404
+			h.leases.revoke(dist.CorrectPlacementGroup, failedHost)
+		}
+	}
+
 	return nil
 }
+
+// replaceObject persists the object and replaces the previous version if it exists. The primary replaces the replicas
+// first. If the write quorum isn't reached, the primary keeps the previous version and a repair restores it on the
+// replicas that have already been replaced.
+func (h *operationHandler) replaceObject(ctx context.Context, objectHash string, openContent OpenContentFunc, metadata file.Metadata) error {
+	content, err := openContent()
+	if err != nil {
+		return fmt.Errorf("open content: %w", err)
+	}
+	defer file.CloseAndLogError(content, "content", h.sugar)
+
+	objectContent, err := io.ReadAll(content)
+	if err != nil {
+		return fmt.Errorf("read content into memory: %w", err)
+	}
+
+	dist, err := h.distributionHandler.GetDistribution(objectHash)
+	if err != nil {
+		return fmt.Errorf("calculate distribution: %w", err)
+	}
+
+	previous, err := h.fileHandler.StatObject(objectHash)
+	exists := err == nil
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("stat previous version: %w", err)
+	}
+
+	var failedHosts []string
+	if dist.IsPrimary {
+		pool, ok := h.pools[metadata.Pool]
+		if !ok {
+			return ErrUnknownPool
+		}
+
+		objectContent, metadata, err = h.fileHandler.EncodeObject(objectContent, metadata)
+		if err != nil {
+			return fmt.Errorf("encode object: %w", err)
+		}
+
+		replicaHosts := h.replicaHosts(dist.SlaveHosts, metadata.Pool)
+		var replicationErr error
+		failedHosts, replicationErr = h.replicationHandler.ReplaceReplicas(ctx, objectHash, objectContent, metadata, replicaHosts)
+
+		numCopies := 1 + len(replicaHosts) - len(failedHosts)
+		if numCopies < pool.MinSize || ctx.Err() != nil {
+			merr := fmt.Errorf("%w: %v of %v copies, replication error: %v", ErrWriteQuorumNotReached, numCopies,
+				pool.MinSize, replicationErr)
+			if ctx.Err() != nil {
+				merr = fmt.Errorf("replace replicas: %w", ctx.Err())
+			}
+			h.sugar.Errorw("Failed to replace replicas of object. The previous version is restored by a repair.",
+				"err", merr,
+				"objectHash", objectHash,
+			)
+			h.requestRepair(objectHash)
+			return merr
+		}
+	}
+
+	if exists {
+		err = h.fileHandler.ReplaceObject(objectHash, objectContent, metadata)
+	} else {
+		err = h.persistLocally(ctx, objectHash, objectContent, metadata)
+	}
+	if err != nil {
+		if dist.IsPrimary {
+			h.requestRepair(objectHash)
+		}
+		return fmt.Errorf("replace object locally: %w", err)
+	}
+
+	if err := h.fileHandler.RemoveTombstone(objectHash); err != nil {
+		return fmt.Errorf("remove tombstone of deleted object: %w", err)
+	}
+
+	if exists {
+		h.recordUsage(objectHash, previous.Metadata, -1)
+	}
+	h.recordUsage(objectHash, metadata, 1)
+
+	for _, failedHost := range failedHosts {
+		h.recordMissing(MissingEntry{dist.CorrectPlacementGroup, failedHost, objectHash})
+		if h.readBalancing {
+			// the replica would answer reads with the previous version
+			h.leases.revoke(dist.CorrectPlacementGroup, failedHost)
+		}
+	}
+
+	return nil
+}
+
+// persistLocally writes the (encoded) object to the local file system.
+func (h *operationHandler) persistLocally(ctx context.Context, objectHash string, objectContent []byte, metadata file.Metadata) error {
+	ctx, span := tracing.Start(ctx, "file.persist", "object", objectHash)
+	defer span.End()
+
+	err := h.fileHandler.PersistObject(ctx, objectHash, objectContent, metadata)
+	span.SetError(err)
+	return err
+}
+
+// rollbackReplicas deletes the replicas of an object that couldn't be persisted. The replicas are deleted even if the
+// operation has been canceled. Replicas that can't be deleted are recorded in the missing set.
+func (h *operationHandler) rollbackReplicas(placementGroup uint32, objectHash string, hosts []string) error {
+	ctx, cancel := h.withTimeout(context.Background())
+	defer cancel()
+
+	var merr error
+	for _, host := range hosts {
+		if err := h.replicationHandler.DeleteFromHost(ctx, objectHash, host); err != nil {
+			h.recordMissing(MissingEntry{placementGroup, host, objectHash})
+			err = fmt.Errorf("delete replica from host %v: %w", host, err)
+			merr = multierr.Append(merr, err)
+		}
+	}
+
+	return merr
+}
+
+// withTimeout applies the configured operation timeout to the context.
+func (h *operationHandler) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if h.operationTimeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, h.operationTimeout)
+}
+
+// replicaHosts returns the hosts that store a replica of objects of the pool. Unknown pools are stored on all nodes
+// of the placement group.
+func (h *operationHandler) replicaHosts(slaveHosts []string, poolName string) []string {
+	pool, ok := h.pools[poolName]
+	if !ok || pool.Size-1 >= len(slaveHosts) {
+		return slaveHosts
+	}
+
+	return slaveHosts[:pool.Size-1]
+}
@@ -0,0 +1,130 @@
+package object
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+const (
+	// peerProbeInterval is the interval in which the peers are probed.
+	peerProbeInterval = 5 * time.Second
+	peerProbeTimeout  = 2 * time.Second
+)
+
+// PeerState is the result of the last probe of a peer.
+type PeerState struct {
+	Host      string
+	Up        bool
+	LastSeen  *time.Time `json:",omitempty"` // nil if the peer hasn't answered since the node has been started
+	LastError string     `json:",omitempty"`
+	Capacity  *Capacity  `json:",omitempty"` // nil if the disk space of the peer is unknown
+
+	// PoolsMismatch is true if the peer uses a different pool configuration than the current node
+	PoolsMismatch bool `json:",omitempty"`
+}
+
+// peerMonitor probes all nodes that share a placement group with the current node. Status requests use the result of
+// the last probe, so they don't send requests to all peers.
+type peerMonitor struct {
+	mu     sync.Mutex
+	states []PeerState
+	probed bool // false until the first probe of all peers has finished
+
+	ownCapacityState CapacityState // empty until the capacity of the current node has been determined
+}
+
+func (f *Handler) monitorPeers() {
+	for {
+		previousStates, _ := f.PeerStates()
+		var states []PeerState
+		for _, host := range f.distributionHandler.PeerHosts() {
+			ctx, cancel := context.WithTimeout(context.Background(), peerProbeTimeout)
+			poolsHash, err := f.operationHandler.replicationHandler.Ping(ctx, host)
+			cancel()
+
+			state := PeerState{Host: host, Up: err == nil}
+			if err != nil {
+				state.LastError = err.Error()
+			} else {
+				state.Capacity = f.probeCapacity(host)
+				state.PoolsMismatch = poolsHash != "" && poolsHash != f.poolsHash
+			}
+			if state.PoolsMismatch && !wasPoolsMismatch(previousStates, host) {
+				f.sugar.Warnw("The peer uses a different pool configuration. All nodes must be started with the "+
+					"same --pools.", "host", host, "poolsHash", f.poolsHash, "peerPoolsHash", poolsHash)
+			}
+			states = append(states, state)
+		}
+		f.peers.update(states)
+		f.logCapacityChange()
+
+		time.Sleep(peerProbeInterval)
+	}
+}
+
+// wasPoolsMismatch returns true if the last probe of the peer detected a different pool configuration.
+func wasPoolsMismatch(states []PeerState, host string) bool {
+	for _, state := range states {
+		if state.Host == host {
+			return state.PoolsMismatch
+		}
+	}
+	return false
+}
+
+// PoolsHash returns the hash of the pool configuration of the current node.
+func (f *Handler) PoolsHash() string {
+	return f.poolsHash
+}
+
+// probeCapacity returns the capacity of the peer or nil if it can't be determined.
+func (f *Handler) probeCapacity(host string) *Capacity {
+	ctx, cancel := context.WithTimeout(context.Background(), peerProbeTimeout)
+	defer cancel()
+
+	space, err := f.operationHandler.replicationHandler.FetchDiskSpace(ctx, host)
+	if err != nil {
+		f.sugar.Debugw("Failed to fetch the disk space of the peer", "err", err, "host", host)
+		return nil
+	}
+	capacity := f.capacityOf(space)
+	return &capacity
+}
+
+func (m *peerMonitor) update(states []PeerState) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	for i := range states {
+		if states[i].Up {
+			states[i].LastSeen = &now
+			continue
+		}
+		for _, previous := range m.states {
+			if previous.Host == states[i].Host {
+				states[i].LastSeen = previous.LastSeen
+			}
+		}
+	}
+	m.states = states
+	m.probed = true
+}
+
+// PeerStates returns the state of all peers. probed is false if the peers haven't been probed yet.
+func (f *Handler) PeerStates() (states []PeerState, probed bool) {
+	f.peers.mu.Lock()
+	defer f.peers.mu.Unlock()
+	return append([]PeerState{}, f.peers.states...), f.peers.probed
+}
+
+// setOwnCapacityState stores the state of the current node and returns the previous state.
+func (m *peerMonitor) setOwnCapacityState(state CapacityState) CapacityState {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	previous := m.ownCapacityState
+	m.ownCapacityState = state
+	return previous
+}
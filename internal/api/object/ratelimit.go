@@ -0,0 +1,52 @@
+package object
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// rateLimiter limits the throughput of background operations like scrubbing. It is shared between all readers that
+// use it, which means that the configured rate is the total rate of all readers.
+type rateLimiter struct {
+	mu             sync.Mutex
+	bytesPerSecond int64
+	next           time.Time // the point in time at which all previously requested bytes have been "paid off"
+}
+
+// unlimitedRate doesn't limit the throughput. It is used for the checksums of repairs; a repair shouldn't wait for the
+// scrubs.
+var unlimitedRate = newRateLimiter(0)
+
+// newRateLimiter returns a limiter that doesn't limit anything if bytesPerSecond is <= 0.
+func newRateLimiter(bytesPerSecond int64) *rateLimiter {
+	return &rateLimiter{bytesPerSecond: bytesPerSecond}
+}
+
+func (l *rateLimiter) wait(numBytes int) {
+	if l.bytesPerSecond <= 0 || numBytes <= 0 {
+		return
+	}
+
+	l.mu.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	l.next = l.next.Add(time.Duration(numBytes) * time.Second / time.Duration(l.bytesPerSecond))
+	delay := l.next.Sub(now)
+	l.mu.Unlock()
+
+	time.Sleep(delay)
+}
+
+type throttledReader struct {
+	reader  io.Reader
+	limiter *rateLimiter
+}
+
+func (r throttledReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.limiter.wait(n)
+	return n, err
+}
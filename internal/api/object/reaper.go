@@ -0,0 +1,61 @@
+package object
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// reapExpiredObjects periodically deletes the expired objects of the placement groups of which the current node is
+// primary.
+func (f *Handler) reapExpiredObjects(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+
+		if _, err := f.reapExpired(time.Now()); err != nil {
+			f.sugar.Errorw("Failed to delete expired objects", "err", err)
+		}
+	}
+}
+
+// reapExpired deletes all objects of the primary placement groups that have expired at the given time. The objects are
+// deleted like objects that are deleted by a client: the replicas are deleted by the primary, and the deletion is
+// delayed while the object is read. It returns the number of deleted objects.
+func (f *Handler) reapExpired(now time.Time) (int, error) {
+	objects, err := f.fileHandler.ListObjects()
+	if err != nil {
+		return 0, fmt.Errorf("list objects: %w", err)
+	}
+
+	deleted := 0
+	for _, info := range objects {
+		if !info.Metadata.Expired(now) {
+			continue
+		}
+		dist, err := f.distributionHandler.GetDistribution(info.Hash)
+		if err != nil {
+			return deleted, fmt.Errorf("calculate distribution of %v: %w", info.Hash, err)
+		}
+		if !dist.IsPrimary {
+			continue // the primary deletes the replicas
+		}
+
+		ctx, cancel := f.operationHandler.withTimeout(context.Background())
+		err = f.Delete(ctx, info.Hash)
+		cancel()
+		switch {
+		case errors.Is(err, ErrObjectDoesNotExist):
+			// the object has already been deleted
+		case errors.Is(err, ErrObjectIsRepaired), errors.Is(err, ErrObjectIsReplaced):
+			// the object is deleted by the next run
+		case err != nil:
+			f.sugar.Warnw("Failed to delete expired object", "err", err, "object", info.Hash)
+		default:
+			f.sugar.Infow("Deleted expired object", "object", info.Hash, "expires", time.Unix(info.Metadata.Expires, 0))
+			deleted++
+		}
+	}
+
+	return deleted, nil
+}
@@ -0,0 +1,84 @@
+package object
+
+import (
+	"context"
+	"errors"
+	"github.com/rstdm/mini-ceph/internal/api/object/file"
+	"github.com/rstdm/mini-ceph/internal/configuration"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReapExpired(t *testing.T) {
+	handler := newSingleNodeHandler(t)
+
+	now := time.Now()
+	expired := "0000000000000000000000000000000000000000000000000000000000000001"
+	unexpired := "0000000000000000000000000000000000000000000000000000000000000002"
+	permanent := "0000000000000000000000000000000000000000000000000000000000000003"
+	for object, expires := range map[string]int64{expired: now.Unix(), unexpired: now.Add(time.Hour).Unix(), permanent: 0} {
+		content, metadata, err := handler.fileHandler.EncodeObject([]byte("content"), file.Metadata{Expires: expires})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := handler.fileHandler.PersistObject(context.Background(), object, content, metadata); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	deleted, err := handler.reapExpired(now)
+	if err != nil || deleted != 1 {
+		t.Fatalf("reapExpired deleted %v objects: %v", deleted, err)
+	}
+
+	read := func(object string) error {
+		return handler.Read(context.Background(), object, true, func(_ io.ReadSeeker, _ time.Time, _ file.Metadata) {})
+	}
+	if err := read(expired); !errors.Is(err, ErrObjectDoesNotExist) {
+		t.Errorf("the expired object hasn't been deleted: %v", err)
+	}
+	if err := read(unexpired); err != nil {
+		t.Errorf("the unexpired object has been deleted: %v", err)
+	}
+	if err := read(permanent); err != nil {
+		t.Errorf("the object without expiry has been deleted: %v", err)
+	}
+}
+
+func TestReplaceExpired(t *testing.T) {
+	handler := newSingleNodeHandler(t)
+	ctx := context.Background()
+
+	expired := "0000000000000000000000000000000000000000000000000000000000000001"
+	unexpired := "0000000000000000000000000000000000000000000000000000000000000002"
+	for object, expires := range map[string]int64{expired: time.Now().Unix(), unexpired: time.Now().Add(time.Hour).Unix()} {
+		content, metadata, err := handler.fileHandler.EncodeObject([]byte("old"), file.Metadata{Expires: expires})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := handler.fileHandler.PersistObject(ctx, object, content, metadata); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	openContent := func() (io.ReadCloser, error) { return io.NopCloser(strings.NewReader("new")), nil }
+	if err := handler.ReplaceExpired(ctx, expired, openContent, file.Metadata{Pool: configuration.DefaultPool}); err != nil {
+		t.Fatalf("replace expired object: %v", err)
+	}
+	if err := handler.ReplaceExpired(ctx, unexpired, openContent, file.Metadata{Pool: configuration.DefaultPool}); !errors.Is(err, ErrObjectDoesExist) {
+		t.Errorf("the unexpired object has been replaced: %v", err)
+	}
+
+	var content []byte
+	err := handler.Read(ctx, expired, true, func(reader io.ReadSeeker, _ time.Time, metadata file.Metadata) {
+		content, _ = io.ReadAll(reader)
+		if metadata.Expires != 0 {
+			t.Errorf("the replacement has the expiry %v of the previous object", metadata.Expires)
+		}
+	})
+	if err != nil || string(content) != "new" {
+		t.Errorf("read replaced object: %q, %v", content, err)
+	}
+}
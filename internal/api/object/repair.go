@@ -0,0 +1,398 @@
+package object
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/rstdm/mini-ceph/internal/api/object/distribution"
+	"github.com/rstdm/mini-ceph/internal/api/object/file"
+	"io"
+)
+
+var ErrObjectIsBusy = errors.New("the object is currently created, deleted, replaced or repaired")
+
+// objectCopy is the copy of an object that is stored on a single node of the placement group.
+type objectCopy struct {
+	host        string
+	isLocal     bool
+	unreachable bool
+	exists      bool
+	loaded      bool   // the content and the complete metadata are only loaded if the copy has to be transferred
+	content     []byte // the stored content; it is encoded according to the metadata
+	metadata    file.Metadata
+	checksum    string // checksum of the clear-text content; empty if the content can't be decoded
+}
+
+type RepairResult struct {
+	ObjectHash       string
+	ShouldExist      bool
+	Checksum         string   `json:",omitempty"` // the checksum of the authoritative copy
+	Actions          []string // human-readable description of everything that has been done
+	UnreachableHosts []string `json:",omitempty"` // these hosts haven't been repaired
+}
+
+func (r RepairResult) isUnreachable(host string) bool {
+	for _, unreachableHost := range r.UnreachableHosts {
+		if unreachableHost == host {
+			return true
+		}
+	}
+	return false
+}
+
+// Repair makes sure that all nodes of the placement group store the authoritative copy of the object. The
+// authoritative copy is the copy that matches the persisted checksum of the primary. If there is no persisted
+// checksum the content that is stored by the majority of all nodes is authoritative. Replicas of objects that don't
+// exist on the primary are deleted, unless a majority of all nodes stores the object. Replicas on nodes that aren't
+// part of the pool of the object are deleted as well. Objects with a tombstone are deleted from all nodes. Unreachable
+// nodes are skipped.
+// The object must not be created or deleted while it is repaired; concurrent reads are allowed.
+func (f *Handler) Repair(ctx context.Context, object string) (RepairResult, error) {
+	ctx, cancel := f.operationHandler.withTimeout(ctx)
+	defer cancel()
+
+	dist, err := f.distributionHandler.GetDistribution(object)
+	if err != nil {
+		return RepairResult{}, fmt.Errorf("calculate distribution: %w", err)
+	}
+	if !dist.IsPrimary {
+		return RepairResult{}, ErrNotPrimary
+	}
+
+	if err := f.startRepair(object); err != nil {
+		return RepairResult{}, err
+	}
+	defer f.finishRepair(object)
+
+	return f.repairLocked(ctx, object, dist)
+}
+
+// repairLocked repairs an object whose repair has already been started with startRepair.
+func (f *Handler) repairLocked(ctx context.Context, object string, dist distribution.Distribution) (RepairResult, error) {
+	copies, err := f.collectCopies(ctx, object, dist.SlaveHosts)
+	if err != nil {
+		return RepairResult{}, fmt.Errorf("collect copies: %w", err)
+	}
+
+	isDeleted, err := f.fileHandler.HasTombstone(object)
+	if err != nil {
+		return RepairResult{}, fmt.Errorf("check tombstone: %w", err)
+	}
+
+	result := RepairResult{ObjectHash: object}
+	var authoritative objectCopy
+	shouldExist := false
+	if !isDeleted {
+		authoritative, shouldExist, err = f.chooseAuthoritativeCopy(copies)
+		if err != nil {
+			return RepairResult{}, fmt.Errorf("choose authoritative copy: %w", err)
+		}
+	}
+	result.ShouldExist = shouldExist
+	if shouldExist {
+		result.Checksum = authoritative.checksum
+	}
+
+	replicaHosts := f.operationHandler.replicaHosts(dist.SlaveHosts, authoritative.metadata.Pool)
+	for _, c := range copies {
+		isReplicaHost := false
+		for _, replicaHost := range replicaHosts {
+			isReplicaHost = isReplicaHost || replicaHost == c.host
+		}
+		shouldStore := shouldExist && (c.isLocal || isReplicaHost)
+
+		switch {
+		case c.unreachable:
+			result.UnreachableHosts = append(result.UnreachableHosts, c.host)
+
+		case c.isLocal && !shouldStore && c.exists:
+			// the deletion has been confirmed but the local copy hasn't been deleted yet
+			if err := f.fileHandler.DeleteObject(object); err != nil {
+				return result, fmt.Errorf("delete local copy: %w", err)
+			}
+			result.Actions = append(result.Actions, "deleted local copy")
+
+		case !shouldStore && c.exists:
+			if err := f.operationHandler.replicationHandler.DeleteFromHost(ctx, object, c.host); err != nil {
+				return result, fmt.Errorf("delete stray replica from %v: %w", c.host, err)
+			}
+			result.Actions = append(result.Actions, fmt.Sprintf("deleted stray replica from %v", c.host))
+
+		case !shouldStore || (c.exists && c.checksum == authoritative.checksum):
+			continue // the copy is consistent
+
+		case c.isLocal && c.exists:
+			if err := f.loadContent(ctx, object, &authoritative); err != nil {
+				return result, fmt.Errorf("load authoritative copy: %w", err)
+			}
+			if err := f.fileHandler.ReplaceObject(object, authoritative.content, authoritative.metadata); err != nil {
+				return result, fmt.Errorf("replace local copy: %w", err)
+			}
+			result.Actions = append(result.Actions, "replaced local copy")
+
+		case c.isLocal:
+			if err := f.loadContent(ctx, object, &authoritative); err != nil {
+				return result, fmt.Errorf("load authoritative copy: %w", err)
+			}
+			if err := f.fileHandler.PersistObject(ctx, object, authoritative.content, authoritative.metadata); err != nil {
+				return result, fmt.Errorf("restore local copy: %w", err)
+			}
+			result.Actions = append(result.Actions, "restored local copy")
+
+		default:
+			if err := f.loadContent(ctx, object, &authoritative); err != nil {
+				return result, fmt.Errorf("load authoritative copy: %w", err)
+			}
+			// the replica is replaced in a single operation; it never misses the object in between
+			if err := f.operationHandler.replicationHandler.ReplaceOnHost(ctx, object, authoritative.content, authoritative.metadata, c.host); err != nil {
+				return result, fmt.Errorf("push authoritative copy to %v: %w", c.host, err)
+			}
+			result.Actions = append(result.Actions, fmt.Sprintf("pushed authoritative copy to %v", c.host))
+		}
+	}
+
+	if isDeleted && len(result.UnreachableHosts) == 0 {
+		// no node stores the object anymore
+		if err := f.fileHandler.RemoveTombstone(object); err != nil {
+			return result, fmt.Errorf("remove tombstone: %w", err)
+		}
+	}
+
+	if len(result.Actions) > 0 {
+		f.sugar.Infow("Repaired object", "object", object, "actions", result.Actions)
+	}
+
+	return result, nil
+}
+
+// RequestRepair schedules a repair of the object without waiting for it. A node that isn't the primary of the object
+// reports the corruption of its copy to the primary, which repairs the object.
+func (f *Handler) RequestRepair(object string) {
+	select {
+	case f.repairQueue <- object:
+	default:
+		f.sugar.Warnw("Repair queue is full. The object will be repaired by the next scrub.", "object", object)
+	}
+}
+
+func (f *Handler) processRepairQueue() {
+	for object := range f.repairQueue {
+		dist, err := f.distributionHandler.GetDistribution(object)
+		if err != nil || !dist.IsInPlacementGroup {
+			continue
+		}
+		if !dist.IsPrimary {
+			// only the primary can repair objects
+			f.reportCorruption(object, dist.PrimaryHost)
+			continue
+		}
+
+		if _, err := f.Repair(context.Background(), object); err != nil {
+			f.sugar.Errorw("Failed to repair object", "err", err, "object", object)
+		}
+	}
+}
+
+// reportCorruption asks the primary to repair the object because the local copy is corrupted. If the report gets lost,
+// the next scrub of the primary detects the corruption.
+func (f *Handler) reportCorruption(object string, primaryHost string) {
+	ctx, cancel := f.operationHandler.withTimeout(context.Background())
+	defer cancel()
+
+	if err := f.operationHandler.replicationHandler.ReportCorruption(ctx, object, primaryHost); err != nil {
+		f.sugar.Warnw("Failed to report corrupted copy to the primary", "err", err, "object", object,
+			"primary", primaryHost)
+	}
+}
+
+// startRepair fails if the object is currently created, deleted, replaced or repaired.
+func (f *Handler) startRepair(object string) error {
+	shard := f.shardOf(object)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	entry := shard.getEntry(object)
+	if fileIsBusy(entry) {
+		return ErrObjectIsBusy
+	}
+
+	entry.repair = true
+	shard.setEntry(object, entry)
+	return nil
+}
+
+func (f *Handler) finishRepair(object string) {
+	shard := f.shardOf(object)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	entry := shard.getEntry(object)
+	entry.repair = false
+	shard.setEntry(object, entry)
+}
+
+// collectCopies compares the copies by their inventory entries; no content is transferred.
+func (f *Handler) collectCopies(ctx context.Context, object string, slaveHosts []string) ([]objectCopy, error) {
+	localCopy := objectCopy{host: f.distributionHandler.OwnHost(), isLocal: true}
+	entry, err := f.ObjectInventory(object)
+	switch {
+	case errors.Is(err, ErrObjectDoesNotExist):
+	case err != nil:
+		return nil, fmt.Errorf("check local copy: %w", err)
+	default:
+		metadata, err := f.fileHandler.GetMetadata(object)
+		if err != nil && !errors.Is(err, file.ErrNoMetadata) {
+			return nil, fmt.Errorf("get metadata: %w", err)
+		}
+
+		localCopy.exists = true
+		localCopy.metadata = metadata
+		localCopy.checksum = entry.ComputedChecksum
+	}
+
+	copies := []objectCopy{localCopy}
+	for _, host := range slaveHosts {
+		entry, exists, err := f.operationHandler.replicationHandler.FetchObjectInventory(ctx, object, host)
+		if err != nil {
+			f.sugar.Warnw("Failed to fetch inventory entry of object", "err", err, "object", object, "host", host)
+			copies = append(copies, objectCopy{host: host, unreachable: true})
+			continue
+		}
+
+		remoteCopy := objectCopy{host: host, exists: exists}
+		if exists {
+			// the remaining metadata is loaded with the content
+			remoteCopy.metadata = file.Metadata{Pool: entry.Pool, Checksum: entry.Checksum}
+			remoteCopy.checksum = entry.ComputedChecksum
+		}
+		copies = append(copies, remoteCopy)
+	}
+
+	return copies, nil
+}
+
+// loadContent loads the stored content and the complete metadata of the copy once. The checksum is verified again
+// because a replica might have been modified after its inventory entry has been created. The checksum and the pool
+// that have been chosen for the copy are kept; the metadata of a replica might be corrupted.
+func (f *Handler) loadContent(ctx context.Context, object string, c *objectCopy) error {
+	if c.loaded {
+		return nil
+	}
+
+	var storedContent []byte
+	var metadata file.Metadata
+	var checksum string
+	if c.isLocal {
+		openedFile, err := f.fileHandler.OpenObject(object)
+		if err != nil {
+			return fmt.Errorf("open local copy: %w", err)
+		}
+		if checksum, storedContent, err = f.readAndClose(openedFile, object); err != nil {
+			return fmt.Errorf("read local copy: %w", err)
+		}
+		if metadata, err = f.fileHandler.GetMetadata(object); err != nil && !errors.Is(err, file.ErrNoMetadata) {
+			return fmt.Errorf("get metadata: %w", err)
+		}
+	} else {
+		content, fetchedMetadata, exists, err := f.operationHandler.replicationHandler.Fetch(ctx, object, false, c.host)
+		if err != nil {
+			return fmt.Errorf("fetch copy from %v: %w", c.host, err)
+		}
+		if !exists {
+			return fmt.Errorf("the copy on %v has been deleted", c.host)
+		}
+		storedContent, metadata = content, fetchedMetadata
+		checksum = f.checksumOfCopy(object, c.host, storedContent, metadata)
+	}
+	if checksum != c.checksum {
+		return fmt.Errorf("the copy on %v has been modified", c.host)
+	}
+
+	metadata.Checksum = c.metadata.Checksum
+	metadata.Pool = c.metadata.Pool
+	c.content, c.metadata, c.loaded = storedContent, metadata, true
+	return nil
+}
+
+func (f *Handler) chooseAuthoritativeCopy(copies []objectCopy) (authoritative objectCopy, shouldExist bool, err error) {
+	localCopy := copies[0]
+
+	numExisting, numReachable := 0, 0
+	for _, c := range copies {
+		if c.exists {
+			numExisting++
+		}
+		if !c.unreachable {
+			numReachable++
+		}
+	}
+	shouldExist = localCopy.exists || numExisting*2 > numReachable
+	if !shouldExist {
+		return objectCopy{}, false, nil
+	}
+
+	if localCopy.exists && localCopy.metadata.Checksum != "" {
+		for _, c := range copies {
+			if c.exists && c.checksum == localCopy.metadata.Checksum {
+				// the replica's metadata might be corrupted as well
+				c.metadata.Checksum = localCopy.metadata.Checksum
+				c.metadata.Pool = localCopy.metadata.Pool
+				return c, true, nil
+			}
+		}
+		return objectCopy{}, false, errors.New("no copy matches the persisted checksum")
+	}
+
+	// majority vote; the local copy wins a draw because it is the first copy. Copies that can't be decoded don't vote.
+	votes := map[string]int{}
+	for _, c := range copies {
+		if c.exists && c.checksum != "" {
+			votes[c.checksum]++
+		}
+	}
+	for _, c := range copies {
+		if c.exists && c.checksum != "" && votes[c.checksum] > votes[authoritative.checksum] {
+			authoritative = c
+		}
+	}
+	if authoritative.checksum == "" {
+		return objectCopy{}, false, errors.New("no copy can be decoded")
+	}
+
+	return authoritative, true, nil
+}
+
+// checksumOfCopy decodes the stored content of a copy and returns the checksum of the clear-text content. It returns
+// an empty string if the copy can't be decoded, e.g. because the ciphertext has been modified.
+func (f *Handler) checksumOfCopy(object string, host string, storedContent []byte, metadata file.Metadata) string {
+	reader, err := f.fileHandler.DecodeObject(storedContent, metadata)
+	if err == nil {
+		var checksum string
+		if checksum, err = reader.Checksum(); err == nil {
+			return checksum
+		}
+	}
+
+	f.sugar.Warnw("Failed to decode copy of object", "err", err, "object", object, "host", host)
+	return ""
+}
+
+// readAndClose returns the checksum of the clear-text content and the stored content of the object.
+func (f *Handler) readAndClose(openedFile *file.ObjectReader, object string) (checksum string, storedContent []byte, err error) {
+	defer file.CloseAndLogError(openedFile, object, f.sugar)
+
+	checksum, err = openedFile.Checksum()
+	if errors.Is(err, file.ErrContentIsCorrupted) {
+		// the local copy is replaced by the authoritative copy
+		f.sugar.Warnw("Failed to decode local copy of object", "err", err, "object", object)
+	} else if err != nil {
+		return "", nil, err
+	}
+
+	stored, err := openedFile.Stored()
+	if err != nil {
+		return "", nil, err
+	}
+	storedContent, err = io.ReadAll(stored)
+	return checksum, storedContent, err
+}
@@ -0,0 +1,101 @@
+package object
+
+import (
+	"github.com/rstdm/mini-ceph/internal/api/object/file"
+	"testing"
+)
+
+func TestChooseAuthoritativeCopy(t *testing.T) {
+	intact, corrupted, other := file.Checksum([]byte("intact")), file.Checksum([]byte("corrupted")), file.Checksum([]byte("other"))
+	local := func(computed string, persisted string) objectCopy {
+		return objectCopy{host: "primary", isLocal: true, exists: true, checksum: computed,
+			metadata: file.Metadata{Checksum: persisted, Pool: "default"}}
+	}
+	replica := func(host string, computed string) objectCopy {
+		return objectCopy{host: host, exists: true, checksum: computed, metadata: file.Metadata{Checksum: computed}}
+	}
+	missing := func(host string) objectCopy { return objectCopy{host: host} }
+	unreachable := func(host string) objectCopy { return objectCopy{host: host, unreachable: true} }
+
+	tests := []struct {
+		name            string
+		copies          []objectCopy
+		wantHost        string // empty if the object shouldn't exist
+		wantError       bool
+		wantShouldExist bool
+	}{
+		{
+			name:            "corrupted primary",
+			copies:          []objectCopy{local(corrupted, intact), replica("a", intact), replica("b", intact)},
+			wantHost:        "a",
+			wantShouldExist: true,
+		},
+		{
+			name:            "corrupted secondary",
+			copies:          []objectCopy{local(intact, intact), replica("a", corrupted), replica("b", intact)},
+			wantHost:        "primary",
+			wantShouldExist: true,
+		},
+		{
+			name:            "undecodable primary",
+			copies:          []objectCopy{local("", intact), replica("a", intact), replica("b", intact)},
+			wantHost:        "a",
+			wantShouldExist: true,
+		},
+		{
+			name:      "no copy matches the persisted checksum",
+			copies:    []objectCopy{local(corrupted, intact), replica("a", other), replica("b", corrupted)},
+			wantError: true,
+		},
+		{
+			name:            "conflicting checksums without persisted checksum are decided by majority",
+			copies:          []objectCopy{local(other, ""), replica("a", intact), replica("b", intact)},
+			wantHost:        "a",
+			wantShouldExist: true,
+		},
+		{
+			name:            "the primary wins a draw",
+			copies:          []objectCopy{local(other, ""), replica("a", intact), missing("b")},
+			wantHost:        "primary",
+			wantShouldExist: true,
+		},
+		{
+			name:      "no copy can be decoded",
+			copies:    []objectCopy{local("", ""), replica("a", "")},
+			wantError: true,
+		},
+		{
+			name:            "missing primary copy of an object stored by the majority",
+			copies:          []objectCopy{missing("primary"), replica("a", intact), replica("b", intact)},
+			wantHost:        "a",
+			wantShouldExist: true,
+		},
+		{
+			name:   "stray replica",
+			copies: []objectCopy{missing("primary"), replica("a", intact), missing("b")},
+		},
+		{
+			name:   "unreachable nodes don't vote",
+			copies: []objectCopy{missing("primary"), replica("a", intact), unreachable("b"), missing("c")},
+		},
+	}
+
+	for _, test := range tests {
+		test.copies[0].isLocal = true
+		authoritative, shouldExist, err := (&Handler{}).chooseAuthoritativeCopy(test.copies)
+		if (err != nil) != test.wantError {
+			t.Errorf("%v: error = %v, want error %v", test.name, err, test.wantError)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if shouldExist != test.wantShouldExist || authoritative.host != test.wantHost {
+			t.Errorf("%v: chose %q (shouldExist %v), want %q (shouldExist %v)", test.name, authoritative.host,
+				shouldExist, test.wantHost, test.wantShouldExist)
+		}
+		if shouldExist && test.copies[0].metadata.Checksum != "" && authoritative.metadata.Checksum != test.copies[0].metadata.Checksum {
+			t.Errorf("%v: the authoritative copy doesn't keep the persisted checksum of the primary: %+v", test.name, authoritative.metadata)
+		}
+	}
+}
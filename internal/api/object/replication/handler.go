@@ -2,64 +2,131 @@ package replication
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
 	"fmt"
 	"github.com/go-resty/resty/v2"
+	"github.com/rstdm/mini-ceph/internal/api/object/file"
+	"github.com/rstdm/mini-ceph/internal/metrics"
+	"github.com/rstdm/mini-ceph/internal/tracing"
 	"go.uber.org/multierr"
 	"go.uber.org/zap"
 	"net/http"
 	"path"
+	"strconv"
+	"time"
 )
 
 type Handler struct {
-	client *resty.Client
-	sugar  *zap.SugaredLogger
+	client   *resty.Client
+	schemes  map[string]string // host -> scheme
+	latency  *metrics.HistogramVec
+	failures *metrics.CounterVec
+	sugar    *zap.SugaredLogger
 }
 
-func NewHandler(clusterBearerToken string, sugar *zap.SugaredLogger) *Handler {
+// NewHandler creates a handler that contacts every host with its scheme; hosts without a scheme are contacted via
+// http. The TLS configuration is used for https connections; the default configuration is used if it is nil. The
+// latency and the failures of the requests are recorded per peer in the registry.
+func NewHandler(clusterBearerToken string, schemes map[string]string, tlsConfig *tls.Config, registry *metrics.Registry, sugar *zap.SugaredLogger) *Handler {
 	client := resty.New()
 
 	if clusterBearerToken != "" {
 		client.SetAuthToken(clusterBearerToken)
 	}
+	if tlsConfig != nil {
+		client.SetTLSClientConfig(tlsConfig)
+	}
+	// the other nodes continue the trace of the request
+	client.OnBeforeRequest(func(_ *resty.Client, request *resty.Request) error {
+		if traceParent := tracing.TraceParent(request.Context()); traceParent != "" {
+			request.SetHeader(tracing.TraceParentHeader, traceParent)
+		}
+		return nil
+	})
 
 	return &Handler{
-		client: client,
-		sugar:  sugar,
+		client:  client,
+		schemes: schemes,
+		latency: registry.NewHistogramVec("miniceph_replication_duration_seconds", "Latency of the requests to "+
+			"other nodes.", metrics.DefaultBuckets, "peer", "operation"),
+		failures: registry.NewCounterVec("miniceph_replication_failures_total", "Number of requests to other nodes "+
+			"that have failed.", "peer", "operation"),
+		sugar: sugar,
 	}
 }
 
-func (h *Handler) Replicate(objectHash string, objectContent []byte, hosts []string) error {
-	var merr error
+// startRequest starts the span of a request to the host. The request has to be finished with finishRequest.
+func (h *Handler) startRequest(ctx context.Context, operation string, host string) (context.Context, *tracing.Span, time.Time) {
+	ctx, span := tracing.Start(ctx, "replication."+operation, "peer", host)
+	return ctx, span, time.Now()
+}
 
-	for _, host := range hosts {
-		if err := h.replicateToHost(objectHash, objectContent, host); err != nil {
-			merr = fmt.Errorf("replicate to %v: %w", host, err)
-			break
-		}
+// finishRequest records the latency of a request to the host and whether it has failed. It is deferred at the
+// beginning of the request.
+func (h *Handler) finishRequest(operation string, host string, span *tracing.Span, start time.Time, err *error) {
+	h.latency.Observe(time.Since(start).Seconds(), host, operation)
+	if *err != nil {
+		h.failures.Inc(host, operation)
 	}
+	span.SetError(*err)
+	span.End()
+}
+
+// MetadataHeader contains the json encoded metadata of an object that is replicated.
+const MetadataHeader = "X-Object-Metadata"
 
-	if merr != nil {
-		h.sugar.Errorw(
-			"Failed to replicate object. Deleting created replicas from all hosts.",
-			"err", merr,
-			"objectHash", objectHash,
-		)
-		if err := h.Delete(objectHash, hosts); err != nil {
-			err = fmt.Errorf("delete replicas after failed replication attempt: %w", err)
+// Replicate persists the object on all hosts. The content is sent as it is stored, i.e. compressed and encrypted
+// according to the metadata. It returns the hosts on which the object could not be persisted. The caller is
+// responsible for deleting the replicas if the object should not be persisted.
+func (h *Handler) Replicate(ctx context.Context, objectHash string, objectContent []byte, metadata file.Metadata, hosts []string) (failedHosts []string, merr error) {
+	return h.replicate(ctx, objectHash, objectContent, metadata, hosts, false)
+}
+
+// ReplaceReplicas persists the object on all hosts like Replicate, but replaces the previous version of the object
+// on every host instead of failing if it already exists.
+func (h *Handler) ReplaceReplicas(ctx context.Context, objectHash string, objectContent []byte, metadata file.Metadata, hosts []string) (failedHosts []string, merr error) {
+	return h.replicate(ctx, objectHash, objectContent, metadata, hosts, true)
+}
+
+func (h *Handler) replicate(ctx context.Context, objectHash string, objectContent []byte, metadata file.Metadata, hosts []string, replace bool) (failedHosts []string, merr error) {
+	for _, host := range hosts {
+		if err := h.replicateToHost(ctx, objectHash, objectContent, metadata, host, replace); err != nil {
+			failedHosts = append(failedHosts, host)
+			err = fmt.Errorf("replicate to %v: %w", host, err)
 			merr = multierr.Append(merr, err)
 		}
-
-		return merr
 	}
 
-	return nil
+	return failedHosts, merr
+}
+
+// ReplicateToHost persists the object on a single host. The object must not exist on the host.
+func (h *Handler) ReplicateToHost(ctx context.Context, objectHash string, objectContent []byte, metadata file.Metadata, host string) error {
+	return h.replicateToHost(ctx, objectHash, objectContent, metadata, host, false)
+}
+
+// ReplaceOnHost persists the object on a single host and replaces the previous version in a single operation.
+func (h *Handler) ReplaceOnHost(ctx context.Context, objectHash string, objectContent []byte, metadata file.Metadata, host string) error {
+	return h.replicateToHost(ctx, objectHash, objectContent, metadata, host, true)
 }
 
-func (h *Handler) replicateToHost(objectHash string, objectContent []byte, host string) error {
-	url := buildURL(objectHash, host)
+func (h *Handler) replicateToHost(ctx context.Context, objectHash string, objectContent []byte, metadata file.Metadata, host string, replace bool) (err error) {
+	ctx, span, start := h.startRequest(ctx, "replicate", host)
+	defer h.finishRequest("replicate", host, span, start, &err)
+	url := h.buildURL(host, "internal", objectHash)
 	reader := bytes.NewReader(objectContent)
 
+	encodedMetadata, err := json.Marshal(metadata)
+	if err != nil {
+		return fmt.Errorf("json encode metadata: %w", err)
+	}
+
 	response, err := h.client.R().
+		SetContext(ctx).
+		SetHeader(MetadataHeader, string(encodedMetadata)).
+		SetQueryParam("replace", strconv.FormatBool(replace)).
 		SetFileReader("file", "file", reader).
 		Put(url)
 	if err != nil {
@@ -73,11 +140,11 @@ func (h *Handler) replicateToHost(objectHash string, objectContent []byte, host
 	return nil
 }
 
-func (h *Handler) Delete(objectHash string, hosts []string) error {
+func (h *Handler) Delete(ctx context.Context, objectHash string, hosts []string) error {
 	var merr error
 
 	for _, host := range hosts {
-		if err := h.deleteFromHost(objectHash, host); err != nil {
+		if err := h.deleteFromHost(ctx, objectHash, host); err != nil {
 			err = fmt.Errorf("delete replica from host %v: %w", host, err)
 			merr = multierr.Append(merr, err)
 		}
@@ -86,13 +153,25 @@ func (h *Handler) Delete(objectHash string, hosts []string) error {
 	return merr
 }
 
-func (h *Handler) deleteFromHost(objectHash string, host string) error {
-	url := buildURL(objectHash, host)
-	response, err := h.client.R().Delete(url)
+// DeleteFromHost deletes the object from a single host.
+func (h *Handler) DeleteFromHost(ctx context.Context, objectHash string, host string) error {
+	return h.deleteFromHost(ctx, objectHash, host)
+}
+
+func (h *Handler) deleteFromHost(ctx context.Context, objectHash string, host string) (err error) {
+	ctx, span, start := h.startRequest(ctx, "delete", host)
+	defer h.finishRequest("delete", host, span, start, &err)
+	url := h.buildURL(host, "internal", objectHash)
+	response, err := h.client.R().SetContext(ctx).Delete(url)
 	if err != nil {
 		return fmt.Errorf("perform DELETE request to url %v: %w", url, err)
 	}
 
+	// the replica doesn't store the object (anymore); this is the desired state
+	if response.StatusCode() == http.StatusNotFound {
+		return nil
+	}
+
 	if response.StatusCode() != http.StatusOK {
 		return fmt.Errorf("requested DELETE %v, server responded with unexpected status code %v", url, response.StatusCode())
 	}
@@ -100,6 +179,98 @@ func (h *Handler) deleteFromHost(objectHash string, host string) error {
 	return nil
 }
 
-func buildURL(objectHash string, host string) string {
-	return "http://" + path.Join(host, "internal", objectHash)
+// ReportCorruption asks the primary of the object to repair it because the copy of the current node is corrupted.
+func (h *Handler) ReportCorruption(ctx context.Context, objectHash string, primaryHost string) (err error) {
+	ctx, span, start := h.startRequest(ctx, "corruption", primaryHost)
+	defer h.finishRequest("corruption", primaryHost, span, start, &err)
+	url := h.buildURL(primaryHost, "internal", objectHash, "corruption")
+	response, err := h.client.R().SetContext(ctx).Post(url)
+	if err != nil {
+		return fmt.Errorf("perform POST request to url %v: %w", url, err)
+	}
+
+	if response.StatusCode() != http.StatusAccepted {
+		return fmt.Errorf("requested POST %v, server responded with unexpected status code %v", url, response.StatusCode())
+	}
+
+	return nil
+}
+
+// Fetch downloads the stored content of the object and its metadata from the host; the content has to be decoded
+// according to the metadata. exists is false if the host doesn't store the object.
+// The host verifies the checksum of the object if verifyChecksum is true.
+func (h *Handler) Fetch(ctx context.Context, objectHash string, verifyChecksum bool, host string) (objectContent []byte, metadata file.Metadata, exists bool, err error) {
+	ctx, span, start := h.startRequest(ctx, "fetch", host)
+	defer h.finishRequest("fetch", host, span, start, &err)
+	url := h.buildURL(host, "internal", objectHash)
+	response, err := h.client.R().
+		SetContext(ctx).
+		SetQueryParam("verifyChecksum", strconv.FormatBool(verifyChecksum)).
+		Get(url)
+	if err != nil {
+		return nil, file.Metadata{}, false, fmt.Errorf("GET %v: %w", url, err)
+	}
+
+	switch response.StatusCode() {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, file.Metadata{}, false, nil
+	default:
+		return nil, file.Metadata{}, false, fmt.Errorf("GET %v yielded unexpected http status code %v", url, response.StatusCode())
+	}
+
+	if encodedMetadata := response.Header().Get(MetadataHeader); encodedMetadata != "" {
+		if err := json.Unmarshal([]byte(encodedMetadata), &metadata); err != nil {
+			return nil, file.Metadata{}, false, fmt.Errorf("parse metadata of %v: %w", url, err)
+		}
+	}
+
+	return response.Body(), metadata, true, nil
+}
+
+// PoolsHashHeader contains the hash of the pool configuration of a node.
+const PoolsHashHeader = "X-Pools-Hash"
+
+// Ping checks whether the node is alive. It returns the hash of the pool configuration of the node; the hash is empty
+// if the node doesn't send it.
+func (h *Handler) Ping(ctx context.Context, host string) (poolsHash string, err error) {
+	ctx, span, start := h.startRequest(ctx, "ping", host)
+	defer h.finishRequest("ping", host, span, start, &err)
+
+	url := h.buildURL(host, "healthz")
+	response, err := h.client.R().SetContext(ctx).Get(url)
+	if err != nil {
+		return "", fmt.Errorf("GET %v: %w", url, err)
+	}
+	if response.StatusCode() != http.StatusOK {
+		return "", fmt.Errorf("GET %v yielded unexpected http status code %v", url, response.StatusCode())
+	}
+
+	return response.Header().Get(PoolsHashHeader), nil
+}
+
+// FetchDiskSpace returns the disk space of the node.
+func (h *Handler) FetchDiskSpace(ctx context.Context, host string) (space file.DiskSpace, err error) {
+	ctx, span, start := h.startRequest(ctx, "capacity", host)
+	defer h.finishRequest("capacity", host, span, start, &err)
+
+	url := h.buildURL(host, "internal", "capacity")
+	response, err := h.client.R().SetContext(ctx).SetResult(&space).Get(url)
+	if err != nil {
+		return file.DiskSpace{}, fmt.Errorf("GET %v: %w", url, err)
+	}
+	if response.StatusCode() != http.StatusOK {
+		return file.DiskSpace{}, fmt.Errorf("GET %v yielded unexpected http status code %v", url, response.StatusCode())
+	}
+
+	return space, nil
+}
+
+func (h *Handler) buildURL(host string, elements ...string) string {
+	scheme, ok := h.schemes[host]
+	if !ok {
+		scheme = "http"
+	}
+
+	return scheme + "://" + path.Join(append([]string{host}, elements...)...)
 }
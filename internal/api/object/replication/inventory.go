@@ -0,0 +1,64 @@
+package replication
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+// InventoryEntry describes an object that is stored on a node. The checksums are only set for deep inventories.
+type InventoryEntry struct {
+	Hash             string
+	Size             int64
+	Pool             string `json:",omitempty"`
+	Checksum         string `json:",omitempty"` // the checksum that has been persisted when the object was created
+	ComputedChecksum string `json:",omitempty"` // the checksum of the content that is currently stored
+}
+
+// FetchInventory requests the inventory of the placement group from the given host.
+func (h *Handler) FetchInventory(ctx context.Context, placementGroup uint32, deep bool, host string) (inventory []InventoryEntry, err error) {
+	ctx, span, start := h.startRequest(ctx, "inventory", host)
+	defer h.finishRequest("inventory", host, span, start, &err)
+	url := h.buildURL(host, "internal", "pg", strconv.FormatUint(uint64(placementGroup), 10), "inventory")
+
+	response, err := h.client.R().
+		SetContext(ctx).
+		SetQueryParam("deep", strconv.FormatBool(deep)).
+		SetResult(&inventory).
+		Get(url)
+	if err != nil {
+		return nil, fmt.Errorf("GET %v: %w", url, err)
+	}
+
+	if response.StatusCode() != http.StatusOK {
+		return nil, fmt.Errorf("GET %v yielded unexpected http status code %v", url, response.StatusCode())
+	}
+
+	return inventory, nil
+}
+
+// FetchObjectInventory requests the deep inventory entry of a single object from the given host. exists is false if
+// the host doesn't store the object.
+func (h *Handler) FetchObjectInventory(ctx context.Context, objectHash string, host string) (entry InventoryEntry, exists bool, err error) {
+	ctx, span, start := h.startRequest(ctx, "object_inventory", host)
+	defer h.finishRequest("object_inventory", host, span, start, &err)
+	url := h.buildURL(host, "internal", objectHash, "inventory")
+
+	response, err := h.client.R().
+		SetContext(ctx).
+		SetResult(&entry).
+		Get(url)
+	if err != nil {
+		return InventoryEntry{}, false, fmt.Errorf("GET %v: %w", url, err)
+	}
+
+	switch response.StatusCode() {
+	case http.StatusOK:
+		return entry, true, nil
+	case http.StatusNotFound:
+		return InventoryEntry{}, false, nil
+	default:
+		return InventoryEntry{}, false, fmt.Errorf("GET %v yielded unexpected http status code %v", url, response.StatusCode())
+	}
+}
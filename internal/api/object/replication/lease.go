@@ -0,0 +1,40 @@
+package replication
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// ReadLease allows a secondary to serve reads of a placement group until the lease expires.
+type ReadLease struct {
+	Duration time.Duration
+}
+
+// RequestReadLease asks the primary for a read lease. granted is false if the primary refuses to grant the lease
+// because the secondary isn't in sync with the primary.
+func (h *Handler) RequestReadLease(ctx context.Context, placementGroup uint32, ownHost string, primaryHost string) (lease ReadLease, granted bool, err error) {
+	ctx, span, start := h.startRequest(ctx, "lease", primaryHost)
+	defer h.finishRequest("lease", primaryHost, span, start, &err)
+	url := h.buildURL(primaryHost, "internal", "pg", strconv.FormatUint(uint64(placementGroup), 10), "lease")
+
+	response, err := h.client.R().
+		SetContext(ctx).
+		SetQueryParam("host", ownHost).
+		SetResult(&lease).
+		Post(url)
+	if err != nil {
+		return ReadLease{}, false, fmt.Errorf("POST %v: %w", url, err)
+	}
+
+	switch response.StatusCode() {
+	case http.StatusOK:
+		return lease, true, nil
+	case http.StatusConflict:
+		return ReadLease{}, false, nil
+	default:
+		return ReadLease{}, false, fmt.Errorf("POST %v yielded unexpected http status code %v", url, response.StatusCode())
+	}
+}
@@ -0,0 +1,91 @@
+package replication
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/rstdm/mini-ceph/internal/api/object/file"
+	"github.com/rstdm/mini-ceph/internal/api/object/upload"
+	"net/http"
+	"strconv"
+)
+
+// UploadHeader contains the json encoded upload of a part that is replicated. The replica creates the upload with
+// its first part.
+const UploadHeader = "X-Upload"
+
+// ReplicatePart persists the encoded content of a part of a multipart upload on the host. An existing part with the
+// same number is replaced.
+func (h *Handler) ReplicatePart(ctx context.Context, multipartUpload upload.Upload, number int, storedContent []byte, metadata file.Metadata, host string) (err error) {
+	ctx, span, start := h.startRequest(ctx, "uploadPart", host)
+	defer h.finishRequest("uploadPart", host, span, start, &err)
+	url := h.buildURL(host, "internal", multipartUpload.ObjectHash, "uploads", multipartUpload.ID, strconv.Itoa(number))
+
+	encodedMetadata, err := json.Marshal(metadata)
+	if err != nil {
+		return fmt.Errorf("json encode metadata: %w", err)
+	}
+	encodedUpload, err := json.Marshal(multipartUpload)
+	if err != nil {
+		return fmt.Errorf("json encode upload: %w", err)
+	}
+
+	response, err := h.client.R().
+		SetContext(ctx).
+		SetHeader(MetadataHeader, string(encodedMetadata)).
+		SetHeader(UploadHeader, string(encodedUpload)).
+		SetFileReader("file", "file", bytes.NewReader(storedContent)).
+		Put(url)
+	if err != nil {
+		return fmt.Errorf("PUT %v: %w", url, err)
+	}
+	if response.StatusCode() != http.StatusOK {
+		return fmt.Errorf("PUT %v yielded unexpected http status code %v", url, response.StatusCode())
+	}
+
+	return nil
+}
+
+// FetchPart downloads the encoded content of a part and its metadata from the host. exists is false if the host
+// doesn't store the part.
+func (h *Handler) FetchPart(ctx context.Context, objectHash string, uploadID string, number int, host string) (storedContent []byte, metadata file.Metadata, exists bool, err error) {
+	ctx, span, start := h.startRequest(ctx, "fetchPart", host)
+	defer h.finishRequest("fetchPart", host, span, start, &err)
+	url := h.buildURL(host, "internal", objectHash, "uploads", uploadID, strconv.Itoa(number))
+
+	response, err := h.client.R().SetContext(ctx).Get(url)
+	if err != nil {
+		return nil, file.Metadata{}, false, fmt.Errorf("GET %v: %w", url, err)
+	}
+	switch response.StatusCode() {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, file.Metadata{}, false, nil
+	default:
+		return nil, file.Metadata{}, false, fmt.Errorf("GET %v yielded unexpected http status code %v", url, response.StatusCode())
+	}
+
+	if err := json.Unmarshal([]byte(response.Header().Get(MetadataHeader)), &metadata); err != nil {
+		return nil, file.Metadata{}, false, fmt.Errorf("parse metadata of %v: %w", url, err)
+	}
+
+	return response.Body(), metadata, true, nil
+}
+
+// AbortUpload deletes the upload and its parts from the host. It succeeds if the host doesn't store the upload.
+func (h *Handler) AbortUpload(ctx context.Context, objectHash string, uploadID string, host string) (err error) {
+	ctx, span, start := h.startRequest(ctx, "abortUpload", host)
+	defer h.finishRequest("abortUpload", host, span, start, &err)
+	url := h.buildURL(host, "internal", objectHash, "uploads", uploadID)
+
+	response, err := h.client.R().SetContext(ctx).Delete(url)
+	if err != nil {
+		return fmt.Errorf("DELETE %v: %w", url, err)
+	}
+	if response.StatusCode() != http.StatusOK && response.StatusCode() != http.StatusNotFound {
+		return fmt.Errorf("DELETE %v yielded unexpected http status code %v", url, response.StatusCode())
+	}
+
+	return nil
+}
@@ -0,0 +1,64 @@
+package replication
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+)
+
+// Usage is the logical (uncompressed) size and the number of objects.
+type Usage struct {
+	Bytes   int64
+	Objects int64
+}
+
+// UsageReport contains the usage of the placement groups of which a node is primary, per owner and per pool. Objects
+// without owner aren't contained in Users.
+type UsageReport struct {
+	Users map[string]Usage
+	Pools map[string]Usage
+}
+
+func NewUsageReport() UsageReport {
+	return UsageReport{Users: map[string]Usage{}, Pools: map[string]Usage{}}
+}
+
+// Add adds the bytes and objects to the usage of the owner and of the pool. Negative values remove objects.
+func (r UsageReport) Add(owner string, pool string, bytes int64, objects int64) {
+	delta := Usage{Bytes: bytes, Objects: objects}
+	if owner != "" {
+		r.Users[owner] = r.Users[owner].plus(delta)
+	}
+	r.Pools[pool] = r.Pools[pool].plus(delta)
+}
+
+// Merge adds the usage of the other report.
+func (r UsageReport) Merge(other UsageReport) {
+	for owner, usage := range other.Users {
+		r.Users[owner] = r.Users[owner].plus(usage)
+	}
+	for pool, usage := range other.Pools {
+		r.Pools[pool] = r.Pools[pool].plus(usage)
+	}
+}
+
+func (u Usage) plus(other Usage) Usage {
+	return Usage{Bytes: u.Bytes + other.Bytes, Objects: u.Objects + other.Objects}
+}
+
+// FetchUsage returns the usage of the placement groups of which the host is primary.
+func (h *Handler) FetchUsage(ctx context.Context, host string) (report UsageReport, err error) {
+	ctx, span, start := h.startRequest(ctx, "usage", host)
+	defer h.finishRequest("usage", host, span, start, &err)
+
+	url := h.buildURL(host, "internal", "usage")
+	response, err := h.client.R().SetContext(ctx).SetResult(&report).Get(url)
+	if err != nil {
+		return UsageReport{}, fmt.Errorf("GET %v: %w", url, err)
+	}
+	if response.StatusCode() != http.StatusOK {
+		return UsageReport{}, fmt.Errorf("GET %v yielded unexpected http status code %v", url, response.StatusCode())
+	}
+
+	return report, nil
+}
@@ -0,0 +1,62 @@
+package object
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// RewrapResult reports the local objects whose data keys have been wrapped with the current master key.
+type RewrapResult struct {
+	Rewrapped int
+	// Busy contains the objects that were modified while the keys were rewrapped. They have to be rewrapped by
+	// another run.
+	Busy []string
+}
+
+// RewrapKeys wraps the data keys of all local objects with the current master key if they use an older key. Every
+// node rewraps its own copies; no content is transferred and the checksums don't change. An old master key can be
+// removed once the rewrap has completed without busy objects on every node.
+func (f *Handler) RewrapKeys(ctx context.Context) (RewrapResult, error) {
+	objects, err := f.fileHandler.ListObjects()
+	if err != nil {
+		return RewrapResult{}, fmt.Errorf("list objects: %w", err)
+	}
+
+	var result RewrapResult
+	for _, info := range objects {
+		if !f.fileHandler.NeedsRewrap(info.Metadata) {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return result, err
+		}
+
+		rewrapped, err := f.rewrapObject(info.Hash)
+		switch {
+		case errors.Is(err, ErrObjectIsBusy):
+			result.Busy = append(result.Busy, info.Hash)
+		case errors.Is(err, os.ErrNotExist):
+			// the object has been deleted in the meantime
+		case err != nil:
+			return result, fmt.Errorf("rewrap %v: %w", info.Hash, err)
+		case rewrapped:
+			result.Rewrapped++
+		}
+	}
+
+	f.sugar.Infow("Rewrapped data keys", "rewrapped", result.Rewrapped, "busy", len(result.Busy))
+	return result, nil
+}
+
+// rewrapObject locks the object like a repair; concurrent writes, replacements and deletions would overwrite or
+// remove the new metadata.
+func (f *Handler) rewrapObject(object string) (bool, error) {
+	if err := f.startRepair(object); err != nil {
+		return false, err
+	}
+	defer f.finishRepair(object)
+
+	return f.fileHandler.RewrapObject(object)
+}
@@ -0,0 +1,531 @@
+package object
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/rstdm/mini-ceph/internal/api/object/file"
+	"github.com/rstdm/mini-ceph/internal/api/object/replication"
+	"math/rand"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+var ErrNotPrimary = errors.New("the node is not the primary of the placement group")
+
+type InconsistencyKind string
+
+const (
+	InconsistencyMissing  InconsistencyKind = "missing"          // the object exists on the primary but not on the host
+	InconsistencyStray    InconsistencyKind = "stray"            // the object exists on the host but not on the primary
+	InconsistencySize     InconsistencyKind = "sizeMismatch"     // the object has a different size than on the primary
+	InconsistencyChecksum InconsistencyKind = "checksumMismatch" // the content doesn't match the persisted checksum
+	InconsistencyContent  InconsistencyKind = "contentMismatch"  // the content differs from the authoritative content
+)
+
+type Inconsistency struct {
+	ObjectHash string
+	Host       string
+	Kind       InconsistencyKind
+}
+
+type ScrubReport struct {
+	PlacementGroup  uint32
+	Deep            bool
+	StartedAt       time.Time
+	FinishedAt      time.Time
+	ObjectsChecked  int
+	Inconsistencies []Inconsistency
+	Repairs         []RepairResult `json:",omitempty"`
+	Errors          []string       `json:",omitempty"` // hosts that couldn't be scrubbed, etc.
+}
+
+type scrubber struct {
+	handler      *Handler
+	interval     time.Duration
+	deepInterval time.Duration
+	autoRepair   bool
+	limiter      *rateLimiter
+
+	running sync.Mutex // only one placement group is scrubbed at a time so that scrubs don't starve client I/O
+
+	mu      sync.Mutex
+	reports map[uint32]ScrubReport // the last report of each placement group
+}
+
+func newScrubber(handler *Handler, interval time.Duration, deepInterval time.Duration, autoRepair bool, bytesPerSecond int64) *scrubber {
+	return &scrubber{
+		handler:      handler,
+		interval:     interval,
+		deepInterval: deepInterval,
+		autoRepair:   autoRepair,
+		limiter:      newRateLimiter(bytesPerSecond),
+		reports:      map[uint32]ScrubReport{},
+	}
+}
+
+// start launches one scheduler per placement group for which the current node is the primary.
+func (s *scrubber) start() {
+	if s.interval <= 0 {
+		s.handler.sugar.Info("Scrubbing is disabled.")
+		return
+	}
+
+	for _, pg := range s.handler.distributionHandler.PrimaryPlacementGroups() {
+		go s.schedule(pg)
+	}
+}
+
+func (s *scrubber) schedule(placementGroup uint32) {
+	lastDeepScrub := time.Now() // there is no reason to perform a deep scrub immediately after the start
+
+	for {
+		// the jitter prevents that all placement groups are scrubbed at the same time
+		jitter := time.Duration(rand.Int63n(int64(s.interval)/5+1)) - s.interval/10
+		time.Sleep(s.interval + jitter)
+
+		deep := s.deepInterval > 0 && time.Since(lastDeepScrub) >= s.deepInterval
+		report := s.scrub(placementGroup, deep)
+		if deep && len(report.Errors) == 0 {
+			lastDeepScrub = report.FinishedAt
+		}
+	}
+}
+
+func (s *scrubber) scrub(placementGroup uint32, deep bool) ScrubReport {
+	s.running.Lock()
+	defer s.running.Unlock()
+
+	report := ScrubReport{
+		PlacementGroup: placementGroup,
+		Deep:           deep,
+		StartedAt:      time.Now(),
+	}
+	s.handler.sugar.Infow("Starting scrub", "placementGroup", placementGroup, "deep", deep)
+
+	localInventory, err := s.handler.inventory(placementGroup, deep, s.limiter)
+	if err != nil {
+		report.Errors = append(report.Errors, fmt.Sprintf("create local inventory: %v", err))
+		return s.finish(report)
+	}
+	report.ObjectsChecked = len(localInventory)
+
+	ownHost := s.handler.distributionHandler.OwnHost()
+	for _, entry := range localInventory {
+		if deep && entry.Checksum != "" && entry.Checksum != entry.ComputedChecksum {
+			report.Inconsistencies = append(report.Inconsistencies, Inconsistency{entry.Hash, ownHost, InconsistencyChecksum})
+		}
+	}
+
+	slaveHosts := s.handler.distributionHandler.SlaveHosts(placementGroup)
+	var scrubbedHosts []string
+	for _, host := range slaveHosts {
+		ctx, cancel := s.withInventoryTimeout(deep, localInventory)
+		remoteInventory, err := s.handler.operationHandler.replicationHandler.FetchInventory(ctx, placementGroup, deep, host)
+		cancel()
+		if err != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("fetch inventory of %v: %v", host, err))
+			continue
+		}
+		scrubbedHosts = append(scrubbedHosts, host)
+
+		report.Inconsistencies = append(report.Inconsistencies, compareInventories(localInventory, remoteInventory, host, deep, s.isExpectedOn(host, slaveHosts))...)
+	}
+
+	// The inventories are created one after another, so objects that are created or deleted in the meantime differ
+	// between them. Every inconsistency is checked again while the object can't be created or deleted; objects that
+	// are currently modified are skipped.
+	locked := map[string]bool{}
+	for _, inconsistency := range report.Inconsistencies {
+		object := inconsistency.ObjectHash
+		if _, ok := locked[object]; !ok {
+			locked[object] = s.handler.startRepair(object) == nil
+		}
+	}
+	defer func() {
+		for object, isLocked := range locked {
+			if isLocked {
+				s.handler.finishRepair(object)
+			}
+		}
+	}()
+	report.Inconsistencies, scrubbedHosts = s.confirm(&report, locked, slaveHosts, scrubbedHosts)
+
+	if s.autoRepair {
+		s.repair(&report)
+	}
+
+	s.markCleanReplicas(report, scrubbedHosts)
+
+	return s.finish(report)
+}
+
+// isExpectedOn returns a function that reports whether the pool of an object stores a replica on the host.
+func (s *scrubber) isExpectedOn(host string, slaveHosts []string) func(entry replication.InventoryEntry) bool {
+	return func(entry replication.InventoryEntry) bool {
+		for _, replicaHost := range s.handler.operationHandler.replicaHosts(slaveHosts, entry.Pool) {
+			if replicaHost == host {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// withInventoryTimeout bounds the request of an inventory by the operation timeout. A deep inventory reads every
+// object at the throttled scrub rate; its timeout is extended by twice the time that the local copies take at this
+// rate because the scrubs of other placement groups share the rate of the peer.
+func (s *scrubber) withInventoryTimeout(deep bool, localInventory []replication.InventoryEntry) (context.Context, context.CancelFunc) {
+	timeout := s.handler.operationHandler.operationTimeout
+	if timeout <= 0 {
+		return context.WithCancel(context.Background())
+	}
+
+	if deep && s.limiter.bytesPerSecond > 0 {
+		var numBytes int64
+		for _, entry := range localInventory {
+			numBytes += entry.Size
+		}
+		timeout += 2 * time.Duration(float64(numBytes)/float64(s.limiter.bytesPerSecond)*float64(time.Second))
+	}
+
+	return context.WithTimeout(context.Background(), timeout)
+}
+
+// confirm compares shallow inventories of the locked objects again and returns the inconsistencies that still exist.
+// A content or checksum mismatch is confirmed if the affected copies still exist; creating and deleting are the only
+// modifications of an object. Hosts whose inventory can't be fetched again aren't scrubbed; their inconsistencies are
+// dropped.
+func (s *scrubber) confirm(report *ScrubReport, locked map[string]bool, slaveHosts []string, scrubbedHosts []string) (confirmed []Inconsistency, confirmedHosts []string) {
+	if len(report.Inconsistencies) == 0 {
+		return nil, scrubbedHosts
+	}
+
+	localInventory, err := s.handler.inventory(report.PlacementGroup, false, s.limiter)
+	if err != nil {
+		report.Errors = append(report.Errors, fmt.Sprintf("create local inventory again: %v", err))
+		return nil, nil
+	}
+	ownHost := s.handler.distributionHandler.OwnHost()
+	exists := map[string]map[string]bool{ownHost: {}} // host -> object -> exists
+	for _, entry := range localInventory {
+		exists[ownHost][entry.Hash] = true
+	}
+
+	type key struct {
+		object string
+		host   string
+		kind   InconsistencyKind
+	}
+	rechecked := map[key]bool{}
+	for _, host := range scrubbedHosts {
+		ctx, cancel := s.handler.operationHandler.withTimeout(context.Background())
+		remoteInventory, err := s.handler.operationHandler.replicationHandler.FetchInventory(ctx, report.PlacementGroup, false, host)
+		cancel()
+		if err != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("fetch inventory of %v again: %v", host, err))
+			continue
+		}
+		confirmedHosts = append(confirmedHosts, host)
+
+		exists[host] = map[string]bool{}
+		for _, entry := range remoteInventory {
+			exists[host][entry.Hash] = true
+		}
+		for _, inconsistency := range compareInventories(localInventory, remoteInventory, host, false, s.isExpectedOn(host, slaveHosts)) {
+			rechecked[key{inconsistency.ObjectHash, inconsistency.Host, inconsistency.Kind}] = true
+		}
+	}
+
+	for _, inconsistency := range report.Inconsistencies {
+		object, host := inconsistency.ObjectHash, inconsistency.Host
+		if !locked[object] || exists[host] == nil {
+			continue
+		}
+
+		var isConfirmed bool
+		switch inconsistency.Kind {
+		case InconsistencyMissing, InconsistencyStray, InconsistencySize:
+			isConfirmed = rechecked[key{object, host, inconsistency.Kind}]
+		case InconsistencyChecksum:
+			isConfirmed = exists[host][object]
+		default:
+			isConfirmed = exists[host][object] && exists[ownHost][object]
+		}
+		if isConfirmed {
+			confirmed = append(confirmed, inconsistency)
+		}
+	}
+
+	return confirmed, confirmedHosts
+}
+
+// repair repairs every object that is mentioned in the report once. The repairs of the objects have already been
+// started by the scrub.
+func (s *scrubber) repair(report *ScrubReport) {
+	repaired := map[string]bool{}
+	for _, inconsistency := range report.Inconsistencies {
+		object := inconsistency.ObjectHash
+		if repaired[object] {
+			continue
+		}
+		repaired[object] = true
+
+		result, err := s.repairLocked(object)
+		if err != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("repair %v: %v", object, err))
+			continue
+		}
+		report.Repairs = append(report.Repairs, result)
+	}
+}
+
+func (s *scrubber) repairLocked(object string) (RepairResult, error) {
+	dist, err := s.handler.distributionHandler.GetDistribution(object)
+	if err != nil {
+		return RepairResult{}, fmt.Errorf("calculate distribution: %w", err)
+	}
+
+	ctx, cancel := s.handler.operationHandler.withTimeout(context.Background())
+	defer cancel()
+	return s.handler.repairLocked(ctx, object, dist)
+}
+
+// markCleanReplicas allows replicas to serve reads again if the scrub didn't detect any remaining inconsistency.
+func (s *scrubber) markCleanReplicas(report ScrubReport, scrubbedHosts []string) {
+	repaired := map[string]bool{}
+	for _, repair := range report.Repairs {
+		repaired[repair.ObjectHash] = true
+	}
+
+	for _, host := range scrubbedHosts {
+		isClean := true
+		for _, inconsistency := range report.Inconsistencies {
+			isClean = isClean && (inconsistency.Host != host || repaired[inconsistency.ObjectHash])
+		}
+
+		if isClean {
+			s.handler.leases.markClean(report.PlacementGroup, host)
+		}
+	}
+}
+
+func (s *scrubber) finish(report ScrubReport) ScrubReport {
+	report.FinishedAt = time.Now()
+
+	for _, inconsistency := range report.Inconsistencies {
+		s.handler.sugar.Warnw("Scrub detected an inconsistency",
+			"placementGroup", report.PlacementGroup,
+			"object", inconsistency.ObjectHash,
+			"host", inconsistency.Host,
+			"kind", inconsistency.Kind,
+		)
+	}
+	s.handler.sugar.Infow("Finished scrub",
+		"placementGroup", report.PlacementGroup,
+		"deep", report.Deep,
+		"objectsChecked", report.ObjectsChecked,
+		"inconsistencies", len(report.Inconsistencies),
+		"errors", report.Errors,
+		"duration", report.FinishedAt.Sub(report.StartedAt),
+	)
+
+	s.mu.Lock()
+	s.reports[report.PlacementGroup] = report
+	s.mu.Unlock()
+
+	return report
+}
+
+// compareInventories compares the inventory of a replica with the inventory of the primary. isExpected returns false
+// if the pool of the object doesn't store a replica on the host.
+func compareInventories(primary []replication.InventoryEntry, replica []replication.InventoryEntry, host string, deep bool, isExpected func(entry replication.InventoryEntry) bool) []Inconsistency {
+	replicaEntries := map[string]replication.InventoryEntry{}
+	for _, entry := range replica {
+		replicaEntries[entry.Hash] = entry
+	}
+
+	var inconsistencies []Inconsistency
+	for _, primaryEntry := range primary {
+		replicaEntry, ok := replicaEntries[primaryEntry.Hash]
+		delete(replicaEntries, primaryEntry.Hash)
+
+		switch {
+		case !isExpected(primaryEntry) && ok:
+			inconsistencies = append(inconsistencies, Inconsistency{primaryEntry.Hash, host, InconsistencyStray})
+		case !isExpected(primaryEntry):
+			continue
+		case !ok:
+			inconsistencies = append(inconsistencies, Inconsistency{primaryEntry.Hash, host, InconsistencyMissing})
+		case primaryEntry.Size != replicaEntry.Size:
+			inconsistencies = append(inconsistencies, Inconsistency{primaryEntry.Hash, host, InconsistencySize})
+		case !deep:
+			continue
+		case replicaEntry.Checksum != "" && replicaEntry.Checksum != replicaEntry.ComputedChecksum:
+			inconsistencies = append(inconsistencies, Inconsistency{primaryEntry.Hash, host, InconsistencyChecksum})
+		case replicaEntry.ComputedChecksum != referenceChecksum(primaryEntry):
+			inconsistencies = append(inconsistencies, Inconsistency{primaryEntry.Hash, host, InconsistencyContent})
+		}
+	}
+
+	var strays []string
+	for objectHash := range replicaEntries {
+		strays = append(strays, objectHash)
+	}
+	sort.Strings(strays)
+	for _, objectHash := range strays {
+		inconsistencies = append(inconsistencies, Inconsistency{objectHash, host, InconsistencyStray})
+	}
+
+	return inconsistencies
+}
+
+// referenceChecksum prefers the persisted checksum because the content of the primary might be corrupted as well.
+func referenceChecksum(entry replication.InventoryEntry) string {
+	if entry.Checksum != "" {
+		return entry.Checksum
+	}
+	return entry.ComputedChecksum
+}
+
+func (s *scrubber) getReport(placementGroup uint32) (ScrubReport, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	report, ok := s.reports[placementGroup]
+	return report, ok
+}
+
+func (s *scrubber) getReports() []ScrubReport {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	reports := make([]ScrubReport, 0, len(s.reports))
+	for _, report := range s.reports {
+		reports = append(reports, report)
+	}
+	sort.Slice(reports, func(i, j int) bool {
+		return reports[i].PlacementGroup < reports[j].PlacementGroup
+	})
+
+	return reports
+}
+
+// Scrub scrubs the placement group immediately. The current node has to be the primary of the placement group.
+func (f *Handler) Scrub(placementGroup uint32, deep bool) (ScrubReport, error) {
+	if !f.isPrimaryOf(placementGroup) {
+		return ScrubReport{}, ErrNotPrimary
+	}
+
+	return f.scrubber.scrub(placementGroup, deep), nil
+}
+
+// ScrubReports returns the report of the last scrub of every placement group.
+func (f *Handler) ScrubReports() []ScrubReport {
+	return f.scrubber.getReports()
+}
+
+// Inventory lists all objects of the placement group that are stored on the current node. Deep inventories contain
+// the checksum of the content of every object.
+func (f *Handler) Inventory(placementGroup uint32, deep bool) ([]replication.InventoryEntry, error) {
+	return f.inventory(placementGroup, deep, f.scrubber.limiter)
+}
+
+func (f *Handler) inventory(placementGroup uint32, deep bool, limiter *rateLimiter) ([]replication.InventoryEntry, error) {
+	objects, err := f.fileHandler.ListObjects()
+	if err != nil {
+		return nil, fmt.Errorf("list objects: %w", err)
+	}
+	sort.Slice(objects, func(i, j int) bool {
+		return objects[i].Hash < objects[j].Hash
+	})
+
+	// expired objects read as deleted and are about to be deleted by the primary; they are neither verified nor repaired
+	now := time.Now()
+	inventory := []replication.InventoryEntry{}
+	for _, object := range objects {
+		if object.Metadata.Expired(now) {
+			continue
+		}
+		dist, err := f.distributionHandler.GetDistribution(object.Hash)
+		if err != nil {
+			return nil, fmt.Errorf("calculate distribution of %v: %w", object.Hash, err)
+		}
+		if dist.CorrectPlacementGroup != placementGroup {
+			continue
+		}
+
+		entry := replication.InventoryEntry{Hash: object.Hash, Size: object.Size, Pool: object.Metadata.Pool}
+		if deep {
+			err = f.addChecksums(&entry, object.Metadata, limiter)
+			if errors.Is(err, os.ErrNotExist) {
+				continue // the object has been deleted in the meantime
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		inventory = append(inventory, entry)
+	}
+
+	return inventory, nil
+}
+
+// ObjectInventory returns the deep inventory entry of a single object. Repairs compare the copies of an object by
+// their entries before any content is transferred. ErrObjectDoesNotExist is returned if the node doesn't store the
+// object.
+func (f *Handler) ObjectInventory(object string) (replication.InventoryEntry, error) {
+	info, err := f.fileHandler.StatObject(object)
+	if errors.Is(err, os.ErrNotExist) {
+		return replication.InventoryEntry{}, ErrObjectDoesNotExist
+	}
+	if err != nil {
+		return replication.InventoryEntry{}, fmt.Errorf("stat object: %w", err)
+	}
+
+	entry := replication.InventoryEntry{Hash: object, Size: info.Size, Pool: info.Metadata.Pool}
+	err = f.addChecksums(&entry, info.Metadata, unlimitedRate)
+	if errors.Is(err, os.ErrNotExist) {
+		return replication.InventoryEntry{}, ErrObjectDoesNotExist
+	}
+	return entry, err
+}
+
+// addChecksums adds the persisted and the computed checksum to the inventory entry. The computed checksum is empty if
+// the content can't be decrypted; the missing checksum is reported as inconsistency.
+func (f *Handler) addChecksums(entry *replication.InventoryEntry, metadata file.Metadata, limiter *rateLimiter) error {
+	entry.Checksum = metadata.Checksum
+
+	var err error
+	entry.ComputedChecksum, err = f.computeChecksum(entry.Hash, limiter)
+	if errors.Is(err, file.ErrContentIsCorrupted) {
+		f.sugar.Warnw("Failed to decode object while computing its checksum", "err", err, "object", entry.Hash)
+		return nil
+	}
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("compute checksum of %v: %w", entry.Hash, err)
+	}
+	return err
+}
+
+func (f *Handler) computeChecksum(objectHash string, limiter *rateLimiter) (string, error) {
+	openedFile, err := f.fileHandler.OpenObject(objectHash)
+	if err != nil {
+		return "", err
+	}
+	defer file.CloseAndLogError(openedFile, objectHash, f.sugar)
+
+	return openedFile.ChecksumOf(throttledReader{reader: openedFile, limiter: limiter})
+}
+
+func (f *Handler) isPrimaryOf(placementGroup uint32) bool {
+	for _, pg := range f.distributionHandler.PrimaryPlacementGroups() {
+		if pg == placementGroup {
+			return true
+		}
+	}
+	return false
+}
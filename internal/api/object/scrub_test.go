@@ -0,0 +1,40 @@
+package object
+
+import (
+	"context"
+	"github.com/rstdm/mini-ceph/internal/api/object/file"
+	"testing"
+)
+
+func TestConfirmInconsistencies(t *testing.T) {
+	handler := newSingleNodeHandler(t)
+	ownHost := handler.distributionHandler.OwnHost()
+
+	stored := "0000000000000000000000000000000000000000000000000000000000000001"
+	deleted := "0000000000000000000000000000000000000000000000000000000000000002"
+	busy := "0000000000000000000000000000000000000000000000000000000000000003"
+	for _, object := range []string{stored, busy} {
+		content, metadata, err := handler.fileHandler.EncodeObject([]byte("content"), file.Metadata{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := handler.fileHandler.PersistObject(context.Background(), object, content, metadata); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	report := ScrubReport{Inconsistencies: []Inconsistency{
+		{stored, ownHost, InconsistencyChecksum},
+		{deleted, ownHost, InconsistencyChecksum}, // the object has been deleted after the inventory was created
+		{busy, ownHost, InconsistencyChecksum},    // the object is modified; its repair couldn't be started
+	}}
+	locked := map[string]bool{stored: true, deleted: true, busy: false}
+
+	confirmed, _ := handler.scrubber.confirm(&report, locked, nil, nil)
+	if len(confirmed) != 1 || confirmed[0].ObjectHash != stored {
+		t.Errorf("confirm() = %+v", confirmed)
+	}
+	if len(report.Errors) != 0 {
+		t.Errorf("unexpected errors %v", report.Errors)
+	}
+}
@@ -0,0 +1,329 @@
+package upload
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/rstdm/mini-ceph/internal/api/object/file"
+	"github.com/rstdm/mini-ceph/internal/api/object/hash"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// MaxPartNumber is the highest part number of an upload; part numbers start at 1.
+	MaxPartNumber = 10000
+
+	uploadFileName      = "upload.json"
+	partFileSuffix      = ".part"
+	temporaryFileSuffix = ".tmp"
+	uploadIDLength      = 16 // bytes; the id is hex encoded
+)
+
+var (
+	ErrUploadDoesNotExist = errors.New("the upload does not exist")
+	ErrPartDoesNotExist   = errors.New("the part does not exist")
+)
+
+// Upload is a multipart upload of an object. Metadata is the metadata of the assembled object, e.g. its pool and
+// owner.
+type Upload struct {
+	ID         string
+	ObjectHash string
+	Metadata   file.Metadata
+	Initiated  time.Time
+	// Overwrite is true if the completion replaces an existing object. The object isn't touched before the upload is
+	// completed.
+	Overwrite bool `json:",omitempty"`
+}
+
+// Part is an uploaded part. The metadata is the metadata of the encoded content of the part; Size is the size of the
+// clear-text content.
+type Part struct {
+	Number   int
+	Size     int64
+	Checksum string
+	Metadata file.Metadata `json:"-"`
+}
+
+// Store persists the uploads and their parts. Every upload is a folder that contains upload.json and one file per
+// part. A part file consists of a line with the json encoded metadata of the part, followed by the encoded content.
+// Parts are replaced atomically, so a part that is uploaded again is either read completely or not at all.
+type Store struct {
+	folder string
+}
+
+// NewStore creates a store in the folder. The folder is created if it doesn't exist.
+func NewStore(folder string) (*Store, error) {
+	if err := os.MkdirAll(folder, 0700); err != nil {
+		return nil, fmt.Errorf("create folder %v: %w", folder, err)
+	}
+	return &Store{folder: folder}, nil
+}
+
+// NewID returns a random upload id.
+func NewID() (string, error) {
+	id := make([]byte, uploadIDLength)
+	if _, err := rand.Read(id); err != nil {
+		return "", fmt.Errorf("read random bytes: %w", err)
+	}
+	return hex.EncodeToString(id), nil
+}
+
+// IsID returns true if the id has the format of the ids that are returned by NewID.
+func IsID(id string) bool {
+	decoded, err := hex.DecodeString(id)
+	return err == nil && len(decoded) == uploadIDLength && strings.ToLower(id) == id
+}
+
+// ParsePartNumber parses a part number between 1 and MaxPartNumber.
+func ParsePartNumber(rawNumber string) (int, error) {
+	number, err := strconv.Atoi(rawNumber)
+	if err != nil || number < 1 || number > MaxPartNumber {
+		return 0, fmt.Errorf("the part number must be between 1 and %v", MaxPartNumber)
+	}
+	return number, nil
+}
+
+func (s *Store) uploadFolder(objectHash string, id string) (string, error) {
+	if !hash.IsObjectHash(objectHash) || !IsID(id) {
+		return "", ErrUploadDoesNotExist
+	}
+	return filepath.Join(s.folder, objectHash, id), nil
+}
+
+func partFileName(number int) string {
+	return strconv.Itoa(number) + partFileSuffix
+}
+
+// Create persists a new upload. The upload is replaced if it already exists.
+func (s *Store) Create(upload Upload) error {
+	folder, err := s.uploadFolder(upload.ObjectHash, upload.ID)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(folder, 0700); err != nil {
+		return fmt.Errorf("create folder %v: %w", folder, err)
+	}
+
+	encodedUpload, err := json.Marshal(upload)
+	if err != nil {
+		return fmt.Errorf("json encode upload: %w", err)
+	}
+	return writeFileAtomically(filepath.Join(folder, uploadFileName), encodedUpload)
+}
+
+// Get returns the upload or ErrUploadDoesNotExist.
+func (s *Store) Get(objectHash string, id string) (Upload, error) {
+	folder, err := s.uploadFolder(objectHash, id)
+	if err != nil {
+		return Upload{}, err
+	}
+	return readUpload(filepath.Join(folder, uploadFileName))
+}
+
+func readUpload(path string) (Upload, error) {
+	encodedUpload, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return Upload{}, ErrUploadDoesNotExist
+	}
+	if err != nil {
+		return Upload{}, fmt.Errorf("read %v: %w", path, err)
+	}
+
+	var upload Upload
+	if err := json.Unmarshal(encodedUpload, &upload); err != nil {
+		return Upload{}, fmt.Errorf("parse content of %v: %w", path, err)
+	}
+	return upload, nil
+}
+
+// PutPart persists the encoded content of a part. An existing part with the same number is replaced. The upload is
+// created if it doesn't exist yet; the replicas learn about an upload with its first part.
+func (s *Store) PutPart(upload Upload, number int, storedContent []byte, metadata file.Metadata) error {
+	folder, err := s.uploadFolder(upload.ObjectHash, upload.ID)
+	if err != nil {
+		return err
+	}
+	if _, err := s.Get(upload.ObjectHash, upload.ID); errors.Is(err, ErrUploadDoesNotExist) {
+		if err := s.Create(upload); err != nil {
+			return fmt.Errorf("create upload: %w", err)
+		}
+	} else if err != nil {
+		return fmt.Errorf("get upload: %w", err)
+	}
+
+	encodedMetadata, err := json.Marshal(metadata)
+	if err != nil {
+		return fmt.Errorf("json encode metadata: %w", err)
+	}
+	content := make([]byte, 0, len(encodedMetadata)+1+len(storedContent))
+	content = append(append(append(content, encodedMetadata...), '\n'), storedContent...)
+
+	return writeFileAtomically(filepath.Join(folder, partFileName(number)), content)
+}
+
+// Parts returns the parts of the upload, ordered by their number.
+func (s *Store) Parts(objectHash string, id string) ([]Part, error) {
+	folder, err := s.uploadFolder(objectHash, id)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(folder)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrUploadDoesNotExist
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read folder %v: %w", folder, err)
+	}
+
+	var parts []Part
+	for _, entry := range entries {
+		number, err := strconv.Atoi(strings.TrimSuffix(entry.Name(), partFileSuffix))
+		if !strings.HasSuffix(entry.Name(), partFileSuffix) || err != nil {
+			continue // upload.json and temporary files
+		}
+
+		metadata, err := readPartMetadata(filepath.Join(folder, entry.Name()))
+		if errors.Is(err, os.ErrNotExist) {
+			continue // the upload has been aborted concurrently
+		}
+		if err != nil {
+			return nil, fmt.Errorf("read metadata of part %v: %w", number, err)
+		}
+		parts = append(parts, Part{Number: number, Size: metadata.Size, Checksum: metadata.Checksum, Metadata: metadata})
+	}
+
+	sort.Slice(parts, func(i, j int) bool { return parts[i].Number < parts[j].Number })
+	return parts, nil
+}
+
+func readPartMetadata(path string) (file.Metadata, error) {
+	partFile, err := os.Open(path)
+	if err != nil {
+		return file.Metadata{}, err
+	}
+	defer func() { _ = partFile.Close() }()
+
+	line, err := bufio.NewReader(partFile).ReadBytes('\n')
+	if err != nil {
+		return file.Metadata{}, fmt.Errorf("read first line of %v: %w", path, err)
+	}
+	var metadata file.Metadata
+	if err := json.Unmarshal(line, &metadata); err != nil {
+		return file.Metadata{}, fmt.Errorf("parse metadata of %v: %w", path, err)
+	}
+	return metadata, nil
+}
+
+// ReadPart returns the encoded content of a part and its metadata or ErrPartDoesNotExist.
+func (s *Store) ReadPart(objectHash string, id string, number int) ([]byte, file.Metadata, error) {
+	folder, err := s.uploadFolder(objectHash, id)
+	if err != nil {
+		return nil, file.Metadata{}, err
+	}
+	path := filepath.Join(folder, partFileName(number))
+	content, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, file.Metadata{}, ErrPartDoesNotExist
+	}
+	if err != nil {
+		return nil, file.Metadata{}, fmt.Errorf("read %v: %w", path, err)
+	}
+
+	separator := bytes.IndexByte(content, '\n')
+	if separator < 0 {
+		return nil, file.Metadata{}, fmt.Errorf("%v doesn't contain metadata", path)
+	}
+	var metadata file.Metadata
+	if err := json.Unmarshal(content[:separator], &metadata); err != nil {
+		return nil, file.Metadata{}, fmt.Errorf("parse metadata of %v: %w", path, err)
+	}
+	return content[separator+1:], metadata, nil
+}
+
+// Delete deletes the upload and all of its parts. It succeeds if the upload doesn't exist.
+func (s *Store) Delete(objectHash string, id string) error {
+	folder, err := s.uploadFolder(objectHash, id)
+	if err != nil {
+		return err
+	}
+	if err := os.RemoveAll(folder); err != nil {
+		return fmt.Errorf("remove %v: %w", folder, err)
+	}
+
+	// the folder of the object is removed with its last upload; it fails if there are other uploads
+	_ = os.Remove(filepath.Dir(folder))
+	return nil
+}
+
+// List returns all uploads. Uploads whose upload.json is missing or unreadable are returned with their ids only, so
+// that they can be deleted.
+func (s *Store) List() ([]Upload, error) {
+	objectFolders, err := os.ReadDir(s.folder)
+	if err != nil {
+		return nil, fmt.Errorf("read folder %v: %w", s.folder, err)
+	}
+
+	var uploads []Upload
+	for _, objectFolder := range objectFolders {
+		if !objectFolder.IsDir() || !hash.IsObjectHash(objectFolder.Name()) {
+			continue
+		}
+		uploadFolders, err := os.ReadDir(filepath.Join(s.folder, objectFolder.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("read folder of object %v: %w", objectFolder.Name(), err)
+		}
+
+		for _, uploadFolder := range uploadFolders {
+			if !uploadFolder.IsDir() || !IsID(uploadFolder.Name()) {
+				continue
+			}
+			upload, err := readUpload(filepath.Join(s.folder, objectFolder.Name(), uploadFolder.Name(), uploadFileName))
+			if err != nil {
+				upload = Upload{}
+			}
+			upload.ID = uploadFolder.Name()
+			upload.ObjectHash = objectFolder.Name()
+			uploads = append(uploads, upload)
+		}
+	}
+
+	return uploads, nil
+}
+
+// writeFileAtomically replaces the file with the content. The content is flushed to disk before the file is replaced.
+// Concurrent calls for the same file don't interfere; the last rename wins.
+func writeFileAtomically(path string, content []byte) error {
+	temporaryFile, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*"+temporaryFileSuffix)
+	if err != nil {
+		return fmt.Errorf("create temporary file for %v: %w", path, err)
+	}
+	temporaryPath := temporaryFile.Name()
+
+	_, err = temporaryFile.Write(content)
+	if err == nil {
+		err = temporaryFile.Sync()
+	}
+	if closeErr := temporaryFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(temporaryPath)
+		return fmt.Errorf("write %v: %w", temporaryPath, err)
+	}
+
+	if err := os.Rename(temporaryPath, path); err != nil {
+		_ = os.Remove(temporaryPath)
+		return fmt.Errorf("rename %v: %w", temporaryPath, err)
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+package upload
+
+import (
+	"errors"
+	"github.com/rstdm/mini-ceph/internal/api/object/file"
+	"testing"
+	"time"
+)
+
+const testObject = "0000000000000000000000000000000000000000000000000000000000000001"
+
+func TestStore(t *testing.T) {
+	store, err := NewStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := NewID()
+	if err != nil || !IsID(id) {
+		t.Fatalf("invalid id %q: %v", id, err)
+	}
+
+	// replicas create the upload with its first part
+	upload := Upload{ID: id, ObjectHash: testObject, Metadata: file.Metadata{Pool: "logs"}, Initiated: time.Now()}
+	for number, content := range map[int]string{2: "second", 1: "first", 10: "tenth"} {
+		metadata := file.Metadata{Size: int64(len(content)), Checksum: file.Checksum([]byte(content))}
+		if err := store.PutPart(upload, number, []byte(content), metadata); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.PutPart(upload, 2, []byte("replaced"), file.Metadata{Size: 8}); err != nil {
+		t.Fatal(err)
+	}
+
+	if stored, err := store.Get(testObject, id); err != nil || stored.Metadata.Pool != "logs" {
+		t.Errorf("Get() = %+v, %v", stored, err)
+	}
+	parts, err := store.Parts(testObject, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(parts) != 3 || parts[0].Number != 1 || parts[1].Number != 2 || parts[2].Number != 10 || parts[1].Size != 8 {
+		t.Errorf("Parts() = %+v", parts)
+	}
+	content, metadata, err := store.ReadPart(testObject, id, 2)
+	if err != nil || string(content) != "replaced" || metadata.Size != 8 {
+		t.Errorf("ReadPart() = %q, %+v, %v", content, metadata, err)
+	}
+	if _, _, err := store.ReadPart(testObject, id, 3); !errors.Is(err, ErrPartDoesNotExist) {
+		t.Errorf("ReadPart() of a missing part = %v", err)
+	}
+
+	uploads, err := store.List()
+	if err != nil || len(uploads) != 1 || uploads[0].ID != id {
+		t.Errorf("List() = %+v, %v", uploads, err)
+	}
+
+	if err := store.Delete(testObject, id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Get(testObject, id); !errors.Is(err, ErrUploadDoesNotExist) {
+		t.Errorf("the upload hasn't been deleted: %v", err)
+	}
+	if err := store.Delete(testObject, id); err != nil {
+		t.Errorf("deleting a missing upload failed: %v", err)
+	}
+}
+
+func TestInvalidIDs(t *testing.T) {
+	store, err := NewStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, id := range []string{"", "../../etc", "0123456789ABCDEF0123456789ABCDEF", "0123"} {
+		if _, err := store.Get(testObject, id); !errors.Is(err, ErrUploadDoesNotExist) {
+			t.Errorf("Get() with id %q = %v", id, err)
+		}
+	}
+	for _, number := range []string{"0", "10001", "-1", "a"} {
+		if _, err := ParsePartNumber(number); err == nil {
+			t.Errorf("ParsePartNumber(%q) succeeded", number)
+		}
+	}
+}
@@ -0,0 +1,271 @@
+package object
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/rstdm/mini-ceph/internal/api/object/file"
+	"github.com/rstdm/mini-ceph/internal/api/object/replication"
+	"github.com/rstdm/mini-ceph/internal/configuration"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// usageSyncInterval is the interval in which the usage of the local primary placement groups is recomputed and
+	// the usage of the other nodes is fetched.
+	usageSyncInterval = 15 * time.Second
+	usageFetchTimeout = 5 * time.Second
+)
+
+var ErrQuotaExceeded = errors.New("quota exceeded")
+
+// usageDelta is a write or a deletion that has been acknowledged by the primary after the last scan has started.
+type usageDelta struct {
+	at      time.Time
+	owner   string
+	pool    string
+	bytes   int64
+	objects int64
+}
+
+// remoteUsage is the last report of another node.
+type remoteUsage struct {
+	report    replication.UsageReport
+	fetched   bool // false if the node hasn't answered since the current node has been started
+	lastError string
+}
+
+// usageTracker counts the bytes and objects of the placement groups of which the current node is primary. Every node
+// counts only its primary placement groups, so the usage of the cluster is the sum of the reports of all nodes.
+//
+// The usage is determined by a scan of all objects. Writes and deletions that have been acknowledged since the scan
+// started are added to the result of the scan until the next scan includes them. Objects that have been written while
+// the scan was running may be counted twice until the next scan, i.e. the usage is rather overestimated.
+type usageTracker struct {
+	mu      sync.Mutex
+	scanned replication.UsageReport
+	deltas  []usageDelta
+	remote  map[string]remoteUsage // host -> last report
+}
+
+// ClusterUsage contains the usage of all users and pools in the cluster. IncompleteHosts are the nodes whose current
+// usage is unknown because the last request failed; their last known usage is included.
+type ClusterUsage struct {
+	replication.UsageReport
+	IncompleteHosts []string `json:",omitempty"`
+}
+
+// scanUsage recomputes the usage of the local primary placement groups. Objects that have a tombstone or that have
+// expired have already been deleted from the point of view of the clients.
+func (f *Handler) scanUsage() error {
+	start := time.Now()
+
+	tombstones, err := f.fileHandler.ListTombstones()
+	if err != nil {
+		return fmt.Errorf("list tombstones: %w", err)
+	}
+	deleted := map[string]bool{}
+	for _, object := range tombstones {
+		deleted[object] = true
+	}
+
+	objects, err := f.fileHandler.ListObjects()
+	if err != nil {
+		return fmt.Errorf("list objects: %w", err)
+	}
+	report := replication.NewUsageReport()
+	for _, info := range objects {
+		if deleted[info.Hash] || info.Metadata.Expired(start) {
+			continue
+		}
+		dist, err := f.distributionHandler.GetDistribution(info.Hash)
+		if err != nil {
+			return fmt.Errorf("calculate distribution of %v: %w", info.Hash, err)
+		}
+		if dist.IsPrimary {
+			report.Add(info.Metadata.Owner, poolOf(info.Metadata), info.Metadata.Size, 1)
+		}
+	}
+
+	f.usage.mu.Lock()
+	defer f.usage.mu.Unlock()
+	f.usage.scanned = report
+	var deltas []usageDelta
+	for _, delta := range f.usage.deltas {
+		if !delta.at.Before(start) {
+			deltas = append(deltas, delta)
+		}
+	}
+	f.usage.deltas = deltas
+
+	return nil
+}
+
+// syncUsage periodically scans the local usage and fetches the usage of all other nodes. The local usage has been
+// scanned when the handler was created; the usage of the other nodes is fetched immediately.
+func (f *Handler) syncUsage() {
+	for {
+		f.fetchRemoteUsage()
+		time.Sleep(usageSyncInterval)
+
+		if err := f.scanUsage(); err != nil {
+			f.sugar.Errorw("Failed to determine the usage of the primary placement groups", "err", err)
+		}
+	}
+}
+
+// fetchRemoteUsage fetches the usage of all other nodes. The last report of a node is kept if it can't be reached.
+func (f *Handler) fetchRemoteUsage() {
+	for _, host := range f.distributionHandler.Hosts() {
+		if host == f.distributionHandler.OwnHost() {
+			continue
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), usageFetchTimeout)
+		report, err := f.operationHandler.replicationHandler.FetchUsage(ctx, host)
+		cancel()
+
+		f.usage.mu.Lock()
+		remote := f.usage.remote[host]
+		if err != nil {
+			remote.lastError = err.Error()
+		} else {
+			remote = remoteUsage{report: report, fetched: true}
+		}
+		f.usage.remote[host] = remote
+		f.usage.mu.Unlock()
+	}
+}
+
+// recordUsage adds a write (objects = 1) or a deletion (objects = -1) of an object of a local primary placement group.
+// Deletions of expired objects are ignored because the scan doesn't count them. An object that expired after the scan
+// started stays counted until the next scan.
+func (f *Handler) recordUsage(object string, metadata file.Metadata, objects int64) {
+	now := time.Now()
+	if objects < 0 && metadata.Expired(now) {
+		return
+	}
+
+	dist, err := f.distributionHandler.GetDistribution(object)
+	if err != nil || !dist.IsPrimary {
+		return
+	}
+
+	f.usage.mu.Lock()
+	defer f.usage.mu.Unlock()
+	f.usage.deltas = append(f.usage.deltas, usageDelta{
+		at:      now,
+		owner:   metadata.Owner,
+		pool:    poolOf(metadata),
+		bytes:   objects * metadata.Size,
+		objects: objects,
+	})
+}
+
+// LocalUsage returns the usage of the placement groups of which the current node is primary.
+func (f *Handler) LocalUsage() replication.UsageReport {
+	f.usage.mu.Lock()
+	defer f.usage.mu.Unlock()
+	return f.localUsageLocked()
+}
+
+func (f *Handler) localUsageLocked() replication.UsageReport {
+	report := replication.NewUsageReport()
+	report.Merge(f.usage.scanned)
+	for _, delta := range f.usage.deltas {
+		report.Add(delta.owner, delta.pool, delta.bytes, delta.objects)
+	}
+	return report
+}
+
+// ClusterUsage returns the usage of the whole cluster. The usage of the other nodes is the result of their last sync.
+func (f *Handler) ClusterUsage() ClusterUsage {
+	f.usage.mu.Lock()
+	defer f.usage.mu.Unlock()
+
+	usage := ClusterUsage{UsageReport: f.localUsageLocked()}
+	for _, host := range f.distributionHandler.Hosts() {
+		if host == f.distributionHandler.OwnHost() {
+			continue
+		}
+		remote, ok := f.usage.remote[host]
+		if !ok || remote.lastError != "" || !remote.fetched {
+			usage.IncompleteHosts = append(usage.IncompleteHosts, host)
+		}
+		usage.Merge(remote.report)
+	}
+	return usage
+}
+
+// CheckQuota returns ErrQuotaExceeded if an object of the given size would exceed the quota of the owner or of the
+// pool. The usage of the cluster may be slightly outdated, so concurrent writes on different primaries may exceed a
+// quota by a few objects.
+func (f *Handler) CheckQuota(owner string, ownerQuota *configuration.Quota, pool string, size int64) error {
+	return f.checkQuotas(owner, ownerQuota, pool, size, nil)
+}
+
+// CheckReplaceQuota is CheckQuota for an object that replaces the local copy of the object, if it exists. The
+// replaced object is subtracted from the usage of its owner and of its pool; expired objects aren't counted anyway.
+func (f *Handler) CheckReplaceQuota(object string, owner string, ownerQuota *configuration.Quota, pool string, size int64) error {
+	info, err := f.fileHandler.StatObject(object)
+	if errors.Is(err, os.ErrNotExist) || (err == nil && info.Metadata.Expired(time.Now())) {
+		return f.checkQuotas(owner, ownerQuota, pool, size, nil)
+	}
+	if err != nil {
+		return fmt.Errorf("stat replaced object: %w", err)
+	}
+	return f.checkQuotas(owner, ownerQuota, pool, size, &info.Metadata)
+}
+
+func (f *Handler) checkQuotas(owner string, ownerQuota *configuration.Quota, pool string, size int64, replaced *file.Metadata) error {
+	if pool == "" {
+		pool = configuration.DefaultPool
+	}
+	poolQuota := f.operationHandler.pools[pool].Quota
+	if ownerQuota == nil && poolQuota == nil {
+		return nil
+	}
+
+	usage := f.ClusterUsage()
+	ownerUsage, poolUsage := usage.Users[owner], usage.Pools[pool]
+	if replaced != nil {
+		if replaced.Owner == owner {
+			ownerUsage = replication.Usage{Bytes: ownerUsage.Bytes - replaced.Size, Objects: ownerUsage.Objects - 1}
+		}
+		if poolOf(*replaced) == pool {
+			poolUsage = replication.Usage{Bytes: poolUsage.Bytes - replaced.Size, Objects: poolUsage.Objects - 1}
+		}
+	}
+
+	if owner != "" {
+		if err := checkQuota("user "+owner, ownerQuota, ownerUsage, size); err != nil {
+			return err
+		}
+	}
+	return checkQuota("pool "+pool, poolQuota, poolUsage, size)
+}
+
+func checkQuota(subject string, quota *configuration.Quota, usage replication.Usage, size int64) error {
+	if quota == nil {
+		return nil
+	}
+	if quota.MaxObjects > 0 && usage.Objects+1 > quota.MaxObjects {
+		return fmt.Errorf("%w: %v already stores %v of %v objects", ErrQuotaExceeded, subject, usage.Objects,
+			quota.MaxObjects)
+	}
+	if quota.MaxBytes > 0 && usage.Bytes+size > quota.MaxBytes {
+		return fmt.Errorf("%w: %v already stores %v of %v bytes, the object has %v bytes", ErrQuotaExceeded, subject,
+			usage.Bytes, quota.MaxBytes, size)
+	}
+	return nil
+}
+
+// poolOf returns the pool of the object; objects that have been created without pool belong to the default pool.
+func poolOf(metadata file.Metadata) string {
+	if metadata.Pool == "" {
+		return configuration.DefaultPool
+	}
+	return metadata.Pool
+}
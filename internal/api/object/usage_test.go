@@ -0,0 +1,65 @@
+package object
+
+import (
+	"errors"
+	"github.com/rstdm/mini-ceph/internal/api/object/distribution"
+	"github.com/rstdm/mini-ceph/internal/api/object/file"
+	"github.com/rstdm/mini-ceph/internal/api/object/replication"
+	"github.com/rstdm/mini-ceph/internal/configuration"
+	"testing"
+)
+
+func TestCheckQuota(t *testing.T) {
+	distributionHandler := distribution.NewHandler(0, []string{"n0", "n1"}, [][]int{{0, 1}, {1, 0}})
+	handler := &Handler{
+		distributionHandler: distributionHandler,
+		operationHandler: &operationHandler{pools: map[string]configuration.Pool{
+			configuration.DefaultPool: {},
+			"logs":                    {Quota: &configuration.Quota{MaxBytes: 1000}},
+		}},
+		usage: usageTracker{
+			scanned: replication.NewUsageReport(),
+			remote:  map[string]remoteUsage{},
+		},
+	}
+
+	// objects of the primary placement group of node 0 are counted by node 0, the others by node 1
+	primaryObject, replicaObject := objectsOfBothRoles(t, distributionHandler)
+
+	handler.recordUsage(primaryObject, file.Metadata{Owner: "alice", Pool: "logs", Size: 600}, 1)
+	handler.recordUsage(replicaObject, file.Metadata{Owner: "alice", Pool: "logs", Size: 600}, 1)
+	if usage := handler.LocalUsage(); usage.Users["alice"] != (replication.Usage{Bytes: 600, Objects: 1}) {
+		t.Errorf("local usage of alice = %+v", usage.Users["alice"])
+	}
+
+	remote := replication.NewUsageReport()
+	remote.Add("alice", configuration.DefaultPool, 300, 2)
+	handler.usage.remote["n1"] = remoteUsage{report: remote, fetched: true}
+	usage := handler.ClusterUsage()
+	if usage.Users["alice"] != (replication.Usage{Bytes: 900, Objects: 3}) || len(usage.IncompleteHosts) != 0 {
+		t.Errorf("cluster usage = %+v", usage)
+	}
+
+	aliceQuota := &configuration.Quota{MaxObjects: 4}
+	if err := handler.CheckQuota("alice", aliceQuota, configuration.DefaultPool, 100); err != nil {
+		t.Errorf("the quota of alice isn't exceeded: %v", err)
+	}
+	if err := handler.CheckQuota("alice", aliceQuota, "logs", 401); !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("the quota of the pool logs is exceeded: %v", err)
+	}
+
+	handler.recordUsage(primaryObject, file.Metadata{Owner: "alice", Pool: "logs", Size: 600}, -1)
+	handler.recordUsage(replicaObject, file.Metadata{Owner: "bob"}, 1)
+	if err := handler.CheckQuota("alice", aliceQuota, "logs", 1000); err != nil {
+		t.Errorf("the deletion hasn't been subtracted: %v", err)
+	}
+
+	handler.usage.remote["n1"] = remoteUsage{report: remote, fetched: true, lastError: "connection refused"}
+	usage = handler.ClusterUsage()
+	if usage.Users["alice"].Objects != 2 || len(usage.IncompleteHosts) != 1 {
+		t.Errorf("the last known usage of an unreachable node isn't used: %+v", usage)
+	}
+	if err := handler.CheckQuota("alice", &configuration.Quota{MaxObjects: 2}, "", 0); !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("the quota of alice is exceeded: %v", err)
+	}
+}
@@ -0,0 +1,100 @@
+package api
+
+import (
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/rstdm/mini-ceph/internal/api/auth"
+	"github.com/rstdm/mini-ceph/internal/api/middleware"
+	"github.com/rstdm/mini-ceph/internal/configuration"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultPresignedURLLifetime = 15 * time.Minute
+	maxPresignedURLLifetime     = 7 * 24 * time.Hour
+)
+
+type presignedURL struct {
+	URL     string
+	Method  string
+	Expires time.Time
+}
+
+// presignObject issues a URL that allows a single method on the object until it expires. The URL is signed on behalf
+// of the user of the request, who needs the capability of the method.
+func (a *API) presignObject(c *gin.Context) {
+	objectHash := middleware.GetObjectHash(c)
+	objectName, ok := middleware.GetObjectName(c)
+	if !ok {
+		return
+	}
+
+	method := c.DefaultQuery("method", http.MethodGet)
+	if method != http.MethodGet && method != http.MethodHead && method != http.MethodPut {
+		c.String(http.StatusBadRequest, "Only GET, HEAD and PUT requests can be presigned")
+		return
+	}
+
+	lifetime := defaultPresignedURLLifetime
+	if rawLifetime := c.Query("expiresIn"); rawLifetime != "" {
+		var err error
+		lifetime, err = time.ParseDuration(rawLifetime)
+		if err != nil || lifetime <= 0 || lifetime > maxPresignedURLLifetime {
+			c.String(http.StatusBadRequest, fmt.Sprintf("expiresIn must be a positive duration of at most %v", maxPresignedURLLifetime))
+			return
+		}
+	}
+
+	request := auth.PresignedRequest{
+		Method:     method,
+		ObjectHash: objectHash,
+		Expires:    time.Now().Add(lifetime),
+		Name:       objectName,
+	}
+	if method == http.MethodPut {
+		request.Pool = c.DefaultQuery("pool", configuration.DefaultPool)
+		for param, limit := range map[string]*int64{"minContentLength": &request.MinContentLength, "maxContentLength": &request.MaxContentLength} {
+			rawLimit := c.Query(param)
+			if rawLimit == "" {
+				continue
+			}
+			value, err := strconv.ParseInt(rawLimit, 10, 64)
+			if err != nil || value < 0 {
+				c.String(http.StatusBadRequest, param+" must be a non-negative integer")
+				return
+			}
+			*limit = value
+		}
+	}
+
+	if user, ok := middleware.GetUser(c); ok {
+		// the grants are checked again when the URL is used; the pool of existing objects is only known by their nodes
+		allowed := user.Allows(auth.CapabilityOfMethod(method), request.Pool, objectName)
+		if request.Pool == "" {
+			allowed = user.MightAllow(auth.CapabilityOfMethod(method), objectName)
+		}
+		if !allowed {
+			c.String(http.StatusForbidden, fmt.Sprintf("User %v isn't allowed to %v this object", user.Name, auth.CapabilityOfMethod(method)))
+			return
+		}
+		request.User = user.Name
+	}
+
+	dist, err := a.distributionHandler.GetDistribution(objectHash)
+	if err != nil {
+		err = fmt.Errorf("calculate distribution: %w", err)
+		_ = c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	objectURL := url.URL{
+		Scheme:   a.nodeSchemes[dist.PrimaryHost],
+		Host:     dist.PrimaryHost,
+		Path:     "/object/" + objectHash,
+		RawQuery: a.urlSigner.Query(request).Encode(),
+	}
+
+	c.JSON(http.StatusOK, presignedURL{URL: objectURL.String(), Method: method, Expires: request.Expires})
+}
@@ -1,43 +1,198 @@
 package api
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/gin-gonic/gin"
 	"github.com/rstdm/mini-ceph/internal/api/middleware"
 	"github.com/rstdm/mini-ceph/internal/api/object"
+	"github.com/rstdm/mini-ceph/internal/api/object/file"
+	"github.com/rstdm/mini-ceph/internal/api/object/replication"
+	"github.com/rstdm/mini-ceph/internal/configuration"
+	"io"
 	"net/http"
+	"time"
 )
 
+// objectExpiresHeader contains the time at which the object expires, either as RFC 3339 timestamp or as duration
+// relative to the request, e.g. 24h.
+const objectExpiresHeader = "X-Object-Expires"
+
 func (a *API) putObject(c *gin.Context) {
 	// TODO this function (putObject) is called before the request body (the file) has completely been transmitted.
 	// TODO c.FormFile blocks until the file has completely been transmitted. -> Check weather the object already
 	// TODO exists before calling c.FormFile. This way the request can be aborted without transmitting the file.
+	objectHash := middleware.GetObjectHash(c)
+
+	// the signature of a presigned URL doesn't cover the parameter, so the holder of the URL can't replace objects
+	overwrite := !middleware.IsClusterEndpoint(c) && middleware.IsOverwrite(c)
+	if overwrite && middleware.IsPresigned(c) {
+		c.String(http.StatusForbidden, "Presigned URLs can't overwrite objects")
+		return
+	}
+
+	// the capacity is checked before the file is transmitted
+	if !a.checkCapacity(c, objectHash) {
+		return
+	}
+
 	formFile, err := c.FormFile("file")
 	if err != nil {
 		c.String(http.StatusBadRequest, "Missing form-file 'file'")
 		return
 	}
 
-	if formFile.Size > a.maxObjectSizeBytes {
+	// the replicas store every object that the primary has accepted, including objects of multipart uploads
+	if formFile.Size > a.maxObjectSizeBytes && !middleware.IsClusterEndpoint(c) {
 		message := fmt.Sprintf("The object size is bigger than the configured threshold of %v bytes.", a.maxObjectSizeBytes)
 		c.String(http.StatusRequestEntityTooLarge, message)
 		return
 	}
 
-	objectHash := middleware.GetObjectHash(c)
+	metadata := file.Metadata{Pool: c.DefaultQuery("pool", configuration.DefaultPool)}
+	var ownerQuota *configuration.Quota
+	if !middleware.IsClusterEndpoint(c) {
+		// the primary enforces the quotas; the replicas store the objects that the primary has accepted
+		metadata.Owner, ownerQuota = ownerOf(c)
+		if overwrite {
+			err = a.objectHandler.CheckReplaceQuota(objectHash, metadata.Owner, ownerQuota, metadata.Pool, formFile.Size)
+		} else {
+			err = a.objectHandler.CheckQuota(metadata.Owner, ownerQuota, metadata.Pool, formFile.Size)
+		}
+		if !respondQuotaError(c, err) {
+			return
+		}
 
-	err = a.objectHandler.Write(objectHash, formFile)
+		expires, ok := parseExpiresHeader(c)
+		if !ok {
+			return
+		}
+		metadata.Expires = expires
+		if metadata.Name, ok = middleware.GetObjectName(c); !ok {
+			return
+		}
+	} else {
+		// replicas are stored with the metadata of the primary
+		metadata = file.Metadata{}
+		if encodedMetadata := c.GetHeader(replication.MetadataHeader); encodedMetadata != "" {
+			if err := json.Unmarshal([]byte(encodedMetadata), &metadata); err != nil {
+				c.String(http.StatusBadRequest, "Invalid header "+replication.MetadataHeader)
+				return
+			}
+		}
+	}
+
+	openContent := func() (io.ReadCloser, error) { return formFile.Open() }
+	if overwrite || (middleware.IsClusterEndpoint(c) && c.Query("replace") == "true") {
+		// the object is replaced in a single operation; readers never miss the object in between. The primary
+		// replaces the replicas the same way.
+		err = a.objectHandler.Replace(c.Request.Context(), objectHash, openContent, metadata)
+	} else {
+		err = a.objectHandler.Write(c.Request.Context(), objectHash, openContent, metadata)
+		if errors.Is(err, object.ErrObjectDoesExist) && !middleware.IsClusterEndpoint(c) {
+			// expired objects read as deleted; they are replaced instead of waiting for their deletion. The quota is
+			// checked again against the object that is replaced.
+			err = a.objectHandler.CheckReplaceQuota(objectHash, metadata.Owner, ownerQuota, metadata.Pool, formFile.Size)
+			if !respondQuotaError(c, err) {
+				return
+			}
+			err = a.objectHandler.ReplaceExpired(c.Request.Context(), objectHash, openContent, metadata)
+		}
+	}
 	if err == nil {
 		c.String(http.StatusOK, "object persisted")
 		return
 	}
 
 	// there was an error
+	if abortOnContextError(c, err) {
+		return
+	}
 	if errors.Is(err, object.ErrObjectDoesExist) {
 		c.String(http.StatusConflict, "The requested object already exists.")
+	} else if errors.Is(err, object.ErrObjectIsBusy) {
+		c.String(http.StatusConflict, "The requested object is currently modified. Try again later.")
+	} else if errors.Is(err, object.ErrUnknownPool) {
+		c.String(http.StatusBadRequest, "The requested pool does not exist.")
+	} else if errors.Is(err, object.ErrWriteQuorumNotReached) {
+		c.String(http.StatusServiceUnavailable, "Too few replicas are available to persist the object. Try again later.")
+	} else if errors.Is(err, object.ErrObjectIsRepaired) {
+		c.String(http.StatusServiceUnavailable, "The requested object is currently repaired. Try again later.")
 	} else {
 		err = fmt.Errorf("persist object: %w", err)
 		_ = c.AbortWithError(http.StatusInternalServerError, err)
 	}
 }
+
+// respondQuotaError completes the request if the quota check has failed. It returns true if the check has passed.
+func respondQuotaError(c *gin.Context, err error) bool {
+	switch {
+	case err == nil:
+		return true
+	case errors.Is(err, object.ErrQuotaExceeded):
+		c.String(http.StatusForbidden, err.Error())
+	default:
+		_ = c.AbortWithError(http.StatusInternalServerError, fmt.Errorf("check quota: %w", err))
+	}
+	return false
+}
+
+// ownerOf returns the name and the quota of the user that has sent the request. The name is empty and the quota is nil
+// if authentication is disabled.
+func ownerOf(c *gin.Context) (string, *configuration.Quota) {
+	user, ok := middleware.GetUser(c)
+	if !ok {
+		return "", nil
+	}
+	return user.Name, user.Quota
+}
+
+// checkCapacity completes the request with 507 Insufficient Storage if a node of the placement group of the object
+// is full.
+func (a *API) checkCapacity(c *gin.Context, objectHash string) bool {
+	err := a.objectHandler.CheckCapacity(objectHash)
+	switch {
+	case errors.Is(err, object.ErrStorageFull):
+		c.String(http.StatusInsufficientStorage, err.Error())
+		return false
+	case err != nil && !errors.Is(err, file.ErrDiskSpaceUnsupported):
+		err = fmt.Errorf("check capacity: %w", err)
+		_ = c.AbortWithError(http.StatusInternalServerError, err)
+		return false
+	default:
+		return true
+	}
+}
+
+// parseExpiresHeader returns the unix time of the objectExpiresHeader or 0 if the header hasn't been sent. The request
+// is completed if the header is invalid.
+func parseExpiresHeader(c *gin.Context) (int64, bool) {
+	rawExpires := c.GetHeader(objectExpiresHeader)
+	if rawExpires == "" {
+		return 0, true
+	}
+	expires, err := parseExpires(rawExpires, time.Now())
+	if err != nil {
+		c.String(http.StatusBadRequest, fmt.Sprintf("Invalid header %v: %v", objectExpiresHeader, err))
+		return 0, false
+	}
+	return expires.Unix(), true
+}
+
+// parseExpires parses the value of the objectExpiresHeader. The time must be in the future.
+func parseExpires(rawExpires string, now time.Time) (time.Time, error) {
+	expires, err := time.Parse(time.RFC3339, rawExpires)
+	if err != nil {
+		duration, durationErr := time.ParseDuration(rawExpires)
+		if durationErr != nil {
+			return time.Time{}, errors.New("expected an RFC 3339 timestamp or a duration")
+		}
+		expires = now.Add(duration)
+	}
+
+	if !expires.After(now) {
+		return time.Time{}, errors.New("the time must be in the future")
+	}
+	return expires, nil
+}
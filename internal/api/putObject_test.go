@@ -0,0 +1,96 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"github.com/rstdm/mini-ceph/client"
+	"github.com/rstdm/mini-ceph/internal/api/object"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseExpires(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		rawExpires string
+		want       time.Time
+		wantErr    bool
+	}{
+		{"2024-05-02T12:00:00Z", now.Add(24 * time.Hour), false},
+		{"2024-05-01T14:00:00+02:00", time.Time{}, true},
+		{"24h", now.Add(24 * time.Hour), false},
+		{"90s", now.Add(90 * time.Second), false},
+		{"2024-04-30T12:00:00Z", time.Time{}, true},
+		{"-1h", time.Time{}, true},
+		{"0s", time.Time{}, true},
+		{"tomorrow", time.Time{}, true},
+	}
+
+	for _, test := range tests {
+		expires, err := parseExpires(test.rawExpires, now)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("parseExpires(%q) = %v, want an error", test.rawExpires, expires)
+			}
+			continue
+		}
+		if err != nil || !expires.Equal(test.want) {
+			t.Errorf("parseExpires(%q) = %v, %v, want %v", test.rawExpires, expires, err, test.want)
+		}
+	}
+}
+
+func TestWriteQuorum(t *testing.T) {
+	tests := []struct {
+		name        string
+		down        []int // nodes that don't answer during the write
+		wantError   bool
+		wantMissing []int // nodes whose copy is recorded as missing; the replicas of a failed write can't be rolled back
+	}{
+		{name: "every replica is reachable"},
+		{name: "the quorum is reached", down: []int{2}, wantMissing: []int{2}},
+		{name: "the quorum isn't reached", down: []int{1, 2}, wantError: true, wantMissing: []int{1, 2}},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			nodes := newTestCluster(t, nil)
+			c := newTestClient(t, nodes, client.ReadFromPrimary)
+			for _, i := range test.down {
+				nodes[i].down.Store(true)
+			}
+
+			err := c.Put(context.Background(), "object", []byte("content"))
+			objectHash := client.ObjectHash("object")
+			var statusErr *client.StatusError
+			if test.wantError != (err != nil) || (err != nil && (!errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusServiceUnavailable)) {
+				t.Fatalf("Put() returned %v, want error %v", err, test.wantError)
+			}
+
+			missing := map[object.MissingEntry]bool{}
+			for _, entry := range nodes[0].currentAPI().objectHandler.MissingEntries() {
+				missing[entry] = true
+			}
+			wantMissing := map[object.MissingEntry]bool{}
+			for _, i := range test.wantMissing {
+				wantMissing[object.MissingEntry{Host: nodes[0].config.NodeHosts[i], ObjectHash: objectHash}] = true
+			}
+			if !reflect.DeepEqual(missing, wantMissing) {
+				t.Errorf("missing entries = %v, want %v", missing, wantMissing)
+			}
+
+			// a failed write leaves no copy behind
+			for i, node := range nodes {
+				stored := node.computedChecksum(t, objectHash) != ""
+				wantStored := !test.wantError && !node.down.Load()
+				if stored != wantStored {
+					t.Errorf("node %v stores the object: %v, want %v", i, stored, wantStored)
+				}
+			}
+		})
+	}
+}
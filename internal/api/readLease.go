@@ -0,0 +1,34 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/rstdm/mini-ceph/internal/api/object"
+	"github.com/rstdm/mini-ceph/internal/api/object/replication"
+	"net/http"
+)
+
+func (a *API) grantReadLease(c *gin.Context) {
+	placementGroup, ok := a.parsePlacementGroup(c)
+	if !ok {
+		return
+	}
+
+	if !a.readBalancing {
+		c.String(http.StatusConflict, "Read balancing is disabled.")
+		return
+	}
+
+	duration, err := a.objectHandler.GrantReadLease(placementGroup, c.Query("host"))
+	switch {
+	case errors.Is(err, object.ErrNotPrimary):
+		c.String(http.StatusMisdirectedRequest, "Wrong node. Read leases are granted by the primary of the placement group.")
+	case errors.Is(err, object.ErrReplicaNotClean):
+		c.String(http.StatusConflict, "The replica isn't in sync with the primary.")
+	case err != nil:
+		c.String(http.StatusBadRequest, fmt.Sprintf("grant read lease: %v", err))
+	default:
+		c.JSON(http.StatusOK, replication.ReadLease{Duration: duration})
+	}
+}
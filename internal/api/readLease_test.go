@@ -0,0 +1,39 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"github.com/rstdm/mini-ceph/client"
+	"github.com/rstdm/mini-ceph/internal/api/object"
+	"github.com/rstdm/mini-ceph/internal/configuration"
+	"testing"
+	"time"
+)
+
+func TestRecoveredReplicaGetsReadLeasesAgain(t *testing.T) {
+	nodes := newTestCluster(t, func(config *configuration.Configuration) {
+		config.ReadBalancing = true
+		config.RecoveryInterval = 20 * time.Millisecond
+	})
+	c := newTestClient(t, nodes, client.ReadFromPrimary)
+	primary := nodes[0].currentAPI().objectHandler
+	host := nodes[2].config.NodeHosts[2]
+
+	// the replica misses the write; it must not serve reads until it has been repaired
+	nodes[2].down.Store(true)
+	if err := c.Put(context.Background(), "object", []byte("content")); err != nil {
+		t.Fatalf("put object: %v", err)
+	}
+	if _, err := primary.GrantReadLease(0, host); !errors.Is(err, object.ErrReplicaNotClean) {
+		t.Errorf("GrantReadLease() of degraded replica returned %v, want ErrReplicaNotClean", err)
+	}
+
+	nodes[2].down.Store(false)
+	waitFor(t, func() bool {
+		_, err := primary.GrantReadLease(0, host)
+		return err == nil
+	}, "the recovered replica gets read leases again")
+	if entries := primary.MissingEntries(); len(entries) != 0 {
+		t.Errorf("missing entries after the recovery: %+v", entries)
+	}
+}
@@ -0,0 +1,54 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/rstdm/mini-ceph/internal/api/middleware"
+	"github.com/rstdm/mini-ceph/internal/api/object"
+	"net/http"
+)
+
+func (a *API) repairObject(c *gin.Context) {
+	objectHash := middleware.GetObjectHash(c)
+
+	result, err := a.objectHandler.Repair(c.Request.Context(), objectHash)
+	switch {
+	case errors.Is(err, object.ErrNotPrimary):
+		c.String(http.StatusMisdirectedRequest, "Wrong node. Repairs have to be started on the primary of the placement group.")
+	case errors.Is(err, object.ErrObjectIsBusy):
+		c.String(http.StatusConflict, "The object is currently created, deleted or repaired. Try again later.")
+	case err != nil && abortOnContextError(c, err):
+	case err != nil:
+		err = fmt.Errorf("repair object: %w", err)
+		_ = c.AbortWithError(http.StatusInternalServerError, err)
+	default:
+		c.JSON(http.StatusOK, result)
+	}
+}
+
+// reportCorruption is called by a secondary whose copy of the object is corrupted. The object is repaired in the
+// background.
+func (a *API) reportCorruption(c *gin.Context) {
+	a.objectHandler.RequestRepair(middleware.GetObjectHash(c))
+	c.Status(http.StatusAccepted)
+}
+
+// rewrapKeys wraps the data keys of the local objects with the current master key.
+func (a *API) rewrapKeys(c *gin.Context) {
+	result, err := a.objectHandler.RewrapKeys(c.Request.Context())
+	if err != nil && abortOnContextError(c, err) {
+		return
+	}
+	if err != nil {
+		err = fmt.Errorf("rewrap data keys: %w", err)
+		_ = c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, result)
+}
+
+func (a *API) getMissingEntries(c *gin.Context) {
+	c.JSON(http.StatusOK, a.objectHandler.MissingEntries())
+}
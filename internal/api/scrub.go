@@ -0,0 +1,81 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/rstdm/mini-ceph/internal/api/middleware"
+	"github.com/rstdm/mini-ceph/internal/api/object"
+	"net/http"
+	"strconv"
+)
+
+func (a *API) getInventory(c *gin.Context) {
+	placementGroup, ok := a.parsePlacementGroup(c)
+	if !ok {
+		return
+	}
+	deep := c.Query("deep") == "true"
+
+	inventory, err := a.objectHandler.Inventory(placementGroup, deep)
+	if err != nil {
+		err = fmt.Errorf("create inventory: %w", err)
+		_ = c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, inventory)
+}
+
+// getObjectInventory sends the deep inventory entry of a single object.
+func (a *API) getObjectInventory(c *gin.Context) {
+	entry, err := a.objectHandler.ObjectInventory(middleware.GetObjectHash(c))
+	if errors.Is(err, object.ErrObjectDoesNotExist) {
+		c.String(http.StatusNotFound, "The requested object does not exist")
+		return
+	}
+	if err != nil {
+		err = fmt.Errorf("create inventory entry: %w", err)
+		_ = c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, entry)
+}
+
+func (a *API) getScrubReports(c *gin.Context) {
+	c.JSON(http.StatusOK, a.objectHandler.ScrubReports())
+}
+
+func (a *API) scrubPlacementGroup(c *gin.Context) {
+	placementGroup, ok := a.parsePlacementGroup(c)
+	if !ok {
+		return
+	}
+	deep := c.Query("deep") == "true"
+
+	report, err := a.objectHandler.Scrub(placementGroup, deep)
+	if errors.Is(err, object.ErrNotPrimary) {
+		c.String(http.StatusMisdirectedRequest, "Wrong node. Scrubs have to be started on the primary of the placement group.")
+		return
+	}
+	if err != nil {
+		err = fmt.Errorf("scrub: %w", err)
+		_ = c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, report)
+}
+
+// parsePlacementGroup responds with an error and returns false if the placement group parameter is invalid.
+func (a *API) parsePlacementGroup(c *gin.Context) (uint32, bool) {
+	rawPlacementGroup := c.Param(placementGroupParam)
+	placementGroup, err := strconv.ParseUint(rawPlacementGroup, 10, 32)
+	if err != nil || placementGroup >= uint64(a.distributionHandler.NumPlacementGroups()) {
+		c.String(http.StatusBadRequest, "Missing or invalid placement group")
+		return 0, false
+	}
+
+	return uint32(placementGroup), true
+}
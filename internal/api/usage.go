@@ -0,0 +1,54 @@
+package api
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/rstdm/mini-ceph/internal/api/object/replication"
+	"github.com/rstdm/mini-ceph/internal/configuration"
+	"net/http"
+)
+
+type quotaUsage struct {
+	replication.Usage
+	Quota *configuration.Quota `json:",omitempty"` // nil if the usage isn't limited
+}
+
+type clusterUsage struct {
+	Users           map[string]quotaUsage
+	Pools           map[string]quotaUsage
+	IncompleteHosts []string `json:",omitempty"` // nodes whose current usage is unknown; their last usage is included
+}
+
+// getUsage returns the usage of the placement groups of which the node is primary to another node.
+func (a *API) getUsage(c *gin.Context) {
+	c.JSON(http.StatusOK, a.objectHandler.LocalUsage())
+}
+
+// getClusterUsage returns the usage and the quotas of all users and pools in the cluster.
+func (a *API) getClusterUsage(c *gin.Context) {
+	usage := a.objectHandler.ClusterUsage()
+
+	result := clusterUsage{
+		Users:           map[string]quotaUsage{},
+		Pools:           map[string]quotaUsage{},
+		IncompleteHosts: usage.IncompleteHosts,
+	}
+	for name, userUsage := range usage.Users {
+		entry := quotaUsage{Usage: userUsage}
+		if a.users != nil {
+			if user, ok := a.users.Lookup(name); ok {
+				entry.Quota = user.Quota
+			}
+		}
+		result.Users[name] = entry
+	}
+	for name, pool := range a.pools {
+		result.Pools[name] = quotaUsage{Usage: usage.Pools[name], Quota: pool.Quota}
+	}
+	for name, poolUsage := range usage.Pools {
+		if _, ok := result.Pools[name]; !ok {
+			result.Pools[name] = quotaUsage{Usage: poolUsage} // the pool has been removed from the configuration
+		}
+	}
+
+	c.JSON(http.StatusOK, result)
+}
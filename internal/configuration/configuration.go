@@ -1,6 +1,8 @@
 package configuration
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"flag"
@@ -10,29 +12,93 @@ import (
 	"path/filepath"
 	"reflect"
 	"strconv"
+	"time"
 )
 
 const (
 	relativePersistedConfigurationPath = "persistedConfiguration.json"
 	relativeObjectStoragePath          = "data"
+	DefaultPool                        = "default"
+
+	// MasterKeysEnvironmentVariable contains the master keys if no key file has been specified.
+	MasterKeysEnvironmentVariable = "MINI_CEPH_MASTER_KEYS"
 )
 
+// Pool contains the settings that apply to all objects of the pool.
+type Pool struct {
+	Size    int // number of nodes that store a copy of an object; the first Size nodes of the placement group are used
+	MinSize int // number of copies that have to be persisted before a write is acknowledged
+
+	// Compression is the algorithm (gzip, zstd or snappy) that is used to compress the objects of the pool. The
+	// objects are stored uncompressed if it is empty.
+	Compression string `json:",omitempty"`
+
+	Quota *Quota `json:",omitempty"` // the pool isn't limited if it is nil
+}
+
+// Quota limits the logical (uncompressed) size and the number of objects of a pool or of the objects that have been
+// created by a user. Zero values don't limit anything.
+type Quota struct {
+	MaxBytes   int64 `json:",omitempty"`
+	MaxObjects int64 `json:",omitempty"`
+}
+
+// Validate checks that the limits aren't negative.
+func (q *Quota) Validate() error {
+	if q != nil && (q.MaxBytes < 0 || q.MaxObjects < 0) {
+		return fmt.Errorf("the limits of the quota must not be negative, got %+v", *q)
+	}
+	return nil
+}
+
 type Configuration struct {
 	UseProductionLogger bool
+	TraceOutput         string // file or "stdout"; tracing is disabled if it is empty
 	Port                int
 	UserBearerToken     string
+	UsersFile           string // users with their own API keys and capabilities; see auth.User
+	URLSigningKey       string // presigned URLs are disabled if it is empty
 	ClusterBearerToken  string
 	MaxObjectSizeBytes  int64
+	OperationTimeout    time.Duration
+
+	MaxMultipartObjectSizeBytes int64
+	MultipartUploadTimeout      time.Duration // incomplete multipart uploads are deleted after this duration
+
+	ScrubInterval       time.Duration
+	DeepScrubInterval   time.Duration
+	ScrubBytesPerSecond int64
+	AutoRepair          bool
+
+	ReadBalancing     bool
+	ReadLeaseDuration time.Duration
+
+	TLSCertFile string // the listener serves HTTPS if a certificate has been specified
+	TLSKeyFile  string
+	TLSCAFile   string
+	ClusterMTLS bool
 
+	Pools            map[string]Pool
+	RecoveryInterval time.Duration
+	ReapInterval     time.Duration // interval in which the primaries delete expired objects; 0 disables the reaper
+
+	NearfullRatio float64 // a warning is logged if the share of the used disk space exceeds this ratio
+	FullRatio     float64 // writes are rejected if a node of the placement group exceeds this ratio
+
+	DataFolder      string
 	ObjectFolder    string
+	StorageBackend  string
+	MasterKeys      string // objects are encrypted if master keys have been specified; see file.ParseKeyring
 	NodeID          int
 	NodeHosts       []string
+	NodeSchemes     []string // the scheme (http or https) of every node; the other nodes are contacted with it
 	PlacementGroups [][]int
 }
 
 type persistedConfiguration struct {
 	NodeID          int
 	NodeHosts       []string
+	NodeSchemes     []string `json:",omitempty"` // the schemes may change, e.g. when TLS is enabled
 	PlacementGroups [][]int
 }
 
@@ -41,31 +107,110 @@ func Parse() (Configuration, error) {
 
 	flag.BoolVar(&values.UseProductionLogger, "useProductionLogger", false, "Determines weather the logger "+
 		"should produce json output or human readable output")
+	flag.StringVar(&values.TraceOutput, "traceOutput", "", "Records a trace span for every request, for the lock "+
+		"waits, the disk I/O and the requests to other nodes. The spans are appended as json lines to this file or "+
+		"written to stdout if the value is \"stdout\". The trace context is sent to the other nodes in the "+
+		"traceparent header. Tracing is disabled if the value is empty.")
 	flag.IntVar(&values.Port, "port", 5000, "Port on which to serve http requests.")
 	flag.StringVar(&values.UserBearerToken, "userBearerToken", "", "this token is used to authorize all "+
 		" user requests. Every request will be accepted without authorization if the token is empty.")
+	flag.StringVar(&values.UsersFile, "usersFile", "", "Path to a json file with the users of the API. Every "+
+		"user has an API key, which is sent as bearer token, and grants that allow read, write, delete or admin "+
+		"operations, optionally limited to pools and object name prefixes. The file is reloaded when it changes. The "+
+		"userBearerToken remains valid and allows all operations. The optional Quota limits the uncompressed size "+
+		"(MaxBytes) and the number of objects (MaxObjects) that the user may store in the whole cluster. "+
+		"Example: [{\"Name\": \"alice\", \"KeyHash\": \"<hex encoded sha256 hash of the key>\", \"Grants\": "+
+		"[{\"Capabilities\": [\"read\", \"write\"], \"Pools\": [\"logs\"], \"Prefixes\": [\"alice/\"]}]}]")
+	flag.StringVar(&values.URLSigningKey, "urlSigningKey", "", "Secret key that signs presigned URLs. Presigned "+
+		"URLs allow a single GET, HEAD or PUT request of an object until they expire, without bearer token. They are "+
+		"issued by POST /presign/<objectHash>. All nodes of the cluster must use the same key. Presigned URLs are "+
+		"disabled if the key is empty.")
 	flag.StringVar(&values.ClusterBearerToken, "clusterBearerToken", "", "this token is used internally "+
 		"by all OSDs to authenticate each other. If no value is specified the userBearerToken will be used.")
 	flag.Int64Var(&values.MaxObjectSizeBytes, "maxObjectSizeBytes", 20000000, "Objects that are bigger than "+
 		"the specified size can not be persisted. Note that this doesn't influence already created objects which will "+
 		"still be available for download.")
+	flag.Int64Var(&values.MaxMultipartObjectSizeBytes, "maxMultipartObjectSizeBytes", 200000000, "Objects that "+
+		"are assembled from the parts of a multipart upload can not be bigger than the specified size. Every part "+
+		"is limited by maxObjectSizeBytes. The assembled object is held in memory while it is persisted and it "+
+		"must be copied to the replicas within the operationTimeout.")
+	flag.DurationVar(&values.MultipartUploadTimeout, "multipartUploadTimeout", 24*time.Hour, "Multipart uploads "+
+		"that haven't been completed or aborted within this duration are deleted together with their parts.")
+	flag.DurationVar(&values.OperationTimeout, "operationTimeout", 30*time.Second, "Maximum duration of a "+
+		"read, write or delete operation, including the communication with the other nodes. Operations are also "+
+		"aborted if the client cancels the request. 0 disables the timeout.")
+	flag.DurationVar(&values.ScrubInterval, "scrubInterval", 24*time.Hour, "Interval in which the primary of a "+
+		"placement group compares the object inventory with all replicas. Scrubbing is disabled if the interval is 0.")
+	flag.DurationVar(&values.DeepScrubInterval, "deepScrubInterval", 7*24*time.Hour, "Minimum interval between two "+
+		"deep scrubs of a placement group. A deep scrub additionally reads and hashes the content of all objects. "+
+		"Deep scrubbing is disabled if the interval is 0.")
+	flag.Int64Var(&values.ScrubBytesPerSecond, "scrubBytesPerSecond", 10000000, "Maximum number of bytes per "+
+		"second that are read from disk by deep scrubs. This prevents scrubs from starving client I/O. Reads are "+
+		"not limited if the value is 0.")
+	flag.BoolVar(&values.AutoRepair, "autoRepair", false, "Determines weather inconsistent objects that have "+
+		"been detected by a scrub are repaired automatically.")
+	flag.BoolVar(&values.ReadBalancing, "readBalancing", false, "Allows secondaries to serve reads of objects. "+
+		"A secondary only serves reads while it holds a read lease of the primary. The value must be the same for all "+
+		"nodes of the cluster.")
+	flag.DurationVar(&values.ReadLeaseDuration, "readLeaseDuration", 5*time.Second, "Duration of the read leases "+
+		"that are granted by the primary. Deletions are delayed by up to this duration if a secondary is unreachable.")
+	flag.StringVar(&values.TLSCertFile, "tlsCertFile", "", "PEM encoded certificate of the node. The node serves "+
+		"HTTPS instead of HTTP if a certificate is specified; the certificate is also presented to the other nodes if "+
+		"they require client certificates. The certificate and the key are reloaded when the files change.")
+	flag.StringVar(&values.TLSKeyFile, "tlsKeyFile", "", "PEM encoded private key of the certificate.")
+	flag.StringVar(&values.TLSCAFile, "tlsCAFile", "", "PEM encoded CA bundle that verifies the certificates of "+
+		"the other nodes. The system roots are used if it is empty.")
+	flag.BoolVar(&values.ClusterMTLS, "clusterMTLS", false, "Requires a client certificate that has been issued by "+
+		"the CA bundle for all cluster endpoints (mutual TLS). Users don't need a client certificate. Requires "+
+		"tlsCertFile, tlsKeyFile and tlsCAFile.")
 
 	// these values must be parsed / validated manually
 	var dataFolder string
 	var rawNodeID string // we cannot use an integer, because we have to detect absent values; the flag library doesn't support *int
 	var rawNodes string
 	var rawPlacementGroups string
+	var rawPools string
+	var masterKeyFile string
 
 	flag.StringVar(&dataFolder, "dataFolder", ".", "Relative path to the folder that is "+
 		"used to store information.")
+	flag.StringVar(&values.StorageBackend, "storageBackend", "file", "Backend that stores the objects. \"file\" "+
+		"stores every object in a separate file in the data folder. \"segment\" appends the objects to large segment "+
+		"files, which is more efficient for many small objects. \"memory\" keeps the objects in memory; they are "+
+		"lost when the node stops. Objects that have been stored by another backend aren't visible.")
+	flag.StringVar(&masterKeyFile, "masterKeyFile", "", "Path to a file with the master keys that encrypt the "+
+		"objects. Every line contains a key in the format <id>:<base64 encoded 32 byte key>; the last key encrypts "+
+		"new objects and the other keys are kept to decrypt older objects. The keys are read from the environment "+
+		"variable "+MasterKeysEnvironmentVariable+" if no file is specified. Objects aren't encrypted if there are no "+
+		"keys. All nodes of the cluster must use the same keys.")
 	flag.StringVar(&rawNodeID, "nodeID", "", "non-negative integer which specifies the ID of the current node")
 	flag.StringVar(&rawNodes, "nodes", "", "json encoded list of hosts for each node. The position in "+
-		"the list is equal to the nodeID of the node. The host must include the schema. "+
+		"the list is equal to the nodeID of the node. The host must include the schema (http or https); the "+
+		"other nodes are contacted with this schema. "+
 		"Example: [\"http://localhost:5000\", \"http://localhost:5001\"] -> The host of node 1 is localhost:5001")
 	flag.StringVar(&rawPlacementGroups, "placementGroups", "", "json encoded list of placement groups. "+
 		"Each placement group contains the IDs of the nodes which belong to this placement group. "+
 		"Example which maps node 1 and 2 to placement group 0 and node 3 and 4 to placement group 1:"+
 		"[[1, 2], [3, 4]]")
+	flag.StringVar(&rawPools, "pools", "", "json encoded map of pools. Size is the number of copies of every "+
+		"object and must not be bigger than the size of the placement groups. Writes succeed once MinSize copies "+
+		"have been persisted; the missing copies are created as soon as the nodes are reachable again. "+
+		"The pool \"default\" stores a copy on every node of the placement group and requires all copies if it isn't "+
+		"specified. Compression (gzip, zstd or snappy) compresses the objects of the pool on disk. Quota limits the "+
+		"uncompressed size (MaxBytes) and the number of objects (MaxObjects) of the pool in the whole cluster. "+
+		"Example: {\"default\": {\"Size\": 3, \"MinSize\": 2}, \"logs\": {\"Size\": 2, \"MinSize\": 1, "+
+		"\"Compression\": \"zstd\", \"Quota\": {\"MaxBytes\": 10000000000}}}")
+	flag.DurationVar(&values.RecoveryInterval, "recoveryInterval", 10*time.Second, "Interval in which the primary "+
+		"tries to create copies that couldn't be persisted because a node was unreachable.")
+	flag.DurationVar(&values.ReapInterval, "reapInterval", time.Minute, "Interval in which the primaries delete "+
+		"expired objects, i.e. objects whose X-Object-Expires time has passed. Expired objects read as deleted even "+
+		"before they are deleted. Expired objects aren't deleted if the interval is 0.")
+
+	flag.Float64Var(&values.NearfullRatio, "nearfullRatio", 0.85, "Share of the disk space of the data folder "+
+		"above which a node is nearfull. Nearfull nodes are logged and marked in the status endpoint.")
+	flag.Float64Var(&values.FullRatio, "fullRatio", 0.95, "Share of the disk space of the data folder above which "+
+		"a node is full. The primary rejects writes with 507 Insufficient Storage if a node of the placement group is "+
+		"full. Deletions are still possible. The ratios should be the same for all nodes of the cluster.")
 
 	flag.Parse()
 
@@ -73,6 +218,31 @@ func Parse() (Configuration, error) {
 		values.ClusterBearerToken = values.UserBearerToken
 	}
 
+	if (values.TLSCertFile == "") != (values.TLSKeyFile == "") {
+		return Configuration{}, errors.New("tlsCertFile and tlsKeyFile have to be specified together")
+	}
+	if values.ClusterMTLS && (values.TLSCertFile == "" || values.TLSCAFile == "") {
+		return Configuration{}, errors.New("clusterMTLS requires tlsCertFile, tlsKeyFile and tlsCAFile")
+	}
+	if values.MultipartUploadTimeout <= 0 {
+		return Configuration{}, errors.New("multipartUploadTimeout must be positive")
+	}
+	if values.NearfullRatio <= 0 || values.NearfullRatio > values.FullRatio || values.FullRatio > 1 {
+		return Configuration{}, fmt.Errorf("the ratios must satisfy 0 < nearfullRatio (%v) <= fullRatio (%v) <= 1",
+			values.NearfullRatio, values.FullRatio)
+	}
+
+	values.MasterKeys = os.Getenv(MasterKeysEnvironmentVariable)
+	if masterKeyFile != "" {
+		masterKeys, err := os.ReadFile(masterKeyFile)
+		if err != nil {
+			err = fmt.Errorf("read master key file: %w", err)
+			return Configuration{}, err
+		}
+		values.MasterKeys = string(masterKeys)
+	}
+
+	values.DataFolder = dataFolder
 	values.ObjectFolder = filepath.Join(dataFolder, relativeObjectStoragePath)
 	persistedConfigurationPath := filepath.Join(dataFolder, relativePersistedConfigurationPath)
 
@@ -87,19 +257,35 @@ func Parse() (Configuration, error) {
 		// -> use the old data
 		values.NodeID = pc.NodeID
 		values.NodeHosts = pc.NodeHosts
+		values.NodeSchemes = pc.NodeSchemes
 		values.PlacementGroups = pc.PlacementGroups
+		if len(values.NodeSchemes) != len(values.NodeHosts) {
+			// the configuration has been persisted by an older version
+			values.NodeSchemes = make([]string, len(values.NodeHosts))
+			for i := range values.NodeSchemes {
+				values.NodeSchemes[i] = "http"
+			}
+		}
+
+		pools, err := parsePools(rawPools, values.PlacementGroups)
+		if err != nil {
+			err = fmt.Errorf("parse pools: %w", err)
+			return Configuration{}, err
+		}
+		values.Pools = pools
 
 		return values, nil
 	}
 
 	// use the configuration data of this instance
 
-	nodeHosts, err := parseNodes(rawNodes)
+	nodeHosts, nodeSchemes, err := parseNodes(rawNodes)
 	if err != nil {
 		err = fmt.Errorf("parse network adresses of nodes: %w", err)
 		return Configuration{}, err
 	}
 	values.NodeHosts = nodeHosts
+	values.NodeSchemes = nodeSchemes
 
 	nodeID, err := parseNodeID(err, rawNodeID, values.NodeHosts)
 	if err != nil {
@@ -115,19 +301,31 @@ func Parse() (Configuration, error) {
 	}
 	values.PlacementGroups = placementGroups
 
+	pools, err := parsePools(rawPools, values.PlacementGroups)
+	if err != nil {
+		err = fmt.Errorf("parse pools: %w", err)
+		return Configuration{}, err
+	}
+	values.Pools = pools
+
 	newPersistedConfiguration := persistedConfiguration{
 		NodeID:          values.NodeID,
 		NodeHosts:       values.NodeHosts,
+		NodeSchemes:     values.NodeSchemes,
 		PlacementGroups: values.PlacementGroups,
 	}
 
 	// make sure that the configuration for these fields hasn't changed
-	if pc != nil && !reflect.DeepEqual(*pc, newPersistedConfiguration) {
-		err = fmt.Errorf("immutable configuration values have changed from %#v to %#v", *pc, newPersistedConfiguration)
-		return Configuration{}, err
+	if pc != nil {
+		immutable, newImmutable := *pc, newPersistedConfiguration
+		immutable.NodeSchemes, newImmutable.NodeSchemes = nil, nil
+		if !reflect.DeepEqual(immutable, newImmutable) {
+			err = fmt.Errorf("immutable configuration values have changed from %#v to %#v", immutable, newImmutable)
+			return Configuration{}, err
+		}
 	}
 
-	if pc == nil { // persist the configuration for the next instance
+	if pc == nil || !reflect.DeepEqual(pc.NodeSchemes, values.NodeSchemes) { // persist the configuration for the next instance
 		if err := persistConfiguration(newPersistedConfiguration, persistedConfigurationPath); err != nil {
 			err = fmt.Errorf("persist configuration: %w", err)
 			return Configuration{}, err
@@ -170,32 +368,36 @@ func persistConfiguration(pc persistedConfiguration, persistedConfigurationPath
 	return nil
 }
 
-func parseNodes(rawNodes string) ([]string, error) {
+func parseNodes(rawNodes string) (hosts []string, schemes []string, err error) {
 	if rawNodes == "" {
 		err := errors.New("nodes must not be empty")
-		return nil, err
+		return nil, nil, err
 	}
 
 	var parsedNodes []string
 	if err := json.Unmarshal([]byte(rawNodes), &parsedNodes); err != nil {
-		return nil, fmt.Errorf("parse json '%v': %w", rawNodes, err)
+		return nil, nil, fmt.Errorf("parse json '%v': %w", rawNodes, err)
 	}
 
 	for currentNodeID, currentNodeHost := range parsedNodes {
 		currentURL, err := url.ParseRequestURI(currentNodeHost)
 		if err != nil {
-			return nil, fmt.Errorf("parse URL %v of node %v: %w", currentNodeHost, currentNodeID, err)
+			return nil, nil, fmt.Errorf("parse URL %v of node %v: %w", currentNodeHost, currentNodeID, err)
 		}
 
 		if currentURL.Host == "" || currentURL.Path != "" {
-			return nil, fmt.Errorf("network address ('%v') of node %v must contain a scheme and must not contain a "+
+			return nil, nil, fmt.Errorf("network address ('%v') of node %v must contain a scheme and must not contain a "+
 				"path. Example: http://foobar.com:5000", currentNodeHost, currentNodeID)
 		}
+		if currentURL.Scheme != "http" && currentURL.Scheme != "https" {
+			return nil, nil, fmt.Errorf("scheme of node %v must be http or https, got %v", currentNodeID, currentURL.Scheme)
+		}
 
-		parsedNodes[currentNodeID] = currentURL.Host // the result should only contain the host
+		hosts = append(hosts, currentURL.Host) // the hosts identify the nodes; they don't contain the scheme
+		schemes = append(schemes, currentURL.Scheme)
 	}
 
-	return parsedNodes, nil
+	return hosts, schemes, nil
 }
 
 func parseNodeID(err error, rawNodeID string, nodes []string) (int, error) {
@@ -260,3 +462,43 @@ func parsePlacementGroups(rawPlacementGroups string, nodes []string) ([][]int, e
 
 	return parsedPlacementGroups, nil
 }
+
+func parsePools(rawPools string, placementGroups [][]int) (map[string]Pool, error) {
+	pgSize := len(placementGroups[0])
+	pools := map[string]Pool{}
+
+	if rawPools != "" {
+		if err := json.Unmarshal([]byte(rawPools), &pools); err != nil {
+			err = fmt.Errorf("parse json string %v: %w", rawPools, err)
+			return nil, err
+		}
+	}
+
+	if _, ok := pools[DefaultPool]; !ok {
+		pools[DefaultPool] = Pool{Size: pgSize, MinSize: pgSize}
+	}
+
+	for name, pool := range pools {
+		if pool.Size < 1 || pool.Size > pgSize {
+			err := fmt.Errorf("size %v of pool %v must be between 1 and the size of the placement groups (%v)", pool.Size, name, pgSize)
+			return nil, err
+		}
+		if pool.MinSize < 1 || pool.MinSize > pool.Size {
+			err := fmt.Errorf("min size %v of pool %v must be between 1 and the size of the pool (%v)", pool.MinSize, name, pool.Size)
+			return nil, err
+		}
+		if err := pool.Quota.Validate(); err != nil {
+			return nil, fmt.Errorf("pool %v: %w", name, err)
+		}
+	}
+
+	return pools, nil
+}
+
+// PoolsHash returns a hash of the pool configuration. All nodes must use the same pools; the nodes compare their
+// hashes to detect a deviating configuration.
+func PoolsHash(pools map[string]Pool) string {
+	encodedPools, _ := json.Marshal(pools) // the keys of maps are sorted; equal configurations yield the same json
+	digest := sha256.Sum256(encodedPools)
+	return hex.EncodeToString(digest[:8])
+}
@@ -0,0 +1,290 @@
+// Package metrics collects counters, gauges and histograms and exposes them in the Prometheus text format. It only
+// implements the small subset of the Prometheus client that the node needs. The official client
+// (github.com/prometheus/client_golang) isn't a dependency of the module: the project is built offline with the modules
+// that are already listed in go.mod, and the client would add a large dependency tree for the few metric types below.
+// The names, types and the text format follow the Prometheus conventions, so the package can be replaced by the
+// official client without changing the scraped metrics.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultBuckets are the upper bounds of the latency histograms in seconds.
+var DefaultBuckets = []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+// family is a metric with all of its label combinations.
+type family interface {
+	write(w *bufio.Writer)
+}
+
+// Registry contains all metrics of the node. The metrics are written in the order in which they have been registered.
+type Registry struct {
+	mu       sync.Mutex
+	families []family
+}
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+func (r *Registry) register(f family) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.families = append(r.families, f)
+}
+
+// Write writes all metrics in the Prometheus text format.
+func (r *Registry) Write(w io.Writer) error {
+	r.mu.Lock()
+	families := append([]family{}, r.families...)
+	r.mu.Unlock()
+
+	writer := bufio.NewWriter(w)
+	for _, f := range families {
+		f.write(writer)
+	}
+	return writer.Flush()
+}
+
+// vec contains the values of all label combinations of a metric. The values are created when they are used first.
+type vec[T any] struct {
+	name   string
+	help   string
+	labels []string
+	create func() T
+
+	mu     sync.Mutex
+	values map[string]T // key: joined label values
+}
+
+func newVec[T any](name string, help string, labels []string, create func() T) *vec[T] {
+	return &vec[T]{name: name, help: help, labels: labels, create: create, values: map[string]T{}}
+}
+
+func (v *vec[T]) get(labelValues []string) T {
+	if len(labelValues) != len(v.labels) {
+		panic(fmt.Sprintf("metric %v expects %v label values, got %v", v.name, len(v.labels), len(labelValues)))
+	}
+	key := strings.Join(labelValues, "\xff")
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	value, ok := v.values[key]
+	if !ok {
+		value = v.create()
+		v.values[key] = value
+	}
+	return value
+}
+
+// sorted calls f for every label combination in a stable order.
+func (v *vec[T]) sorted(f func(labelValues []string, value T)) {
+	v.mu.Lock()
+	keys := make([]string, 0, len(v.values))
+	for key := range v.values {
+		keys = append(keys, key)
+	}
+	values := make(map[string]T, len(v.values))
+	for key, value := range v.values {
+		values[key] = value
+	}
+	v.mu.Unlock()
+
+	sort.Strings(keys)
+	for _, key := range keys {
+		var labelValues []string
+		if len(v.labels) > 0 {
+			labelValues = strings.Split(key, "\xff")
+		}
+		f(labelValues, values[key])
+	}
+}
+
+func (v *vec[T]) writeHeader(w *bufio.Writer, metricType string) {
+	fmt.Fprintf(w, "# HELP %v %v\n# TYPE %v %v\n", v.name, escapeHelp(v.help), v.name, metricType)
+}
+
+// CounterVec counts events per label combination.
+type CounterVec struct {
+	*vec[*counter]
+}
+
+type counter struct {
+	mu    sync.Mutex
+	value float64
+}
+
+func (r *Registry) NewCounterVec(name string, help string, labels ...string) *CounterVec {
+	c := &CounterVec{newVec(name, help, labels, func() *counter { return &counter{} })}
+	r.register(c)
+	return c
+}
+
+func (c *CounterVec) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+func (c *CounterVec) Add(delta float64, labelValues ...string) {
+	value := c.get(labelValues)
+	value.mu.Lock()
+	value.value += delta
+	value.mu.Unlock()
+}
+
+func (c *CounterVec) write(w *bufio.Writer) {
+	c.writeHeader(w, "counter")
+	c.sorted(func(labelValues []string, value *counter) {
+		value.mu.Lock()
+		total := value.value
+		value.mu.Unlock()
+		writeSample(w, c.name, c.labels, labelValues, "", "", total)
+	})
+}
+
+// HistogramVec counts observations in buckets per label combination, e.g. the latency of requests.
+type HistogramVec struct {
+	*vec[*histogram]
+	buckets []float64
+}
+
+type histogram struct {
+	mu     sync.Mutex
+	counts []uint64 // one count per bucket; the observations are counted in the first bucket that contains them
+	count  uint64
+	sum    float64
+}
+
+func (r *Registry) NewHistogramVec(name string, help string, buckets []float64, labels ...string) *HistogramVec {
+	h := &HistogramVec{buckets: buckets}
+	h.vec = newVec(name, help, labels, func() *histogram { return &histogram{counts: make([]uint64, len(buckets))} })
+	r.register(h)
+	return h
+}
+
+func (h *HistogramVec) Observe(value float64, labelValues ...string) {
+	histogram := h.get(labelValues)
+	bucket := sort.SearchFloat64s(h.buckets, value) // the first bucket whose upper bound is >= value
+
+	histogram.mu.Lock()
+	defer histogram.mu.Unlock()
+	if bucket < len(histogram.counts) {
+		histogram.counts[bucket]++
+	}
+	histogram.count++
+	histogram.sum += value
+}
+
+func (h *HistogramVec) write(w *bufio.Writer) {
+	h.writeHeader(w, "histogram")
+	h.sorted(func(labelValues []string, value *histogram) {
+		value.mu.Lock()
+		counts := append([]uint64{}, value.counts...)
+		count, sum := value.count, value.sum
+		value.mu.Unlock()
+
+		cumulative := uint64(0)
+		for i, upperBound := range h.buckets {
+			cumulative += counts[i]
+			writeSample(w, h.name+"_bucket", h.labels, labelValues, "le", formatFloat(upperBound), float64(cumulative))
+		}
+		writeSample(w, h.name+"_bucket", h.labels, labelValues, "le", "+Inf", float64(count))
+		writeSample(w, h.name+"_sum", h.labels, labelValues, "", "", sum)
+		writeSample(w, h.name+"_count", h.labels, labelValues, "", "", float64(count))
+	})
+}
+
+// gaugeFunc reports a value that is calculated when the metrics are collected.
+type gaugeFunc struct {
+	name  string
+	help  string
+	value func() float64
+}
+
+// NewGaugeFunc registers a gauge whose value is calculated by the function whenever the metrics are collected.
+func (r *Registry) NewGaugeFunc(name string, help string, value func() float64) {
+	r.register(&gaugeFunc{name: name, help: help, value: value})
+}
+
+func (g *gaugeFunc) write(w *bufio.Writer) {
+	fmt.Fprintf(w, "# HELP %v %v\n# TYPE %v gauge\n", g.name, escapeHelp(g.help), g.name)
+	writeSample(w, g.name, nil, nil, "", "", g.value())
+}
+
+// Gauge is a value of a gauge collector.
+type Gauge struct {
+	Name  string
+	Help  string
+	Value float64
+}
+
+// gaugeCollector reports several gauges that are calculated together.
+type gaugeCollector struct {
+	collect func() []Gauge
+}
+
+// NewGaugeCollector registers gauges whose values are calculated by a single call of collect whenever the metrics are
+// collected, e.g. because they are summarized from the same expensive snapshot. collect has to return the same gauges
+// in the same order on every call.
+func (r *Registry) NewGaugeCollector(collect func() []Gauge) {
+	r.register(&gaugeCollector{collect: collect})
+}
+
+func (g *gaugeCollector) write(w *bufio.Writer) {
+	for _, gauge := range g.collect() {
+		fmt.Fprintf(w, "# HELP %v %v\n# TYPE %v gauge\n", gauge.Name, escapeHelp(gauge.Help), gauge.Name)
+		writeSample(w, gauge.Name, nil, nil, "", "", gauge.Value)
+	}
+}
+
+func writeSample(w *bufio.Writer, name string, labels []string, labelValues []string, extraLabel string, extraValue string, value float64) {
+	w.WriteString(name)
+	if len(labels) > 0 || extraLabel != "" {
+		w.WriteByte('{')
+		for i, label := range labels {
+			if i > 0 {
+				w.WriteByte(',')
+			}
+			fmt.Fprintf(w, "%v=\"%v\"", label, escapeLabelValue(labelValues[i]))
+		}
+		if extraLabel != "" {
+			if len(labels) > 0 {
+				w.WriteByte(',')
+			}
+			fmt.Fprintf(w, "%v=\"%v\"", extraLabel, extraValue)
+		}
+		w.WriteByte('}')
+	}
+	w.WriteByte(' ')
+	w.WriteString(formatFloat(value))
+	w.WriteByte('\n')
+}
+
+func formatFloat(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	default:
+		return strconv.FormatFloat(value, 'g', -1, 64)
+	}
+}
+
+var labelValueReplacer = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+var helpReplacer = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+
+func escapeLabelValue(value string) string {
+	return labelValueReplacer.Replace(value)
+}
+
+func escapeHelp(help string) string {
+	return helpReplacer.Replace(help)
+}
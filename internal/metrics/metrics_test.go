@@ -0,0 +1,58 @@
+package metrics
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestRegistryWrite(t *testing.T) {
+	registry := NewRegistry()
+	requests := registry.NewCounterVec("requests_total", "Number of requests.", "route", "status")
+	latency := registry.NewHistogramVec("latency_seconds", "Latency.", []float64{0.1, 1}, "route")
+	registry.NewGaugeFunc("objects", "Number of\nobjects.", func() float64 { return 3 })
+	collections := 0
+	registry.NewGaugeCollector(func() []Gauge {
+		collections++
+		return []Gauge{{Name: "reads", Help: "Reads.", Value: 2}, {Name: "writes", Help: "Writes.", Value: 1}}
+	})
+
+	requests.Inc("/object/:objectHash", "200")
+	requests.Inc("/object/:objectHash", "200")
+	requests.Inc(`/a"b`, "404")
+	latency.Observe(0.05, "/object")
+	latency.Observe(0.1, "/object")
+	latency.Observe(5, "/object")
+
+	var output bytes.Buffer
+	if err := registry.Write(&output); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	expected := `# HELP requests_total Number of requests.
+# TYPE requests_total counter
+requests_total{route="/a\"b",status="404"} 1
+requests_total{route="/object/:objectHash",status="200"} 2
+# HELP latency_seconds Latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{route="/object",le="0.1"} 2
+latency_seconds_bucket{route="/object",le="1"} 2
+latency_seconds_bucket{route="/object",le="+Inf"} 3
+latency_seconds_sum{route="/object"} 5.15
+latency_seconds_count{route="/object"} 3
+# HELP objects Number of\nobjects.
+# TYPE objects gauge
+objects 3
+# HELP reads Reads.
+# TYPE reads gauge
+reads 2
+# HELP writes Writes.
+# TYPE writes gauge
+writes 1
+`
+	if output.String() != expected {
+		t.Errorf("unexpected output:\n%v", output.String())
+	}
+	if collections != 1 {
+		t.Errorf("the gauges of the collector have been collected %v times per scrape, want 1", collections)
+	}
+}
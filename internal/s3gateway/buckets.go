@@ -0,0 +1,277 @@
+package s3gateway
+
+import (
+	"encoding/base64"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/rstdm/mini-ceph/client"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// bucketMarkerPrefix is the prefix of the objects that mark the existence of a bucket. Bucket names can't start with a
+// dot, so the markers never collide with the objects of a bucket.
+const bucketMarkerPrefix = ".s3buckets/"
+
+// maxKeyLength is the maximum length of an object key in bytes.
+const maxKeyLength = 1024
+
+// skipPrefix is appended to a common prefix to continue a listing after all keys with the prefix. It is bigger than
+// every byte of a valid UTF-8 key.
+const skipPrefix = "\xff"
+
+var bucketNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9.-]{1,61}[a-z0-9]$`)
+var ipAddressPattern = regexp.MustCompile(`^\d+\.\d+\.\d+\.\d+$`)
+
+// markerName returns the name of the object that marks the existence of the bucket.
+func markerName(bucket string) string {
+	return bucketMarkerPrefix + bucket
+}
+
+// objectName returns the name of the object that stores the key of the bucket.
+func objectName(bucket string, key string) string {
+	return bucket + "/" + key
+}
+
+func validBucketName(bucket string) bool {
+	return bucketNamePattern.MatchString(bucket) && !ipAddressPattern.MatchString(bucket) && !strings.Contains(bucket, "..")
+}
+
+// requireBucket returns the name of the bucket of the request. The request is completed if the bucket doesn't exist.
+func (g *Gateway) requireBucket(c *gin.Context) (string, bool) {
+	bucket := c.Param(bucketParam)
+	if !validBucketName(bucket) {
+		g.respondError(c, errInvalidBucketName)
+		return "", false
+	}
+
+	if _, err := g.store(c).Stat(c.Request.Context(), markerName(bucket)); err != nil {
+		if errors.Is(err, client.ErrObjectDoesNotExist) {
+			err = errNoSuchBucket
+		}
+		g.respondError(c, err)
+		return "", false
+	}
+	return bucket, true
+}
+
+// listBuckets lists all buckets of the cluster. The creation date is the time of the bucket marker.
+func (g *Gateway) listBuckets(c *gin.Context) {
+	auth := getAuthentication(c)
+	result := listAllMyBucketsResult{Owner: owner{ID: auth.credential.AccessKeyID, DisplayName: auth.credential.AccessKeyID}}
+
+	startAfter := ""
+	for {
+		markers, truncated, err := g.store(c).List(c.Request.Context(), bucketMarkerPrefix, startAfter, client.MaxListLimit)
+		if err != nil {
+			g.respondError(c, err)
+			return
+		}
+		for _, marker := range markers {
+			result.Buckets.Bucket = append(result.Buckets.Bucket, bucketEntry{
+				Name:         strings.TrimPrefix(marker.Name, bucketMarkerPrefix),
+				CreationDate: formatTime(marker.LastModified),
+			})
+			startAfter = marker.Name
+		}
+		if !truncated {
+			break
+		}
+	}
+
+	writeXML(c, http.StatusOK, result)
+}
+
+// createBucket creates the marker of the bucket. The location constraint of the request is ignored.
+func (g *Gateway) createBucket(c *gin.Context) {
+	bucket := c.Param(bucketParam)
+	if !validBucketName(bucket) {
+		g.respondError(c, errInvalidBucketName)
+		return
+	}
+
+	err := g.store(c).Put(c.Request.Context(), markerName(bucket), []byte{})
+	if errors.Is(err, client.ErrObjectDoesExist) {
+		err = errBucketAlreadyExists
+	}
+	if err != nil {
+		g.respondError(c, err)
+		return
+	}
+
+	c.Header("Location", "/"+bucket)
+	c.Status(http.StatusOK)
+}
+
+func (g *Gateway) headBucket(c *gin.Context) {
+	if _, ok := g.requireBucket(c); !ok {
+		return
+	}
+
+	c.Header("x-amz-bucket-region", g.region)
+	c.Status(http.StatusOK)
+}
+
+// deleteBucket deletes the marker of the bucket if the bucket doesn't contain objects. Incomplete multipart uploads
+// aren't considered.
+func (g *Gateway) deleteBucket(c *gin.Context) {
+	bucket, ok := g.requireBucket(c)
+	if !ok {
+		return
+	}
+
+	objects, _, err := g.store(c).List(c.Request.Context(), objectName(bucket, ""), "", 1)
+	if err == nil && len(objects) > 0 {
+		err = errBucketNotEmpty
+	}
+	if err == nil {
+		err = g.store(c).Delete(c.Request.Context(), markerName(bucket))
+	}
+	if err != nil {
+		if errors.Is(err, client.ErrObjectDoesNotExist) {
+			err = errNoSuchBucket // the bucket has been deleted concurrently
+		}
+		g.respondError(c, err)
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// getBucket serves GetBucketLocation and ListObjectsV2. Version 1 of ListObjects isn't supported.
+func (g *Gateway) getBucket(c *gin.Context) {
+	if _, isLocation := c.GetQuery("location"); isLocation {
+		if _, ok := g.requireBucket(c); !ok {
+			return
+		}
+		region := g.region
+		if region == "us-east-1" {
+			region = "" // S3 reports the classic region as empty location
+		}
+		writeXML(c, http.StatusOK, locationConstraint{Region: region})
+		return
+	}
+	if c.Query("list-type") != "2" {
+		g.respondError(c, errNotImplemented.withMessage("Only ListObjectsV2 (list-type=2) is supported."))
+		return
+	}
+
+	g.listObjects(c)
+}
+
+// listObjects lists the keys of a bucket like ListObjectsV2. Keys that contain the delimiter after the prefix are
+// grouped into common prefixes. The continuation token is the base64 encoded key after which the next page starts.
+func (g *Gateway) listObjects(c *gin.Context) {
+	bucket, ok := g.requireBucket(c)
+	if !ok {
+		return
+	}
+
+	prefix := c.Query("prefix")
+	delimiter := c.Query("delimiter")
+	encodingType := c.Query("encoding-type")
+	if encodingType != "" && encodingType != "url" {
+		g.respondError(c, errInvalidArgument.withMessage("Invalid Encoding Method specified in Request"))
+		return
+	}
+	maxKeys := client.MaxListLimit
+	if rawMaxKeys, isSet := c.GetQuery("max-keys"); isSet {
+		var err error
+		if maxKeys, err = strconv.Atoi(rawMaxKeys); err != nil || maxKeys < 0 {
+			g.respondError(c, errInvalidArgument.withMessage("max-keys must be a non-negative integer."))
+			return
+		}
+		if maxKeys > client.MaxListLimit {
+			maxKeys = client.MaxListLimit
+		}
+	}
+	cursor := c.Query("start-after")
+	if token := c.Query("continuation-token"); token != "" {
+		decoded, err := base64.URLEncoding.DecodeString(token)
+		if err != nil {
+			g.respondError(c, errInvalidArgument.withMessage("The continuation token provided is incorrect."))
+			return
+		}
+		cursor = string(decoded)
+	}
+
+	result := listBucketResult{
+		Name:              bucket,
+		Prefix:            encodeKey(prefix, encodingType),
+		Delimiter:         encodeKey(delimiter, encodingType),
+		StartAfter:        encodeKey(c.Query("start-after"), encodingType),
+		ContinuationToken: c.Query("continuation-token"),
+		EncodingType:      encodingType,
+		MaxKeys:           maxKeys,
+	}
+
+	lastPrefix := ""
+	startAfter := ""
+	if cursor != "" {
+		startAfter = objectName(bucket, cursor)
+	}
+list:
+	for {
+		objects, more, err := g.store(c).List(c.Request.Context(), objectName(bucket, prefix), startAfter, client.MaxListLimit)
+		if err != nil {
+			g.respondError(c, err)
+			return
+		}
+
+		for _, object := range objects {
+			key := strings.TrimPrefix(object.Name, objectName(bucket, ""))
+
+			groupPrefix := ""
+			if delimiter != "" {
+				if index := strings.Index(key[len(prefix):], delimiter); index >= 0 {
+					groupPrefix = key[:len(prefix)+index+len(delimiter)]
+				}
+			}
+			if groupPrefix != "" && groupPrefix == lastPrefix {
+				continue // the prefix has already been listed
+			}
+
+			if result.KeyCount == maxKeys {
+				result.IsTruncated = true
+				break list
+			}
+			result.KeyCount++
+			if groupPrefix != "" {
+				result.CommonPrefixes = append(result.CommonPrefixes, commonPrefix{Prefix: encodeKey(groupPrefix, encodingType)})
+				lastPrefix = groupPrefix
+				cursor = groupPrefix + skipPrefix
+			} else {
+				result.Contents = append(result.Contents, objectEntry{
+					Key:          encodeKey(key, encodingType),
+					LastModified: formatTime(object.LastModified),
+					ETag:         objectETag(object),
+					Size:         object.Size,
+					StorageClass: "STANDARD",
+				})
+				cursor = key
+			}
+			startAfter = objectName(bucket, cursor)
+		}
+
+		if !more {
+			break
+		}
+	}
+	if result.IsTruncated {
+		result.NextContinuationToken = base64.URLEncoding.EncodeToString([]byte(cursor))
+	}
+
+	writeXML(c, http.StatusOK, result)
+}
+
+// encodeKey encodes the key if the client has requested the encoding type url. Keys may contain characters that are
+// invalid in XML.
+func encodeKey(key string, encodingType string) string {
+	if encodingType != "url" {
+		return key
+	}
+	return strings.ReplaceAll(url.QueryEscape(key), "%2F", "/")
+}
@@ -0,0 +1,108 @@
+package s3gateway
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+)
+
+type Configuration struct {
+	UseProductionLogger bool
+	Port                int
+	Nodes               []string // URLs of the nodes, including the scheme
+	PlacementGroups     [][]int
+	CredentialsFile     string
+	Region              string
+	MaxObjectSizeBytes  int64
+	TLSCertFile         string
+	TLSKeyFile          string
+	TLSCAFile           string
+}
+
+// Parse parses the command line flags of the gateway.
+func Parse() (Configuration, error) {
+	values := Configuration{}
+
+	var rawNodes string
+	var rawPlacementGroups string
+
+	flag.BoolVar(&values.UseProductionLogger, "useProductionLogger", false, "Determines weather the logger "+
+		"should produce json output or human readable output")
+	flag.IntVar(&values.Port, "port", 9000, "Port on which to serve the S3 API.")
+	flag.StringVar(&rawNodes, "nodes", "", "json encoded list of the URLs of the nodes. It must be equal to the "+
+		"--nodes argument of the cluster. Example: [\"http://localhost:5000\", \"http://localhost:5001\"]")
+	flag.StringVar(&rawPlacementGroups, "placementGroups", "", "json encoded list of placement groups. It must be "+
+		"equal to the --placementGroups argument of the cluster. Example: [[0, 1], [1, 0]]")
+	flag.StringVar(&values.CredentialsFile, "credentialsFile", "", "Path to a json file with the access keys of "+
+		"the gateway. Requests that are signed with an access key are sent to the cluster with its bearer token, so "+
+		"the grants and the quota of the cluster user apply. Example: [{\"AccessKeyID\": \"alice\", "+
+		"\"SecretAccessKey\": \"<secret>\", \"BearerToken\": \"<API key of alice>\"}]")
+	flag.StringVar(&values.Region, "region", "us-east-1", "Region that the clients use to sign their requests.")
+	flag.Int64Var(&values.MaxObjectSizeBytes, "maxObjectSizeBytes", 20000000, "Objects and parts that are bigger "+
+		"than the specified size are rejected before they are sent to the cluster. The size should be equal to the "+
+		"--maxObjectSizeBytes argument of the cluster. Every request body is held in memory.")
+	flag.StringVar(&values.TLSCertFile, "tlsCertFile", "", "PEM encoded certificate of the gateway. The gateway "+
+		"serves HTTPS instead of HTTP if a certificate is specified.")
+	flag.StringVar(&values.TLSKeyFile, "tlsKeyFile", "", "PEM encoded private key of the certificate.")
+	flag.StringVar(&values.TLSCAFile, "tlsCAFile", "", "PEM encoded CA bundle that verifies the certificates of "+
+		"the nodes. The system roots are used if it is empty.")
+
+	flag.Parse()
+
+	if (values.TLSCertFile == "") != (values.TLSKeyFile == "") {
+		return Configuration{}, errors.New("tlsCertFile and tlsKeyFile have to be specified together")
+	}
+	if values.CredentialsFile == "" {
+		return Configuration{}, errors.New("credentialsFile must be specified")
+	}
+	if values.MaxObjectSizeBytes <= 0 {
+		return Configuration{}, errors.New("maxObjectSizeBytes must be positive")
+	}
+
+	if err := json.Unmarshal([]byte(rawNodes), &values.Nodes); err != nil {
+		return Configuration{}, fmt.Errorf("parse nodes: %w", err)
+	}
+	for _, node := range values.Nodes {
+		nodeURL, err := url.Parse(node)
+		if err != nil || (nodeURL.Scheme != "http" && nodeURL.Scheme != "https") || nodeURL.Host == "" {
+			return Configuration{}, fmt.Errorf("the node %q isn't a http or https URL", node)
+		}
+	}
+	if err := json.Unmarshal([]byte(rawPlacementGroups), &values.PlacementGroups); err != nil {
+		return Configuration{}, fmt.Errorf("parse placement groups: %w", err)
+	}
+
+	return values, nil
+}
+
+// LoadCredentials reads the json encoded credentials file. Access key ids must be unique, and every credential needs
+// a secret access key.
+func LoadCredentials(path string) ([]Credential, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read credentials file: %w", err)
+	}
+	var credentials []Credential
+	if err := json.Unmarshal(content, &credentials); err != nil {
+		return nil, fmt.Errorf("json decode credentials file: %w", err)
+	}
+
+	accessKeyIDs := map[string]bool{}
+	for _, credential := range credentials {
+		if credential.AccessKeyID == "" || credential.SecretAccessKey == "" {
+			return nil, errors.New("every credential must have an AccessKeyID and a SecretAccessKey")
+		}
+		if accessKeyIDs[credential.AccessKeyID] {
+			return nil, fmt.Errorf("the access key id %v is used by multiple credentials", credential.AccessKeyID)
+		}
+		accessKeyIDs[credential.AccessKeyID] = true
+	}
+	if len(credentials) == 0 {
+		return nil, errors.New("the credentials file doesn't contain credentials")
+	}
+
+	return credentials, nil
+}
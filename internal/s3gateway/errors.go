@@ -0,0 +1,105 @@
+package s3gateway
+
+import (
+	"context"
+	"errors"
+	"github.com/rstdm/mini-ceph/client"
+	"net/http"
+)
+
+// apiError is an error of the S3 REST API. It is sent to the client as XML document with the code and the message.
+type apiError struct {
+	status  int
+	code    string
+	message string
+}
+
+func (e apiError) Error() string {
+	return e.code + ": " + e.message
+}
+
+// Is reports whether the target has the same code, so errors with a more specific message still match.
+func (e apiError) Is(target error) bool {
+	other, ok := target.(apiError)
+	return ok && other.code == e.code
+}
+
+// withMessage returns a copy of the error with a more specific message.
+func (e apiError) withMessage(message string) apiError {
+	e.message = message
+	return e
+}
+
+var (
+	errAccessDenied              = apiError{http.StatusForbidden, "AccessDenied", "Access Denied"}
+	errInvalidAccessKeyID        = apiError{http.StatusForbidden, "InvalidAccessKeyId", "The AWS access key Id you provided does not exist in our records."}
+	errSignatureDoesNotMatch     = apiError{http.StatusForbidden, "SignatureDoesNotMatch", "The request signature we calculated does not match the signature you provided."}
+	errRequestTimeTooSkewed      = apiError{http.StatusForbidden, "RequestTimeTooSkewed", "The difference between the request time and the current time is too large."}
+	errAuthorizationMalformed    = apiError{http.StatusBadRequest, "AuthorizationHeaderMalformed", "The authorization header is malformed."}
+	errAuthorizationQueryInvalid = apiError{http.StatusBadRequest, "AuthorizationQueryParametersError", "The authorization query parameters are invalid."}
+	errContentSHA256Mismatch     = apiError{http.StatusBadRequest, "XAmzContentSHA256Mismatch", "The provided 'x-amz-content-sha256' header does not match what was computed."}
+	errBadDigest                 = apiError{http.StatusBadRequest, "BadDigest", "The Content-MD5 or checksum you specified did not match what we received."}
+	errInvalidDigest             = apiError{http.StatusBadRequest, "InvalidDigest", "The Content-MD5 or checksum you specified is not valid."}
+	errIncompleteBody            = apiError{http.StatusBadRequest, "IncompleteBody", "You did not provide the number of bytes specified by the Content-Length HTTP header."}
+	errInvalidRequest            = apiError{http.StatusBadRequest, "InvalidRequest", "The request is invalid."}
+	errInvalidArgument           = apiError{http.StatusBadRequest, "InvalidArgument", "An argument of the request is invalid."}
+	errInvalidBucketName         = apiError{http.StatusBadRequest, "InvalidBucketName", "The specified bucket is not valid."}
+	errKeyTooLong                = apiError{http.StatusBadRequest, "KeyTooLongError", "Your key is too long."}
+	errEntityTooLarge            = apiError{http.StatusBadRequest, "EntityTooLarge", "Your proposed upload exceeds the maximum allowed object size."}
+	errMalformedXML              = apiError{http.StatusBadRequest, "MalformedXML", "The XML you provided was not well-formed or did not validate against our published schema."}
+	errInvalidPart               = apiError{http.StatusBadRequest, "InvalidPart", "One or more of the specified parts could not be found, or the specified entity tag did not match the part's entity tag."}
+	errNoSuchBucket              = apiError{http.StatusNotFound, "NoSuchBucket", "The specified bucket does not exist."}
+	errNoSuchKey                 = apiError{http.StatusNotFound, "NoSuchKey", "The specified key does not exist."}
+	errNoSuchUpload              = apiError{http.StatusNotFound, "NoSuchUpload", "The specified multipart upload does not exist."}
+	errBucketAlreadyExists       = apiError{http.StatusConflict, "BucketAlreadyExists", "The requested bucket name is not available."}
+	errBucketNotEmpty            = apiError{http.StatusConflict, "BucketNotEmpty", "The bucket you tried to delete is not empty."}
+	errInvalidRange              = apiError{http.StatusRequestedRangeNotSatisfiable, "InvalidRange", "The requested range is not satisfiable."}
+	errInternalError             = apiError{http.StatusInternalServerError, "InternalError", "We encountered an internal error. Please try again."}
+	errNotImplemented            = apiError{http.StatusNotImplemented, "NotImplemented", "A header or query you provided implies functionality that is not implemented."}
+	errServiceUnavailable        = apiError{http.StatusServiceUnavailable, "ServiceUnavailable", "The cluster is currently unavailable. Please try again."}
+	errSlowDown                  = apiError{http.StatusServiceUnavailable, "SlowDown", "The object is currently modified by another request. Please try again."}
+	errGatewayTimeout            = apiError{http.StatusGatewayTimeout, "RequestTimeout", "The cluster didn't answer in time."}
+	errInsufficientStorage       = apiError{http.StatusInsufficientStorage, "InsufficientStorage", "The cluster is full."}
+)
+
+// toAPIError converts an error of the gateway or of the mini-ceph client into the error that is sent to the S3
+// client. ok is false if the error is unexpected and has to be logged.
+func toAPIError(err error) (converted apiError, ok bool) {
+	var statusErr *client.StatusError
+	switch {
+	case errors.As(err, &converted):
+		return converted, true
+	case errors.Is(err, client.ErrObjectDoesNotExist):
+		return errNoSuchKey, true
+	case errors.Is(err, client.ErrUploadDoesNotExist):
+		return errNoSuchUpload, true
+	case errors.Is(err, client.ErrInvalidPart):
+		return errInvalidPart, true
+	case errors.Is(err, client.ErrObjectIsBusy), errors.Is(err, client.ErrObjectDoesExist):
+		// the gateway overwrites objects, so a conflict is a concurrent modification; S3 clients retry SlowDown
+		return errSlowDown, true
+	case errors.Is(err, context.DeadlineExceeded):
+		return errGatewayTimeout, true
+	case errors.As(err, &statusErr):
+		switch statusErr.StatusCode {
+		case http.StatusBadRequest:
+			return errInvalidRequest.withMessage(statusErr.Message), true
+		case http.StatusUnauthorized, http.StatusForbidden:
+			return errAccessDenied.withMessage(statusErr.Message), true
+		case http.StatusConflict:
+			return errSlowDown.withMessage(statusErr.Message), true
+		case http.StatusRequestEntityTooLarge:
+			return errEntityTooLarge.withMessage(statusErr.Message), true
+		case http.StatusInsufficientStorage:
+			return errInsufficientStorage.withMessage(statusErr.Message), true
+		case http.StatusServiceUnavailable:
+			return errServiceUnavailable.withMessage(statusErr.Message), true
+		case http.StatusGatewayTimeout:
+			return errGatewayTimeout, true
+		}
+		return errInternalError, false
+	default:
+		// the nodes are unreachable or the request failed otherwise
+		return errServiceUnavailable, false
+	}
+}
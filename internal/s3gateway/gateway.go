@@ -0,0 +1,201 @@
+// Package s3gateway translates a subset of the S3 REST API into requests of the mini-ceph client, so S3 SDKs and tools
+// can use the cluster. Buckets and keys are mapped to object names; the client calculates the placement group of every
+// name and sends the requests directly to the primary.
+package s3gateway
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/rstdm/mini-ceph/client"
+	"go.uber.org/zap"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	bucketParam = "bucket"
+	keyParam    = "key"
+
+	authenticationKey = "s3Authentication"
+	requestIDHeader   = "x-amz-request-id"
+)
+
+// Store is the part of the mini-ceph client that the gateway uses.
+type Store interface {
+	Put(ctx context.Context, name string, content []byte) error
+	Overwrite(ctx context.Context, name string, content []byte) error
+	Get(ctx context.Context, name string) ([]byte, error)
+	GetRange(ctx context.Context, name string, offset int64, length int64) ([]byte, error)
+	Stat(ctx context.Context, name string) (client.ObjectInfo, error)
+	Delete(ctx context.Context, name string) error
+	List(ctx context.Context, prefix string, startAfter string, limit int) ([]client.ObjectInfo, bool, error)
+
+	InitiateUpload(ctx context.Context, name string) (string, error)
+	InitiateOverwrite(ctx context.Context, name string) (string, error)
+	UploadPart(ctx context.Context, name string, uploadID string, number int, content []byte) (client.Part, error)
+	ListParts(ctx context.Context, name string, uploadID string) ([]client.Part, error)
+	CompleteUpload(ctx context.Context, name string, uploadID string, parts []client.Part) error
+	AbortUpload(ctx context.Context, name string, uploadID string) error
+}
+
+// Gateway serves the S3 REST API with path-style addressing, i.e. the bucket is the first segment of the path.
+type Gateway struct {
+	verifier      *verifier
+	stores        map[string]Store // access key id -> client that uses the bearer token of the credential
+	region        string
+	maxObjectSize int64
+	sugar         *zap.SugaredLogger
+}
+
+// New creates the gateway. Every credential gets its own client of the cluster. The TLS configuration is used for the
+// connections to the nodes; it may be nil.
+func New(config Configuration, clusterTLSConfig *tls.Config, sugar *zap.SugaredLogger) (*Gateway, error) {
+	credentials, err := LoadCredentials(config.CredentialsFile)
+	if err != nil {
+		return nil, fmt.Errorf("load credentials: %w", err)
+	}
+
+	stores := map[string]Store{}
+	for _, credential := range credentials {
+		store, err := client.New(client.Config{
+			Nodes:           config.Nodes,
+			PlacementGroups: config.PlacementGroups,
+			BearerToken:     credential.BearerToken,
+			TLSConfig:       clusterTLSConfig,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("create client of access key %v: %w", credential.AccessKeyID, err)
+		}
+		stores[credential.AccessKeyID] = store
+	}
+
+	return newGateway(config.Region, config.MaxObjectSizeBytes, credentials, stores, sugar), nil
+}
+
+func newGateway(region string, maxObjectSize int64, credentials []Credential, stores map[string]Store, sugar *zap.SugaredLogger) *Gateway {
+	gateway := &Gateway{
+		verifier:      newVerifier(region, credentials),
+		stores:        stores,
+		region:        region,
+		maxObjectSize: maxObjectSize,
+		sugar:         sugar,
+	}
+	return gateway
+}
+
+func (g *Gateway) RegisterHandler(engine *gin.Engine) {
+	group := engine.Group("", g.authenticate)
+
+	group.GET("/", g.listBuckets)
+
+	bucketRoute := "/:" + bucketParam
+	group.PUT(bucketRoute, g.createBucket)
+	group.HEAD(bucketRoute, g.headBucket)
+	group.GET(bucketRoute, g.getBucket)
+	group.DELETE(bucketRoute, g.deleteBucket)
+	group.POST(bucketRoute, g.notImplemented)
+
+	// a trailing slash without key addresses the bucket
+	objectRoute := bucketRoute + "/*" + keyParam
+	group.PUT(objectRoute, g.onObjectOrBucket(g.putObject, g.createBucket))
+	group.HEAD(objectRoute, g.onObjectOrBucket(g.headObject, g.headBucket))
+	group.GET(objectRoute, g.onObjectOrBucket(g.getObject, g.getBucket))
+	group.DELETE(objectRoute, g.onObjectOrBucket(g.deleteObject, g.deleteBucket))
+	group.POST(objectRoute, g.onObjectOrBucket(g.postObject, g.notImplemented))
+
+	// the middlewares of the group don't apply to unknown routes
+	engine.NoRoute(g.authenticate, g.notImplemented)
+}
+
+// authenticate verifies the signature of the request. Every response contains a request id, like the responses of S3.
+func (g *Gateway) authenticate(c *gin.Context) {
+	c.Header(requestIDHeader, newRequestID())
+
+	auth, err := g.verifier.verify(c.Request)
+	if err != nil {
+		g.respondError(c, err)
+		return
+	}
+	c.Set(authenticationKey, auth)
+
+	c.Next()
+}
+
+func (g *Gateway) onObjectOrBucket(objectHandler gin.HandlerFunc, bucketHandler gin.HandlerFunc) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if objectKey(c) == "" {
+			bucketHandler(c)
+			return
+		}
+		objectHandler(c)
+	}
+}
+
+func (g *Gateway) notImplemented(c *gin.Context) {
+	g.respondError(c, errNotImplemented)
+}
+
+// store returns the client of the authenticated credential.
+func (g *Gateway) store(c *gin.Context) Store {
+	return g.stores[getAuthentication(c).credential.AccessKeyID]
+}
+
+func getAuthentication(c *gin.Context) authentication {
+	return c.MustGet(authenticationKey).(authentication)
+}
+
+func objectKey(c *gin.Context) string {
+	return strings.TrimPrefix(c.Param(keyParam), "/")
+}
+
+// respondError sends the error as S3 error document. Unexpected errors are logged.
+func (g *Gateway) respondError(c *gin.Context, err error) {
+	converted, ok := toAPIError(err)
+	if !ok {
+		g.sugar.Errorw("S3 request failed", "err", err, "method", c.Request.Method, "path", c.Request.URL.Path)
+	}
+	if errors.Is(err, context.Canceled) {
+		// the client has gone away; nobody reads the response
+		c.AbortWithStatus(http.StatusServiceUnavailable)
+		return
+	}
+
+	if c.Request.Method == http.MethodHead {
+		c.AbortWithStatus(converted.status) // responses to HEAD requests have no body
+		return
+	}
+	writeXML(c, converted.status, errorResponse{
+		Code:      converted.code,
+		Message:   converted.message,
+		Resource:  c.Request.URL.Path,
+		RequestID: c.Writer.Header().Get(requestIDHeader),
+	})
+	c.Abort()
+}
+
+func writeXML(c *gin.Context, status int, value interface{}) {
+	encoded, err := xml.Marshal(value)
+	if err != nil {
+		_ = c.AbortWithError(http.StatusInternalServerError, fmt.Errorf("xml encode response: %w", err))
+		return
+	}
+	c.Data(status, "application/xml", append([]byte(xml.Header), encoded...))
+}
+
+func newRequestID() string {
+	id := make([]byte, 8)
+	_, _ = rand.Read(id) // the id only correlates log entries
+	return strings.ToUpper(hex.EncodeToString(id))
+}
+
+// formatTime formats a timestamp like the XML documents of S3.
+func formatTime(t time.Time) string {
+	return t.UTC().Format("2006-01-02T15:04:05.000Z")
+}
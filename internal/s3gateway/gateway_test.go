@@ -0,0 +1,475 @@
+package s3gateway
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/rstdm/mini-ceph/client"
+	"go.uber.org/zap"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memoryStore imitates the cluster: objects are only replaced by Overwrite and by overwriting uploads, and the
+// checksum is the sha256 digest of the content. Objects in busy can't be overwritten, like objects that are currently
+// modified by another request.
+type memoryStore struct {
+	mutex   sync.Mutex
+	objects map[string][]byte
+	uploads map[string]*memoryUpload
+	busy    map[string]bool
+}
+
+type memoryUpload struct {
+	name      string
+	overwrite bool
+	parts     map[int][]byte
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{objects: map[string][]byte{}, uploads: map[string]*memoryUpload{}, busy: map[string]bool{}}
+}
+
+func checksumOf(content []byte) string {
+	digest := sha256.Sum256(content)
+	return hex.EncodeToString(digest[:])
+}
+
+func md5Of(content []byte) string {
+	digest := md5.Sum(content)
+	return hex.EncodeToString(digest[:])
+}
+
+func (s *memoryStore) Put(_ context.Context, name string, content []byte) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.objects[name]; ok {
+		return client.ErrObjectDoesExist
+	}
+	s.objects[name] = content
+	return nil
+}
+
+func (s *memoryStore) Overwrite(_ context.Context, name string, content []byte) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.busy[name] {
+		return client.ErrObjectIsBusy
+	}
+	s.objects[name] = content
+	return nil
+}
+
+func (s *memoryStore) Get(_ context.Context, name string) ([]byte, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	content, ok := s.objects[name]
+	if !ok {
+		return nil, client.ErrObjectDoesNotExist
+	}
+	return content, nil
+}
+
+func (s *memoryStore) GetRange(ctx context.Context, name string, offset int64, length int64) ([]byte, error) {
+	content, err := s.Get(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if offset >= int64(len(content)) {
+		return []byte{}, nil
+	}
+	end := offset + length
+	if end > int64(len(content)) {
+		end = int64(len(content))
+	}
+	return content[offset:end], nil
+}
+
+func (s *memoryStore) Stat(ctx context.Context, name string) (client.ObjectInfo, error) {
+	content, err := s.Get(ctx, name)
+	if err != nil {
+		return client.ObjectInfo{}, err
+	}
+	return client.ObjectInfo{Name: name, Size: int64(len(content)), LastModified: time.Now(), Checksum: checksumOf(content),
+		MD5: md5Of(content)}, nil
+}
+
+func (s *memoryStore) Delete(_ context.Context, name string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.objects[name]; !ok {
+		return client.ErrObjectDoesNotExist
+	}
+	delete(s.objects, name)
+	return nil
+}
+
+func (s *memoryStore) List(_ context.Context, prefix string, startAfter string, limit int) ([]client.ObjectInfo, bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var names []string
+	for name := range s.objects {
+		if strings.HasPrefix(name, prefix) && name > startAfter {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	truncated := len(names) > limit
+	if truncated {
+		names = names[:limit]
+	}
+	infos := make([]client.ObjectInfo, 0, len(names))
+	for _, name := range names {
+		content := s.objects[name]
+		infos = append(infos, client.ObjectInfo{Name: name, Size: int64(len(content)), LastModified: time.Now(),
+			Checksum: checksumOf(content), MD5: md5Of(content)})
+	}
+	return infos, truncated, nil
+}
+
+func (s *memoryStore) InitiateUpload(_ context.Context, name string) (string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.objects[name]; ok {
+		return "", client.ErrObjectDoesExist
+	}
+	return s.initiateLocked(name, false), nil
+}
+
+func (s *memoryStore) InitiateOverwrite(_ context.Context, name string) (string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.initiateLocked(name, true), nil
+}
+
+func (s *memoryStore) initiateLocked(name string, overwrite bool) string {
+	id := fmt.Sprintf("upload-%v", len(s.uploads))
+	s.uploads[id] = &memoryUpload{name: name, overwrite: overwrite, parts: map[int][]byte{}}
+	return id
+}
+
+func (s *memoryStore) upload(name string, uploadID string) (*memoryUpload, error) {
+	upload, ok := s.uploads[uploadID]
+	if !ok || upload.name != name {
+		return nil, client.ErrUploadDoesNotExist
+	}
+	return upload, nil
+}
+
+func (s *memoryStore) UploadPart(_ context.Context, name string, uploadID string, number int, content []byte) (client.Part, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	upload, err := s.upload(name, uploadID)
+	if err != nil {
+		return client.Part{}, err
+	}
+	upload.parts[number] = content
+	return client.Part{Number: number, Size: int64(len(content)), Checksum: checksumOf(content)}, nil
+}
+
+func (s *memoryStore) ListParts(_ context.Context, name string, uploadID string) ([]client.Part, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	upload, err := s.upload(name, uploadID)
+	if err != nil {
+		return nil, err
+	}
+	var parts []client.Part
+	for number, content := range upload.parts {
+		parts = append(parts, client.Part{Number: number, Size: int64(len(content)), Checksum: checksumOf(content)})
+	}
+	sort.Slice(parts, func(i, j int) bool { return parts[i].Number < parts[j].Number })
+	return parts, nil
+}
+
+func (s *memoryStore) CompleteUpload(_ context.Context, name string, uploadID string, parts []client.Part) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	upload, err := s.upload(name, uploadID)
+	if err != nil {
+		return err
+	}
+	if _, ok := s.objects[name]; ok && (!upload.overwrite || s.busy[name]) {
+		return client.ErrObjectDoesExist
+	}
+	var content []byte
+	for _, part := range parts {
+		partContent, ok := upload.parts[part.Number]
+		if !ok || checksumOf(partContent) != part.Checksum {
+			return client.ErrInvalidPart
+		}
+		content = append(content, partContent...)
+	}
+	s.objects[name] = content
+	delete(s.uploads, uploadID)
+	return nil
+}
+
+func (s *memoryStore) AbortUpload(_ context.Context, name string, uploadID string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, err := s.upload(name, uploadID); err != nil {
+		return err
+	}
+	delete(s.uploads, uploadID)
+	return nil
+}
+
+var testCredential = Credential{AccessKeyID: "alice", SecretAccessKey: "secret"}
+
+func newTestEngine(t *testing.T) (*gin.Engine, *memoryStore) {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	store := newMemoryStore()
+	gateway := newGateway("us-east-1", 1<<20, []Credential{testCredential}, map[string]Store{testCredential.AccessKeyID: store}, zap.NewNop().Sugar())
+	engine := gin.New()
+	gateway.RegisterHandler(engine)
+	return engine, store
+}
+
+// send signs the request with the Authorization header like an S3 SDK and serves it.
+func send(t *testing.T, engine *gin.Engine, method string, target string, body []byte, header http.Header) *httptest.ResponseRecorder {
+	t.Helper()
+	request := httptest.NewRequest(method, target, bytes.NewReader(body))
+	for name, values := range header {
+		request.Header[name] = values
+	}
+
+	amzDate := time.Now().UTC().Format(amzDateFormat)
+	scope := strings.Join([]string{amzDate[:8], "us-east-1", scopeService, scopeTerminator}, "/")
+	payloadHash := checksumOf(body)
+	request.Header.Set(amzDateHeader, amzDate)
+	request.Header.Set(contentSHA256Header, payloadHash)
+
+	signedHeaders := []string{"host", "x-amz-content-sha256", "x-amz-date"}
+	canonical, err := canonicalRequest(request, signedHeaders, payloadHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := signingKey(testCredential.SecretAccessKey, amzDate[:8], "us-east-1")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign(amzDate, scope, canonical)))
+	request.Header.Set("Authorization", fmt.Sprintf("%v Credential=%v/%v,SignedHeaders=%v,Signature=%v",
+		signatureAlgorithm, testCredential.AccessKeyID, scope, strings.Join(signedHeaders, ";"), signature))
+
+	recorder := httptest.NewRecorder()
+	engine.ServeHTTP(recorder, request)
+	return recorder
+}
+
+func expectStatus(t *testing.T, recorder *httptest.ResponseRecorder, status int) {
+	t.Helper()
+	if recorder.Code != status {
+		t.Fatalf("expected status %v, got %v: %v", status, recorder.Code, recorder.Body.String())
+	}
+}
+
+func decodeXML(t *testing.T, recorder *httptest.ResponseRecorder, value interface{}) {
+	t.Helper()
+	if err := xml.Unmarshal(recorder.Body.Bytes(), value); err != nil {
+		t.Fatalf("xml decode %q: %v", recorder.Body.String(), err)
+	}
+}
+
+func TestBucketsAndObjects(t *testing.T) {
+	engine, store := newTestEngine(t)
+
+	unsigned := httptest.NewRecorder()
+	engine.ServeHTTP(unsigned, httptest.NewRequest(http.MethodGet, "/", nil))
+	expectStatus(t, unsigned, http.StatusForbidden)
+	unsigned = httptest.NewRecorder()
+	engine.ServeHTTP(unsigned, httptest.NewRequest(http.MethodPost, "/", nil))
+	expectStatus(t, unsigned, http.StatusForbidden)
+	expectStatus(t, send(t, engine, http.MethodPost, "/", nil, nil), http.StatusNotImplemented)
+
+	expectStatus(t, send(t, engine, http.MethodPut, "/photos", nil, nil), http.StatusOK)
+	expectStatus(t, send(t, engine, http.MethodPut, "/photos", nil, nil), http.StatusConflict)
+	expectStatus(t, send(t, engine, http.MethodPut, "/Invalid_Bucket", nil, nil), http.StatusBadRequest)
+	expectStatus(t, send(t, engine, http.MethodPut, "/missing/key", []byte("content"), nil), http.StatusNotFound)
+	expectStatus(t, send(t, engine, http.MethodHead, "/photos", nil, nil), http.StatusOK)
+
+	var buckets listAllMyBucketsResult
+	decodeXML(t, send(t, engine, http.MethodGet, "/", nil, nil), &buckets)
+	if len(buckets.Buckets.Bucket) != 1 || buckets.Buckets.Bucket[0].Name != "photos" {
+		t.Errorf("unexpected buckets %+v", buckets.Buckets)
+	}
+
+	for _, key := range []string{"2024/a.jpg", "2024/b.jpg", "readme.txt"} {
+		expectStatus(t, send(t, engine, http.MethodPut, "/photos/"+key, []byte("first"), nil), http.StatusOK)
+	}
+	// the second write replaces the object
+	recorder := send(t, engine, http.MethodPut, "/photos/readme.txt", []byte("hello world"), nil)
+	expectStatus(t, recorder, http.StatusOK)
+	etag := recorder.Header().Get("ETag")
+	if content := store.objects["photos/readme.txt"]; string(content) != "hello world" {
+		t.Errorf("the stored content is %q", content)
+	}
+	if etag != `"5eb63bbbe01eeed093cb22bb8f5acdc3"` {
+		t.Errorf("the ETag %v isn't the md5 digest of the content", etag)
+	}
+
+	recorder = send(t, engine, http.MethodGet, "/photos/readme.txt", nil, nil)
+	expectStatus(t, recorder, http.StatusOK)
+	if recorder.Body.String() != "hello world" || recorder.Header().Get("ETag") != etag {
+		t.Errorf("GetObject returned %q with the ETag %v instead of %v", recorder.Body.String(), recorder.Header().Get("ETag"), etag)
+	}
+
+	recorder = send(t, engine, http.MethodGet, "/photos/readme.txt", nil, http.Header{"Range": {"bytes=6-"}})
+	expectStatus(t, recorder, http.StatusPartialContent)
+	if recorder.Body.String() != "world" || recorder.Header().Get("Content-Range") != "bytes 6-10/11" {
+		t.Errorf("the range is %q with Content-Range %v", recorder.Body.String(), recorder.Header().Get("Content-Range"))
+	}
+	expectStatus(t, send(t, engine, http.MethodGet, "/photos/readme.txt", nil, http.Header{"Range": {"bytes=11-"}}), http.StatusRequestedRangeNotSatisfiable)
+
+	recorder = send(t, engine, http.MethodHead, "/photos/readme.txt", nil, nil)
+	expectStatus(t, recorder, http.StatusOK)
+	if recorder.Header().Get("Content-Length") != "11" {
+		t.Errorf("HeadObject returned the length %v", recorder.Header().Get("Content-Length"))
+	}
+	expectStatus(t, send(t, engine, http.MethodGet, "/photos/missing", nil, nil), http.StatusNotFound)
+
+	expectStatus(t, send(t, engine, http.MethodDelete, "/photos", nil, nil), http.StatusConflict)
+	for _, key := range []string{"2024/a.jpg", "2024/b.jpg", "readme.txt", "missing"} {
+		expectStatus(t, send(t, engine, http.MethodDelete, "/photos/"+key, nil, nil), http.StatusNoContent)
+	}
+	expectStatus(t, send(t, engine, http.MethodDelete, "/photos", nil, nil), http.StatusNoContent)
+	expectStatus(t, send(t, engine, http.MethodHead, "/photos", nil, nil), http.StatusNotFound)
+}
+
+func TestListObjectsV2(t *testing.T) {
+	engine, _ := newTestEngine(t)
+	expectStatus(t, send(t, engine, http.MethodPut, "/logs", nil, nil), http.StatusOK)
+	for _, key := range []string{"2023/01.log", "2023/02.log", "2024/01.log", "current.log", "next.log"} {
+		expectStatus(t, send(t, engine, http.MethodPut, "/logs/"+key, []byte(key), nil), http.StatusOK)
+	}
+
+	var result listBucketResult
+	decodeXML(t, send(t, engine, http.MethodGet, "/logs?list-type=2&delimiter=/", nil, nil), &result)
+	if result.KeyCount != 4 || len(result.CommonPrefixes) != 2 || result.CommonPrefixes[1].Prefix != "2024/" ||
+		len(result.Contents) != 2 || result.Contents[0].Key != "current.log" || result.IsTruncated {
+		t.Errorf("unexpected listing %+v", result)
+	}
+
+	var keys []string
+	token := ""
+	for page := 0; page < 10; page++ {
+		target := "/logs?list-type=2&delimiter=/&max-keys=1"
+		if token != "" {
+			target += "&continuation-token=" + token
+		}
+		result = listBucketResult{}
+		decodeXML(t, send(t, engine, http.MethodGet, target, nil, nil), &result)
+		for _, prefix := range result.CommonPrefixes {
+			keys = append(keys, prefix.Prefix)
+		}
+		for _, object := range result.Contents {
+			keys = append(keys, object.Key)
+		}
+		if !result.IsTruncated {
+			break
+		}
+		token = result.NextContinuationToken
+	}
+	if strings.Join(keys, ",") != "2023/,2024/,current.log,next.log" {
+		t.Errorf("the pages contain %v", keys)
+	}
+
+	result = listBucketResult{}
+	decodeXML(t, send(t, engine, http.MethodGet, "/logs?list-type=2&prefix=2023/&start-after=2023/01.log", nil, nil), &result)
+	if len(result.Contents) != 1 || result.Contents[0].Key != "2023/02.log" || result.Contents[0].Size != 11 {
+		t.Errorf("unexpected listing %+v", result)
+	}
+
+	expectStatus(t, send(t, engine, http.MethodGet, "/logs", nil, nil), http.StatusNotImplemented)
+}
+
+func TestMultipartUpload(t *testing.T) {
+	engine, store := newTestEngine(t)
+	expectStatus(t, send(t, engine, http.MethodPut, "/videos", nil, nil), http.StatusOK)
+	expectStatus(t, send(t, engine, http.MethodPut, "/videos/movie", []byte("old"), nil), http.StatusOK)
+
+	var initiated initiateMultipartUploadResult
+	decodeXML(t, send(t, engine, http.MethodPost, "/videos/movie?uploads", nil, nil), &initiated)
+	if initiated.UploadID == "" || initiated.Key != "movie" {
+		t.Fatalf("unexpected initiation %+v", initiated)
+	}
+	// the existing object is only replaced by the completion
+	if content := store.objects["videos/movie"]; string(content) != "old" {
+		t.Errorf("the object is %q after the upload has been initiated", content)
+	}
+
+	completion := completeMultipartUpload{}
+	for number, content := range []string{"first part, ", "second part"} {
+		target := fmt.Sprintf("/videos/movie?partNumber=%v&uploadId=%v", number+1, initiated.UploadID)
+		recorder := send(t, engine, http.MethodPut, target, []byte(content), nil)
+		expectStatus(t, recorder, http.StatusOK)
+		completion.Parts = append(completion.Parts, completedPart{PartNumber: number + 1, ETag: recorder.Header().Get("ETag")})
+	}
+	expectStatus(t, send(t, engine, http.MethodPut, "/videos/movie?partNumber=0&uploadId="+initiated.UploadID, []byte("x"), nil), http.StatusBadRequest)
+
+	var parts listPartsResult
+	decodeXML(t, send(t, engine, http.MethodGet, "/videos/movie?uploadId="+initiated.UploadID, nil, nil), &parts)
+	if len(parts.Parts) != 2 || parts.Parts[1].ETag != completion.Parts[1].ETag || parts.Parts[1].Size != 11 {
+		t.Errorf("unexpected parts %+v", parts)
+	}
+
+	wrongPart := completeMultipartUpload{Parts: []completedPart{{PartNumber: 1, ETag: completion.Parts[1].ETag}}}
+	body, _ := xml.Marshal(wrongPart)
+	expectStatus(t, send(t, engine, http.MethodPost, "/videos/movie?uploadId="+initiated.UploadID, body, nil), http.StatusBadRequest)
+
+	body, _ = xml.Marshal(completion)
+	var completed completeMultipartUploadResult
+	decodeXML(t, send(t, engine, http.MethodPost, "/videos/movie?uploadId="+initiated.UploadID, body, nil), &completed)
+	recorder := send(t, engine, http.MethodGet, "/videos/movie", nil, nil)
+	expectStatus(t, recorder, http.StatusOK)
+	if recorder.Body.String() != "first part, second part" || recorder.Header().Get("ETag") != completed.ETag {
+		t.Errorf("the object is %q with the ETag %v instead of %v", recorder.Body.String(), recorder.Header().Get("ETag"), completed.ETag)
+	}
+
+	decodeXML(t, send(t, engine, http.MethodPost, "/videos/other?uploads", nil, nil), &initiated)
+	expectStatus(t, send(t, engine, http.MethodDelete, "/videos/other?uploadId="+initiated.UploadID, nil, nil), http.StatusNoContent)
+	expectStatus(t, send(t, engine, http.MethodDelete, "/videos/other?uploadId="+initiated.UploadID, nil, nil), http.StatusNotFound)
+}
+
+func TestAbortedUploadKeepsTheObject(t *testing.T) {
+	engine, _ := newTestEngine(t)
+	expectStatus(t, send(t, engine, http.MethodPut, "/videos", nil, nil), http.StatusOK)
+	expectStatus(t, send(t, engine, http.MethodPut, "/videos/movie", []byte("old"), nil), http.StatusOK)
+
+	var initiated initiateMultipartUploadResult
+	decodeXML(t, send(t, engine, http.MethodPost, "/videos/movie?uploads", nil, nil), &initiated)
+	target := "/videos/movie?partNumber=1&uploadId=" + initiated.UploadID
+	expectStatus(t, send(t, engine, http.MethodPut, target, []byte("new"), nil), http.StatusOK)
+	expectStatus(t, send(t, engine, http.MethodDelete, "/videos/movie?uploadId="+initiated.UploadID, nil, nil), http.StatusNoContent)
+
+	recorder := send(t, engine, http.MethodGet, "/videos/movie", nil, nil)
+	expectStatus(t, recorder, http.StatusOK)
+	if recorder.Body.String() != "old" {
+		t.Errorf("the object is %q after the upload has been aborted", recorder.Body.String())
+	}
+}
+
+func TestConcurrentModificationsAreRetryable(t *testing.T) {
+	engine, store := newTestEngine(t)
+	expectStatus(t, send(t, engine, http.MethodPut, "/videos", nil, nil), http.StatusOK)
+	expectStatus(t, send(t, engine, http.MethodPut, "/videos/movie", []byte("old"), nil), http.StatusOK)
+	store.busy["videos/movie"] = true
+
+	recorder := send(t, engine, http.MethodPut, "/videos/movie", []byte("new"), nil)
+	expectStatus(t, recorder, http.StatusServiceUnavailable)
+	if !strings.Contains(recorder.Body.String(), "<Code>SlowDown</Code>") {
+		t.Errorf("unexpected error %v", recorder.Body.String())
+	}
+	if content := store.objects["videos/movie"]; string(content) != "old" {
+		t.Errorf("the object is %q", content)
+	}
+}
@@ -0,0 +1,175 @@
+package s3gateway
+
+import (
+	"encoding/xml"
+	"github.com/gin-gonic/gin"
+	"github.com/rstdm/mini-ceph/client"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	maxPartNumber = 10000
+	// maxCompletionSize limits the XML document of CompleteMultipartUpload; it lists at most maxPartNumber parts.
+	maxCompletionSize = 2 << 20
+	maxListedParts    = 1000
+)
+
+// initiateUpload serves CreateMultipartUpload. An existing object with the key is kept until the upload is completed;
+// the completion replaces it.
+func (g *Gateway) initiateUpload(c *gin.Context) {
+	bucket, name, ok := g.requireObject(c)
+	if !ok {
+		return
+	}
+
+	uploadID, err := g.store(c).InitiateOverwrite(c.Request.Context(), name)
+	if err != nil {
+		g.respondError(c, err)
+		return
+	}
+
+	writeXML(c, http.StatusOK, initiateMultipartUploadResult{Bucket: bucket, Key: objectKey(c), UploadID: uploadID})
+}
+
+// uploadPart serves UploadPart. The entity tag of the part is its checksum.
+func (g *Gateway) uploadPart(c *gin.Context) {
+	number, err := strconv.Atoi(c.Query("partNumber"))
+	if err != nil || number < 1 || number > maxPartNumber {
+		g.respondError(c, errInvalidArgument.withMessage("Part number must be an integer between 1 and 10000, inclusive."))
+		return
+	}
+	_, name, ok := g.requireObject(c)
+	if !ok {
+		return
+	}
+
+	content, err := readContent(c.Request, getAuthentication(c), g.maxObjectSize)
+	if err != nil {
+		g.respondError(c, err)
+		return
+	}
+	part, err := g.store(c).UploadPart(c.Request.Context(), name, c.Query("uploadId"), number, content)
+	if err != nil {
+		g.respondError(c, err)
+		return
+	}
+
+	c.Header("ETag", etagOf(part.Checksum))
+	c.Status(http.StatusOK)
+}
+
+// completeUpload serves CompleteMultipartUpload. The entity tags of the request select the uploaded parts.
+func (g *Gateway) completeUpload(c *gin.Context) {
+	bucket, name, ok := g.requireObject(c)
+	if !ok {
+		return
+	}
+
+	body, _, err := readPayload(c.Request, getAuthentication(c), maxCompletionSize)
+	if err != nil {
+		g.respondError(c, err)
+		return
+	}
+	var completion completeMultipartUpload
+	if err := xml.Unmarshal(body, &completion); err != nil || len(completion.Parts) == 0 {
+		g.respondError(c, errMalformedXML)
+		return
+	}
+	parts := make([]client.Part, 0, len(completion.Parts))
+	for _, part := range completion.Parts {
+		checksum := strings.Trim(part.ETag, `"`)
+		if checksum == "" {
+			g.respondError(c, errInvalidPart)
+			return
+		}
+		parts = append(parts, client.Part{Number: part.PartNumber, Checksum: checksum})
+	}
+
+	store := g.store(c)
+	if err := store.CompleteUpload(c.Request.Context(), name, c.Query("uploadId"), parts); err != nil {
+		g.respondError(c, err)
+		return
+	}
+	info, err := store.Stat(c.Request.Context(), name)
+	if err != nil {
+		g.respondError(c, err)
+		return
+	}
+
+	writeXML(c, http.StatusOK, completeMultipartUploadResult{
+		Location: "/" + bucket + "/" + objectKey(c),
+		Bucket:   bucket,
+		Key:      objectKey(c),
+		ETag:     objectETag(info),
+	})
+}
+
+func (g *Gateway) abortUpload(c *gin.Context) {
+	_, name, ok := g.requireObject(c)
+	if !ok {
+		return
+	}
+
+	if err := g.store(c).AbortUpload(c.Request.Context(), name, c.Query("uploadId")); err != nil {
+		g.respondError(c, err)
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// listParts serves ListParts. The parts are paginated by part-number-marker and max-parts.
+func (g *Gateway) listParts(c *gin.Context) {
+	bucket, name, ok := g.requireObject(c)
+	if !ok {
+		return
+	}
+
+	marker, maxParts := 0, maxListedParts
+	var err error
+	if rawMarker := c.Query("part-number-marker"); rawMarker != "" {
+		if marker, err = strconv.Atoi(rawMarker); err != nil || marker < 0 {
+			g.respondError(c, errInvalidArgument.withMessage("part-number-marker must be a non-negative integer."))
+			return
+		}
+	}
+	if rawMaxParts := c.Query("max-parts"); rawMaxParts != "" {
+		if maxParts, err = strconv.Atoi(rawMaxParts); err != nil || maxParts < 0 {
+			g.respondError(c, errInvalidArgument.withMessage("max-parts must be a non-negative integer."))
+			return
+		}
+		if maxParts > maxListedParts {
+			maxParts = maxListedParts
+		}
+	}
+
+	uploadID := c.Query("uploadId")
+	parts, err := g.store(c).ListParts(c.Request.Context(), name, uploadID)
+	if err != nil {
+		g.respondError(c, err)
+		return
+	}
+
+	result := listPartsResult{
+		Bucket:           bucket,
+		Key:              objectKey(c),
+		UploadID:         uploadID,
+		PartNumberMarker: marker,
+		MaxParts:         maxParts,
+	}
+	for _, part := range parts {
+		if part.Number <= marker {
+			continue
+		}
+		if len(result.Parts) == maxParts {
+			result.IsTruncated = true
+			break
+		}
+		result.Parts = append(result.Parts, partEntry{PartNumber: part.Number, ETag: etagOf(part.Checksum), Size: part.Size})
+		result.NextPartNumberMarker = part.Number
+	}
+
+	writeXML(c, http.StatusOK, result)
+}
@@ -0,0 +1,235 @@
+package s3gateway
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/rstdm/mini-ceph/client"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// requireObject returns the bucket and the name of the object of the request. The request is completed if the key is
+// invalid or if the bucket doesn't exist.
+func (g *Gateway) requireObject(c *gin.Context) (bucket string, name string, ok bool) {
+	key := objectKey(c)
+	if len(key) > maxKeyLength {
+		g.respondError(c, errKeyTooLong)
+		return "", "", false
+	}
+	if bucket, ok = g.requireBucket(c); !ok {
+		return "", "", false
+	}
+	return bucket, objectName(bucket, key), true
+}
+
+// putObject serves PutObject and UploadPart. Objects with the key are replaced in a single operation of the cluster;
+// readers never miss the object.
+func (g *Gateway) putObject(c *gin.Context) {
+	if c.GetHeader("x-amz-copy-source") != "" {
+		g.respondError(c, errNotImplemented.withMessage("Copying objects is not supported."))
+		return
+	}
+	if _, isPart := c.GetQuery("uploadId"); isPart {
+		g.uploadPart(c)
+		return
+	}
+	_, name, ok := g.requireObject(c)
+	if !ok {
+		return
+	}
+
+	content, err := readContent(c.Request, getAuthentication(c), g.maxObjectSize)
+	if err != nil {
+		g.respondError(c, err)
+		return
+	}
+	store := g.store(c)
+	if err := store.Overwrite(c.Request.Context(), name, content); err != nil {
+		g.respondError(c, err)
+		return
+	}
+
+	// the entity tag depends on the pool of the object: encrypted objects don't have an md5 digest
+	if info, err := store.Stat(c.Request.Context(), name); err == nil {
+		c.Header("ETag", objectETag(info))
+	} else {
+		g.sugar.Warnw("Failed to determine the entity tag of a written object", "err", err, "name", name)
+	}
+	c.Status(http.StatusOK)
+}
+
+// getObject serves GetObject and ListParts. A single byte range of the Range header is supported; other ranges are
+// ignored and the whole object is sent.
+func (g *Gateway) getObject(c *gin.Context) {
+	if _, isUpload := c.GetQuery("uploadId"); isUpload {
+		g.listParts(c)
+		return
+	}
+	if _, isPart := c.GetQuery("partNumber"); isPart {
+		g.respondError(c, errNotImplemented.withMessage("Reading single parts is not supported."))
+		return
+	}
+	_, name, ok := g.requireObject(c)
+	if !ok {
+		return
+	}
+
+	store := g.store(c)
+	info, err := store.Stat(c.Request.Context(), name)
+	if err != nil {
+		g.respondError(c, err)
+		return
+	}
+	setObjectHeaders(c, info)
+
+	start, end, isRange, err := parseRange(c.GetHeader("Range"), info.Size)
+	if err != nil {
+		c.Header("Content-Range", fmt.Sprintf("bytes */%v", info.Size))
+		g.respondError(c, err)
+		return
+	}
+	if !isRange {
+		content, err := store.Get(c.Request.Context(), name)
+		if err != nil {
+			g.respondError(c, err)
+			return
+		}
+		c.Data(http.StatusOK, "application/octet-stream", content)
+		return
+	}
+
+	content, err := store.GetRange(c.Request.Context(), name, start, end-start+1)
+	if err != nil {
+		g.respondError(c, err)
+		return
+	}
+	c.Header("Content-Range", fmt.Sprintf("bytes %v-%v/%v", start, start+int64(len(content))-1, info.Size))
+	c.Data(http.StatusPartialContent, "application/octet-stream", content)
+}
+
+func (g *Gateway) headObject(c *gin.Context) {
+	_, name, ok := g.requireObject(c)
+	if !ok {
+		return
+	}
+
+	info, err := g.store(c).Stat(c.Request.Context(), name)
+	if err != nil {
+		g.respondError(c, err)
+		return
+	}
+
+	setObjectHeaders(c, info)
+	c.Header("Content-Type", "application/octet-stream")
+	c.Header("Content-Length", strconv.FormatInt(info.Size, 10))
+	c.Status(http.StatusOK)
+}
+
+// deleteObject serves DeleteObject and AbortMultipartUpload. Deleting a key that doesn't exist succeeds, like in S3.
+func (g *Gateway) deleteObject(c *gin.Context) {
+	if _, isUpload := c.GetQuery("uploadId"); isUpload {
+		g.abortUpload(c)
+		return
+	}
+	_, name, ok := g.requireObject(c)
+	if !ok {
+		return
+	}
+
+	if err := g.store(c).Delete(c.Request.Context(), name); err != nil && !errors.Is(err, client.ErrObjectDoesNotExist) {
+		g.respondError(c, err)
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// postObject serves CreateMultipartUpload and CompleteMultipartUpload.
+func (g *Gateway) postObject(c *gin.Context) {
+	if _, isInitiation := c.GetQuery("uploads"); isInitiation {
+		g.initiateUpload(c)
+		return
+	}
+	if _, isCompletion := c.GetQuery("uploadId"); isCompletion {
+		g.completeUpload(c)
+		return
+	}
+	g.notImplemented(c)
+}
+
+func setObjectHeaders(c *gin.Context, info client.ObjectInfo) {
+	if etag := objectETag(info); etag != "" {
+		c.Header("ETag", etag)
+	}
+	if !info.LastModified.IsZero() {
+		c.Header("Last-Modified", info.LastModified.UTC().Format(http.TimeFormat))
+	}
+	c.Header("Accept-Ranges", "bytes")
+}
+
+// objectETag returns the entity tag of an object. Like in S3, it is the md5 digest of the content. Objects without md5
+// digest, i.e. encrypted objects and objects of older versions, use their checksum instead.
+func objectETag(info client.ObjectInfo) string {
+	if info.MD5 != "" {
+		return etagOf(info.MD5)
+	}
+	return etagOf(info.Checksum)
+}
+
+// etagOf returns the quoted entity tag of a digest. The entity tag of a part is its sha256 checksum, not the md5
+// digest of S3; it selects the part when the upload is completed.
+func etagOf(checksum string) string {
+	if checksum == "" {
+		return ""
+	}
+	return `"` + checksum + `"`
+}
+
+// parseRange parses a Range header with a single range of bytes: bytes=<start>-<end>, bytes=<start>- or bytes=-<suffix
+// length>. end is inclusive and shortened to the size of the object. isRange is false if the header is empty or
+// doesn't contain a single range of bytes; the header is ignored in that case.
+func parseRange(header string, size int64) (start int64, end int64, isRange bool, err error) {
+	rawRange := strings.TrimPrefix(header, "bytes=")
+	if rawRange == header || strings.Contains(rawRange, ",") {
+		return 0, 0, false, nil
+	}
+	rawStart, rawEnd, found := strings.Cut(strings.TrimSpace(rawRange), "-")
+	if !found {
+		return 0, 0, false, nil
+	}
+
+	if rawStart == "" {
+		suffix, err := strconv.ParseInt(rawEnd, 10, 64)
+		if err != nil || suffix < 0 {
+			return 0, 0, false, nil
+		}
+		if suffix == 0 || size == 0 {
+			return 0, 0, false, errInvalidRange
+		}
+		if suffix > size {
+			suffix = size
+		}
+		return size - suffix, size - 1, true, nil
+	}
+
+	start, parseErr := strconv.ParseInt(rawStart, 10, 64)
+	if parseErr != nil || start < 0 {
+		return 0, 0, false, nil
+	}
+	end = size - 1
+	if rawEnd != "" {
+		requestedEnd, err := strconv.ParseInt(rawEnd, 10, 64)
+		if err != nil || requestedEnd < start {
+			return 0, 0, false, nil
+		}
+		if requestedEnd < end {
+			end = requestedEnd
+		}
+	}
+	if start >= size {
+		return 0, 0, false, errInvalidRange
+	}
+	return start, end, true, nil
+}
@@ -0,0 +1,232 @@
+package s3gateway
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	chunkSignatureAlgorithm = "AWS4-HMAC-SHA256-PAYLOAD"
+	// maxChunkLineLength limits the length of the chunk headers and of the trailers of aws-chunked bodies.
+	maxChunkLineLength   = 4096
+	checksumHeaderPrefix = "x-amz-checksum-"
+)
+
+// checksumAlgorithms creates the hashes of the flexible checksums (x-amz-checksum-<algorithm>) that are verified.
+var checksumAlgorithms = map[string]func() hash.Hash{
+	"crc32":  func() hash.Hash { return crc32.NewIEEE() },
+	"crc32c": func() hash.Hash { return crc32.New(crc32.MakeTable(crc32.Castagnoli)) },
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+}
+
+// readContent reads the content of an object or of a part. In addition to readPayload, it verifies the flexible
+// checksums of the headers or the trailers.
+func readContent(r *http.Request, auth authentication, maxSize int64) ([]byte, error) {
+	content, trailers, err := readPayload(r, auth, maxSize)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifyChecksums(r.Header, content); err != nil {
+		return nil, err
+	}
+	if err := verifyChecksums(trailers, content); err != nil {
+		return nil, err
+	}
+	return content, nil
+}
+
+// readPayload reads the body of the request into memory and verifies it against the payload hash that has been signed
+// and against Content-MD5. Streaming uploads in aws-chunked encoding are decoded; their trailers are returned. Bodies
+// that are bigger than maxSize are rejected.
+func readPayload(r *http.Request, auth authentication, maxSize int64) ([]byte, http.Header, error) {
+	var content []byte
+	trailers := http.Header{}
+	var err error
+
+	switch auth.payloadHash {
+	case streamingSignedPayload:
+		content, err = decodeChunked(r.Body, &auth, false, maxSize, trailers)
+	case streamingUnsignedTrailer:
+		content, err = decodeChunked(r.Body, nil, true, maxSize, trailers)
+	case unsignedPayload:
+		content, err = readAll(r.Body, maxSize)
+	default:
+		if len(auth.payloadHash) != sha256.Size*2 {
+			return nil, nil, errNotImplemented.withMessage("The payload signature " + auth.payloadHash + " is not supported.")
+		}
+		if content, err = readAll(r.Body, maxSize); err == nil {
+			digest := sha256.Sum256(content)
+			if hex.EncodeToString(digest[:]) != strings.ToLower(auth.payloadHash) {
+				err = errContentSHA256Mismatch
+			}
+		}
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if decodedLength := r.Header.Get("X-Amz-Decoded-Content-Length"); decodedLength != "" && decodedLength != strconv.Itoa(len(content)) {
+		return nil, nil, errIncompleteBody
+	}
+	if err := verifyContentMD5(r.Header.Get("Content-MD5"), content); err != nil {
+		return nil, nil, err
+	}
+
+	return content, trailers, nil
+}
+
+func readAll(body io.Reader, maxSize int64) ([]byte, error) {
+	content, err := io.ReadAll(io.LimitReader(body, maxSize+1))
+	if err != nil {
+		return nil, errIncompleteBody.withMessage(err.Error())
+	}
+	if int64(len(content)) > maxSize {
+		return nil, errEntityTooLarge
+	}
+	return content, nil
+}
+
+// decodeChunked decodes a body in aws-chunked encoding. Every chunk starts with a line of its hex encoded size,
+// followed by ;chunk-signature=<signature> if the chunks are signed; the chunk ends with \r\n. The last chunk is empty.
+// The signature of every chunk covers the content of the chunk and the signature of the previous chunk, starting with
+// the signature of the request. The trailers that follow the last chunk are added to trailers.
+func decodeChunked(body io.Reader, signed *authentication, hasTrailers bool, maxSize int64, trailers http.Header) ([]byte, error) {
+	reader := bufio.NewReaderSize(body, maxChunkLineLength)
+	var content bytes.Buffer
+	var previousSignature string
+	if signed != nil {
+		previousSignature = signed.signature
+	}
+
+	for {
+		line, err := readChunkLine(reader)
+		if err != nil {
+			return nil, err
+		}
+		rawSize, extension, _ := strings.Cut(line, ";")
+		size, err := strconv.ParseInt(rawSize, 16, 64)
+		if err != nil || size < 0 {
+			return nil, errInvalidRequest.withMessage("Invalid chunk size " + rawSize + ".")
+		}
+		if size > maxSize-int64(content.Len()) {
+			return nil, errEntityTooLarge
+		}
+
+		chunk := make([]byte, size)
+		if _, err := io.ReadFull(reader, chunk); err != nil {
+			return nil, errIncompleteBody
+		}
+
+		if signed != nil {
+			signature := strings.TrimPrefix(extension, "chunk-signature=")
+			chunkDigest := sha256.Sum256(chunk)
+			stringToSign := strings.Join([]string{chunkSignatureAlgorithm, signed.amzDate, signed.scope, previousSignature,
+				emptyPayloadHash, hex.EncodeToString(chunkDigest[:])}, "\n")
+			expected := hex.EncodeToString(hmacSHA256(signed.signingKey, stringToSign))
+			if !hmac.Equal([]byte(expected), []byte(signature)) {
+				return nil, errSignatureDoesNotMatch.withMessage("The signature of a chunk does not match.")
+			}
+			previousSignature = expected
+		}
+
+		if size == 0 {
+			break
+		}
+		content.Write(chunk)
+		if line, err := readChunkLine(reader); err != nil || line != "" {
+			return nil, errIncompleteBody.withMessage("A chunk isn't terminated by CRLF.")
+		}
+	}
+
+	// the last chunk is followed by the trailers and an empty line; signed chunks have no trailers
+	for {
+		line, err := readChunkLine(reader)
+		if errors.Is(err, io.ErrUnexpectedEOF) && !hasTrailers {
+			return content.Bytes(), nil // some clients omit the final empty line
+		}
+		if err != nil {
+			return nil, err
+		}
+		if line == "" {
+			return content.Bytes(), nil
+		}
+		name, value, found := strings.Cut(line, ":")
+		if !found || !hasTrailers {
+			return nil, errInvalidRequest.withMessage("Invalid trailer " + line + ".")
+		}
+		trailers.Add(strings.TrimSpace(name), strings.TrimSpace(value))
+	}
+}
+
+// readChunkLine reads a line that is terminated by CRLF, without the terminator.
+func readChunkLine(reader *bufio.Reader) (string, error) {
+	line, err := reader.ReadSlice('\n')
+	switch {
+	case errors.Is(err, bufio.ErrBufferFull):
+		return "", errInvalidRequest.withMessage("A chunk header or a trailer is too long.")
+	case errors.Is(err, io.EOF):
+		return "", io.ErrUnexpectedEOF
+	case err != nil:
+		return "", errIncompleteBody.withMessage(err.Error())
+	}
+	return strings.TrimSuffix(strings.TrimSuffix(string(line), "\n"), "\r"), nil
+}
+
+// verifyContentMD5 compares the content with the base64 encoded md5 digest of the Content-MD5 header, if it is set.
+func verifyContentMD5(contentMD5 string, content []byte) error {
+	if contentMD5 == "" {
+		return nil
+	}
+	expected, err := base64.StdEncoding.DecodeString(contentMD5)
+	if err != nil || len(expected) != md5.Size {
+		return errInvalidDigest
+	}
+	digest := md5.Sum(content)
+	if !bytes.Equal(digest[:], expected) {
+		return errBadDigest
+	}
+	return nil
+}
+
+// verifyChecksums compares the content with the flexible checksums x-amz-checksum-<algorithm> of the header. Unknown
+// algorithms are rejected, since the client expects that the checksum is verified. The checksums aren't stored.
+func verifyChecksums(header http.Header, content []byte) error {
+	for name, values := range header {
+		algorithm := strings.TrimPrefix(strings.ToLower(name), checksumHeaderPrefix)
+		if algorithm == strings.ToLower(name) || algorithm == "algorithm" || algorithm == "type" || algorithm == "mode" {
+			continue
+		}
+		newHash, ok := checksumAlgorithms[algorithm]
+		if !ok {
+			return errNotImplemented.withMessage("The checksum algorithm " + algorithm + " is not supported.")
+		}
+
+		checksum := newHash()
+		checksum.Write(content)
+		digest := checksum.Sum(nil) // the crc32 hashes are big endian like the checksums of the clients
+		for _, value := range values {
+			expected, err := base64.StdEncoding.DecodeString(value)
+			if err != nil {
+				return errInvalidDigest
+			}
+			if !bytes.Equal(expected, digest) {
+				return errBadDigest
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,339 @@
+package s3gateway
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	signatureAlgorithm = "AWS4-HMAC-SHA256"
+	amzDateFormat      = "20060102T150405Z"
+	scopeDateFormat    = "20060102"
+	scopeService       = "s3"
+	scopeTerminator    = "aws4_request"
+
+	// maxClockSkew is the maximum difference between the time of a signed request and the time of the gateway.
+	maxClockSkew = 15 * time.Minute
+	// maxPresignedExpiry is the maximum validity of a presigned URL.
+	maxPresignedExpiry = 7 * 24 * time.Hour
+
+	// the special values of the x-amz-content-sha256 header
+	unsignedPayload              = "UNSIGNED-PAYLOAD"
+	streamingSignedPayload       = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD"
+	streamingUnsignedTrailer     = "STREAMING-UNSIGNED-PAYLOAD-TRAILER"
+	emptyPayloadHash             = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	contentSHA256Header          = "X-Amz-Content-Sha256"
+	amzDateHeader                = "X-Amz-Date"
+	presignedSignatureQueryParam = "X-Amz-Signature"
+)
+
+// Credential is an access key of the gateway. The requests that are signed with the key are sent to the cluster with
+// the bearer token, so the grants and the quota of the corresponding cluster user apply.
+type Credential struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	BearerToken     string // may be empty if the cluster doesn't require authentication
+}
+
+// authentication is the verified signature of a request. The signing key, the scope and the signature are needed to
+// verify the signatures of the chunks of a streaming upload.
+type authentication struct {
+	credential  Credential
+	payloadHash string // value of the x-amz-content-sha256 header; UNSIGNED-PAYLOAD for presigned URLs
+	amzDate     string
+	scope       string
+	signingKey  []byte
+	signature   string
+}
+
+// verifier authenticates requests that are signed with AWS Signature Version 4, either with the Authorization header
+// or as presigned URL.
+type verifier struct {
+	region      string
+	credentials map[string]Credential // access key id -> credential
+	now         func() time.Time
+}
+
+func newVerifier(region string, credentials []Credential) *verifier {
+	byAccessKeyID := map[string]Credential{}
+	for _, credential := range credentials {
+		byAccessKeyID[credential.AccessKeyID] = credential
+	}
+	return &verifier{region: region, credentials: byAccessKeyID, now: time.Now}
+}
+
+// signatureParameters are the parts of the Authorization header or of the presigned query parameters.
+type signatureParameters struct {
+	accessKeyID   string
+	scopeDate     string
+	scopeRegion   string
+	signedHeaders []string
+	signature     string
+	amzDate       string
+}
+
+// verify checks the signature of the request. Anonymous requests are rejected.
+func (v *verifier) verify(r *http.Request) (authentication, error) {
+	var params signatureParameters
+	var payloadHash string
+	var err error
+
+	query := r.URL.Query()
+	switch {
+	case r.Header.Get("Authorization") != "":
+		if params, err = parseAuthorizationHeader(r.Header.Get("Authorization")); err != nil {
+			return authentication{}, err
+		}
+		params.amzDate = r.Header.Get(amzDateHeader)
+		payloadHash = r.Header.Get(contentSHA256Header)
+		if payloadHash == "" {
+			return authentication{}, errInvalidRequest.withMessage("Missing required header for this request: x-amz-content-sha256")
+		}
+		if err := v.checkRequestTime(params.amzDate, 0); err != nil {
+			return authentication{}, err
+		}
+	case query.Get(presignedSignatureQueryParam) != "":
+		if params, err = parsePresignedQuery(query); err != nil {
+			return authentication{}, err
+		}
+		expires, err := strconv.Atoi(query.Get("X-Amz-Expires"))
+		if err != nil || expires <= 0 || time.Duration(expires)*time.Second > maxPresignedExpiry {
+			return authentication{}, errAuthorizationQueryInvalid.withMessage("X-Amz-Expires must be between 1 and 604800 seconds.")
+		}
+		if err := v.checkRequestTime(params.amzDate, time.Duration(expires)*time.Second); err != nil {
+			return authentication{}, err
+		}
+		payloadHash = unsignedPayload
+	default:
+		return authentication{}, errAccessDenied.withMessage("Anonymous requests are not supported.")
+	}
+
+	credential, ok := v.credentials[params.accessKeyID]
+	if !ok {
+		return authentication{}, errInvalidAccessKeyID
+	}
+	if params.scopeDate != params.amzDate[:len(scopeDateFormat)] || params.scopeRegion != v.region {
+		message := fmt.Sprintf("The credential scope must be <date of the request>/%v/%v/%v.", v.region, scopeService, scopeTerminator)
+		return authentication{}, errAuthorizationMalformed.withMessage(message)
+	}
+	if !containsString(params.signedHeaders, "host") {
+		return authentication{}, errAuthorizationMalformed.withMessage("The host header must be signed.")
+	}
+
+	request, err := canonicalRequest(r, params.signedHeaders, payloadHash)
+	if err != nil {
+		return authentication{}, err
+	}
+	scope := strings.Join([]string{params.scopeDate, params.scopeRegion, scopeService, scopeTerminator}, "/")
+	key := signingKey(credential.SecretAccessKey, params.scopeDate, params.scopeRegion)
+	expected := hex.EncodeToString(hmacSHA256(key, stringToSign(params.amzDate, scope, request)))
+	if !hmac.Equal([]byte(expected), []byte(strings.ToLower(params.signature))) {
+		return authentication{}, errSignatureDoesNotMatch
+	}
+
+	result := authentication{
+		credential:  credential,
+		payloadHash: payloadHash,
+		amzDate:     params.amzDate,
+		scope:       scope,
+		signingKey:  key,
+		signature:   expected,
+	}
+	return result, nil
+}
+
+// checkRequestTime rejects requests whose time differs too much from the current time. Presigned URLs are valid for
+// the duration of expires after the request time.
+func (v *verifier) checkRequestTime(amzDate string, expires time.Duration) error {
+	requestTime, err := time.Parse(amzDateFormat, amzDate)
+	if err != nil {
+		return errAccessDenied.withMessage("The request must contain a valid X-Amz-Date in the format " + amzDateFormat + ".")
+	}
+
+	now := v.now()
+	if requestTime.After(now.Add(maxClockSkew)) {
+		return errRequestTimeTooSkewed
+	}
+	if expires > 0 {
+		if now.After(requestTime.Add(expires)) {
+			return errAccessDenied.withMessage("Request has expired")
+		}
+		return nil
+	}
+	if requestTime.Before(now.Add(-maxClockSkew)) {
+		return errRequestTimeTooSkewed
+	}
+	return nil
+}
+
+// parseAuthorizationHeader parses a header like
+// AWS4-HMAC-SHA256 Credential=<key id>/<date>/<region>/s3/aws4_request, SignedHeaders=host;x-amz-date, Signature=<hex>
+func parseAuthorizationHeader(header string) (signatureParameters, error) {
+	rawParams := strings.TrimPrefix(header, signatureAlgorithm+" ")
+	if rawParams == header {
+		return signatureParameters{}, errAuthorizationMalformed.withMessage("Only the algorithm " + signatureAlgorithm + " is supported.")
+	}
+
+	values := map[string]string{}
+	for _, param := range strings.Split(rawParams, ",") {
+		name, value, found := strings.Cut(strings.TrimSpace(param), "=")
+		if !found {
+			return signatureParameters{}, errAuthorizationMalformed
+		}
+		values[name] = value
+	}
+	if values["SignedHeaders"] == "" || values["Signature"] == "" {
+		return signatureParameters{}, errAuthorizationMalformed
+	}
+
+	params, err := parseCredential(values["Credential"])
+	if err != nil {
+		return signatureParameters{}, errAuthorizationMalformed.withMessage(err.Error())
+	}
+	params.signedHeaders = strings.Split(values["SignedHeaders"], ";")
+	params.signature = values["Signature"]
+	return params, nil
+}
+
+// parsePresignedQuery parses the X-Amz-* query parameters of a presigned URL.
+func parsePresignedQuery(query url.Values) (signatureParameters, error) {
+	if query.Get("X-Amz-Algorithm") != signatureAlgorithm {
+		return signatureParameters{}, errAuthorizationQueryInvalid.withMessage("X-Amz-Algorithm must be " + signatureAlgorithm + ".")
+	}
+	if query.Get("X-Amz-SignedHeaders") == "" {
+		return signatureParameters{}, errAuthorizationQueryInvalid.withMessage("X-Amz-SignedHeaders is missing.")
+	}
+
+	params, err := parseCredential(query.Get("X-Amz-Credential"))
+	if err != nil {
+		return signatureParameters{}, errAuthorizationQueryInvalid.withMessage(err.Error())
+	}
+	params.signedHeaders = strings.Split(query.Get("X-Amz-SignedHeaders"), ";")
+	params.signature = query.Get(presignedSignatureQueryParam)
+	params.amzDate = query.Get(amzDateHeader)
+	return params, nil
+}
+
+// parseCredential parses <key id>/<date>/<region>/s3/aws4_request.
+func parseCredential(credential string) (signatureParameters, error) {
+	parts := strings.Split(credential, "/")
+	if len(parts) != 5 || parts[3] != scopeService || parts[4] != scopeTerminator {
+		return signatureParameters{}, fmt.Errorf("the credential must have the format <access key id>/<date>/<region>/%v/%v", scopeService, scopeTerminator)
+	}
+	if _, err := time.Parse(scopeDateFormat, parts[1]); err != nil {
+		return signatureParameters{}, fmt.Errorf("the date of the credential must have the format %v", scopeDateFormat)
+	}
+	return signatureParameters{accessKeyID: parts[0], scopeDate: parts[1], scopeRegion: parts[2]}, nil
+}
+
+// canonicalRequest builds the canonical request of Signature Version 4. The signature of a presigned URL isn't part of
+// the canonical query.
+func canonicalRequest(r *http.Request, signedHeaders []string, payloadHash string) (string, error) {
+	path := r.URL.Path
+	if path == "" {
+		path = "/"
+	}
+
+	var headers strings.Builder
+	for _, name := range signedHeaders {
+		var values []string
+		switch name {
+		case "host":
+			values = []string{r.Host}
+		case "content-length":
+			values = []string{strconv.FormatInt(r.ContentLength, 10)}
+		default:
+			values = r.Header.Values(name)
+		}
+		if len(values) == 0 {
+			return "", errAuthorizationMalformed.withMessage(fmt.Sprintf("The signed header %v is missing.", name))
+		}
+		for i, value := range values {
+			values[i] = strings.Join(strings.Fields(value), " ")
+		}
+		headers.WriteString(name + ":" + strings.Join(values, ",") + "\n")
+	}
+
+	request := strings.Join([]string{
+		r.Method,
+		uriEncode(path, false),
+		canonicalQuery(r.URL.RawQuery),
+		headers.String(),
+		strings.Join(signedHeaders, ";"),
+		payloadHash,
+	}, "\n")
+	return request, nil
+}
+
+// canonicalQuery sorts the query parameters and encodes them with uriEncode.
+func canonicalQuery(rawQuery string) string {
+	var params []string
+	for _, param := range strings.Split(rawQuery, "&") {
+		if param == "" {
+			continue
+		}
+		name, value, _ := strings.Cut(param, "=")
+		// a plus is a literal plus sign; the clients encode spaces as %20
+		name, nameErr := url.PathUnescape(name)
+		value, valueErr := url.PathUnescape(value)
+		if nameErr != nil || valueErr != nil || name == presignedSignatureQueryParam {
+			continue
+		}
+		params = append(params, uriEncode(name, true)+"="+uriEncode(value, true))
+	}
+	sort.Strings(params)
+	return strings.Join(params, "&")
+}
+
+// uriEncode encodes every byte except the unreserved characters as %XY with upper case hex digits. The slash is kept
+// in paths.
+func uriEncode(value string, encodeSlash bool) string {
+	var encoded strings.Builder
+	for i := 0; i < len(value); i++ {
+		b := value[i]
+		switch {
+		case 'A' <= b && b <= 'Z', 'a' <= b && b <= 'z', '0' <= b && b <= '9', b == '-', b == '.', b == '_', b == '~':
+			encoded.WriteByte(b)
+		case b == '/' && !encodeSlash:
+			encoded.WriteByte(b)
+		default:
+			encoded.WriteString(fmt.Sprintf("%%%02X", b))
+		}
+	}
+	return encoded.String()
+}
+
+func stringToSign(amzDate string, scope string, canonicalRequest string) string {
+	digest := sha256.Sum256([]byte(canonicalRequest))
+	return strings.Join([]string{signatureAlgorithm, amzDate, scope, hex.EncodeToString(digest[:])}, "\n")
+}
+
+func signingKey(secretAccessKey string, date string, region string) []byte {
+	key := hmacSHA256([]byte("AWS4"+secretAccessKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, scopeService)
+	return hmacSHA256(key, scopeTerminator)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func containsString(values []string, value string) bool {
+	for _, candidate := range values {
+		if candidate == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,62 @@
+package server
+
+import (
+	"crypto/tls"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/rstdm/mini-ceph/internal/s3gateway"
+	"github.com/rstdm/mini-ceph/internal/server/middleware"
+	"github.com/rstdm/mini-ceph/internal/tlsconfig"
+	"go.uber.org/zap"
+	"net/http"
+)
+
+// NewGateway creates the server of the S3 gateway. It is launched and stopped like the server of a node.
+func NewGateway(config s3gateway.Configuration, sugar *zap.SugaredLogger) (*Server, error) {
+	gin.SetMode(gin.ReleaseMode)
+
+	router := gin.New()
+	if err := router.SetTrustedProxies(nil); err != nil {
+		return nil, fmt.Errorf("set trusted proxies to nil: %w", err)
+	}
+	if config.UseProductionLogger {
+		router.Use(middleware.ProductionLogger(sugar), middleware.ProductionRecovery(sugar))
+	} else {
+		router.Use(gin.Logger(), gin.Recovery())
+	}
+
+	var tlsReloader *tlsconfig.Reloader
+	var clusterTLSConfig *tls.Config
+	if config.TLSCertFile != "" || config.TLSCAFile != "" {
+		var err error
+		tlsReloader, err = tlsconfig.NewReloader(config.TLSCertFile, config.TLSKeyFile, config.TLSCAFile, sugar)
+		if err != nil {
+			err = fmt.Errorf("load certificates: %w", err)
+			return nil, err
+		}
+		tlsReloader.Watch(certificateReloadInterval)
+		clusterTLSConfig = tlsReloader.ClientConfig()
+	}
+
+	gateway, err := s3gateway.New(config, clusterTLSConfig, sugar)
+	if err != nil {
+		err = fmt.Errorf("create gateway: %w", err)
+		return nil, err
+	}
+	gateway.RegisterHandler(router)
+
+	httpServer := &http.Server{
+		Addr:    fmt.Sprintf(":%v", config.Port),
+		Handler: router,
+	}
+	if config.TLSCertFile != "" {
+		httpServer.TLSConfig = tlsReloader.ServerConfig(false)
+	}
+	server := &Server{
+		router: router,
+		server: httpServer,
+		sugar:  sugar,
+	}
+
+	return server, nil
+}
@@ -0,0 +1,32 @@
+package middleware
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/rstdm/mini-ceph/internal/metrics"
+	"strconv"
+	"time"
+)
+
+// Metrics counts the requests and records their latency per route, method and status. The route is the registered
+// path, e.g. /object/:objectHash, so the number of label combinations doesn't grow with the number of objects.
+func Metrics(registry *metrics.Registry) gin.HandlerFunc {
+	requests := registry.NewCounterVec("miniceph_http_requests_total", "Number of handled HTTP requests.",
+		"route", "method", "status")
+	latency := registry.NewHistogramVec("miniceph_http_request_duration_seconds", "Latency of the HTTP requests.",
+		metrics.DefaultBuckets, "route", "method", "status")
+
+	return func(c *gin.Context) {
+		start := time.Now()
+
+		c.Next()
+
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+		status := strconv.Itoa(c.Writer.Status())
+
+		requests.Inc(route, c.Request.Method, status)
+		latency.Observe(time.Since(start).Seconds(), route, c.Request.Method, status)
+	}
+}
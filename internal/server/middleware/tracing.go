@@ -0,0 +1,32 @@
+package middleware
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/rstdm/mini-ceph/internal/tracing"
+	"strconv"
+)
+
+// Tracing starts a span for every request. The span continues the trace of the traceparent header, e.g. of the primary
+// that replicates an object. The handlers start their spans with the context of the request.
+func Tracing(tracer *tracing.Tracer) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+
+		ctx, span := tracer.StartRoot(c.Request.Context(), c.Request.Method+" "+route, c.GetHeader(tracing.TraceParentHeader))
+		span.SetAttribute("http.method", c.Request.Method)
+		span.SetAttribute("http.route", route)
+		span.SetAttribute("http.target", c.Request.URL.RequestURI())
+		c.Request = c.Request.WithContext(ctx)
+
+		c.Next()
+
+		span.SetAttribute("http.status_code", strconv.Itoa(c.Writer.Status()))
+		if len(c.Errors) > 0 {
+			span.SetError(c.Errors.Last())
+		}
+		span.End()
+	}
+}
@@ -2,11 +2,16 @@ package server
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
 	"github.com/gin-gonic/gin"
 	"github.com/rstdm/mini-ceph/internal/api"
 	"github.com/rstdm/mini-ceph/internal/configuration"
+	"github.com/rstdm/mini-ceph/internal/metrics"
 	"github.com/rstdm/mini-ceph/internal/server/middleware"
+	"github.com/rstdm/mini-ceph/internal/tlsconfig"
+	"github.com/rstdm/mini-ceph/internal/tracing"
+	"github.com/rstdm/mini-ceph/internal/version"
 	"go.uber.org/zap"
 	"net/http"
 	"os"
@@ -15,9 +20,15 @@ import (
 	"time"
 )
 
+const metricsRoute = "/metrics"
+
+// certificateReloadInterval is the interval in which the certificate files are checked for modifications.
+const certificateReloadInterval = 10 * time.Second
+
 type Server struct {
 	router *gin.Engine
 	server *http.Server
+	tracer *tracing.Tracer // nil if tracing is disabled
 	sugar  *zap.SugaredLogger
 }
 
@@ -29,7 +40,7 @@ func (s *Server) Launch() {
 	}()
 
 	// Wait for interrupt signal to gracefully shutdown the server
-	quit := make(chan os.Signal)
+	quit := make(chan os.Signal, 1)
 	// kill (no param) default send syscall.SIGTERM
 	// kill -2 is syscall.SIGINT
 	// kill -9 is syscall.SIGKILL but can't be catch, so don't need add it
@@ -40,8 +51,13 @@ func (s *Server) Launch() {
 }
 
 func (s *Server) start() error {
-	s.sugar.Infow("Starting server", "address", s.server.Addr)
-	err := s.server.ListenAndServe()
+	s.sugar.Infow("Starting server", "address", s.server.Addr, "tls", s.server.TLSConfig != nil, "version", version.Get())
+	var err error
+	if s.server.TLSConfig != nil {
+		err = s.server.ListenAndServeTLS("", "") // the certificates are provided by the TLS config
+	} else {
+		err = s.server.ListenAndServe()
+	}
 	if err == http.ErrServerClosed {
 		return nil
 	}
@@ -55,6 +71,14 @@ func (s *Server) StopGraceful() {
 	if err := s.server.Shutdown(ctx); err != nil {
 		s.sugar.Fatalw("Server forced to shutdown:", "error", err)
 	}
+	if s.tracer != nil {
+		if err := s.tracer.Close(); err != nil {
+			s.sugar.Warnw("Failed to close the trace output", "err", err)
+		}
+		if dropped := s.tracer.Dropped(); dropped > 0 {
+			s.sugar.Warnw("Spans have been dropped because the trace output couldn't keep up", "droppedSpans", dropped)
+		}
+	}
 }
 
 func New(flagValues configuration.Configuration, sugar *zap.SugaredLogger) (*Server, error) {
@@ -71,24 +95,65 @@ func New(flagValues configuration.Configuration, sugar *zap.SugaredLogger) (*Ser
 	} else {
 		middlewares = []gin.HandlerFunc{gin.Logger(), gin.Recovery()}
 	}
+	registry := metrics.NewRegistry()
+	middlewares = append(middlewares, middleware.Metrics(registry))
+	var tracer *tracing.Tracer
+	if flagValues.TraceOutput != "" {
+		var err error
+		tracer, err = tracing.NewTracer(flagValues.TraceOutput, fmt.Sprintf("node-%v", flagValues.NodeID))
+		if err != nil {
+			err = fmt.Errorf("create tracer: %w", err)
+			return nil, err
+		}
+		middlewares = append(middlewares, middleware.Tracing(tracer))
+	}
 	router.Use(middlewares...)
 
-	a, err := api.NewAPI(flagValues, sugar)
+	var tlsReloader *tlsconfig.Reloader
+	var clusterTLSConfig *tls.Config
+	if flagValues.TLSCertFile != "" || flagValues.TLSCAFile != "" {
+		var err error
+		tlsReloader, err = tlsconfig.NewReloader(flagValues.TLSCertFile, flagValues.TLSKeyFile, flagValues.TLSCAFile, sugar)
+		if err != nil {
+			err = fmt.Errorf("load certificates: %w", err)
+			return nil, err
+		}
+		tlsReloader.Watch(certificateReloadInterval)
+		clusterTLSConfig = tlsReloader.ClientConfig()
+	}
+
+	a, err := api.NewAPI(flagValues, clusterTLSConfig, registry, sugar)
 	if err != nil {
 		err = fmt.Errorf("create api: %w", err)
 		return nil, err
 	}
 	a.RegisterHandler(router)
+	router.GET(metricsRoute, metricsHandler(registry))
 
 	httpServer := &http.Server{
 		Addr:    fmt.Sprintf(":%v", flagValues.Port),
 		Handler: router,
 	}
+	if flagValues.TLSCertFile != "" {
+		httpServer.TLSConfig = tlsReloader.ServerConfig(flagValues.ClusterMTLS)
+	}
 	server := &Server{
 		router: router,
 		server: httpServer,
+		tracer: tracer,
 		sugar:  sugar,
 	}
 
 	return server, nil
 }
+
+// metricsHandler serves the metrics in the Prometheus text format.
+func metricsHandler(registry *metrics.Registry) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Header("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		c.Status(http.StatusOK)
+		if err := registry.Write(c.Writer); err != nil {
+			_ = c.Error(fmt.Errorf("write metrics: %w", err))
+		}
+	}
+}
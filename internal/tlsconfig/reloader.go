@@ -0,0 +1,222 @@
+// Package tlsconfig provides the TLS configuration of the listener and of the connections to the other nodes. The
+// certificates are reloaded when the files change on disk, so they can be renewed without restarting the node.
+package tlsconfig
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"go.uber.org/zap"
+	"os"
+	"sync"
+	"time"
+)
+
+// Reloader provides the certificate of the node and the CA bundle that verifies the other nodes. The files are checked
+// periodically; new connections use the certificates that have been loaded last.
+type Reloader struct {
+	certFile string
+	keyFile  string
+	caFile   string
+	sugar    *zap.SugaredLogger
+
+	mu          sync.RWMutex
+	certificate *tls.Certificate // nil if no certificate has been specified
+	caPool      *x509.CertPool   // nil if no CA bundle has been specified; the system roots are used instead
+	modTimes    []time.Time      // modification times of the loaded files
+}
+
+// NewReloader loads the certificate and the key of the node and the CA bundle. The certificate and the CA bundle are
+// optional, but the key has to be specified together with the certificate.
+func NewReloader(certFile string, keyFile string, caFile string, sugar *zap.SugaredLogger) (*Reloader, error) {
+	if (certFile == "") != (keyFile == "") {
+		return nil, errors.New("the certificate and the key have to be specified together")
+	}
+
+	r := &Reloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+		caFile:   caFile,
+		sugar:    sugar,
+	}
+
+	modTimes, err := r.getModTimes()
+	if err != nil {
+		return nil, err
+	}
+	if err := r.load(modTimes); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+func (r *Reloader) files() []string {
+	var files []string
+	for _, file := range []string{r.certFile, r.keyFile, r.caFile} {
+		if file != "" {
+			files = append(files, file)
+		}
+	}
+	return files
+}
+
+func (r *Reloader) getModTimes() ([]time.Time, error) {
+	var modTimes []time.Time
+	for _, file := range r.files() {
+		info, err := os.Stat(file)
+		if err != nil {
+			return nil, fmt.Errorf("stat %v: %w", file, err)
+		}
+		modTimes = append(modTimes, info.ModTime())
+	}
+	return modTimes, nil
+}
+
+func (r *Reloader) load(modTimes []time.Time) error {
+	var certificate *tls.Certificate
+	if r.certFile != "" {
+		loaded, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+		if err != nil {
+			return fmt.Errorf("load certificate %v: %w", r.certFile, err)
+		}
+		certificate = &loaded
+	}
+
+	var caPool *x509.CertPool
+	if r.caFile != "" {
+		bundle, err := os.ReadFile(r.caFile)
+		if err != nil {
+			return fmt.Errorf("read CA bundle: %w", err)
+		}
+		caPool = x509.NewCertPool()
+		if !caPool.AppendCertsFromPEM(bundle) {
+			return fmt.Errorf("CA bundle %v doesn't contain a PEM encoded certificate", r.caFile)
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.certificate = certificate
+	r.caPool = caPool
+	r.modTimes = modTimes
+
+	return nil
+}
+
+// Watch starts reloading the files whenever one of them has been modified. The files are checked every interval.
+func (r *Reloader) Watch(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			r.reloadIfModified()
+		}
+	}()
+}
+
+func (r *Reloader) reloadIfModified() {
+	modTimes, err := r.getModTimes()
+	if err != nil {
+		r.sugar.Warnw("Failed to check the certificates for modifications", "err", err)
+		return
+	}
+
+	r.mu.RLock()
+	modified := false
+	for i := range modTimes {
+		modified = modified || !modTimes[i].Equal(r.modTimes[i])
+	}
+	r.mu.RUnlock()
+	if !modified {
+		return
+	}
+
+	// the files might be written one after another; the old certificates are kept until all files match again
+	if err := r.load(modTimes); err != nil {
+		r.sugar.Warnw("Failed to reload the certificates. The old certificates are used until the next attempt.", "err", err)
+		return
+	}
+	r.sugar.Infow("Reloaded the certificates", "certFile", r.certFile, "caFile", r.caFile)
+}
+
+func (r *Reloader) getCertificate() *tls.Certificate {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.certificate
+}
+
+func (r *Reloader) getCAPool() *x509.CertPool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.caPool
+}
+
+// ServerConfig returns the configuration of the listener. If requestClientCertificates is true, clients are asked for
+// a certificate that is verified with the CA bundle. The certificate is optional on the TLS level because users don't
+// have one; the routes that require it check tls.ConnectionState.VerifiedChains.
+func (r *Reloader) ServerConfig(requestClientCertificates bool) *tls.Config {
+	config := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			certificate := r.getCertificate()
+			if certificate == nil {
+				return nil, errors.New("no certificate has been configured")
+			}
+			return certificate, nil
+		},
+	}
+
+	if requestClientCertificates {
+		config.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			connectionConfig := config.Clone()
+			connectionConfig.GetConfigForClient = nil
+			connectionConfig.ClientAuth = tls.VerifyClientCertIfGiven
+			connectionConfig.ClientCAs = r.getCAPool()
+			return connectionConfig, nil
+		}
+	}
+
+	return config
+}
+
+// ClientConfig returns the configuration of the connections to the other nodes. The certificate of the node is
+// presented if the other node asks for it. The other nodes are verified with the CA bundle, or with the system roots
+// if no bundle has been specified.
+func (r *Reloader) ClientConfig() *tls.Config {
+	config := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			if certificate := r.getCertificate(); certificate != nil {
+				return certificate, nil
+			}
+			return &tls.Certificate{}, nil // no certificate is sent
+		},
+	}
+
+	if r.caFile != "" {
+		// tls.Config.RootCAs can't be changed after the config has been created. The default verification is replaced
+		// by VerifyConnection, which uses the current CA bundle.
+		config.InsecureSkipVerify = true
+		config.VerifyConnection = func(state tls.ConnectionState) error {
+			if len(state.PeerCertificates) == 0 {
+				return errors.New("the server didn't present a certificate")
+			}
+
+			intermediates := x509.NewCertPool()
+			for _, certificate := range state.PeerCertificates[1:] {
+				intermediates.AddCert(certificate)
+			}
+			_, err := state.PeerCertificates[0].Verify(x509.VerifyOptions{
+				DNSName:       state.ServerName,
+				Roots:         r.getCAPool(),
+				Intermediates: intermediates,
+			})
+			return err
+		}
+	}
+
+	return config
+}
@@ -0,0 +1,172 @@
+package tlsconfig
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"go.uber.org/zap"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type testCA struct {
+	certificate *x509.Certificate
+	key         *ecdsa.PrivateKey
+	pem         []byte
+}
+
+func newTestCA(t *testing.T) testCA {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate CA key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("create CA certificate: %v", err)
+	}
+	certificate, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("parse CA certificate: %v", err)
+	}
+
+	return testCA{certificate, key, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue writes a certificate for 127.0.0.1 that can be used by servers and clients.
+func (ca testCA) issue(t *testing.T, serial int64, certFile string, keyFile string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "node"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.certificate, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatalf("create certificate: %v", err)
+	}
+	encodedKey, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("encode key: %v", err)
+	}
+
+	writeFile(t, certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+	writeFile(t, keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: encodedKey}))
+}
+
+// writeFile writes the file and moves its modification time forward; the reloader would miss changes within the
+// resolution of the file system otherwise.
+func writeFile(t *testing.T, name string, content []byte) {
+	t.Helper()
+
+	modTime := time.Now()
+	if info, err := os.Stat(name); err == nil {
+		modTime = info.ModTime().Add(time.Second)
+	}
+	if err := os.WriteFile(name, content, 0600); err != nil {
+		t.Fatalf("write %v: %v", name, err)
+	}
+	if err := os.Chtimes(name, modTime, modTime); err != nil {
+		t.Fatalf("set modification time of %v: %v", name, err)
+	}
+}
+
+func TestMutualTLSAndReload(t *testing.T) {
+	folder := t.TempDir()
+	certFile, keyFile, caFile := filepath.Join(folder, "node.crt"), filepath.Join(folder, "node.key"), filepath.Join(folder, "ca.crt")
+	ca := newTestCA(t)
+	writeFile(t, caFile, ca.pem)
+	ca.issue(t, 2, certFile, keyFile)
+
+	reloader, err := NewReloader(certFile, keyFile, caFile, zap.NewNop().Sugar())
+	if err != nil {
+		t.Fatalf("create reloader: %v", err)
+	}
+
+	var verifiedClients atomic.Int64
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.TLS.VerifiedChains) > 0 {
+			verifiedClients.Add(1)
+		}
+	}))
+	server.TLS = reloader.ServerConfig(true)
+	server.StartTLS()
+	defer server.Close()
+
+	// every request uses a new connection, so the current certificates are used
+	request := func(clientConfig *tls.Config) (*http.Response, error) {
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: clientConfig, DisableKeepAlives: true}}
+		return client.Get(server.URL)
+	}
+
+	response, err := request(reloader.ClientConfig())
+	if err != nil {
+		t.Fatalf("request with client certificate: %v", err)
+	}
+	if serial := response.TLS.PeerCertificates[0].SerialNumber.Int64(); serial != 2 || verifiedClients.Load() != 1 {
+		t.Errorf("serial = %v, verified clients = %v", serial, verifiedClients.Load())
+	}
+
+	// users don't have a client certificate, but they trust the CA
+	userConfig := &tls.Config{RootCAs: x509.NewCertPool()}
+	userConfig.RootCAs.AddCert(ca.certificate)
+	if _, err := request(userConfig); err != nil || verifiedClients.Load() != 1 {
+		t.Errorf("request without client certificate: %v, verified clients = %v", err, verifiedClients.Load())
+	}
+
+	// the renewed certificate is used without restarting
+	ca.issue(t, 3, certFile, keyFile)
+	reloader.reloadIfModified()
+	response, err = request(reloader.ClientConfig())
+	if err != nil {
+		t.Fatalf("request after reload: %v", err)
+	}
+	if serial := response.TLS.PeerCertificates[0].SerialNumber.Int64(); serial != 3 {
+		t.Errorf("serial after reload = %v", serial)
+	}
+
+	// invalid files are ignored; the old certificates are kept
+	writeFile(t, keyFile, []byte("not a key"))
+	reloader.reloadIfModified()
+	response, err = request(reloader.ClientConfig())
+	if err != nil || response.TLS.PeerCertificates[0].SerialNumber.Int64() != 3 {
+		t.Errorf("request after failed reload: %v", err)
+	}
+
+	// a rotated CA doesn't trust the certificates of the old CA anymore
+	writeFile(t, caFile, newTestCA(t).pem)
+	ca.issue(t, 4, certFile, keyFile)
+	reloader.reloadIfModified()
+	if _, err := request(reloader.ClientConfig()); err == nil {
+		t.Errorf("certificate of the old CA has been accepted")
+	}
+}
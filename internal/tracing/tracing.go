@@ -0,0 +1,259 @@
+// Package tracing records spans of requests in the style of OpenTelemetry. The trace context is propagated between
+// the nodes with the W3C traceparent header, so the spans of the primary and of the replicas belong to the same
+// trace. Finished spans are written as json lines to a file or to stdout by a background goroutine, so requests never
+// wait for the output.
+package tracing
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// TraceParentHeader contains the trace context, e.g. 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01.
+const TraceParentHeader = "traceparent"
+
+// StdoutOutput writes the spans to stdout instead of a file.
+const StdoutOutput = "stdout"
+
+// spanBufferSize is the number of finished spans that wait for the export. Further spans are dropped until the
+// exporter has caught up.
+const spanBufferSize = 4096
+
+type spanKey struct{}
+
+// Tracer exports the finished spans. It is only used to start the root spans of the node; the other spans are started
+// with the span of the context as parent.
+type Tracer struct {
+	service string
+	output  io.WriteCloser
+	dropped atomic.Int64 // spans that have been dropped because the buffer was full
+
+	mu       sync.RWMutex // protects closed; spans must not be sent after the buffer has been closed
+	closed   bool
+	spans    chan []byte // encoded spans
+	exported chan struct{}
+}
+
+// NewTracer creates a tracer that writes the spans to stdout or appends them to the file. The file is only readable by
+// the owner; the spans contain object hashes and peers.
+func NewTracer(output string, service string) (*Tracer, error) {
+	var writer io.WriteCloser = os.Stdout
+	if output != StdoutOutput {
+		file, err := os.OpenFile(output, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+		if err != nil {
+			return nil, fmt.Errorf("open trace file: %w", err)
+		}
+		writer = file
+	}
+
+	return newTracer(writer, service), nil
+}
+
+func newTracer(output io.WriteCloser, service string) *Tracer {
+	t := &Tracer{
+		service:  service,
+		output:   output,
+		spans:    make(chan []byte, spanBufferSize),
+		exported: make(chan struct{}),
+	}
+	go t.export()
+	return t
+}
+
+// export writes the spans until the buffer is closed. The output is flushed whenever no further span is waiting.
+func (t *Tracer) export() {
+	defer close(t.exported)
+
+	writer := bufio.NewWriter(t.output)
+	for encodedSpan := range t.spans {
+		_, _ = writer.Write(encodedSpan)
+		if len(t.spans) == 0 {
+			_ = writer.Flush()
+		}
+	}
+	_ = writer.Flush()
+}
+
+// Span is a timed operation of a trace. Spans that have been started without tracer do nothing, so the code doesn't
+// have to check whether tracing is enabled.
+type Span struct {
+	tracer *Tracer
+	record spanRecord
+	mu     sync.Mutex // attributes may be set by multiple goroutines
+}
+
+type spanRecord struct {
+	TraceID      string            `json:"traceId"`
+	SpanID       string            `json:"spanId"`
+	ParentSpanID string            `json:"parentSpanId,omitempty"`
+	Name         string            `json:"name"`
+	Service      string            `json:"service"`
+	Start        time.Time         `json:"startTime"`
+	End          time.Time         `json:"endTime"`
+	DurationMs   float64           `json:"durationMs"`
+	Attributes   map[string]string `json:"attributes,omitempty"`
+	Error        string            `json:"error,omitempty"`
+}
+
+// StartRoot starts the span of an incoming request. The span continues the trace of the traceparent header; a new
+// trace is started if the header is empty or invalid.
+func (t *Tracer) StartRoot(ctx context.Context, name string, traceParent string) (context.Context, *Span) {
+	traceID, parentSpanID, ok := parseTraceParent(traceParent)
+	if !ok {
+		traceID = randomID(16)
+		parentSpanID = ""
+	}
+
+	return t.start(ctx, name, traceID, parentSpanID)
+}
+
+func (t *Tracer) start(ctx context.Context, name string, traceID string, parentSpanID string) (context.Context, *Span) {
+	span := &Span{
+		tracer: t,
+		record: spanRecord{
+			TraceID:      traceID,
+			SpanID:       randomID(8),
+			ParentSpanID: parentSpanID,
+			Name:         name,
+			Service:      t.service,
+			Start:        time.Now(),
+		},
+	}
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+// Start starts a child of the span of the context. The attributes are pairs of keys and values. The span does nothing
+// if the context doesn't contain a span.
+func Start(ctx context.Context, name string, attributes ...string) (context.Context, *Span) {
+	parent, ok := ctx.Value(spanKey{}).(*Span)
+	if !ok || parent.tracer == nil {
+		return ctx, &Span{}
+	}
+
+	ctx, span := parent.tracer.start(ctx, name, parent.record.TraceID, parent.record.SpanID)
+	for i := 0; i+1 < len(attributes); i += 2 {
+		span.SetAttribute(attributes[i], attributes[i+1])
+	}
+	return ctx, span
+}
+
+// TraceParent returns the traceparent header that continues the trace of the context with the span of the context
+// as parent. It is empty if the context doesn't contain a span.
+func TraceParent(ctx context.Context) string {
+	span, ok := ctx.Value(spanKey{}).(*Span)
+	if !ok || span.tracer == nil {
+		return ""
+	}
+	return fmt.Sprintf("00-%v-%v-01", span.record.TraceID, span.record.SpanID)
+}
+
+func (s *Span) SetAttribute(key string, value string) {
+	if s.tracer == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.record.Attributes == nil {
+		s.record.Attributes = map[string]string{}
+	}
+	s.record.Attributes[key] = value
+}
+
+// SetError marks the span as failed. Nil errors are ignored.
+func (s *Span) SetError(err error) {
+	if s.tracer == nil || err == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.record.Error = err.Error()
+}
+
+// End finishes the span and hands it to the exporter. The span is dropped if the exporter can't keep up.
+func (s *Span) End() {
+	if s.tracer == nil {
+		return
+	}
+
+	s.mu.Lock()
+	s.record.End = time.Now()
+	s.record.DurationMs = float64(s.record.End.Sub(s.record.Start).Microseconds()) / 1000
+	encodedSpan, err := json.Marshal(s.record)
+	s.mu.Unlock()
+	if err != nil {
+		return // the record only contains strings and times
+	}
+
+	s.tracer.mu.RLock()
+	defer s.tracer.mu.RUnlock()
+	if s.tracer.closed {
+		return
+	}
+	select {
+	case s.tracer.spans <- append(encodedSpan, '\n'):
+	default:
+		s.tracer.dropped.Add(1)
+	}
+}
+
+// Close writes the remaining spans and closes the trace file. Spans that end afterwards are dropped.
+func (t *Tracer) Close() error {
+	t.mu.Lock()
+	if !t.closed {
+		t.closed = true
+		close(t.spans)
+	}
+	t.mu.Unlock()
+	<-t.exported
+
+	if t.output == os.Stdout {
+		return nil
+	}
+	return t.output.Close()
+}
+
+// Dropped returns the number of spans that have been dropped because the exporter couldn't keep up.
+func (t *Tracer) Dropped() int64 {
+	return t.dropped.Load()
+}
+
+// parseTraceParent parses a traceparent header of version 00.
+func parseTraceParent(traceParent string) (traceID string, parentSpanID string, ok bool) {
+	parts := strings.Split(traceParent, "-")
+	if len(parts) != 4 || parts[0] != "00" || !isHexID(parts[1], 16) || !isHexID(parts[2], 8) {
+		return "", "", false
+	}
+	return parts[1], parts[2], true
+}
+
+// isHexID returns true if the id is the lower case hex encoding of numBytes bytes that aren't all zero.
+func isHexID(id string, numBytes int) bool {
+	decoded, err := hex.DecodeString(id)
+	if err != nil || len(decoded) != numBytes || id != strings.ToLower(id) {
+		return false
+	}
+	for _, b := range decoded {
+		if b != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func randomID(numBytes int) string {
+	id := make([]byte, numBytes)
+	_, _ = rand.Read(id) // crypto/rand doesn't fail on supported platforms
+	return hex.EncodeToString(id)
+}
@@ -0,0 +1,130 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+type bufferCloser struct {
+	bytes.Buffer
+}
+
+func (b *bufferCloser) Close() error {
+	return nil
+}
+
+func readSpans(t *testing.T, output *bufferCloser) []spanRecord {
+	var spans []spanRecord
+	for _, line := range strings.Split(strings.TrimSpace(output.String()), "\n") {
+		var span spanRecord
+		if err := json.Unmarshal([]byte(line), &span); err != nil {
+			t.Fatalf("unmarshal span %q: %v", line, err)
+		}
+		spans = append(spans, span)
+	}
+	return spans
+}
+
+func TestPropagation(t *testing.T) {
+	output := &bufferCloser{}
+	tracer := newTracer(output, "node-0")
+
+	const incoming = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	ctx, root := tracer.StartRoot(context.Background(), "PUT /object/:objectHash", incoming)
+	childCtx, child := Start(ctx, "replication.replicate", "peer", "node-1")
+	traceParent := TraceParent(childCtx)
+	child.SetError(errors.New("connection refused"))
+	child.End()
+	root.End()
+	if err := tracer.Close(); err != nil {
+		t.Fatalf("close tracer: %v", err)
+	}
+
+	spans := readSpans(t, output)
+	if len(spans) != 2 {
+		t.Fatalf("got %v spans, want 2", len(spans))
+	}
+	childRecord, rootRecord := spans[0], spans[1]
+	if rootRecord.TraceID != "4bf92f3577b34da6a3ce929d0e0e4736" || rootRecord.ParentSpanID != "00f067aa0ba902b7" {
+		t.Errorf("root span doesn't continue the incoming trace: %+v", rootRecord)
+	}
+	if childRecord.TraceID != rootRecord.TraceID || childRecord.ParentSpanID != rootRecord.SpanID {
+		t.Errorf("child span isn't a child of the root span: %+v", childRecord)
+	}
+	if childRecord.Attributes["peer"] != "node-1" || childRecord.Error != "connection refused" {
+		t.Errorf("unexpected child span: %+v", childRecord)
+	}
+	if want := "00-" + childRecord.TraceID + "-" + childRecord.SpanID + "-01"; traceParent != want {
+		t.Errorf("traceparent = %v, want %v", traceParent, want)
+	}
+}
+
+func TestInvalidTraceParentStartsNewTrace(t *testing.T) {
+	for _, traceParent := range []string{
+		"",
+		"01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa-01",
+	} {
+		output := &bufferCloser{}
+		tracer := newTracer(output, "node-0")
+		_, span := tracer.StartRoot(context.Background(), "GET /object/:objectHash", traceParent)
+		span.End()
+		_ = tracer.Close()
+
+		record := readSpans(t, output)[0]
+		if record.ParentSpanID != "" || !isHexID(record.TraceID, 16) {
+			t.Errorf("traceparent %q: expected a new trace, got %+v", traceParent, record)
+		}
+	}
+}
+
+func TestSpansWithoutTracer(t *testing.T) {
+	ctx, span := Start(context.Background(), "object.lock_wait")
+	span.SetAttribute("object", "abc")
+	span.SetError(errors.New("error"))
+	span.End()
+
+	if traceParent := TraceParent(ctx); traceParent != "" {
+		t.Errorf("traceparent = %q, want empty", traceParent)
+	}
+}
+
+func TestSpansAreDroppedInsteadOfBlocking(t *testing.T) {
+	output := &blockingWriter{unblock: make(chan struct{})}
+	tracer := newTracer(output, "node-0")
+
+	for i := 0; i < 2*spanBufferSize; i++ {
+		_, span := tracer.StartRoot(context.Background(), "GET /object/:objectHash", "")
+		span.End()
+	}
+	if tracer.Dropped() == 0 {
+		t.Errorf("no span has been dropped although the output is blocked")
+	}
+
+	close(output.unblock)
+	if err := tracer.Close(); err != nil {
+		t.Fatalf("close tracer: %v", err)
+	}
+	_, span := tracer.StartRoot(context.Background(), "GET /object/:objectHash", "")
+	span.End() // spans that end after Close are dropped
+}
+
+// blockingWriter blocks all writes until unblock is closed.
+type blockingWriter struct {
+	unblock chan struct{}
+}
+
+func (w *blockingWriter) Write(p []byte) (int, error) {
+	<-w.unblock
+	return len(p), nil
+}
+
+func (w *blockingWriter) Close() error {
+	return nil
+}
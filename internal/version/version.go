@@ -0,0 +1,31 @@
+// Package version provides the version of the binary.
+package version
+
+import "runtime/debug"
+
+// Version is set at build time:
+// go build -ldflags "-X github.com/rstdm/mini-ceph/internal/version.Version=v1.2.3"
+var Version = ""
+
+// Get returns the version that has been set at build time. Otherwise, it returns the version of the module or the VCS
+// revision that have been recorded by the go command, or "dev" if neither is known.
+func Get() string {
+	if Version != "" {
+		return Version
+	}
+
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "dev"
+	}
+	if info.Main.Version != "" && info.Main.Version != "(devel)" {
+		return info.Main.Version
+	}
+	for _, setting := range info.Settings {
+		if setting.Key == "vcs.revision" {
+			return setting.Value
+		}
+	}
+
+	return "dev"
+}
@@ -27,6 +27,8 @@ func main() {
 	truncatedFlagValues := flagValues                  // create a copy
 	truncatedFlagValues.UserBearerToken = "<redacted>" // the token must not be logged
 	truncatedFlagValues.ClusterBearerToken = "<redacted>"
+	truncatedFlagValues.URLSigningKey = "<redacted>"
+	truncatedFlagValues.MasterKeys = "<redacted>"
 	log.Infow("Logging server configuration", "flagValues", truncatedFlagValues)
 
 	serv, err := server.New(flagValues, log)